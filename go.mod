@@ -1,3 +1,3 @@
 module github.com/mauserzjeh/pingo/v2
 
-go 1.22
+go 1.23
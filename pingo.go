@@ -23,26 +23,68 @@
 package pingo
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
+	"html"
 	"io"
+	"io/fs"
+	"iter"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/netip"
 	"net/textproto"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	runtimedebug "runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/mauserzjeh/pingo/v2/pingoschema"
 )
 
 type (
@@ -54,6 +96,15 @@ type (
 		timeFormat atomic.Pointer[string] // format of the time part when [Ftime] flag is provided
 	}
 
+	// LeveledLogger is a logger with levels, which can be set by calling [Client.SetLogger].
+	// Request summaries are logged at info level, failed requests at warn or error level and the debug output at debug level
+	LeveledLogger interface {
+		Debug(msg string)
+		Info(msg string)
+		Warn(msg string)
+		Error(msg string)
+	}
+
 	// Client is the client used by the package
 	Client struct {
 		client       *http.Client  // underlying [net/http.Client]
@@ -65,24 +116,460 @@ type (
 		timeout      time.Duration // timeout for the client
 		logger       *logger       // logger used by the client
 		isLogEnabled bool          // whether logging is enabled or disabled in this client
+		logLevel     atomic.Int32  // [LogLevel] overriding the log and debug settings, which can be changed concurrently
+		leveled      LeveledLogger // logger set by [Client.SetLogger], the built-in logger is used if nil
+
+		logFilter     func(method, url string, status int, d time.Duration) bool // decides which requests are logged
+		logSampleRate float64                                                    // fraction of the requests passing the filter which are logged
+
+		requestIdHeader    string        // header of the request ID, request IDs are disabled if empty
+		requestIdGenerator func() string // generates the request IDs
+
+		userAgent string // User-Agent set by [Client.SetUserAgent], which is protected from the header setters of the requests
+
+		hosts      map[string]*HostConfig // per-host configuration profiles
+		pathLimits []pathLimit            // rate limits of the requests by path pattern, the first matching pattern applies
+		hostsMu    sync.RWMutex           // guards hosts and pathLimits
+
+		endpoints   map[string]endpoint // registered endpoints
+		schemas     map[string][]byte   // JSON Schemas registered for the endpoints
+		endpointsMu sync.RWMutex        // guards endpoints and schemas
+
+		fallbackBaseUrl string           // base URL used when the base URL is unreachable
+		balancer        *LatencyBalancer // selects the base URL of the requests, nil if the base URL is used
+		bandwidth       *rateLimiter     // limiter of the bandwidth used by the request and response bodies
+
+		dialer    *net.Dialer // dialer used by the transport of the client
+		ipVersion IPVersion   // IP version used when dialing
+
+		proxy    func(req *http.Request) (*url.URL, error) // proxy set by [Client.SetProxy] or [Client.SetProxyFromEnvironment]
+		proxySet bool                                      // whether proxy is set, the proxy of the transport is used otherwise
+		noProxy  []string                                  // hosts reached directly instead of through the proxy
+
+		sharedTransport atomic.Bool // whether the transport is shared with other clients or supplied by the caller, so that it is cloned before it is changed
+
+		allowedHosts    []string       // patterns of the hosts allowed to be dialed, any host is allowed if empty
+		blockedNetworks []netip.Prefix // networks not allowed to be dialed
+		blockedErr      error          // error of parsing the blocked networks, which fails every dial
+
+		stats   clientStats     // cumulative statistics of the requests
+		latency latencyRecorder // latencies of the most recent requests
+
+		slowThreshold time.Duration                                         // latency above which a request is reported as slow
+		onSlow        func(method, url string, status int, d time.Duration) // called with the slow requests
+		faults        *FaultConfig                                          // faults injected into the requests
+
+		tokenSource     TokenSource      // source of the Bearer tokens of the requests
+		connEvents      ConnEvents       // callbacks of the connection level events
+		validationRules []ValidationRule // rules validating the requests before they are sent
+
+		middlewares   []namedMiddleware // middlewares wrapping the sending of the requests ordered by their priorities, replaced on every change
+		middlewaresMu sync.RWMutex      // guards middlewares
+
+		recoverPanics bool // whether the panics of the callbacks are recovered and returned as [*PanicError]
+
+		maxRetries   int           // maximum number of retries of a failed request
+		retryBackoff time.Duration // delay before the first retry, doubled after every retry
+		retryBudget  *RetryBudget  // budget limiting the retries of the requests
+
+		maxRetryDelay time.Duration // maximum delay before a retry, including the one requested by the Retry-After header
+
+		cache   *ResponseCache // cache of the responses, nil if the responses are not cached
+		offline atomic.Bool    // whether the requests are served only from the cache
+
+		concurrency    *concurrencyLimiter // limiter of the number of requests in flight, nil if unlimited
+		methodOverride MethodOverride      // way the methods other than GET, HEAD and POST are tunneled through POST requests
+		inFlight       inFlightTracker     // tracker of the requests in flight
+
+		isSuccess func(statusCode int) bool // reports whether the status code of a response is considered successful
+
+		jsonUseNumber bool // whether JSON numbers are decoded into [encoding/json.Number] instead of float64
+		jsonStrict    bool // whether unknown fields in JSON objects fail the decoding
+
+		zeroCopy bool // whether the response bodies are returned as strings without copying them
+
+		charsets map[string]CharsetDecoder // charset decoders by lowercase charset name set by calling [Client.SetCharsetDecoder], replaced on every change
+		decoders map[string]BodyDecoder    // body decoders by lowercase media type set by calling [Client.SetBodyDecoder], replaced on every change
+
+		jsonMarshal   func(v any) ([]byte, error)    // JSON encoder of the request bodies, [encoding/json.Marshal] is used if nil
+		jsonUnmarshal func(data []byte, v any) error // JSON decoder of the response bodies, [encoding/json.Unmarshal] is used if nil
+
+		debugFormat    DebugFormat // format of the debug output
+		debugBodyLimit int         // maximum number of body bytes included in the debug output
+	}
+
+	// RequestSpec is a declarative definition of a request and the assertions on its response, which can be
+	// decoded from JSON by calling [ParseSpecs] and performed by calling [Client.RunSpecs]
+	RequestSpec struct {
+		Name    string            `json:"name"`    // name of the request in the results
+		Method  string            `json:"method"`  // method of the request, defaults to GET
+		Path    string            `json:"path"`    // path of the request relative to the base URL of the client, or a full URL
+		Headers map[string]string `json:"headers"` // headers of the request
+		Query   map[string]string `json:"query"`   // query parameters of the request
+		Body    json.RawMessage   `json:"body"`    // body of the request, a JSON string is sent as text and any other value as JSON
+		Expect  SpecExpectation   `json:"expect"`  // assertions on the response
+	}
+
+	// SpecExpectation contains the assertions on the response of a [RequestSpec]
+	SpecExpectation struct {
+		Status       int               `json:"status"`       // expected status code, any successful status code is accepted if zero
+		Headers      map[string]string `json:"headers"`      // expected header values
+		BodyContains string            `json:"bodyContains"` // substring expected in the body
+		MaxDuration  time.Duration     `json:"maxDuration"`  // maximum duration of the request, given either as a string e.g.: "500ms" or as nanoseconds
+	}
+
+	// SpecResult is the result of performing a [RequestSpec]
+	SpecResult struct {
+		Name       string        // name of the request
+		Method     string        // method of the request
+		Url        string        // URL of the request
+		StatusCode int           // status code of the response, 0 if the request failed
+		Duration   time.Duration // duration of the request
+		Err        error         // error of the request, the assertions are not checked if it is not nil
+		Failures   []string      // descriptions of the failed assertions
+	}
+
+	// HealthMonitor periodically checks the health of an upstream with a client, created by calling [Client.NewHealthMonitor]
+	HealthMonitor struct {
+		client   *Client                       // client performing the checks
+		path     string                        // path of the health check
+		expect   SpecExpectation               // assertions of a healthy response
+		interval time.Duration                 // delay between the checks
+		jitter   time.Duration                 // maximum random delay added to the interval
+		onChange func(healthy bool, err error) // called when the state changes
+
+		mu      sync.Mutex         // guards the fields below
+		checked bool               // whether the upstream was checked
+		healthy bool               // result of the last check
+		err     error              // error of the last check
+		stop    context.CancelFunc // stops the monitor, nil if it is not running
+		done    chan struct{}      // closed when the monitor stopped
+	}
+
+	// LatencyBalancer selects the base URL of the requests of a client by periodically measuring the latency of every
+	// base URL and preferring the fastest healthy one, created by calling [Client.NewLatencyBalancer]
+	LatencyBalancer struct {
+		client     *Client               // client measuring the latencies
+		baseUrls   []string              // base URLs to select from
+		interval   time.Duration         // delay between the measurements
+		samples    int                   // number of requests per base URL in a measurement
+		hysteresis float64               // fraction by which another base URL must be faster to switch to it
+		onSwitch   func(from, to string) // called when the selected base URL changes
+
+		mu      sync.Mutex         // guards the fields below
+		current int                // index of the selected base URL
+		stats   []LatencyStats     // latencies of the last measurement by base URL
+		stop    context.CancelFunc // stops the balancer, nil if it is not running
+		done    chan struct{}      // closed when the balancer stopped
+	}
+
+	// FetchMetadata contains the fetch metadata request headers sent by browsers, set by calling [Request.SetFetchMetadata].
+	// Empty fields are not sent
+	FetchMetadata struct {
+		Site string // Sec-Fetch-Site e.g.: "same-origin", "same-site", "cross-site" or "none"
+		Mode string // Sec-Fetch-Mode e.g.: "navigate", "cors", "no-cors" or "same-origin"
+		Dest string // Sec-Fetch-Dest e.g.: "document", "empty" or "image"
+		User bool   // whether Sec-Fetch-User is sent, which signals a navigation triggered by the user
+	}
+
+	// BrowserProfile contains the headers a browser sends with every request, set by calling [Client.SetBrowserProfile]
+	BrowserProfile struct {
+		UserAgent      string      // User-Agent header
+		Accept         string      // Accept header
+		AcceptLanguage string      // Accept-Language header
+		Headers        http.Header // other headers e.g.: the client hints of Chromium based browsers
+	}
+
+	// Session is a cookie based session of a client, created by calling [Client.NewSession]. The cookies set by the responses
+	// are stored and sent with the following requests of the session, and the CSRF token extracted from the responses
+	// is sent in a header, see [Session.SetCSRF]
+	Session struct {
+		client      *Client                        // derived client sending the requests of the session
+		jar         *sessionJar                    // cookies of the session
+		csrfHeader  string                         // header of the CSRF token
+		csrfExtract CSRFExtractor                  // extracts the CSRF token from the responses, nil if no token is used
+		isExpired   func(resp *http.Response) bool // reports whether a response signals that the session expired
+		onExpired   func()                         // called when the session expires
+
+		mu        sync.RWMutex // guards the fields below
+		csrfToken string       // current CSRF token
+		loggedIn  bool         // whether the session is logged in
+	}
+
+	// sessionJar is a [net/http.CookieJar] which can be cleared
+	sessionJar struct {
+		mu  sync.RWMutex   // guards jar
+		jar *cookiejar.Jar // stored cookies
+	}
+
+	// CSRFExtractor extracts a CSRF token from a response, see [CSRFFromJson], [CSRFFromHeader], [CSRFFromMetaTag] and [CSRFFromCookie]
+	CSRFExtractor func(resp *Response) (string, error)
+
+	// CSRFConfig configures the CSRF protection of a site for [CSRFMiddleware]
+	CSRFConfig struct {
+		TokenUrl  string        // URL fetched to obtain the token, which may be relative to the URL of the request e.g.: "/csrf"
+		Extract   CSRFExtractor // extracts the token from the response of the token URL
+		Header    string        // header in which the token is sent, [DefaultCSRFHeader] is used if both Header and FormField are empty
+		FormField string        // field of the form URL encoded bodies in which the token is sent
+	}
+
+	// Batch is a batch of requests sent in a single multipart/mixed request and answered with a multipart/mixed response
+	// as used e.g.: by the batch endpoints of Google APIs and OData services, created by calling [Client.NewBatch]
+	Batch struct {
+		client   *Client    // client sending the batch
+		path     string     // path of the batch endpoint
+		requests []*Request // requests in the batch
+	}
+
+	// csrfSite is the state of a site configured for [CSRFMiddleware]
+	csrfSite struct {
+		config CSRFConfig // configuration of the site
+		mu     sync.Mutex // guards token and serializes the fetching of the token
+		token  string     // cached token, empty if it has to be fetched
+	}
+
+	// Option configures a client created by calling [NewClientWithOptions]
+	Option func(c *Client)
+
+	// Config is the configuration of a client created by calling [ClientFromConfig].
+	// It can be decoded from JSON by calling [ParseConfig], where the durations are given either as strings e.g.: "5s" or as nanoseconds
+	Config struct {
+		BaseUrl            string            `json:"baseUrl"`            // base URL of the client
+		Timeout            time.Duration     `json:"timeout"`            // timeout of the requests
+		Proxy              string            `json:"proxy"`              // URL of the proxy
+		InsecureSkipVerify bool              `json:"insecureSkipVerify"` // whether the TLS certificates are not verified
+		MaxRetries         int               `json:"maxRetries"`         // maximum number of retries of a failed request
+		RetryBackoff       time.Duration     `json:"retryBackoff"`       // delay before the first retry
+		Headers            map[string]string `json:"headers"`            // default headers of the requests
+	}
+
+	// FaultConfig configures the faults injected into the requests of a client by calling [Client.InjectFaults].
+	// It is meant for testing how the callers handle failures and must not be used in production
+	FaultConfig struct {
+		ErrorRate       float64         // probability between 0 and 1 of failing a request with [ErrInjectedFault] without sending it
+		LatencyJitter   time.Duration   // maximum random delay added before sending a request
+		StatusOverrides map[int]float64 // probabilities between 0 and 1 by status code of replacing the response with an empty one with that status code
+	}
+
+	// Stats contains the cumulative statistics of the requests performed by a client
+	Stats struct {
+		Requests      int64 // number of requests sent
+		Errors        int64 // number of requests that failed or received an error status code
+		BytesSent     int64 // number of request body bytes sent
+		BytesReceived int64 // number of response body bytes received
+	}
+
+	// InFlightRequest describes a request of a client in flight, see [Client.InFlight]
+	InFlightRequest struct {
+		Method    string        // method of the request
+		Url       string        // URL of the request
+		RequestId string        // ID of the request, empty if request IDs are disabled
+		Started   time.Time     // time when the request was started
+		Elapsed   time.Duration // time elapsed since the request was started
+	}
+
+	// RetryBudget limits the retries of a client to a fraction of its requests, so that retries do not amplify an outage,
+	// created by calling [NewRetryBudget]. Every request deposits the ratio into the budget and every retry withdraws 1
+	// from it, the retry is not performed if the budget has less than 1. It can be shared by multiple clients
+	RetryBudget struct {
+		ratio float64                                    // fraction of the requests which may be retries
+		burst float64                                    // maximum balance of the budget
+		hook  func(state RetryBudgetState, allowed bool) // called after every decision about a retry
+
+		mu    sync.Mutex       // guards the field below
+		state RetryBudgetState // current state of the budget
+	}
+
+	// ResponseCache is an in-memory cache of the responses of GET requests, created by calling [NewResponseCache] and set by calling
+	// [Client.SetCache]. A response is stored per URL and per variant of the request headers listed in its Vary header and
+	// the headers set by calling [ResponseCache.SetVaryHeaders] or [ResponseCache.SetHashedVaryHeaders], so that e.g.:
+	// the responses of different users are not served across users. It can be shared by multiple clients
+	ResponseCache struct {
+		ttl           time.Duration // freshness of the responses without explicit freshness
+		maxEntries    int           // maximum number of stored responses
+		varyHeaders   []string      // request headers always included in the variants
+		hashedHeaders []string      // request headers always included in the variants as SHA-256 hashes
+
+		mu      sync.Mutex               // guards the fields above and below
+		entries map[string][]*cacheEntry // stored variants by the method and the URL of the requests
+		count   int                      // number of stored variants
+	}
+
+	// cacheEntry is a response stored in a [ResponseCache]
+	cacheEntry struct {
+		key        string            // method and URL of the request
+		vary       map[string]string // values of the request headers the response was stored for
+		status     string            // status of the response
+		statusCode int               // status code of the response
+		headers    http.Header       // headers of the response
+		body       []byte            // body of the response
+		stored     time.Time         // time the response was stored
+		expires    time.Time         // time the response becomes stale
+	}
+
+	// cachingBody is the body of a response which is stored in a [ResponseCache] once it is read entirely
+	cachingBody struct {
+		io.ReadCloser                   // the original response body
+		buf           bytes.Buffer      // data read so far
+		store         func(body []byte) // stores the body, nil if it is not stored
+	}
+
+	// LatencyStats contains the latencies measured by calling [Client.MeasureLatency] or [Request.MeasureLatency]
+	LatencyStats struct {
+		Requests  int           // number of requests sent
+		Errors    int           // number of requests that failed or received an error status code
+		ErrorRate float64       // fraction of the requests that failed
+		Min       time.Duration // minimum latency of the successful requests
+		Avg       time.Duration // average latency of the successful requests
+		P95       time.Duration // 95th percentile of the latencies of the successful requests
+		Max       time.Duration // maximum latency of the successful requests
+	}
+
+	// RetryBudgetState is the state of a [RetryBudget]
+	RetryBudgetState struct {
+		Balance  float64 // number of retries currently allowed
+		Requests int64   // number of requests
+		Retries  int64   // number of retries allowed
+		Denied   int64   // number of retries denied
+	}
+
+	// ConnectionPool is a pool of connections, which can be shared by multiple clients by calling [Client.SetConnectionPool],
+	// created by calling [NewConnectionPool]. It implements the [net/http.RoundTripper] interface
+	ConnectionPool struct {
+		transport *http.Transport // transport pooling the connections
+		dialer    *net.Dialer     // dialer of the connections
+
+		requests atomic.Int64 // number of requests sent
+		reused   atomic.Int64 // number of requests sent on a reused connection
+		opened   atomic.Int64 // number of connections opened
+		closed   atomic.Int64 // number of connections closed
+	}
+
+	// PoolStats contains the statistics of a [ConnectionPool]
+	PoolStats struct {
+		Requests    int64 // number of requests sent
+		Reused      int64 // number of requests sent on a reused connection
+		OpenedConns int64 // number of connections opened
+		ClosedConns int64 // number of connections closed
+		OpenConns   int64 // number of connections currently open, either in use or idle
+	}
+
+	// latencyRecorder records the latencies of the most recent requests of a client
+	latencyRecorder struct {
+		mu      sync.Mutex      // guards the fields below
+		samples []time.Duration // ring buffer of the latencies
+		next    int             // index of the next sample in the ring buffer
+	}
+
+	// clockSkew estimates the offset of the clock of a server from the Date headers of its responses
+	clockSkew struct {
+		mu      sync.Mutex    // guards offset
+		offset  time.Duration // estimated offset of the server clock from the local clock
+		maxSkew time.Duration // maximum offset which is corrected
+	}
+
+	// clientStats contains the counters of the statistics of a client
+	clientStats struct {
+		requests      atomic.Int64 // number of requests sent
+		errors        atomic.Int64 // number of requests that failed or received an error status code
+		bytesSent     atomic.Int64 // number of request body bytes sent
+		bytesReceived atomic.Int64 // number of response body bytes received
+	}
+
+	// countingBody is a body that counts the bytes read from it
+	countingBody struct {
+		io.ReadCloser               // the original body
+		n             *atomic.Int64 // counter of the bytes read
+	}
+
+	// HostConfig holds per-host settings of a client, created by calling [Client.Host].
+	// Settings of a host take precedence over the client defaults, but not over the settings of a request
+	HostConfig struct {
+		mu          sync.RWMutex  // guards the fields below
+		headers     http.Header   // headers for the host
+		queryParams url.Values    // query parameters for the host
+		timeout     time.Duration // timeout for the host
+		limiter     *rateLimiter  // rate limiter for the host
+	}
+
+	// pathLimit is the rate limit of the requests whose path matches a pattern, see [Client.SetPathRateLimit]
+	pathLimit struct {
+		pattern string       // pattern of the paths
+		limiter *rateLimiter // rate limiter of the matching requests
+	}
+
+	// rateLimiter is a simple token bucket rate limiter
+	rateLimiter struct {
+		mu     sync.Mutex // guards the fields below
+		rate   float64    // tokens added per second
+		burst  float64    // maximum number of tokens
+		tokens float64    // currently available tokens
+		last   time.Time  // last time the tokens were refilled
 	}
 
 	// Request is the request created by calling [NewRequest]
 	Request struct {
-		client       *Client            // the client the request was created on
-		method       string             // method of the request e.g: "GET", "POST", "PUT"
-		baseUrl      string             // base URL for the request
-		path         string             // path of the request
-		headers      http.Header        // headers for the request
-		queryParams  url.Values         // query parameters for the request
-		timeout      time.Duration      // timeout for the request
-		body         *bytes.Buffer      // request body
-		bodyErr      error              // error signaling if there was an error creating the request body
-		cancel       context.CancelFunc // cancel is used to cancel any resources associated with the [context.Context] of the request
-		ctx          context.Context    // [context.Context] of the request
-		debug        bool               // debug mode
-		debugBody    bool               // debug mode to include body
-		isLogEnabled bool               // whether loggin is enabled or disabled for the request
+		client       *Client                       // the client the request was created on
+		method       string                        // method of the request e.g: "GET", "POST", "PUT"
+		baseUrl      string                        // base URL for the request
+		path         string                        // path of the request
+		url          string                        // full URL of the request, which overrides the base URL and the path
+		headers      http.Header                   // headers for the request
+		userAgent    string                        // User-Agent set by [Request.SetUserAgent]
+		queryParams  url.Values                    // query parameters for the request
+		timeout      time.Duration                 // timeout for the request
+		body         *bytes.Buffer                 // request body
+		bodyErr      error                         // error signaling if there was an error creating the request body
+		bodyStream   func() (io.ReadCloser, error) // creates the streamed request body for every attempt, which is used instead of body if not nil
+		cancel       context.CancelFunc            // cancel is used to cancel any resources associated with the [context.Context] of the request
+		ctx          context.Context               // [context.Context] of the request
+		debug        bool                          // debug mode
+		debugBody    bool                          // debug mode to include body
+		isLogEnabled bool                          // whether loggin is enabled or disabled for the request
+		endpoint     string                        // name of the endpoint the request was created from
+		pathParams   map[string]string             // path parameters to substitute in the path
+		err          error                         // error signaling if there was an error building the request
+
+		connectTimeout        time.Duration // timeout of establishing a connection
+		tlsHandshakeTimeout   time.Duration // timeout of the TLS handshake
+		responseHeaderTimeout time.Duration // timeout of waiting for the response headers after the request is written
+
+		trailers http.Header // trailers for the request
+
+		preserveRawQuery bool     // whether the already encoded query of the URL is preserved as is
+		querySeparator   string   // separator of the query parameters, defaults to "&"
+		priority         Priority // priority of the request when the concurrency of the client is limited
+		rawQueries       []string // already encoded query fragments appended in order after the query parameters
+
+		maxRetries   int           // maximum number of retries of a failed request
+		retryBackoff time.Duration // delay before the first retry, doubled after every retry
+
+		profile bool // whether the timings of the phases of the request are logged
+
+		httpRequestHooks []func(req *http.Request) // hooks customizing the [net/http.Request] before it is sent
+		transport        http.RoundTripper         // transport used instead of the transport of the client
+
+		debugFormat    DebugFormat // format of the debug output
+		debugBodyLimit int         // maximum number of body bytes included in the debug output
+
+		headersCopied     bool                // whether the headers shared with the client were copied before they were modified
+		queryParamsCopied bool                // whether the query parameters shared with the client were copied before they were modified
+		setHeaders        map[string]struct{} // keys of the headers set on the request, which are not overridden by the host settings
+		setQueryParams    map[string]struct{} // keys of the query parameters set on the request, which are not overridden by the host settings
+		timeoutSet        bool                // whether the timeout was set on the request, which is not overridden by the host settings
+	}
+
+	// throttledBody is a body whose reading is limited by a rate limiter
+	throttledBody struct {
+		io.ReadCloser                 // the original body
+		ctx           context.Context // [context.Context] to stop waiting on
+		limiter       *rateLimiter    // limiter of the bytes read
+	}
+
+	// endpoint is a named request template registered by calling [Client.Endpoint]
+	endpoint struct {
+		method string // method of the endpoint
+		path   string // path of the endpoint, which may contain path parameters e.g.: "/users/{id}"
 	}
 
 	// responseHeader contains information about response headers
@@ -90,6 +577,182 @@ type (
 		status     string      // status of the response
 		statusCode int         // status code of the response
 		headers    http.Header // headers of the response
+		connInfo   ConnInfo    // information about the connection used by the request
+		requestId  string      // ID of the request
+		tls        *TLSInfo    // information about the TLS connection, nil if TLS was not used
+		receivedAt time.Time   // time the response was received
+		url        string      // URL of the request, which the relative URLs of the headers are resolved against
+	}
+
+	// ErrClass is the class of an error e.g.: network, DNS or timeout error
+	ErrClass int
+
+	// Error is a structured error that wraps the underlying error of a failed request with its class.
+	// Use [ClassifyError], [IsTimeout], [IsTemporary] or [IsStatus] to inspect errors
+	Error struct {
+		Class  ErrClass // class of the error
+		Method string   // method of the request
+		Url    string   // URL of the request
+		Err    error    // the underlying error
+	}
+
+	// PanicError is returned when a callback panics and the panics are recovered, see [Client.SetPanicRecovery]
+	PanicError struct {
+		Value any    // value passed to panic
+		Stack []byte // stack trace of the goroutine at the time of the panic
+	}
+
+	// TimeoutError is returned when a request times out. It wraps the cause of the timeout
+	// e.g.: [ErrRequestTimedOut], [ErrConnectTimeout]
+	TimeoutError struct {
+		Phase   string        // phase of the request that timed out: "dns", "dial", "tls", "write", "headers" or "body"
+		Attempt int           // number of the attempt that timed out
+		Elapsed time.Duration // time elapsed since the request was started
+		Err     error         // cause of the timeout
+	}
+
+	// ConnInfo contains information about the connection used to perform a request
+	ConnInfo struct {
+		Reused   bool          // whether the connection was reused from a previous request
+		WasIdle  bool          // whether the connection was obtained from the idle pool
+		IdleTime time.Duration // how long the connection was idle, if WasIdle is true
+	}
+
+	// TLSInfo is information about the TLS connection a response was received on
+	TLSInfo struct {
+		Version            uint16              // TLS version e.g.: [crypto/tls.VersionTLS13]
+		CipherSuite        uint16              // cipher suite e.g.: [crypto/tls.TLS_AES_128_GCM_SHA256]
+		NegotiatedProtocol string              // protocol negotiated with ALPN e.g.: "h2"
+		ServerName         string              // server name sent with SNI
+		PeerCertificates   []*x509.Certificate // certificates sent by the server, the leaf certificate first
+		OCSPStapled        bool                // whether the server stapled an OCSP response
+		OCSPResponse       []byte              // the stapled OCSP response, if any
+	}
+
+	// ConnEvents are callbacks of connection level events set by calling [Client.SetConnEvents], e.g.: to record
+	// the connection churn per host or the negotiated TLS versions and cipher suites. Nil callbacks are ignored
+	ConnEvents struct {
+		OnConnect      func(network, addr string, duration time.Duration, err error) // called when a new connection is established or failed
+		OnTLSHandshake func(addr string, state tls.ConnectionState, err error)       // called when a TLS handshake is completed or failed
+		OnConnClosed   func(network, addr string)                                    // called when a connection is closed
+	}
+
+	// dialSettings is a snapshot of the settings of a client used by its transport to dial connections,
+	// so that a transport shared by clones keeps dialing with the settings it was configured with
+	dialSettings struct {
+		dialer          net.Dialer                 // dialer of the connections
+		ipVersion       IPVersion                  // IP version used when dialing
+		allowedHosts    []string                   // patterns of the hosts allowed to be dialed, any host is allowed if empty
+		blockedNetworks []netip.Prefix             // networks not allowed to be dialed
+		blockedErr      error                      // error of parsing the blocked networks, which fails every dial
+		onConnClosed    func(network, addr string) // called when a connection is closed
+	}
+
+	// eventConn is a connection which reports its closing to [ConnEvents.OnConnClosed]
+	eventConn struct {
+		net.Conn
+		once    sync.Once                  // ensures that the callback is called once
+		onClose func(network, addr string) // the callback
+	}
+
+	// DebugFormat is the format of the debug output of the requests
+	DebugFormat int
+
+	// LogLevel is the verbosity of the logs of a client set at runtime by calling [Client.SetLogLevel]
+	LogLevel int32
+
+	// debugEntry is the debug output of a request in [DebugFormatJson] format
+	debugEntry struct {
+		Method     string        `json:"method"`              // method of the request
+		Url        string        `json:"url"`                 // URL of the request
+		StatusCode int           `json:"statusCode"`          // status code of the response
+		DurationMs float64       `json:"durationMs"`          // duration of the request in milliseconds
+		Attempt    int           `json:"attempt"`             // number of the attempt
+		RequestId  string        `json:"requestId,omitempty"` // ID of the request
+		Proxy      string        `json:"proxy"`               // proxy used by the request
+		Error      string        `json:"error,omitempty"`     // error of the request
+		Request    *debugMessage `json:"request,omitempty"`   // the request
+		Response   *debugMessage `json:"response,omitempty"`  // the response
+		Timings    debugTimings  `json:"timings"`             // durations of the phases of the request
+	}
+
+	// debugMessage is a request or response in a [debugEntry]
+	debugMessage struct {
+		Headers       http.Header `json:"headers"`                 // headers of the message
+		Body          string      `json:"body,omitempty"`          // body of the message, truncated to the debug body limit
+		BodyTruncated bool        `json:"bodyTruncated,omitempty"` // whether the body was truncated
+	}
+
+	// debugTimings are the durations of the phases of a request in milliseconds in a [debugEntry]
+	debugTimings struct {
+		DNS     float64 `json:"dnsMs"`     // duration of the DNS lookup
+		Connect float64 `json:"connectMs"` // duration of establishing the connection
+		TLS     float64 `json:"tlsMs"`     // duration of the TLS handshake
+		TTFB    float64 `json:"ttfbMs"`    // time to first byte
+	}
+
+	// Timings contains the durations of the phases of a request. The DNS, connect and TLS durations
+	// are zero if the connection was reused
+	Timings struct {
+		DNS      time.Duration // duration of the DNS lookup
+		Connect  time.Duration // duration of establishing the connection
+		TLS      time.Duration // duration of the TLS handshake
+		TTFB     time.Duration // time to first byte, measured from sending the request until the first byte of the response
+		Transfer time.Duration // duration of reading the response body
+		Total    time.Duration // total duration from sending the request until the response body is read
+	}
+
+	// RedirectPolicy configures following the redirects by calling [Client.SetRedirectPolicy]
+	RedirectPolicy struct {
+		MaxRedirects     int  // maximum number of redirects followed, defaults to [DefaultMaxRedirects] if zero
+		RefuseDowngrade  bool // whether redirects from https to http are refused
+		AllowedHostsOnly bool // whether redirects are restricted to the hosts allowed by [Client.SetAllowedHosts]
+	}
+
+	// ExtractLimits limits the extraction of an archive by [Response.ExtractZip] and [Response.ExtractTarGz].
+	// Zero values use the defaults
+	ExtractLimits struct {
+		MaxFiles     int   // maximum number of extracted files, defaults to [DefaultExtractMaxFiles]
+		MaxFileSize  int64 // maximum size of a single extracted file, defaults to [DefaultExtractMaxSize]
+		MaxTotalSize int64 // maximum total size of the extracted files, defaults to [DefaultExtractMaxSize]
+	}
+
+	// extractor extracts the entries of an archive into a directory within the limits
+	extractor struct {
+		dir    string        // destination directory
+		limits ExtractLimits // limits of the extraction
+		files  int           // number of extracted files
+		total  int64         // total size of the extracted files
+	}
+
+	// requestTrace collects information about performing a request using [net/http/httptrace]
+	// and enforces the timeouts of the phases of the request
+	requestTrace struct {
+		connInfo  ConnInfo   // information about the connection used by the request
+		attempt   int        // number of the current attempt
+		events    ConnEvents // callbacks of the connection level events
+		connAddr  string     // address of the connection being established
+		start     time.Time  // time the request was started
+		requestId string     // ID of the request, shared by all attempts
+
+		mu                    sync.Mutex              // guards the fields below
+		phase                 string                  // current phase of the request
+		abort                 context.CancelCauseFunc // aborts the request when a phase times out
+		connectTimeout        time.Duration           // timeout of establishing a connection
+		tlsHandshakeTimeout   time.Duration           // timeout of the TLS handshake
+		responseHeaderTimeout time.Duration           // timeout of waiting for the response headers
+		connectTimer          *time.Timer             // timer of the connect phase
+		tlsHandshakeTimer     *time.Timer             // timer of the TLS handshake phase
+		responseHeaderTimer   *time.Timer             // timer of the response header phase
+
+		sendStart    time.Time // time the request was sent
+		dnsStart     time.Time // time the DNS lookup started
+		dnsDone      time.Time // time the DNS lookup finished
+		connectStart time.Time // time establishing the connection started
+		connectDone  time.Time // time the connection was established
+		tlsStart     time.Time // time the TLS handshake started
+		tlsDone      time.Time // time the TLS handshake finished
+		firstByte    time.Time // time the first byte of the response was received
 	}
 
 	// ResponseStream is a streamed response
@@ -98,18 +761,99 @@ type (
 		cancel         context.CancelFunc // [context.CancelFunc] to cancel any resources associated with the request/response
 		reader         *bufio.Reader      // [bufio.Reader] to read the response from
 		response       *http.Response     // the original [net/http.Response]
+		body           *streamBody        // the response body wrapped by the reader
+		decoding       *decodingReader    // decodes the Content-Encoding of the body, nil if the body is not encoded
+		deadline       *deadlineReader    // applies the timeouts of [ResponseStream.RecvWithTimeout] to the reads of the body
+		jsonUseNumber  bool               // whether the JSON decoders decode the numbers into [encoding/json.Number]
+		jsonStrict     bool               // whether the JSON decoders disallow unknown fields
+		recoverPanics  bool               // whether the panics of the [StreamReceiver] functions are recovered
+	}
+
+	// streamBody is the body of a streamed response, which copies the read data to the tee writers
+	// and aborts the stream if no data arrives within the idle timeout
+	streamBody struct {
+		reader      io.Reader               // the original response body
+		tees        []io.Writer             // writers receiving a copy of the read data
+		closers     []io.Closer             // closers to close when the stream is closed
+		abort       context.CancelCauseFunc // aborts the streamed request
+		idleTimeout atomic.Int64            // idle timeout of the stream
+		idle        atomic.Bool             // whether the stream was aborted because of the idle timeout
+	}
+
+	// decodingReader decodes the gzip or deflate Content-Encoding of a streamed response body,
+	// the decoder is created on the first read so that the decoding can be disabled until then
+	decodingReader struct {
+		body     io.Reader // the encoded body
+		encoding string    // the Content-Encoding of the body
+		disabled bool      // whether the body is read as is
+		decoder  io.Reader // the decoder of the body, nil until the first read
+	}
+
+	// deadlineReader reads in the background while a timeout is set, so that a read exceeding the timeout
+	// returns without losing the data, which is returned by the next read
+	deadlineReader struct {
+		reader   io.Reader       // the underlying reader
+		timeout  time.Duration   // timeout of the reads, zero if the reads are not limited
+		pending  chan readResult // result of the read in progress, nil if there is none
+		buffered []byte          // data read in the background not returned yet
+		err      error           // error of the read in the background returned after the buffered data
+	}
+
+	// readResult is the result of a read of a [deadlineReader] in the background
+	readResult struct {
+		data []byte // data read
+		err  error  // error of the read
 	}
 
 	// Response holds the response data
 	Response struct {
-		responseHeader        // response header info
-		body           []byte // response body
+		responseHeader               // response header info
+		body           []byte        // response body
+		schema         []byte        // JSON Schema registered for the endpoint of the request
+		trailers       http.Header   // trailers of the response
+		timings        Timings       // durations of the phases of the request
+		duration       time.Duration // time spent on the request including the retries
+		attempts       int           // number of attempts of the request
+
+		isSuccess   func(statusCode int) bool // reports whether the status code is considered successful
+		jsonDecoder BodyDecoder               // decoder of the JSON bodies configured on the client, [encoding/json.Unmarshal] is used if nil
+		zeroCopy    bool                      // whether [Response.BodyString] returns the body without copying it
+
+		charsets map[string]CharsetDecoder // charset decoders set on the client, which take precedence over the built-in ones
+		decoders map[string]BodyDecoder    // body decoders set on the client, which take precedence over the built-in ones
+
+		recoverPanics bool // whether the panics of the [ResponseUnmarshaler] functions are recovered
+	}
+
+	// responseSnapshot is the serialized form of a [Response], see [Response.MarshalBinary]
+	responseSnapshot struct {
+		Version    int           // version of the format
+		Status     string        // status of the response
+		StatusCode int           // status code of the response
+		Headers    http.Header   // headers of the response
+		Trailers   http.Header   // trailers of the response
+		Body       []byte        // body of the response
+		RequestId  string        // ID of the request
+		Timings    Timings       // durations of the phases of the request
+		Duration   time.Duration // time spent on the request including the retries
+		Attempts   int           // number of attempts of the request
+		ReceivedAt time.Time     // time the response was received
+		Url        string        // URL of the request
 	}
 
+	// SchemaError is returned when a JSON document does not conform to a JSON Schema, see [pingoschema.Error]
+	SchemaError = pingoschema.Error
+
+	// SchemaViolation describes a single violation of a JSON Schema, see [pingoschema.Violation]
+	SchemaViolation = pingoschema.Violation
+
 	// ResponseError holds data of response that is considered to be an error
 	ResponseError struct {
-		responseHeader        // response header info
-		body           []byte // response body
+		responseHeader             // response header info
+		body           []byte      // response body
+		jsonDecoder    BodyDecoder // decoder of the JSON bodies configured on the client, [encoding/json.Unmarshal] is used if nil
+
+		decoders map[string]BodyDecoder // body decoders set on the client, which take precedence over the built-in ones
 	}
 
 	// AsyncResponse is a structure holding response data for async request
@@ -118,12 +862,194 @@ type (
 		Err      error     // error of the request
 	}
 
+	// CharsetDecoder is a function that converts text encoded with a charset to a UTF-8 string
+	CharsetDecoder func(b []byte) (string, error)
+
+	// Middleware wraps the sending of the requests of a client, added by calling [Client.Use].
+	// It can modify the request before calling the next [net/http.RoundTripper] or the response after it
+	Middleware func(next http.RoundTripper) http.RoundTripper
+
+	// namedMiddleware is a [Middleware] registered on a client
+	namedMiddleware struct {
+		name     string     // name of the middleware, empty if it was added by calling [Client.Use]
+		priority int        // position of the middleware in the chain, lower priorities are outer
+		wrap     Middleware // the middleware
+	}
+
+	// ValidationRule validates a request before it is sent, added by calling [Client.AddValidationRules].
+	// A non nil error fails the request without sending it
+	ValidationRule func(req *http.Request) error
+
+	// RoundTripFunc is an adapter to allow the use of ordinary functions as [net/http.RoundTripper]
+	RoundTripFunc func(req *http.Request) (*http.Response, error)
+
+	// BodyDecoder is a function that decodes a response body into the value pointed to by v
+	BodyDecoder func(data []byte, v any) error
+
+	// IPVersion is the IP version used when dialing connections
+	IPVersion int
+
+	// MethodOverride is the way the methods are tunneled through POST requests set by calling [Client.SetMethodOverride]
+	MethodOverride int
+
+	// Priority is the priority of a request waiting for a free slot when the concurrency of the client is limited
+	Priority int
+
+	// concurrencyLimiter limits the number of requests in flight, the waiting requests get the free slots
+	// in the order of their priority, then in the order of their arrival
+	concurrencyLimiter struct {
+		mu      sync.Mutex         // guards the fields below
+		limit   int                // maximum number of requests in flight
+		active  int                // number of requests in flight
+		waiting [3][]chan struct{} // waiting requests by priority, from the lowest to the highest
+	}
+
+	// releasingBody is a body that calls release once when it is closed e.g.: to release the slot of the request
+	// in the [concurrencyLimiter]
+	releasingBody struct {
+		io.ReadCloser           // the original body
+		once          sync.Once // ensures that release is called once
+		release       func()    // called when the body is closed
+	}
+
+	// inFlightTracker tracks the requests of a client in flight, from starting them until their response body is closed
+	inFlightTracker struct {
+		mu       sync.Mutex                  // guards the fields below
+		closed   bool                        // whether new requests are refused
+		requests map[*inFlightEntry]struct{} // requests in flight
+		drained  chan struct{}               // closed when the tracker is closed and no request is in flight
+	}
+
+	// inFlightEntry is a request tracked by an [inFlightTracker]
+	inFlightEntry struct {
+		InFlightRequest                         // description of the request
+		cancel          context.CancelCauseFunc // cancels the request
+	}
+
 	// ResponseUnmarshaler is a function that can be used to unmarshal a response
 	ResponseUnmarshaler func(r *Response) error
 
 	// StreamReceiver is a function that can be used to read from a streamed response
 	StreamReceiver func(r *bufio.Reader) error
 
+	// PageExtractor is a function that extracts the items of a page from a response.
+	// It prepares the request for the next page e.g.: by setting the cursor query parameter
+	// and reports whether there is a next page
+	PageExtractor[T any] func(resp *Response, next *Request) (items []T, hasNext bool, err error)
+
+	// PaginationStrategy is the name of a ready-made pagination strategy, see [Paginate]
+	PaginationStrategy string
+
+	// PaginationConfig configures a ready-made pagination strategy created by calling [Paginate]. The fields are top-level
+	// fields of JSON object bodies and the empty values are replaced by the defaults of the strategy
+	PaginationConfig struct {
+		Items       string // field of the items, "value" for [PaginationNextLink], "data" for [PaginationCursor], the body is a JSON array of the items otherwise
+		NextLink    string // field of the URL of the next page for [PaginationNextLink], "@odata.nextLink" by default
+		Cursor      string // field of the cursor of the next page for [PaginationCursor], "next_cursor" by default
+		CursorParam string // query parameter of the cursor for [PaginationCursor], "cursor" by default
+		PageParam   string // query parameter of the page number for [PaginationPage], "page" by default
+		PerPage     int    // page size requested by the request for [PaginationPage], a shorter page is the last one. If zero, an empty page is the last one
+	}
+
+	// JobConfig configures an asynchronous job run by calling [RunJob]
+	JobConfig[T any] struct {
+		// PollInterval is the delay between polling the status of the job, which defaults to 1 second.
+		// The Retry-After header of a status response takes precedence if present
+		PollInterval time.Duration
+
+		// Status reports whether the job is done from a status response and the URL of the result.
+		// If the result URL is empty, then the result is read from the status response itself.
+		// If nil, then the job is done when the status code is not 202 and the result URL is the Location header
+		Status func(resp *Response) (done bool, resultUrl string, err error)
+
+		// Result reads the result of the job from the response. If nil, then [Response.Decode] is used
+		Result func(resp *Response) (T, error)
+	}
+
+	// Endpoint is a typed request template combining the method, the path, the encoder of the request values
+	// and the decoder of the response values, performed by calling [Endpoint.Call]
+	Endpoint[Req, Resp any] struct {
+		// Method is the request method, "GET" if empty
+		Method string
+
+		// Path is the request path, which may contain path parameters e.g.: "/users/{id}"
+		Path string
+
+		// Encode prepares the request from the request value e.g.: by setting the path parameters and the body.
+		// If nil, then the value is sent with [Request.Body] unless the method is GET, HEAD, OPTIONS or TRACE
+		Encode func(r *Request, req Req)
+
+		// Decode reads the response value from the response. If nil, then [Response.Decode] is used
+		// and an empty body results in the zero value
+		Decode func(resp *Response) (Resp, error)
+	}
+
+	// Webhook sends signed JSON payloads to a URL, created by calling [Client.NewWebhook]
+	Webhook struct {
+		client          *Client                         // client used to send the payloads
+		url             string                          // URL the payloads are sent to
+		secret          []byte                          // secret used to sign the payloads
+		signatureHeader string                          // header of the signature
+		signaturePrefix string                          // prefix of the signature e.g.: "sha256="
+		hash            func() hash.Hash                // hash function used by the HMAC signature
+		attempts        int                             // maximum number of attempts to send a payload
+		backoff         time.Duration                   // delay before the first retry, doubled after every retry
+		deadLetter      func(payload []byte, err error) // callback receiving the payloads that could not be sent
+	}
+
+	// TokenSource provides the tokens sent as Bearer tokens in the Authorization header, set by calling [Client.SetTokenSource]
+	TokenSource interface {
+		Token(ctx context.Context) (string, error)
+	}
+
+	// JwtMinter is a [TokenSource] that mints short-lived JWTs from a signing key and a claims template,
+	// created by calling [NewJwtMinter]
+	JwtMinter struct {
+		key        any            // signing key
+		claims     map[string]any // claims template
+		ttl        time.Duration  // lifetime of the tokens
+		keyId      string         // ID of the key sent in the "kid" header, omitted if empty
+		perRequest bool           // whether a new token is minted for every request
+
+		mu     sync.Mutex // guards the fields below
+		token  string     // the last minted token
+		expiry time.Time  // expiry of the last minted token
+	}
+
+	// MetadataTokenSource is a [TokenSource] that fetches access tokens from the metadata endpoint of a cloud instance
+	// and caches them until they are about to expire, created by calling [NewGcpTokenSource] or [NewAzureTokenSource]
+	MetadataTokenSource struct {
+		client *Client                                                         // client used to reach the metadata endpoint
+		fetch  func(ctx context.Context, c *Client) (string, time.Time, error) // fetches a token and its expiry
+
+		mu     sync.Mutex // guards the fields below
+		token  string     // the cached token
+		expiry time.Time  // expiry of the cached token
+	}
+
+	// AwsCredentials are temporary AWS credentials of an instance role
+	AwsCredentials struct {
+		AccessKeyId     string    // access key ID
+		SecretAccessKey string    // secret access key
+		SessionToken    string    // session token
+		Expiration      time.Time // expiry of the credentials
+	}
+
+	// AwsCredentialsProvider fetches the credentials of the instance role from the AWS instance metadata service (IMDSv2)
+	// and caches them until they are about to expire, created by calling [NewAwsCredentialsProvider].
+	// AWS does not use Bearer tokens, so it provides the credentials to sign the requests with instead of being a [TokenSource]
+	AwsCredentialsProvider struct {
+		client *Client // client used to reach the metadata endpoint
+
+		mu          sync.Mutex     // guards the fields below
+		credentials AwsCredentials // the cached credentials
+	}
+
+	// errReader is a reader that always fails with the error
+	errReader struct {
+		err error // error returned by Read
+	}
+
 	// multipartFormFile contains information about a multipartform file
 	multipartFormFile struct {
 		reader    io.Reader // [io.Reader] to read the file data
@@ -136,10 +1062,63 @@ type (
 var (
 	headerUserAgentDefaultValue = pingoWithVersion + " (github.com/mauserzjeh/pingo)"
 	pingoWithVersion            = pingo + " " + version
+	pingoProductToken           = pingo + "/" + strings.TrimPrefix(version, "v")
+
+	// base URLs of the metadata endpoints of the cloud providers
+	gcpMetadataUrl   = "http://metadata.google.internal"
+	azureMetadataUrl = "http://169.254.169.254"
+	awsMetadataUrl   = "http://169.254.169.254"
 
 	// default client created by the package
 	defaultClient = newDefaultClient()
 
+	// BrowserChrome is the [BrowserProfile] of Chrome on Windows
+	BrowserChrome = BrowserProfile{
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36",
+		Accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8",
+		AcceptLanguage: "en-US,en;q=0.9",
+		Headers: http.Header{
+			"Sec-Ch-Ua":                 {`"Chromium";v="130", "Google Chrome";v="130", "Not?A_Brand";v="99"`},
+			"Sec-Ch-Ua-Mobile":          {"?0"},
+			"Sec-Ch-Ua-Platform":        {`"Windows"`},
+			"Upgrade-Insecure-Requests": {"1"},
+		},
+	}
+
+	// BrowserFirefox is the [BrowserProfile] of Firefox on Windows
+	BrowserFirefox = BrowserProfile{
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:132.0) Gecko/20100101 Firefox/132.0",
+		Accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		AcceptLanguage: "en-US,en;q=0.5",
+		Headers: http.Header{
+			"Upgrade-Insecure-Requests": {"1"},
+		},
+	}
+
+	// charset decoders by lowercase charset name
+	charsetDecoders = map[string]CharsetDecoder{
+		"utf-8":        decodeUtf8,
+		"utf8":         decodeUtf8,
+		"us-ascii":     decodeUtf8,
+		"ascii":        decodeUtf8,
+		"iso-8859-1":   decodeLatin1,
+		"iso8859-1":    decodeLatin1,
+		"latin1":       decodeLatin1,
+		"windows-1252": decodeWindows1252,
+		"cp1252":       decodeWindows1252,
+		"utf-16":       decodeUtf16(nil),
+		"utf-16le":     decodeUtf16(binary.LittleEndian),
+		"utf-16be":     decodeUtf16(binary.BigEndian),
+	}
+
+	// body decoders by lowercase media type
+	bodyDecoders = map[string]BodyDecoder{
+		"application/json": json.Unmarshal,
+		"text/json":        json.Unmarshal,
+		"application/xml":  xml.Unmarshal,
+		"text/xml":         xml.Unmarshal,
+	}
+
 	// header constants
 
 	headerContentType  = textproto.CanonicalMIMEHeaderKey("Content-Type")
@@ -148,9 +1127,79 @@ var (
 	headerConnection   = textproto.CanonicalMIMEHeaderKey("Connection")
 	headerUserAgent    = textproto.CanonicalMIMEHeaderKey("User-Agent")
 
+	headerContentEncoding = textproto.CanonicalMIMEHeaderKey("Content-Encoding")
+	headerAcceptLanguage  = textproto.CanonicalMIMEHeaderKey("Accept-Language")
+	headerContentLanguage = textproto.CanonicalMIMEHeaderKey("Content-Language")
+	headerPriority        = textproto.CanonicalMIMEHeaderKey("Priority")
+	headerSecFetchSite    = textproto.CanonicalMIMEHeaderKey("Sec-Fetch-Site")
+	headerSecFetchMode    = textproto.CanonicalMIMEHeaderKey("Sec-Fetch-Mode")
+	headerSecFetchDest    = textproto.CanonicalMIMEHeaderKey("Sec-Fetch-Dest")
+	headerSecFetchUser    = textproto.CanonicalMIMEHeaderKey("Sec-Fetch-User")
+
+	headerContentLength      = textproto.CanonicalMIMEHeaderKey("Content-Length")
+	headerContentDisposition = textproto.CanonicalMIMEHeaderKey("Content-Disposition")
+	headerLocation           = textproto.CanonicalMIMEHeaderKey("Location")
+	headerLink               = textproto.CanonicalMIMEHeaderKey("Link")
+
+	headerIfNoneMatch     = textproto.CanonicalMIMEHeaderKey("If-None-Match")
+	headerIfModifiedSince = textproto.CanonicalMIMEHeaderKey("If-Modified-Since")
+	headerETag            = textproto.CanonicalMIMEHeaderKey("ETag")
+	headerLastModified    = textproto.CanonicalMIMEHeaderKey("Last-Modified")
+	headerDate            = textproto.CanonicalMIMEHeaderKey("Date")
+	headerAge             = textproto.CanonicalMIMEHeaderKey("Age")
+
+	headerAuthorization = textproto.CanonicalMIMEHeaderKey("Authorization")
+	headerCookie        = textproto.CanonicalMIMEHeaderKey("Cookie")
+
+	// request headers carrying the credentials of the user
+	credentialHeaders = []string{headerAuthorization, headerCookie}
+
+	headerMethodOverride = textproto.CanonicalMIMEHeaderKey("X-HTTP-Method-Override")
+	queryMethodOverride  = "_method"
+
+	headerTimestamp = textproto.CanonicalMIMEHeaderKey("X-Timestamp")
+	headerNonce     = textproto.CanonicalMIMEHeaderKey("X-Nonce")
+	headerSignature = textproto.CanonicalMIMEHeaderKey("X-Signature")
+
+	// patterns of the meta tags and their attributes searched by [CSRFFromMetaTag]
+	metaTagPattern  = regexp.MustCompile(`(?i)<meta\s[^>]*>`)
+	htmlAttrPattern = regexp.MustCompile(`([\w-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
 	// errors
 
-	ErrRequestTimedOut = errors.New("request timed out")
+	ErrRequestTimedOut  = errors.New("request timed out")
+	ErrEndpointNotFound = errors.New("endpoint not found")
+	ErrStreamIdle       = errors.New("stream idle timeout")
+	ErrReadTimeout      = errors.New("stream read timed out")
+
+	ErrUnsupportedCharset = errors.New("unsupported charset")
+	ErrUnsupportedMedia   = errors.New("unsupported media type")
+	ErrTooManyPages       = errors.New("too many pages")
+	ErrNotModified        = errors.New("not modified")
+	ErrRangeNotSatisfied  = errors.New("range request not satisfied")
+	ErrInvalidUrl         = errors.New("invalid URL")
+	ErrInjectedFault      = errors.New("injected fault")
+	ErrUnsafeArchivePath  = errors.New("unsafe archive path")
+	ErrArchiveTooLarge    = errors.New("archive too large")
+	ErrValidationFailed   = errors.New("request validation failed")
+	ErrHostNotAllowed     = errors.New("host not allowed")
+	ErrAddressBlocked     = errors.New("address blocked")
+	ErrRedirectRefused    = errors.New("redirect refused")
+	ErrUnsupportedKey     = errors.New("unsupported key")
+	ErrClientShutdown     = errors.New("client is shut down")
+	ErrInvalidSnapshot    = errors.New("invalid response snapshot")
+	ErrBodyNotReplayable  = errors.New("body cannot be replayed")
+	ErrUnhealthy          = errors.New("unhealthy")
+	ErrCSRFTokenNotFound  = errors.New("CSRF token not found")
+	ErrInvalidBatch       = errors.New("invalid batch response")
+	ErrUnknownPagination  = errors.New("unknown pagination strategy")
+	ErrOffline            = errors.New("client is offline")
+	ErrUnsupportedFormat  = errors.New("unsupported format")
+	ErrPoolRestricted     = errors.New("connection pool cannot enforce the host restrictions")
+
+	ErrConnectTimeout        = errors.New("connect timed out")
+	ErrTLSHandshakeTimeout   = errors.New("TLS handshake timed out")
+	ErrResponseHeaderTimeout = errors.New("response header timed out")
 )
 
 const (
@@ -171,6 +1220,143 @@ const (
 	ContentTypeXml             = "application/xml"
 	ContentTypeFormUrlEncoded  = "application/x-www-form-urlencoded"
 	ContentTypeTextEventStream = "text/event-stream"
+	ContentTypeGzip            = "application/gzip"
+	ContentTypeText            = "text/plain; charset=utf-8"
+	ContentTypeHtml            = "text/html; charset=utf-8"
+)
+
+const (
+	// DefaultMaxPages is the maximum number of pages fetched by [CollectAll]
+	DefaultMaxPages = 1000
+
+	// maximum number of attempts to download a segment by [Client.DownloadParallel]
+	downloadSegmentAttempts = 3
+
+	// DefaultDebugBodyLimit is the default maximum number of body bytes included in the debug output
+	DefaultDebugBodyLimit = 64 << 10
+
+	// DefaultMaxRetryDelay is the default maximum delay before a retry, see [Client.SetMaxRetryDelay]
+	DefaultMaxRetryDelay = time.Minute
+
+	// default delay between polling the status of a job run by [RunJob]
+	defaultJobPollInterval = time.Second
+
+	// DefaultWebhookSignatureHeader is the default header of the signature sent by a [Webhook]
+	DefaultWebhookSignatureHeader = "X-Hub-Signature-256"
+
+	// default maximum number of attempts and the delay before the first retry of a [Webhook]
+	defaultWebhookAttempts = 3
+	defaultWebhookBackoff  = time.Second
+
+	// default size of the chunks read by [ResponseStream.Chan]
+	defaultStreamChunkSize = 32 << 10
+
+	// name of a file saved by [Response.SaveToDir] when the response does not provide one
+	defaultDownloadName = "download"
+
+	// maximum length of a file name in bytes saved by [Response.SaveToDir], which is the limit of common file systems
+	maxFilenameLength = 255
+
+	// DefaultExtractMaxFiles and DefaultExtractMaxSize are the default limits of extracting an archive, see [ExtractLimits]
+	DefaultExtractMaxFiles = 10000
+	DefaultExtractMaxSize  = 1 << 30
+
+	// DefaultMaxRedirects is the default maximum number of redirects followed, which is the same as the default of [net/http.Client]
+	DefaultMaxRedirects = 10
+
+	// DefaultMaxClockSkew is the maximum clock skew corrected by [SigningMiddleware]
+	DefaultMaxClockSkew = 15 * time.Minute
+
+	// time before the expiry of a token or credentials fetched from a metadata endpoint when they are refreshed
+	metadataRefreshMargin = time.Minute
+
+	// timeout of the requests to the metadata endpoints
+	metadataTimeout = 5 * time.Second
+
+	// version of the format of the serialized responses
+	responseSnapshotVersion = 1
+
+	// DefaultLatencyWindow is the number of the most recent requests whose latencies are recorded by a client
+	DefaultLatencyWindow = 1024
+
+	// DefaultBalancerInterval is the default delay between the measurements of a [LatencyBalancer]
+	DefaultBalancerInterval = 30 * time.Second
+
+	// DefaultBalancerSamples is the default number of requests per base URL in a measurement of a [LatencyBalancer]
+	DefaultBalancerSamples = 3
+
+	// DefaultBalancerHysteresis is the default fraction by which another base URL must be faster for a [LatencyBalancer] to switch to it
+	DefaultBalancerHysteresis = 0.2
+
+	// DefaultCSRFHeader is the default header of the CSRF token sent by a [Session]
+	DefaultCSRFHeader = "X-CSRF-Token"
+
+	// non-standard status code sent by some frameworks when the CSRF token expired
+	statusCSRFExpired = 419
+
+	// DefaultCacheMaxEntries is the default maximum number of responses stored by a [ResponseCache]
+	DefaultCacheMaxEntries = 1024
+
+	// maximum size of a response body stored by a [ResponseCache]
+	cacheMaxBodySize = 8 << 20
+
+	// DefaultRequestIdHeader is the default header of the request ID enabled by calling [Client.SetRequestId]
+	DefaultRequestIdHeader = "X-Request-ID"
+)
+
+// Debug formats
+const (
+	DebugFormatText DebugFormat = iota // human readable tables of the request and the response dumps
+	DebugFormatJson                    // a JSON object per request after the log prefix on a single line, which can be indexed by log aggregation systems
+)
+
+// Log levels
+const (
+	LogLevelDefault LogLevel = iota // the log and debug settings of the client and the requests apply
+	LogLevelOff                     // nothing is logged
+	LogLevelInfo                    // a summary line is logged per request
+	LogLevelDebug                   // the dumps of the requests and the responses are logged as well
+)
+
+// Error classes
+const (
+	ErrClassUnknown    ErrClass = iota // the error could not be classified
+	ErrClassNetwork                    // the connection could not be established or was broken
+	ErrClassDNS                        // the host could not be resolved
+	ErrClassTLS                        // the TLS handshake or certificate verification failed
+	ErrClassTimeout                    // the request timed out
+	ErrClassCanceled                   // the request was canceled
+	ErrClassHTTPStatus                 // the response has an error status code
+	ErrClassDecode                     // the response could not be decoded
+)
+
+// Priorities
+const (
+	PriorityLow    Priority = -1 // bulk background traffic
+	PriorityNormal Priority = 0  // the default priority
+	PriorityHigh   Priority = 1  // latency-critical requests
+)
+
+// Pagination strategies
+const (
+	PaginationNextLink   PaginationStrategy = "nextLink"   // the URL of the next page is in a field of the body e.g.: "@odata.nextLink" of OData services
+	PaginationLinkHeader PaginationStrategy = "linkHeader" // the URL of the next page is in the Link header with rel="next" e.g.: GitHub
+	PaginationPage       PaginationStrategy = "page"       // the page number is sent in a query parameter and incremented until the last page
+	PaginationCursor     PaginationStrategy = "cursor"     // the cursor of the next page is in a field of the body and sent in a query parameter
+)
+
+// Method overrides
+const (
+	MethodOverrideNone   MethodOverride = iota // the methods are sent as is
+	MethodOverrideHeader                       // the method is sent in the X-HTTP-Method-Override header
+	MethodOverrideQuery                        // the method is sent in the _method query parameter
+)
+
+// IP versions
+const (
+	IPVersionAuto IPVersion = iota // use both IPv4 and IPv6 (dual-stack with fast fallback)
+	IPv4Only                       // use IPv4 only
+	IPv6Only                       // use IPv6 only
 )
 
 // ---------------------------------------------- //
@@ -214,7 +1400,19 @@ func (l *logger) setOutput(w io.Writer) {
 	l.l.SetOutput(w)
 }
 
-// log writes the log message
+// clone returns a copy of the logger writing to the same output
+func (l *logger) clone() *logger {
+	c := &logger{
+		l: log.New(l.l.Writer(), "", 0),
+	}
+
+	c.setFlags(l.flags())
+	c.setTimeFormat(l.timeFmt())
+
+	return c
+}
+
+// log writes the log message
 func (l *logger) log(format string, args ...any) {
 	t := time.Now()
 	flag := l.flags()
@@ -239,7 +1437,8 @@ func (l *logger) log(format string, args ...any) {
 
 	// file + line
 	if flag&(Fshortfile|Flongfile) != 0 {
-		_, file, line, _ := runtime.Caller(5)
+		frame := callerFrame()
+		file, line := frame.File, frame.Line
 		if flag&Fshortfile != 0 {
 			file = path.Base(file)
 		}
@@ -254,6 +1453,25 @@ func (l *logger) log(format string, args ...any) {
 	l.l.Println(sb.String())
 }
 
+// callerFrame returns the frame of the call site of the user, which is the first frame outside of the pingo package
+// and the runtime. If there is no such frame e.g.: for an async request, then the outermost frame is returned
+func callerFrame() runtime.Frame {
+	_, self, _, _ := runtime.Caller(0)
+
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+
+	var frame runtime.Frame
+	for more := true; more; {
+		frame, more = frames.Next()
+		if frame.File != self && !strings.HasPrefix(frame.Function, "runtime.") {
+			return frame
+		}
+	}
+
+	return frame
+}
+
 // ---------------------------------------------- //
 // Client                                         //
 // ---------------------------------------------- //
@@ -261,11 +1479,21 @@ func (l *logger) log(format string, args ...any) {
 // newDefaultClient creates a new default client
 func newDefaultClient() *Client {
 	c := &Client{
-		client:       &http.Client{},
-		logger:       newDefaultLogger(),
-		headers:      make(http.Header),
-		queryParams:  make(url.Values),
-		isLogEnabled: true,
+		client:         &http.Client{},
+		logger:         newDefaultLogger(),
+		headers:        make(http.Header),
+		queryParams:    make(url.Values),
+		isLogEnabled:   true,
+		hosts:          make(map[string]*HostConfig),
+		endpoints:      make(map[string]endpoint),
+		schemas:        make(map[string][]byte),
+		debugBodyLimit: DefaultDebugBodyLimit,
+		maxRetryDelay:  DefaultMaxRetryDelay,
+		logSampleRate:  1,
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
 	}
 
 	c.headers.Set(headerUserAgent, headerUserAgentDefaultValue)
@@ -280,681 +1508,7858 @@ func NewClient() *Client {
 	return c
 }
 
-// SetClient sets the underlying [net/http.Client]
-func (c *Client) SetClient(client *http.Client) *Client {
-	c.client = client
+// NewClientWithOptions creates a new client with the default settings and applies the given options in order.
+// It is an alternative to chaining the setters of [Client], which allows sharing configurations as option slices
+func NewClientWithOptions(opts ...Option) *Client {
+	c := newDefaultClient()
+	for _, opt := range opts {
+		opt(c)
+	}
+
 	return c
 }
 
-// SetBaseUrl sets the base URL
-func (c *Client) SetBaseUrl(baseUrl string) *Client {
-	c.baseUrl = baseUrl
-	return c
+// Clone returns a derived client with a copy of the settings of the client, which can be changed independently
+// e.g.: to use different base URLs, headers or timeouts per tenant. The derived client shares the [net/http.RoundTripper]
+// of the client, so the connections are pooled together instead of opening new ones for every derived client.
+// Changing the settings applied to the transport e.g.: [Client.SetAllowedHosts], [Client.SetBlockedNetworks],
+// [Client.SetIPVersion] or [Client.SetConnEvents] on either client replaces its transport with a copy, so that the other
+// clients are not affected. The retry budget and the bandwidth limit are shared as well, while the statistics and
+// the requests in flight are tracked separately
+func (c *Client) Clone() *Client {
+	if c.client.Transport == nil {
+		c.transport()
+	}
+	c.sharedTransport.Store(true)
+
+	httpClient := *c.client
+	dialer := *c.dialer
+
+	clone := &Client{
+		client:             &httpClient,
+		baseUrl:            c.baseUrl,
+		debug:              c.debug,
+		debugBody:          c.debugBody,
+		headers:            cloneValues(c.headers),
+		queryParams:        cloneValues(c.queryParams),
+		timeout:            c.timeout,
+		logger:             c.logger.clone(),
+		isLogEnabled:       c.isLogEnabled,
+		leveled:            c.leveled,
+		logFilter:          c.logFilter,
+		logSampleRate:      c.logSampleRate,
+		requestIdHeader:    c.requestIdHeader,
+		requestIdGenerator: c.requestIdGenerator,
+		userAgent:          c.userAgent,
+		hosts:              make(map[string]*HostConfig),
+		fallbackBaseUrl:    c.fallbackBaseUrl,
+		balancer:           c.balancer,
+		bandwidth:          c.bandwidth,
+		dialer:             &dialer,
+		ipVersion:          c.ipVersion,
+		proxy:              c.proxy,
+		proxySet:           c.proxySet,
+		noProxy:            slices.Clone(c.noProxy),
+		methodOverride:     c.methodOverride,
+		allowedHosts:       slices.Clone(c.allowedHosts),
+		blockedNetworks:    slices.Clone(c.blockedNetworks),
+		blockedErr:         c.blockedErr,
+		faults:             c.faults,
+		slowThreshold:      c.slowThreshold,
+		onSlow:             c.onSlow,
+		tokenSource:        c.tokenSource,
+		connEvents:         c.connEvents,
+		validationRules:    slices.Clone(c.validationRules),
+		maxRetries:         c.maxRetries,
+		retryBackoff:       c.retryBackoff,
+		retryBudget:        c.retryBudget,
+		maxRetryDelay:      c.maxRetryDelay,
+		recoverPanics:      c.recoverPanics,
+		cache:              c.cache,
+		isSuccess:          c.isSuccess,
+		jsonUseNumber:      c.jsonUseNumber,
+		jsonStrict:         c.jsonStrict,
+		zeroCopy:           c.zeroCopy,
+		charsets:           c.charsets,
+		decoders:           c.decoders,
+		jsonMarshal:        c.jsonMarshal,
+		jsonUnmarshal:      c.jsonUnmarshal,
+		debugFormat:        c.debugFormat,
+		debugBodyLimit:     c.debugBodyLimit,
+	}
+
+	clone.logLevel.Store(c.logLevel.Load())
+	clone.offline.Store(c.offline.Load())
+	clone.sharedTransport.Store(true)
+
+	c.middlewaresMu.RLock()
+	clone.middlewares = c.middlewares
+	c.middlewaresMu.RUnlock()
+
+	if c.concurrency != nil {
+		clone.SetMaxConcurrency(c.concurrency.limit)
+	}
+
+	c.hostsMu.RLock()
+	for host, hc := range c.hosts {
+		hc.mu.RLock()
+		clone.hosts[host] = &HostConfig{
+			headers:     cloneValues(hc.headers),
+			queryParams: cloneValues(hc.queryParams),
+			timeout:     hc.timeout,
+			limiter:     hc.limiter,
+		}
+		hc.mu.RUnlock()
+	}
+	clone.pathLimits = slices.Clone(c.pathLimits)
+	c.hostsMu.RUnlock()
+
+	c.endpointsMu.RLock()
+	clone.endpoints = maps.Clone(c.endpoints)
+	clone.schemas = maps.Clone(c.schemas)
+	c.endpointsMu.RUnlock()
+
+	return clone
 }
 
-// SetHeaders sets the header values
-func (c *Client) SetHeaders(headers http.Header) *Client {
-	setValues(headers, c.headers)
-	return c
+// With returns a derived client created by calling [Client.Clone] with the given options applied in order
+func (c *Client) With(opts ...Option) *Client {
+	clone := c.Clone()
+	for _, opt := range opts {
+		opt(clone)
+	}
+
+	return clone
 }
 
-// SetHeader sets a single header value
-func (c *Client) SetHeader(key, value string) *Client {
-	c.headers.Set(key, value)
-	return c
+// WithClient sets the underlying [net/http.Client], see [Client.SetClient]
+func WithClient(client *http.Client) Option {
+	return func(c *Client) { c.SetClient(client) }
 }
 
-// AddHeaders adds the header values
-func (c *Client) AddHeaders(headers http.Header) *Client {
-	addValues(headers, c.headers)
-	return c
+// WithBaseUrl sets the base URL, see [Client.SetBaseUrl]
+func WithBaseUrl(baseUrl string) Option {
+	return func(c *Client) { c.SetBaseUrl(baseUrl) }
 }
 
-// AddHeader adds a single header value
-func (c *Client) AddHeader(key, value string) *Client {
-	c.headers.Add(key, value)
-	return c
+// WithFallbackBaseUrl sets the fallback base URL, see [Client.SetFallbackBaseUrl]
+func WithFallbackBaseUrl(baseUrl string) Option {
+	return func(c *Client) { c.SetFallbackBaseUrl(baseUrl) }
 }
 
-// SetQueryParams sets the query parameters
-func (c *Client) SetQueryParams(queryParams url.Values) *Client {
-	setValues(queryParams, c.queryParams)
-	return c
+// WithTimeout sets the timeout, see [Client.SetTimeout]
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) { c.SetTimeout(timeout) }
 }
 
-// SetQueryParam sets a single query parameter
-func (c *Client) SetQueryParam(key, value string) *Client {
-	c.queryParams.Set(key, value)
+// WithRetry sets the retries of failed requests, see [Client.SetRetry]
+func WithRetry(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) { c.SetRetry(maxRetries, backoff) }
+}
+
+// WithMaxRetryDelay sets the maximum delay before a retry, see [Client.SetMaxRetryDelay]
+func WithMaxRetryDelay(delay time.Duration) Option {
+	return func(c *Client) { c.SetMaxRetryDelay(delay) }
+}
+
+// WithHeader sets a single header, see [Client.SetHeader]
+func WithHeader(key, value string) Option {
+	return func(c *Client) { c.SetHeader(key, value) }
+}
+
+// WithQueryParam sets a single query parameter, see [Client.SetQueryParam]
+func WithQueryParam(key, value string) Option {
+	return func(c *Client) { c.SetQueryParam(key, value) }
+}
+
+// WithDebug sets the debug mode, see [Client.SetDebug]
+func WithDebug(debug, includeBody bool) Option {
+	return func(c *Client) { c.SetDebug(debug, includeBody) }
+}
+
+// WithLogger sets the output and the flags of the logger, see [Client.SetLogOutput] and [Client.SetLogFlags].
+// A nil writer disables logging
+func WithLogger(w io.Writer, flag int) Option {
+	return func(c *Client) {
+		if w == nil {
+			c.SetLogEnabled(false)
+			return
+		}
+
+		c.SetLogEnabled(true).SetLogOutput(w).SetLogFlags(flag)
+	}
+}
+
+// WithMiddleware adds the given middlewares, see [Client.Use]
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(c *Client) { c.Use(middlewares...) }
+}
+
+// SetClient sets the underlying [net/http.Client]. The client and its transport are not changed by the setters
+// configuring the transport e.g.: [Client.DisableKeepAlives], which configure a copy of them instead
+func (c *Client) SetClient(client *http.Client) *Client {
+	c.client = client
+	c.proxy, c.proxySet = nil, false
+	c.sharedTransport.Store(true)
 	return c
 }
 
-// AddQueryParams adds the query parameters
-func (c *Client) AddQueryParams(queryParams url.Values) *Client {
-	addValues(queryParams, c.queryParams)
+// SetConnectionPool sets the [ConnectionPool] used by the client, which can be shared by multiple clients.
+// The settings of the client applied to the transport e.g.: [Client.SetIPVersion] have no effect afterwards,
+// since the connections are dialed by the pool. Since the connections of the pool are shared regardless of
+// the host restrictions set by calling [Client.SetAllowedHosts] or [Client.SetBlockedNetworks], the requests
+// of a client with host restrictions fail with [ErrPoolRestricted]. The underlying [net/http.Client] is copied,
+// so that a client supplied by the caller is not changed
+func (c *Client) SetConnectionPool(pool *ConnectionPool) *Client {
+	httpClient := *c.client
+	httpClient.Transport = pool
+	c.client = &httpClient
 	return c
 }
 
-// AddQueryParam adds a single query parameter
-func (c *Client) AddQueryParam(key, value string) *Client {
-	c.queryParams.Add(key, value)
+// SetLatencyBalancer sets the [LatencyBalancer] selecting the base URL of the requests, which use the base URL of the client.
+// A nil balancer removes the balancer
+func (c *Client) SetLatencyBalancer(balancer *LatencyBalancer) *Client {
+	c.balancer = balancer
 	return c
 }
 
-// SetTimeout sets the timeout
-func (c *Client) SetTimeout(timeout time.Duration) *Client {
-	c.timeout = timeout
+// SetBaseUrl sets the base URL
+func (c *Client) SetBaseUrl(baseUrl string) *Client {
+	c.baseUrl = baseUrl
 	return c
 }
 
-// SetDebug sets the debug mode
-func (c *Client) SetDebug(debug, includeBody bool) *Client {
-	c.debug = debug
-	c.debugBody = includeBody
+// SetFallbackBaseUrl sets the fallback base URL. Requests using the base URL of the client
+// are performed again against the fallback base URL if the base URL is unreachable
+// e.g.: the connection is refused or the host cannot be resolved
+func (c *Client) SetFallbackBaseUrl(baseUrl string) *Client {
+	c.fallbackBaseUrl = baseUrl
 	return c
 }
 
-// SetLogEnabled sets the log mode
-func (c *Client) SetLogEnabled(enable bool) *Client {
-	c.isLogEnabled = enable
+// SetBandwidthLimit limits the bandwidth used by the request and response bodies
+// of the client to the given bytes per second. The limit is shared by all requests of the client.
+// A limit less than or equal to zero disables the limit
+func (c *Client) SetBandwidthLimit(bytesPerSec int64) *Client {
+	if bytesPerSec <= 0 {
+		c.bandwidth = nil
+		return c
+	}
+
+	c.bandwidth = newRateLimiter(float64(bytesPerSec), int(bytesPerSec))
 	return c
 }
 
-// SetLogTimeFormat sets the log time format if [Ftime] flag is given
-func (c *Client) SetLogTimeFormat(layout string) *Client {
-	c.logger.setTimeFormat(layout)
+// DisableKeepAlives disables or enables HTTP keep-alives. If keep-alives are disabled,
+// then a connection is used for a single request only. It has no effect if the underlying
+// [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) DisableKeepAlives(disable bool) *Client {
+	if t := c.transport(); t != nil {
+		t.DisableKeepAlives = disable
+	}
 	return c
 }
 
-// SetLogOutput sets the log output to the given [io.Writer]
-func (c *Client) SetLogOutput(w io.Writer) *Client {
-	c.logger.setOutput(w)
+// SetProxy sets the URL of the proxy used by the requests, which overrides the proxy given by the environment
+// variables, see [Client.SetProxyFromEnvironment]. A nil URL disables the use of a proxy.
+// It has no effect if the underlying [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) SetProxy(proxyUrl *url.URL) *Client {
+	if t := c.transport(); t != nil {
+		c.proxy, c.proxySet = http.ProxyURL(proxyUrl), true
+		c.applyProxy(t)
+	}
 	return c
 }
 
-// SetLogFlags sets the log flags
-func (c *Client) SetLogFlags(flag int) *Client {
-	c.logger.setFlags(flag)
+// SetProxyFromEnvironment sets the proxy used by the requests to the one given by the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables, which is the default. It has no effect if the underlying [net/http.Client]
+// uses a custom [net/http.RoundTripper]
+func (c *Client) SetProxyFromEnvironment() *Client {
+	if t := c.transport(); t != nil {
+		c.proxy, c.proxySet = http.ProxyFromEnvironment, true
+		c.applyProxy(t)
+	}
 	return c
 }
 
-// NewRequest creates a new request
-func (c *Client) NewRequest() *Request {
-	return &Request{
-		client:       c,
-		method:       http.MethodGet,
-		baseUrl:      c.baseUrl,
-		path:         "",
-		headers:      c.headers,
-		queryParams:  c.queryParams,
-		timeout:      c.timeout,
-		body:         nil,
-		bodyErr:      nil,
-		cancel:       nil,
-		ctx:          nil,
-		debug:        c.debug,
-		debugBody:    c.debugBody,
-		isLogEnabled: c.isLogEnabled,
+// SetNoProxy sets the hosts that are reached directly instead of through the proxy, in addition to the NO_PROXY
+// environment variable. It replaces the previously set hosts and applies to the proxy set before or after it.
+// A host matches if it is equal to the given one or if it is a subdomain of a given one starting with a dot
+// e.g.: ".example.com". "*" matches every host. It has no effect if the underlying [net/http.Client] uses
+// a custom [net/http.RoundTripper]
+func (c *Client) SetNoProxy(hosts ...string) *Client {
+	if t := c.transport(); t != nil {
+		c.noProxy = slices.Clone(hosts)
+		c.applyProxy(t)
 	}
+	return c
 }
 
-// ---------------------------------------------- //
-// Request                                        //
-// ---------------------------------------------- //
+// applyProxy sets the proxy of the transport to the proxy of the client, which skips the hosts set by calling [Client.SetNoProxy]
+func (c *Client) applyProxy(t *http.Transport) {
+	if !c.proxySet {
+		c.proxy, c.proxySet = t.Proxy, true
+	}
 
-// NewRequest creates a new request on the default client
-func NewRequest() *Request {
-	return defaultClient.NewRequest()
-}
+	proxy, hosts := c.proxy, c.noProxy
+	if proxy == nil || len(hosts) == 0 {
+		t.Proxy = proxy
+		return
+	}
 
-// SetDebug sets the debug mode
-func (r *Request) SetDebug(debug, includeBody bool) *Request {
-	r.debug = debug
-	r.debugBody = includeBody
-	return r
-}
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		host := strings.ToLower(req.URL.Hostname())
+		for _, h := range hosts {
+			h = strings.ToLower(h)
+			if h == "*" || h == host || strings.HasPrefix(h, ".") && (strings.HasSuffix(host, h) || host == h[1:]) {
+				return nil, nil
+			}
+		}
 
-// SetLogEnabled sets the log mode
-func (r *Request) SetLogEnabled(enabled bool) *Request {
-	r.isLogEnabled = enabled
-	return r
+		return proxy(req)
+	}
 }
 
-// SetMethod sets the request method
-// e.g.: "GET", "POST", "PUT"
-func (r *Request) SetMethod(method string) *Request {
-	if method != "" {
-		r.method = method
+// proxyFor returns the URL of the proxy used by the given request or "direct" if no proxy is used
+func (c *Client) proxyFor(req *http.Request) string {
+	proxy := http.ProxyFromEnvironment
+	if c.client.Transport != nil {
+		t, ok := c.client.Transport.(*http.Transport)
+		if !ok {
+			return "unknown"
+		}
+		proxy = t.Proxy
 	}
-	return r
+
+	if proxy == nil {
+		return "direct"
+	}
+
+	u, err := proxy(req)
+	if err != nil || u == nil {
+		return "direct"
+	}
+
+	return u.Redacted()
 }
 
-// SetBaseUrl sets the base URL
-func (r *Request) SetBaseUrl(baseUrl string) *Request {
-	r.baseUrl = baseUrl
-	return r
+// SetInsecureSkipVerify sets whether the TLS certificates of the servers are not verified.
+// It should only be used for testing. It has no effect if the underlying [net/http.Client]
+// uses a custom [net/http.RoundTripper]
+func (c *Client) SetInsecureSkipVerify(skip bool) *Client {
+	if t := c.transport(); t != nil {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = skip
+	}
+	return c
 }
 
-// SetPath sets the request path
-func (r *Request) SetPath(path string) *Request {
-	r.path = path
-	return r
+// SetMethodOverride sets how the methods other than GET, HEAD and POST are sent for servers and firewalls accepting
+// only GET and POST requests. Unless it is [MethodOverrideNone], such requests are sent as POST requests
+// with the real method in the X-HTTP-Method-Override header or in the _method query parameter
+func (c *Client) SetMethodOverride(mode MethodOverride) *Client {
+	c.methodOverride = mode
+	return c
 }
 
-// SetHeaders sets the header values
-func (r *Request) SetHeaders(headers http.Header) *Request {
-	setValues(headers, r.headers)
-	return r
+// SetIPVersion sets the IP version used when dialing connections, which is useful
+// when one address family is broken in a given environment. It has no effect
+// if the underlying [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) SetIPVersion(version IPVersion) *Client {
+	c.ipVersion = version
+	if t := c.transport(); t != nil {
+		t.DialContext = c.dialSettings().dialContext
+	}
+	return c
 }
 
-// SetHeader sets a single header value
-func (r *Request) SetHeader(key, value string) *Request {
-	r.headers.Set(key, value)
-	return r
+// SetConnectTimeout sets the timeout of establishing a connection. It has no effect
+// if the underlying [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) SetConnectTimeout(timeout time.Duration) *Client {
+	c.dialer.Timeout = timeout
+	if t := c.transport(); t != nil {
+		t.DialContext = c.dialSettings().dialContext
+	}
+	return c
 }
 
-// AddHeaders adds the header values
-func (r *Request) AddHeaders(headers http.Header) *Request {
-	addValues(headers, r.headers)
-	return r
+// SetTLSHandshakeTimeout sets the timeout of the TLS handshake. It has no effect
+// if the underlying [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) SetTLSHandshakeTimeout(timeout time.Duration) *Client {
+	if t := c.transport(); t != nil {
+		t.TLSHandshakeTimeout = timeout
+	}
+	return c
 }
 
-// AddHeader adds a single header value
-func (r *Request) AddHeader(key, value string) *Request {
-	r.headers.Add(key, value)
-	return r
+// SetResponseHeaderTimeout sets the timeout of waiting for the response headers after the request is written.
+// It has no effect if the underlying [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) SetResponseHeaderTimeout(timeout time.Duration) *Client {
+	if t := c.transport(); t != nil {
+		t.ResponseHeaderTimeout = timeout
+	}
+	return c
 }
 
-// SetQueryParams sets the query parameters
-func (r *Request) SetQueryParams(queryParams url.Values) *Request {
-	setValues(queryParams, r.queryParams)
-	return r
+// SetAllowedHosts restricts the hosts which can be dialed to the ones matching the given patterns e.g.: "api.example.com"
+// or "*.example.com", see [path.Match] for the syntax. It protects against requests to user supplied URLs reaching
+// unexpected hosts, including the targets of redirects. If a proxy is used, then the host of the proxy is checked.
+// Dialing any other host fails with [ErrHostNotAllowed] and the idle connections are closed, so that they are checked again.
+// Calling it without patterns allows any host.
+// It has no effect if the underlying [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) SetAllowedHosts(patterns ...string) *Client {
+	c.allowedHosts = nil
+	for _, p := range patterns {
+		c.allowedHosts = append(c.allowedHosts, strings.ToLower(p))
+	}
+
+	if t := c.transport(); t != nil {
+		t.DialContext = c.dialSettings().dialContext
+		t.CloseIdleConnections()
+	}
+	return c
 }
 
-// SetQueryParam sets a single query parameter
-func (r *Request) SetQueryParam(key, value string) *Request {
-	r.queryParams.Set(key, value)
-	return r
+// SetBlockedNetworks blocks dialing the addresses of the given networks in CIDR notation e.g.: "169.254.0.0/16"
+// or single IP addresses. The addresses are checked after the DNS resolution, so that host names resolving to internal
+// addresses e.g.: cloud metadata services cannot be reached. Dialing a blocked address fails with [ErrAddressBlocked].
+// If any of the networks is invalid, then every dial fails. The idle connections are closed, so that they are checked again.
+// Calling it without networks removes the blocking.
+// It has no effect if the underlying [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) SetBlockedNetworks(cidrs ...string) *Client {
+	c.blockedNetworks = nil
+	c.blockedErr = nil
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				c.blockedErr = err
+				break
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		c.blockedNetworks = append(c.blockedNetworks, prefix.Masked())
+	}
+
+	if t := c.transport(); t != nil {
+		t.DialContext = c.dialSettings().dialContext
+		t.CloseIdleConnections()
+	}
+	return c
 }
 
-// AddQueryParams adds the query parameters
-func (r *Request) AddQueryParams(queryParams url.Values) *Request {
-	addValues(queryParams, r.queryParams)
-	return r
+// SetRedirectPolicy sets the policy of following the redirects. Redirects violating the policy fail the request
+// with [ErrRedirectRefused]
+func (c *Client) SetRedirectPolicy(policy RedirectPolicy) *Client {
+	if policy.MaxRedirects <= 0 {
+		policy.MaxRedirects = DefaultMaxRedirects
+	}
+
+	c.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= policy.MaxRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrRedirectRefused, policy.MaxRedirects)
+		}
+
+		if policy.RefuseDowngrade && via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme != "https" {
+			return fmt.Errorf("%w: downgrade from https to %s", ErrRedirectRefused, req.URL.Scheme)
+		}
+
+		if policy.AllowedHostsOnly {
+			if err := c.checkHost(req.URL.Hostname()); err != nil {
+				return fmt.Errorf("%w: %w", ErrRedirectRefused, err)
+			}
+		}
+
+		return nil
+	}
+
+	return c
 }
 
-// AddQueryParam adds a single query parameter
-func (r *Request) AddQueryParam(key, value string) *Request {
-	r.queryParams.Add(key, value)
-	return r
+// hasHostRestrictions reports whether the hosts or the networks dialed by the client are restricted
+func (c *Client) hasHostRestrictions() bool {
+	return len(c.allowedHosts) > 0 || len(c.blockedNetworks) > 0 || c.blockedErr != nil
 }
 
-// SetTimeout sets the timeout
-func (r *Request) SetTimeout(timeout time.Duration) *Request {
-	r.timeout = timeout
-	return r
+// checkHost checks whether the given host is allowed by the allowed hosts
+func (c *Client) checkHost(host string) error {
+	return checkHost(c.allowedHosts, host)
 }
 
-// BodyJson prepares the body as a JSON request with the given data.
-// Content-Type header is automatically set to "application/json"
-func (r *Request) BodyJson(data any) *Request {
-	r.resetBody()
-	r.SetHeader(headerContentType, ContentTypeJson)
+// dialSettings returns a snapshot of the settings used to dial connections
+func (c *Client) dialSettings() *dialSettings {
+	s := &dialSettings{
+		dialer:          *c.dialer,
+		ipVersion:       c.ipVersion,
+		allowedHosts:    c.allowedHosts,
+		blockedNetworks: c.blockedNetworks,
+		blockedErr:      c.blockedErr,
+		onConnClosed:    c.recoveredConnEvents(c.connEvents).OnConnClosed,
+	}
 
-	b, err := json.Marshal(data)
-	if err != nil {
-		r.bodyErr = err
-		return r
+	if len(s.blockedNetworks) > 0 || s.blockedErr != nil {
+		s.dialer.Control = s.checkAddress
 	}
 
-	r.body = bytes.NewBuffer(b)
-	return r
+	return s
 }
 
-// BodyXml prepares the body as an XML request with the given data.
-// Content-Type header is automatically set to "application/xml"
-func (r *Request) BodyXml(data any) *Request {
-	r.resetBody()
-	r.SetHeader(headerContentType, ContentTypeXml)
+// checkAddress checks whether the resolved address is allowed to be dialed, it is used as [net.Dialer.Control]
+func (s *dialSettings) checkAddress(_, address string, _ syscall.RawConn) error {
+	if s.blockedErr != nil {
+		return s.blockedErr
+	}
 
-	b, err := xml.Marshal(data)
+	addrPort, err := netip.ParseAddrPort(address)
 	if err != nil {
-		r.bodyErr = err
-		return r
+		return err
 	}
 
-	r.body = bytes.NewBuffer(b)
-	return r
-}
+	addr := addrPort.Addr().Unmap()
+	for _, network := range s.blockedNetworks {
+		if network.Contains(addr) {
+			return fmt.Errorf("%w: %s", ErrAddressBlocked, addr)
+		}
+	}
+
+	return nil
+}
+
+// SetConnEvents sets the callbacks of the connection level events. The closing of the connections is only reported
+// if the underlying [net/http.Client] does not use a custom [net/http.RoundTripper]
+func (c *Client) SetConnEvents(events ConnEvents) *Client {
+	c.connEvents = events
+	if t := c.transport(); t != nil {
+		t.DialContext = c.dialSettings().dialContext
+	}
+	return c
+}
+
+// Close closes the connection and calls the callback on the first call
+func (c *eventConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.onClose(c.RemoteAddr().Network(), c.RemoteAddr().String())
+	})
+	return err
+}
+
+// dialContext dials a connection according to the settings
+func (s *dialSettings) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkHost(s.allowedHosts, host); err != nil {
+		return nil, err
+	}
+
+	switch s.ipVersion {
+	case IPv4Only:
+		network = "tcp4"
+	case IPv6Only:
+		network = "tcp6"
+	}
+
+	conn, err := s.dialer.DialContext(ctx, network, addr)
+	if err != nil || s.onConnClosed == nil {
+		return conn, err
+	}
+
+	return &eventConn{
+		Conn:    conn,
+		onClose: s.onConnClosed,
+	}, nil
+}
+
+// transport returns the underlying [net/http.Transport] of the client, which can be configured without affecting other clients.
+// If the client uses the default transport, then it is replaced by a clone of [net/http.DefaultTransport]. If the transport
+// is shared with other clients or supplied by the caller, then it is replaced by a clone of it.
+// It returns nil if the underlying [net/http.Client] uses a custom [net/http.RoundTripper]
+func (c *Client) transport() *http.Transport {
+	if c.client.Transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = c.dialSettings().dialContext
+		c.setTransport(t)
+		return t
+	}
+
+	t, ok := c.client.Transport.(*http.Transport)
+	if !ok {
+		return nil
+	}
+
+	if c.sharedTransport.Load() {
+		t = t.Clone()
+		c.setTransport(t)
+	}
+
+	return t
+}
+
+// setTransport sets the transport owned by the client. The underlying [net/http.Client] is copied,
+// so that a client supplied by the caller e.g.: [net/http.DefaultClient] is not changed
+func (c *Client) setTransport(t *http.Transport) {
+	httpClient := *c.client
+	httpClient.Transport = t
+
+	c.client = &httpClient
+	c.sharedTransport.Store(false)
+}
+
+// SetBrowserProfile sets the headers a browser sends with every request, e.g.: [BrowserChrome] or [BrowserFirefox].
+// The User-Agent is protected the same way as the one set by calling [Client.SetUserAgent]. The Accept-Encoding header is
+// not set, so that the responses are still decompressed transparently. Note that [net/http] does not preserve the order of
+// the headers, so the order a browser sends them in is not reproduced
+func (c *Client) SetBrowserProfile(profile BrowserProfile) *Client {
+	c.userAgent = profile.UserAgent
+	c.headers.Set(headerUserAgent, profile.UserAgent)
+
+	if profile.Accept != "" {
+		c.headers.Set(headerAccept, profile.Accept)
+	}
+
+	if profile.AcceptLanguage != "" {
+		c.headers.Set(headerAcceptLanguage, profile.AcceptLanguage)
+	}
+
+	setValues(profile.Headers, c.headers)
+	return c
+}
+
+// SetHeaders sets the header values
+func (c *Client) SetHeaders(headers http.Header) *Client {
+	setValues(headers, c.headers)
+	return c
+}
+
+// SetHeader sets a single header value
+func (c *Client) SetHeader(key, value string) *Client {
+	c.headers.Set(key, value)
+	return c
+}
+
+// AddHeaders adds the header values
+func (c *Client) AddHeaders(headers http.Header) *Client {
+	addValues(headers, c.headers)
+	return c
+}
+
+// AddHeader adds a single header value
+func (c *Client) AddHeader(key, value string) *Client {
+	c.headers.Add(key, value)
+	return c
+}
+
+// SetQueryParams sets the query parameters
+func (c *Client) SetQueryParams(queryParams url.Values) *Client {
+	setValues(queryParams, c.queryParams)
+	return c
+}
+
+// SetQueryParam sets a single query parameter
+func (c *Client) SetQueryParam(key, value string) *Client {
+	c.queryParams.Set(key, value)
+	return c
+}
+
+// AddQueryParams adds the query parameters
+func (c *Client) AddQueryParams(queryParams url.Values) *Client {
+	addValues(queryParams, c.queryParams)
+	return c
+}
+
+// AddQueryParam adds a single query parameter
+func (c *Client) AddQueryParam(key, value string) *Client {
+	c.queryParams.Add(key, value)
+	return c
+}
+
+// SetLocale sets the Accept-Language header to the given language tags in the order of preference.
+// Quality values are assigned in descending order unless a tag already has one e.g.:
+// SetLocale("en-US", "en", "de") results in "en-US, en;q=0.9, de;q=0.8", see [Client.SetAccept] for the details.
+// The header is removed if no tags are given
+func (c *Client) SetLocale(tags ...string) *Client {
+	if len(tags) == 0 {
+		c.headers.Del(headerAcceptLanguage)
+		return c
+	}
+
+	c.headers.Set(headerAcceptLanguage, qualityList(tags))
+	return c
+}
+
+// SetAccept sets the Accept header to the given media types in the order of preference.
+// Quality values are assigned in descending order unless a type already has one e.g.:
+// SetAccept("application/json", "application/xml") results in "application/json, application/xml;q=0.9".
+// The quality values decrease in steps of 0.1 for up to 10 types and in steps of 0.001 for more, so that the order
+// is kept for up to 1000 types. Use [Response.Decode] to decode the response based on the negotiated Content-Type.
+// The header is removed if no types are given
+func (c *Client) SetAccept(types ...string) *Client {
+	if len(types) == 0 {
+		c.headers.Del(headerAccept)
+		return c
+	}
+
+	c.headers.Set(headerAccept, qualityList(types))
+	return c
+}
+
+// Use adds the given middlewares, which wrap the sending of every request of the client.
+// The middleware added first is the outermost one. The middlewares are added with priority 0, see [Client.UseNamed]
+func (c *Client) Use(middlewares ...Middleware) *Client {
+	c.middlewaresMu.Lock()
+	defer c.middlewaresMu.Unlock()
+
+	list := slices.Clone(c.middlewares)
+	for _, m := range middlewares {
+		list = insertMiddleware(list, namedMiddleware{wrap: m})
+	}
+
+	c.middlewares = list
+	return c
+}
+
+// UseNamed adds the given middleware with the given name and priority, so that it can be replaced or removed later
+// e.g.: by the applications using a client shipped by a library. The middlewares with lower priorities wrap the ones with
+// higher priorities, and the middlewares with equal priorities are ordered by the time they were added. If a middleware
+// is registered with the name already, then it is replaced, keeping its position if the priority is the same.
+// The middlewares can be changed concurrently with the requests, which use the chain at the time they were sent
+func (c *Client) UseNamed(name string, priority int, middleware Middleware) *Client {
+	c.middlewaresMu.Lock()
+	defer c.middlewaresMu.Unlock()
+
+	m := namedMiddleware{name: name, priority: priority, wrap: middleware}
+	list := slices.Clone(c.middlewares)
+
+	i := -1
+	if name != "" {
+		i = slices.IndexFunc(list, func(m namedMiddleware) bool { return m.name == name })
+	}
+
+	switch {
+	case i >= 0 && list[i].priority == priority:
+		list[i] = m
+	case i >= 0:
+		list = insertMiddleware(slices.Delete(list, i, i+1), m)
+	default:
+		list = insertMiddleware(list, m)
+	}
+
+	c.middlewares = list
+	return c
+}
+
+// RemoveMiddleware removes the middleware registered with the given name by calling [Client.UseNamed]
+func (c *Client) RemoveMiddleware(name string) *Client {
+	c.middlewaresMu.Lock()
+	defer c.middlewaresMu.Unlock()
+
+	if name != "" {
+		c.middlewares = slices.DeleteFunc(slices.Clone(c.middlewares), func(m namedMiddleware) bool { return m.name == name })
+	}
+
+	return c
+}
+
+// MiddlewareNames returns the names of the middlewares registered by calling [Client.UseNamed] from the outermost to the innermost
+func (c *Client) MiddlewareNames() []string {
+	c.middlewaresMu.RLock()
+	defer c.middlewaresMu.RUnlock()
+
+	var names []string
+	for _, m := range c.middlewares {
+		if m.name != "" {
+			names = append(names, m.name)
+		}
+	}
+
+	return names
+}
+
+// insertMiddleware inserts the middleware after the middlewares with lower or equal priorities
+func insertMiddleware(list []namedMiddleware, m namedMiddleware) []namedMiddleware {
+	i := slices.IndexFunc(list, func(other namedMiddleware) bool { return other.priority > m.priority })
+	if i < 0 {
+		i = len(list)
+	}
+
+	return slices.Insert(list, i, m)
+}
+
+// AddValidationRules adds rules, which validate every request of the client before it is sent e.g.: [RequireHeader] or [RequireHttps].
+// The rules are run in order after the request is fully prepared and the first violation fails the request
+// with an error wrapping both [ErrValidationFailed] and the error of the rule, without sending or retrying it
+func (c *Client) AddValidationRules(rules ...ValidationRule) *Client {
+	c.validationRules = append(c.validationRules, rules...)
+	return c
+}
+
+// validate runs the validation rules of the client on the request
+func (c *Client) validate(req *http.Request) error {
+	for _, rule := range c.validationRules {
+		if err := rule(req); err != nil {
+			return fmt.Errorf("%w: %s %s: %w", ErrValidationFailed, req.Method, req.URL.Redacted(), err)
+		}
+	}
+
+	return nil
+}
+
+// RequireHeader returns a [ValidationRule] which requires the given header to be set e.g.: Authorization
+func RequireHeader(key string) ValidationRule {
+	return func(req *http.Request) error {
+		if req.Header.Get(key) == "" {
+			return fmt.Errorf("missing %s header", key)
+		}
+
+		return nil
+	}
+}
+
+// RequireHttps returns a [ValidationRule] which requires the requests to use HTTPS
+func RequireHttps() ValidationRule {
+	return func(req *http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("scheme %s is not allowed, only https", req.URL.Scheme)
+		}
+
+		return nil
+	}
+}
+
+// InjectFaults injects the faults of the given configuration into the requests of the client, which randomly
+// delays or fails the requests or replaces the status codes of the responses. Use an empty [FaultConfig] to disable it.
+// It is meant for testing the retry or circuit breaker handling of the callers without an external proxy
+func (c *Client) InjectFaults(config FaultConfig) *Client {
+	if config.ErrorRate <= 0 && config.LatencyJitter <= 0 && len(config.StatusOverrides) == 0 {
+		c.faults = nil
+		return c
+	}
+
+	config.StatusOverrides = maps.Clone(config.StatusOverrides)
+	c.faults = &config
+	return c
+}
+
+// Stats returns the cumulative statistics of the requests performed by the client
+func (c *Client) Stats() Stats {
+	return Stats{
+		Requests:      c.stats.requests.Load(),
+		Errors:        c.stats.errors.Load(),
+		BytesSent:     c.stats.bytesSent.Load(),
+		BytesReceived: c.stats.bytesReceived.Load(),
+	}
+}
+
+// LatencyP returns the given quantile between 0 and 1 of the latencies of the most recent requests e.g.: 0.99
+// for the 99th percentile. The latency of every attempt is recorded from sending it until the response headers
+// are received or it fails, and the last [DefaultLatencyWindow] attempts are kept. It returns 0 if no request was sent yet
+func (c *Client) LatencyP(q float64) time.Duration {
+	return c.latency.quantile(q)
+}
+
+// OnSlowRequest sets a callback, which is called after every attempt of a request with a latency above the given threshold.
+// The latency is measured the same way as for [Client.LatencyP] and the status is 0 if the attempt failed without a response.
+// A nil callback removes the callback
+func (c *Client) OnSlowRequest(threshold time.Duration, fn func(method, url string, status int, d time.Duration)) *Client {
+	c.slowThreshold = threshold
+	c.onSlow = fn
+	return c
+}
+
+// MeasureLatency performs n HEAD requests to the base URL and returns the statistics of the latencies,
+// see [Request.MeasureLatency] for details. Use [Request.MeasureLatency] to measure other requests
+func (c *Client) MeasureLatency(ctx context.Context, n int) LatencyStats {
+	return c.Head("").MeasureLatency(ctx, n)
+}
+
+// ResetStats resets the statistics of the client
+func (c *Client) ResetStats() *Client {
+	c.stats.requests.Store(0)
+	c.stats.errors.Store(0)
+	c.stats.bytesSent.Store(0)
+	c.stats.bytesReceived.Store(0)
+	return c
+}
+
+// Shutdown stops the client from accepting new requests, which fail with [ErrClientShutdown] from now on, and waits
+// until the requests in flight, including the retries, the async requests and the streams, are completed.
+// A request is completed when its response body is read or closed. Then the idle connections are closed.
+// If the given [context.Context] is done before the requests are completed, then the idle connections are closed
+// and the cause of the context is returned
+func (c *Client) Shutdown(ctx context.Context) error {
+	var err error
+	select {
+	case <-c.inFlight.close():
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	}
+
+	c.client.CloseIdleConnections()
+	return err
+}
+
+// InFlight returns the requests of the client in flight ordered by their start time.
+// A request is in flight from starting it, including its retries, until its response body is read or closed
+func (c *Client) InFlight() []InFlightRequest {
+	return c.inFlight.list()
+}
+
+// CancelAll cancels the requests of the client in flight with the given reason, which is returned as the cause
+// of the failed requests. If the reason is nil, then [context.Canceled] is used
+func (c *Client) CancelAll(reason error) *Client {
+	c.inFlight.cancelAll(reason)
+	return c
+}
+
+// SetRetry sets the maximum number of retries of a failed request and the delay before the first retry,
+// which is doubled after every retry. Requests that failed without a response and responses with status code
+// 429 or 5xx are retried. The Retry-After header of the response takes precedence over the backoff if present.
+// The delay is capped at the maximum set by calling [Client.SetMaxRetryDelay].
+// Since requests are retried regardless of their method, only enable it for idempotent APIs
+func (c *Client) SetRetry(maxRetries int, backoff time.Duration) *Client {
+	c.maxRetries = max(maxRetries, 0)
+	c.retryBackoff = backoff
+	return c
+}
+
+// SetMaxRetryDelay sets the maximum delay before a retry, which caps both the backoff and the delay requested
+// by the Retry-After header of the response. It defaults to [DefaultMaxRetryDelay]. Zero or a negative delay removes the cap
+func (c *Client) SetMaxRetryDelay(delay time.Duration) *Client {
+	c.maxRetryDelay = delay
+	return c
+}
+
+// SetJsonUseNumber sets whether JSON numbers are decoded into [encoding/json.Number] instead of float64 when decoding
+// into interface values e.g.: map[string]any, so that large integers do not lose precision
+func (c *Client) SetJsonUseNumber(useNumber bool) *Client {
+	c.jsonUseNumber = useNumber
+	return c
+}
+
+// SetJsonStrict sets whether decoding a JSON object with fields unknown to the destination struct fails
+func (c *Client) SetJsonStrict(strict bool) *Client {
+	c.jsonStrict = strict
+	return c
+}
+
+// SetZeroCopyStrings sets whether [Response.BodyString] returns the body without copying it, which avoids an allocation
+// for hot paths with large bodies. It is unsafe: the body returned by [Response.BodyRaw] must not be modified afterwards,
+// otherwise the strings previously returned by [Response.BodyString] change as well
+func (c *Client) SetZeroCopyStrings(enable bool) *Client {
+	c.zeroCopy = enable
+	return c
+}
+
+// SetCharsetDecoder sets the decoder of the charset with the given name used by [Response.BodyText] of the responses
+// of the client, which can add support for additional charsets e.g.: Shift_JIS by using golang.org/x/text/encoding.
+// It does not affect the responses received before
+func (c *Client) SetCharsetDecoder(name string, decoder CharsetDecoder) *Client {
+	charsets := maps.Clone(c.charsets)
+	if charsets == nil {
+		charsets = make(map[string]CharsetDecoder)
+	}
+
+	charsets[strings.ToLower(name)] = decoder
+	c.charsets = charsets
+	return c
+}
+
+// SetBodyDecoder sets the decoder of the given media type used by [Response.Decode] of the responses of the client,
+// which can add support for additional media types or replace the built-in ones. It does not affect the responses received before
+func (c *Client) SetBodyDecoder(mediaType string, decoder BodyDecoder) *Client {
+	decoders := maps.Clone(c.decoders)
+	if decoders == nil {
+		decoders = make(map[string]BodyDecoder)
+	}
+
+	decoders[strings.ToLower(mediaType)] = decoder
+	c.decoders = decoders
+	return c
+}
+
+// SetJsonFuncs sets the JSON implementation used to encode the request bodies and decode the response bodies
+// e.g.: an alternative library which is faster than [encoding/json]. A nil function restores the [encoding/json] one.
+// A custom unmarshal function takes precedence over [Client.SetJsonUseNumber] and [Client.SetJsonStrict]
+func (c *Client) SetJsonFuncs(marshal func(v any) ([]byte, error), unmarshal func(data []byte, v any) error) *Client {
+	c.jsonMarshal = marshal
+	c.jsonUnmarshal = unmarshal
+	return c
+}
+
+// marshalJson encodes v as JSON using the JSON implementation of the client
+func (c *Client) marshalJson(v any) ([]byte, error) {
+	if c.jsonMarshal != nil {
+		return c.jsonMarshal(v)
+	}
+
+	return json.Marshal(v)
+}
+
+// jsonDecoder returns the decoder of the JSON response bodies according to the settings of the client,
+// or nil if the default [encoding/json.Unmarshal] is used
+func (c *Client) jsonDecoder() BodyDecoder {
+	if c.jsonUnmarshal != nil {
+		return c.jsonUnmarshal
+	}
+
+	if !c.jsonUseNumber && !c.jsonStrict {
+		return nil
+	}
+
+	useNumber, strict := c.jsonUseNumber, c.jsonStrict
+	return func(data []byte, v any) error {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		if useNumber {
+			dec.UseNumber()
+		}
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+
+		if err := dec.Decode(v); err != nil {
+			return err
+		}
+
+		if _, err := dec.Token(); err != io.EOF {
+			return errors.New("invalid data after top-level JSON value")
+		}
+
+		return nil
+	}
+}
+
+// SetRetryBudget sets the budget limiting the retries of the requests of the client. A nil budget removes the limit
+func (c *Client) SetRetryBudget(budget *RetryBudget) *Client {
+	c.retryBudget = budget
+	return c
+}
+
+// SetCache sets the cache of the responses of the client, see [ResponseCache]. A nil cache disables caching
+func (c *Client) SetCache(cache *ResponseCache) *Client {
+	c.cache = cache
+	return c
+}
+
+// SetOffline sets whether the client is offline. An offline client serves the requests only from its cache set by calling
+// [Client.SetCache], including the stale responses, and fails every other request with [ErrOffline] without sending it
+// e.g.: for demos, development without network access or deterministic tests. The requests of an offline client
+// do not wait for the rate limits and do not fetch tokens from the [TokenSource]. It can be changed concurrently
+func (c *Client) SetOffline(offline bool) *Client {
+	c.offline.Store(offline)
+	return c
+}
+
+// SetPanicRecovery sets whether the panics of the callbacks are recovered and returned as [*PanicError] with the stack trace,
+// so that a bad callback does not crash the whole service. The middlewares, the hooks set by calling [Request.WithHttpRequest]
+// and [Client.OnSlowRequest], the [ConnEvents] callbacks, the [StreamReceiver] and the [ResponseUnmarshaler] functions are covered.
+// The panics of the slow request hook are dropped since the request has already completed, and the panics of the [ConnEvents]
+// callbacks are logged since they are called by the transport. Requests failed by a panic are not retried
+func (c *Client) SetPanicRecovery(enable bool) *Client {
+	c.recoverPanics = enable
+	return c
+}
+
+// callHook calls the given hook, recovering its panic if enabled
+func (c *Client) callHook(hook func()) (err error) {
+	defer recoverPanic(c.recoverPanics, &err)
+	hook()
+	return nil
+}
+
+// recoveredConnEvents returns the given callbacks wrapped, so that their panics are recovered and logged if enabled
+func (c *Client) recoveredConnEvents(events ConnEvents) ConnEvents {
+	if f := events.OnConnect; f != nil {
+		events.OnConnect = func(network, addr string, duration time.Duration, err error) {
+			c.callConnEvent("OnConnect", func() { f(network, addr, duration, err) })
+		}
+	}
+
+	if f := events.OnTLSHandshake; f != nil {
+		events.OnTLSHandshake = func(addr string, state tls.ConnectionState, err error) {
+			c.callConnEvent("OnTLSHandshake", func() { f(addr, state, err) })
+		}
+	}
+
+	if f := events.OnConnClosed; f != nil {
+		events.OnConnClosed = func(network, addr string) {
+			c.callConnEvent("OnConnClosed", func() { f(network, addr) })
+		}
+	}
+
+	return events
+}
+
+// callConnEvent calls the callback of a connection level event with the given name and logs its recovered panic
+func (c *Client) callConnEvent(name string, callback func()) {
+	err := c.callHook(callback)
+	if err == nil || !c.isLogEnabled {
+		return
+	}
+
+	if l := c.leveled; l != nil {
+		l.Error(fmt.Sprintf("%s: %v", name, err))
+		return
+	}
+
+	c.logger.log("%s: %v", name, err)
+}
+
+// SetMaxConcurrency limits the number of requests of the client in flight. A request occupies a slot from sending it
+// until its response body is read or closed, and the requests waiting for a free slot get it in the order of their
+// priority set by calling [Request.SetPriority]. Zero or a negative limit removes the limit
+func (c *Client) SetMaxConcurrency(limit int) *Client {
+	c.concurrency = nil
+	if limit > 0 {
+		c.concurrency = &concurrencyLimiter{
+			limit: limit,
+		}
+	}
+	return c
+}
+
+// SetPathRateLimit limits the requests whose URL path matches the given pattern to rate requests per second, allowing bursts
+// of up to burst requests e.g.: SetPathRateLimit("/search/*", 1, 1).SetPathRateLimit("*", 10, 10). The pattern has the syntax
+// of [path.Match], except that a trailing "*" matches the rest of the path including the slashes. The patterns are checked
+// in the order they were first set and only the first matching one applies. A rate less than or equal to zero removes the limit
+// of the pattern. The limits are applied in addition to the limits of the hosts, see [HostConfig.SetRateLimit]
+func (c *Client) SetPathRateLimit(pattern string, rate float64, burst int) *Client {
+	c.hostsMu.Lock()
+	defer c.hostsMu.Unlock()
+
+	i := slices.IndexFunc(c.pathLimits, func(l pathLimit) bool {
+		return l.pattern == pattern
+	})
+
+	switch {
+	case rate <= 0:
+		if i >= 0 {
+			c.pathLimits = slices.Delete(slices.Clone(c.pathLimits), i, i+1)
+		}
+	case i >= 0:
+		c.pathLimits = slices.Clone(c.pathLimits)
+		c.pathLimits[i].limiter = newRateLimiter(rate, burst)
+	default:
+		c.pathLimits = append(slices.Clip(c.pathLimits), pathLimit{pattern: pattern, limiter: newRateLimiter(rate, burst)})
+	}
+
+	return c
+}
+
+// pathLimiter returns the rate limiter of the first pattern matching the given path, or nil if there is none
+func (c *Client) pathLimiter(p string) *rateLimiter {
+	c.hostsMu.RLock()
+	defer c.hostsMu.RUnlock()
+
+	for _, l := range c.pathLimits {
+		if matchPath(l.pattern, p) {
+			return l.limiter
+		}
+	}
+
+	return nil
+}
+
+// matchPath reports whether the path matches the pattern of [path.Match], where a trailing "*" matches the rest of the path
+func matchPath(pattern, p string) bool {
+	if ok, _ := path.Match(pattern, p); ok || !strings.HasSuffix(pattern, "*") {
+		return ok
+	}
+
+	for i := range len(p) {
+		if p[i] != '/' {
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, p[:i]); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetSuccessFunc sets the predicate reporting whether the status code of a response is successful, which is used by
+// [Response.IsError] e.g.: to accept 304 as well. A nil predicate restores the default [IsSuccessStatus]
+func (c *Client) SetSuccessFunc(f func(statusCode int) bool) *Client {
+	c.isSuccess = f
+	return c
+}
+
+// isSuccessStatus reports whether the status code is considered successful by the client
+func (c *Client) isSuccessStatus(statusCode int) bool {
+	if c.isSuccess == nil {
+		return IsSuccessStatus(statusCode)
+	}
+
+	return c.isSuccess(statusCode)
+}
+
+// SetTimeout sets the timeout
+func (c *Client) SetTimeout(timeout time.Duration) *Client {
+	c.timeout = timeout
+	return c
+}
+
+// SetDebug sets the debug mode
+func (c *Client) SetDebug(debug, includeBody bool) *Client {
+	c.debug = debug
+	c.debugBody = includeBody
+	return c
+}
+
+// SetDebugFormat sets the format of the debug output, which defaults to [DebugFormatText]
+func (c *Client) SetDebugFormat(format DebugFormat) *Client {
+	c.debugFormat = format
+	return c
+}
+
+// SetDebugBodyLimit sets the maximum number of body bytes included in the debug output, which defaults to
+// [DefaultDebugBodyLimit]. Zero or a negative limit disables the truncation
+func (c *Client) SetDebugBodyLimit(limit int) *Client {
+	c.debugBodyLimit = limit
+	return c
+}
+
+// SetLogEnabled sets the log mode
+func (c *Client) SetLogEnabled(enable bool) *Client {
+	c.isLogEnabled = enable
+	return c
+}
+
+// SetLogLevel sets the verbosity of the logs, which overrides the log and debug settings of the client and its requests
+// unless it is [LogLevelDefault]. Unlike the other setters it is safe to call concurrently with the requests of the client
+// and it takes effect on every request sent afterwards, including the retries of the requests in flight.
+// [LogLevelDebug] includes the bodies in the dumps if it is enabled by calling [Client.SetDebug] or [Request.SetDebug]
+func (c *Client) SetLogLevel(level LogLevel) *Client {
+	c.logLevel.Store(int32(level))
+	return c
+}
+
+// LogLevel returns the verbosity of the logs set by calling [Client.SetLogLevel]
+func (c *Client) LogLevel() LogLevel {
+	return LogLevel(c.logLevel.Load())
+}
+
+// SetLogTimeFormat sets the log time format if [Ftime] flag is given
+func (c *Client) SetLogTimeFormat(layout string) *Client {
+	c.logger.setTimeFormat(layout)
+	return c
+}
+
+// SetLogOutput sets the log output to the given [io.Writer]
+func (c *Client) SetLogOutput(w io.Writer) *Client {
+	c.logger.setOutput(w)
+	return c
+}
+
+// SetLogFlags sets the log flags
+func (c *Client) SetLogFlags(flag int) *Client {
+	c.logger.setFlags(flag)
+	return c
+}
+
+// SetLogFilter sets a filter which decides whether a request is logged based on its method, URL, status code and duration.
+// A nil filter logs every request
+func (c *Client) SetLogFilter(f func(method, url string, status int, d time.Duration) bool) *Client {
+	c.logFilter = f
+	return c
+}
+
+// SetLogSampleRate sets the fraction between 0 and 1 of the requests which are logged after passing the filter.
+// Failed requests are always logged if they pass the filter. It defaults to 1, which logs every request
+func (c *Client) SetLogSampleRate(rate float64) *Client {
+	c.logSampleRate = rate
+	return c
+}
+
+// shouldLog reports whether a request should be logged based on the log filter and the sample rate
+func (c *Client) shouldLog(method, url string, status int, d time.Duration, err error) bool {
+	if c.logFilter != nil && !c.logFilter(method, url, status, d) {
+		return false
+	}
+
+	return err != nil || c.logSampleRate >= 1 || rand.Float64() < c.logSampleRate
+}
+
+// SetUserAgent sets the User-Agent header in the format of "product/version (comment) pingo/x.y.z".
+// The version and the comment are omitted if empty. The User-Agent set this way is not overwritten by the header setters
+// of the requests, only by calling [Request.SetUserAgent]
+func (c *Client) SetUserAgent(product, version, comment string) *Client {
+	sb := strings.Builder{}
+	sb.WriteString(product)
+	if version != "" {
+		sb.WriteRune('/')
+		sb.WriteString(version)
+	}
+
+	if comment != "" {
+		sb.WriteString(" (")
+		sb.WriteString(comment)
+		sb.WriteRune(')')
+	}
+
+	sb.WriteRune(' ')
+	sb.WriteString(pingoProductToken)
+
+	c.userAgent = sb.String()
+	c.headers.Set(headerUserAgent, c.userAgent)
+	return c
+}
+
+// SetRequestId enables sending an ID with every request in the given header, which defaults to [DefaultRequestIdHeader]
+// if empty. The ID is created by the generator, or a random UUID is used if it is nil. Retries of a request share the same ID
+// and an ID set explicitly in the header of a request is kept. The ID is included in the logs and can be accessed on the response
+func (c *Client) SetRequestId(header string, generator func() string) *Client {
+	if header == "" {
+		header = DefaultRequestIdHeader
+	}
+
+	if generator == nil {
+		generator = newRequestId
+	}
+
+	c.requestIdHeader = header
+	c.requestIdGenerator = generator
+	return c
+}
+
+// requestId returns the ID of the request, or an empty string if request IDs are disabled
+func (r *Request) requestId() string {
+	if r.client.requestIdHeader == "" {
+		return ""
+	}
+
+	if id := r.headers.Get(r.client.requestIdHeader); id != "" {
+		return id
+	}
+
+	return r.client.requestIdGenerator()
+}
+
+// SetLogger sets a leveled logger, which replaces the built-in logger. Setting it to nil restores the built-in logger.
+// The log output, flags and time format only apply to the built-in logger
+func (c *Client) SetLogger(l LeveledLogger) *Client {
+	c.leveled = l
+	return c
+}
+
+// NewRequest creates a new request
+func (c *Client) NewRequest() *Request {
+	return &Request{
+		client:         c,
+		method:         http.MethodGet,
+		baseUrl:        c.baseUrl,
+		path:           "",
+		headers:        c.headers,
+		queryParams:    c.queryParams,
+		timeout:        c.timeout,
+		body:           nil,
+		bodyErr:        nil,
+		cancel:         nil,
+		ctx:            nil,
+		debug:          c.debug,
+		debugBody:      c.debugBody,
+		isLogEnabled:   c.isLogEnabled,
+		maxRetries:     c.maxRetries,
+		retryBackoff:   c.retryBackoff,
+		debugFormat:    c.debugFormat,
+		debugBodyLimit: c.debugBodyLimit,
+	}
+}
+
+// Get creates a new GET request with the given path
+func (c *Client) Get(path string) *Request {
+	return c.NewRequest().SetMethod(http.MethodGet).SetPath(path)
+}
+
+// Head creates a new HEAD request with the given path
+func (c *Client) Head(path string) *Request {
+	return c.NewRequest().SetMethod(http.MethodHead).SetPath(path)
+}
+
+// Options creates a new OPTIONS request with the given path
+func (c *Client) Options(path string) *Request {
+	return c.NewRequest().SetMethod(http.MethodOptions).SetPath(path)
+}
+
+// Delete creates a new DELETE request with the given path
+func (c *Client) Delete(path string) *Request {
+	return c.NewRequest().SetMethod(http.MethodDelete).SetPath(path)
+}
+
+// Post creates a new POST request with the given path and body. See [Request.Body] for how the body is prepared
+func (c *Client) Post(path string, body any) *Request {
+	return c.NewRequest().SetMethod(http.MethodPost).SetPath(path).Body(body)
+}
+
+// Put creates a new PUT request with the given path and body. See [Request.Body] for how the body is prepared
+func (c *Client) Put(path string, body any) *Request {
+	return c.NewRequest().SetMethod(http.MethodPut).SetPath(path).Body(body)
+}
+
+// Patch creates a new PATCH request with the given path and body. See [Request.Body] for how the body is prepared
+func (c *Client) Patch(path string, body any) *Request {
+	return c.NewRequest().SetMethod(http.MethodPatch).SetPath(path).Body(body)
+}
+
+// Endpoint registers a named endpoint with the given method and path.
+// The path may contain path parameters in the form of "{name}" e.g.: "/users/{id}",
+// which can be substituted by calling [Request.SetPathParam] on requests created by [Client.Request]
+func (c *Client) Endpoint(name, method, path string) *Client {
+	c.endpointsMu.Lock()
+	defer c.endpointsMu.Unlock()
+
+	c.endpoints[name] = endpoint{
+		method: method,
+		path:   path,
+	}
+	return c
+}
+
+// SetSchema registers a JSON Schema for the endpoint with the given name.
+// Responses of requests created from the endpoint can be validated by calling [Response.Validate]
+func (c *Client) SetSchema(endpoint string, schemaJSON []byte) *Client {
+	c.endpointsMu.Lock()
+	defer c.endpointsMu.Unlock()
+
+	c.schemas[endpoint] = schemaJSON
+	return c
+}
+
+// schema returns the JSON Schema registered for the endpoint with the given name
+func (c *Client) schema(endpoint string) []byte {
+	c.endpointsMu.RLock()
+	defer c.endpointsMu.RUnlock()
+
+	return c.schemas[endpoint]
+}
+
+// Request creates a new request from the endpoint registered with the given name.
+// If there is no such endpoint, performing the request returns [ErrEndpointNotFound]
+func (c *Client) Request(name string) *Request {
+	r := c.NewRequest()
+	r.endpoint = name
+
+	c.endpointsMu.RLock()
+	e, ok := c.endpoints[name]
+	c.endpointsMu.RUnlock()
+
+	if !ok {
+		r.err = fmt.Errorf("%w: %q", ErrEndpointNotFound, name)
+		return r
+	}
+
+	return r.SetMethod(e.method).SetPath(e.path)
+}
+
+// Host returns the configuration profile for the given host, creating it if it does not exist yet.
+// The host is matched against the host of the request URL, with or without the port e.g.: "api.github.com", "localhost:8080"
+func (c *Client) Host(host string) *HostConfig {
+	host = strings.ToLower(host)
+
+	c.hostsMu.Lock()
+	defer c.hostsMu.Unlock()
+
+	hc, ok := c.hosts[host]
+	if !ok {
+		hc = &HostConfig{
+			headers:     make(http.Header),
+			queryParams: make(url.Values),
+		}
+		c.hosts[host] = hc
+	}
+
+	return hc
+}
+
+// hostConfig returns the host configuration matching the given request URL or nil if there is none
+func (c *Client) hostConfig(requestUrl string) *HostConfig {
+	u, err := url.Parse(requestUrl)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+
+	c.hostsMu.RLock()
+	defer c.hostsMu.RUnlock()
+
+	if hc, ok := c.hosts[strings.ToLower(u.Host)]; ok {
+		return hc
+	}
+
+	return c.hosts[strings.ToLower(u.Hostname())]
+}
+
+// doRequest sends the request through the middlewares of the client.
+// If the given transport is not nil, then it is used instead of the transport of the underlying [net/http.Client].
+// If the given dump function is not nil, then it is called with the request as it is passed on by the middlewares
+// and the request returned by it is sent
+func (c *Client) doRequest(req *http.Request, transport http.RoundTripper, dump func(req *http.Request) *http.Request) (resp *http.Response, err error) {
+	defer recoverPanic(c.recoverPanics, &err)
+
+	client := c.client
+	if transport != nil {
+		hc := *c.client
+		hc.Transport = transport
+		client = &hc
+	}
+
+	if _, ok := client.Transport.(*ConnectionPool); ok && c.hasHostRestrictions() {
+		return nil, ErrPoolRestricted
+	}
+
+	send := func(req *http.Request) (*http.Response, error) {
+		return c.send(client, req)
+	}
+
+	if cache := c.cache; cache != nil {
+		next := send
+		send = func(req *http.Request) (*http.Response, error) {
+			return cache.roundTrip(req, next)
+		}
+	}
+
+	if c.offline.Load() {
+		send = func(req *http.Request) (*http.Response, error) {
+			if cache := c.cache; cache != nil {
+				if e := cache.lookup(req, time.Time{}); e != nil {
+					return e.response(req), nil
+				}
+			}
+
+			return nil, ErrOffline
+		}
+	}
+
+	if dump != nil {
+		next := send
+		send = func(req *http.Request) (*http.Response, error) {
+			return next(dump(req))
+		}
+	}
+
+	c.middlewaresMu.RLock()
+	middlewares := c.middlewares
+	c.middlewaresMu.RUnlock()
+
+	if len(middlewares) == 0 {
+		return send(req)
+	}
+
+	var rt http.RoundTripper = RoundTripFunc(send)
+	for _, m := range slices.Backward(middlewares) {
+		rt = m.wrap(rt)
+	}
+
+	return rt.RoundTrip(req)
+}
+
+// send sends the request using the given [net/http.Client] and injects the faults if configured
+func (c *Client) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	f := c.faults
+	if f == nil {
+		return client.Do(req)
+	}
+
+	if f.LatencyJitter > 0 {
+		delay := time.NewTimer(rand.N(f.LatencyJitter))
+		defer delay.Stop()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-delay.C:
+		}
+	}
+
+	if rand.Float64() < f.ErrorRate {
+		return nil, ErrInjectedFault
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range slices.Sorted(maps.Keys(f.StatusOverrides)) {
+		if rand.Float64() < f.StatusOverrides[code] {
+			resp.Body.Close()
+			resp.StatusCode = code
+			resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+			resp.Header = make(http.Header)
+			resp.ContentLength = 0
+			resp.Body = http.NoBody
+			break
+		}
+	}
+
+	return resp, nil
+}
+
+// ---------------------------------------------- //
+// Config                                         //
+// ---------------------------------------------- //
+
+// ClientFromConfig creates a new client with the default settings and applies the given configuration.
+// It returns an error if the proxy URL is invalid
+func ClientFromConfig(cfg Config) (*Client, error) {
+	c := NewClient().
+		SetBaseUrl(cfg.BaseUrl).
+		SetTimeout(cfg.Timeout).
+		SetRetry(cfg.MaxRetries, cfg.RetryBackoff)
+
+	if cfg.Proxy != "" {
+		proxyUrl, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		c.SetProxy(proxyUrl)
+	}
+
+	if cfg.InsecureSkipVerify {
+		c.SetInsecureSkipVerify(true)
+	}
+
+	for k, v := range cfg.Headers {
+		c.SetHeader(k, v)
+	}
+
+	return c, nil
+}
+
+// ClientFromEnv creates a new client configured by the environment variables with the given prefix:
+//   - <prefix>_BASE_URL: base URL
+//   - <prefix>_TIMEOUT: timeout e.g.: "5s"
+//   - <prefix>_PROXY: URL of the proxy
+//   - <prefix>_INSECURE_SKIP_VERIFY: whether the TLS certificates are not verified e.g.: "true"
+//   - <prefix>_MAX_RETRIES: maximum number of retries
+//   - <prefix>_RETRY_BACKOFF: delay before the first retry e.g.: "500ms"
+//   - <prefix>_HEADER_<NAME>: default header, where underscores in the name are replaced by dashes
+//     e.g.: <prefix>_HEADER_X_API_KEY sets the X-Api-Key header
+//
+// It returns an error if a variable has an invalid value
+func ClientFromEnv(prefix string) (*Client, error) {
+	var (
+		cfg = Config{Headers: make(map[string]string)}
+		err error
+	)
+
+	prefix = strings.TrimSuffix(prefix, "_") + "_"
+	cfg.BaseUrl = os.Getenv(prefix + "BASE_URL")
+	cfg.Proxy = os.Getenv(prefix + "PROXY")
+
+	if v := os.Getenv(prefix + "TIMEOUT"); v != "" {
+		if cfg.Timeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid %sTIMEOUT: %w", prefix, err)
+		}
+	}
+
+	if v := os.Getenv(prefix + "INSECURE_SKIP_VERIFY"); v != "" {
+		if cfg.InsecureSkipVerify, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid %sINSECURE_SKIP_VERIFY: %w", prefix, err)
+		}
+	}
+
+	if v := os.Getenv(prefix + "MAX_RETRIES"); v != "" {
+		if cfg.MaxRetries, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid %sMAX_RETRIES: %w", prefix, err)
+		}
+	}
+
+	if v := os.Getenv(prefix + "RETRY_BACKOFF"); v != "" {
+		if cfg.RetryBackoff, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid %sRETRY_BACKOFF: %w", prefix, err)
+		}
+	}
+
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if name, ok := strings.CutPrefix(key, prefix+"HEADER_"); ok && name != "" {
+			cfg.Headers[strings.ReplaceAll(name, "_", "-")] = value
+		}
+	}
+
+	return ClientFromConfig(cfg)
+}
+
+// ParseConfig parses a JSON object of [Config]. Other formats e.g.: YAML are not supported
+// and an error wrapping [ErrUnsupportedFormat] is returned for them, so they have to be converted to JSON first
+func ParseConfig(data []byte) (Config, error) {
+	var cfg Config
+	if err := checkJsonFormat(data, '{'); err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// UnmarshalJSON implements the [encoding/json.Unmarshaler] interface,
+// which accepts durations given either as strings e.g.: "5s" or as nanoseconds
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+	aux := struct {
+		*config
+		Timeout      json.RawMessage `json:"timeout"`
+		RetryBackoff json.RawMessage `json:"retryBackoff"`
+	}{
+		config: (*config)(c),
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	var err error
+	if c.Timeout, err = parseJSONDuration(aux.Timeout, c.Timeout); err != nil {
+		return fmt.Errorf("invalid timeout: %w", err)
+	}
+
+	if c.RetryBackoff, err = parseJSONDuration(aux.RetryBackoff, c.RetryBackoff); err != nil {
+		return fmt.Errorf("invalid retryBackoff: %w", err)
+	}
+
+	return nil
+}
+
+// parseJSONDuration parses a duration given either as a JSON string e.g.: "5s" or as a number of nanoseconds.
+// If the data is empty, then the given default is returned
+func parseJSONDuration(data json.RawMessage, def time.Duration) (time.Duration, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return def, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return time.ParseDuration(s)
+	}
+
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(n), nil
+}
+
+// ---------------------------------------------- //
+// Spec runner                                    //
+// ---------------------------------------------- //
+
+// ParseSpecs parses a JSON array of [RequestSpec]. Other formats e.g.: YAML are not supported
+// and an error wrapping [ErrUnsupportedFormat] is returned for them, so they have to be converted to JSON first
+func ParseSpecs(data []byte) ([]RequestSpec, error) {
+	if err := checkJsonFormat(data, '['); err != nil {
+		return nil, err
+	}
+
+	var specs []RequestSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, err
+	}
+
+	return specs, nil
+}
+
+// UnmarshalJSON implements the [encoding/json.Unmarshaler] interface,
+// which accepts the maximum duration given either as a string e.g.: "500ms" or as nanoseconds
+func (e *SpecExpectation) UnmarshalJSON(data []byte) error {
+	type expectation SpecExpectation
+	aux := struct {
+		*expectation
+		MaxDuration json.RawMessage `json:"maxDuration"`
+	}{
+		expectation: (*expectation)(e),
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	var err error
+	if e.MaxDuration, err = parseJSONDuration(aux.MaxDuration, e.MaxDuration); err != nil {
+		return fmt.Errorf("invalid maxDuration: %w", err)
+	}
+
+	return nil
+}
+
+// Passed reports whether the request succeeded and every assertion passed
+func (r SpecResult) Passed() bool {
+	return r.Err == nil && len(r.Failures) == 0
+}
+
+// RunSpecs performs the given requests in order with the given [context.Context] and checks the assertions on their responses.
+// A failed request or assertion does not stop the run, every request has a result in the same order
+func (c *Client) RunSpecs(ctx context.Context, specs []RequestSpec) []SpecResult {
+	results := make([]SpecResult, 0, len(specs))
+	for _, spec := range specs {
+		results = append(results, c.runSpec(ctx, spec))
+	}
+
+	return results
+}
+
+// runSpec performs the given request and checks the assertions on its response
+func (c *Client) runSpec(ctx context.Context, spec RequestSpec) SpecResult {
+	method := cmp.Or(strings.ToUpper(spec.Method), http.MethodGet)
+	r := c.NewRequest().SetMethod(method)
+	if strings.HasPrefix(spec.Path, "http://") || strings.HasPrefix(spec.Path, "https://") {
+		r.SetUrl(spec.Path)
+	} else {
+		r.SetPath(spec.Path)
+	}
+
+	for k, v := range spec.Headers {
+		r.SetHeader(k, v)
+	}
+
+	for k, v := range spec.Query {
+		r.SetQueryParam(k, v)
+	}
+
+	if len(spec.Body) > 0 && string(spec.Body) != "null" {
+		var text string
+		if err := json.Unmarshal(spec.Body, &text); err == nil {
+			r.BodyRaw([]byte(text))
+		} else {
+			r.BodyRaw(spec.Body)
+			if r.headers.Get(headerContentType) == "" {
+				r.SetHeader(headerContentType, ContentTypeJson)
+			}
+		}
+	}
+
+	result := SpecResult{
+		Name:   spec.Name,
+		Method: method,
+		Url:    r.requestUrl(r.baseUrl),
+	}
+
+	resp, err := r.DoCtx(ctx)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.StatusCode = resp.StatusCode()
+	result.Duration = resp.Duration()
+
+	expect := spec.Expect
+	if expect.Status != 0 && resp.StatusCode() != expect.Status {
+		result.Failures = append(result.Failures, fmt.Sprintf("expected status %d, got %d", expect.Status, resp.StatusCode()))
+	} else if expect.Status == 0 && resp.IsError() != nil {
+		result.Failures = append(result.Failures, fmt.Sprintf("expected a successful status, got %d", resp.StatusCode()))
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(expect.Headers)) {
+		if got := resp.GetHeader(k); got != expect.Headers[k] {
+			result.Failures = append(result.Failures, fmt.Sprintf("expected header %s to be %q, got %q", k, expect.Headers[k], got))
+		}
+	}
+
+	if expect.BodyContains != "" && !bytes.Contains(resp.BodyRaw(), []byte(expect.BodyContains)) {
+		result.Failures = append(result.Failures, fmt.Sprintf("expected body to contain %q", expect.BodyContains))
+	}
+
+	if expect.MaxDuration > 0 && resp.Duration() > expect.MaxDuration {
+		result.Failures = append(result.Failures, fmt.Sprintf("expected duration at most %v, got %v", expect.MaxDuration, resp.Duration()))
+	}
+
+	return result
+}
+
+// ---------------------------------------------- //
+// HealthMonitor                                  //
+// ---------------------------------------------- //
+
+// HealthCheck performs a GET request to the given path and checks the response against the given expectation, see [SpecExpectation].
+// It returns nil if the upstream is healthy, the error of the request if it failed, or an error wrapping [ErrUnhealthy]
+// describing the failed assertions
+func (c *Client) HealthCheck(ctx context.Context, path string, expect SpecExpectation) error {
+	result := c.runSpec(ctx, RequestSpec{Path: path, Expect: expect})
+	if result.Err != nil {
+		return result.Err
+	}
+
+	if len(result.Failures) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnhealthy, strings.Join(result.Failures, "; "))
+	}
+
+	return nil
+}
+
+// NewHealthMonitor creates a new [HealthMonitor] checking the given path with the client every interval, see [Client.HealthCheck]
+func (c *Client) NewHealthMonitor(path string, expect SpecExpectation, interval time.Duration) *HealthMonitor {
+	return &HealthMonitor{
+		client:   c,
+		path:     path,
+		expect:   expect,
+		interval: interval,
+	}
+}
+
+// SetJitter sets the maximum random delay added to the interval, so that multiple monitors do not check at the same time
+func (m *HealthMonitor) SetJitter(jitter time.Duration) *HealthMonitor {
+	m.jitter = jitter
+	return m
+}
+
+// OnChange sets the callback called with the result of the first check and whenever the health of the upstream changes.
+// The error is the error of the failed check, or nil if the upstream is healthy
+func (m *HealthMonitor) OnChange(fn func(healthy bool, err error)) *HealthMonitor {
+	m.onChange = fn
+	return m
+}
+
+// Start starts checking the upstream in the background until the given [context.Context] is done or [HealthMonitor.Stop]
+// is called. The first check is performed immediately. Calling it on a running monitor has no effect
+func (m *HealthMonitor) Start(ctx context.Context) *HealthMonitor {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop != nil {
+		return m
+	}
+
+	ctx, m.stop = context.WithCancel(ctx)
+	m.done = make(chan struct{})
+	go m.run(ctx, m.done)
+	return m
+}
+
+// Stop stops the monitor and waits until the check in progress finishes
+func (m *HealthMonitor) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+
+	if stop != nil {
+		stop()
+		<-done
+	}
+}
+
+// Healthy reports whether the last check succeeded, it is false before the first check
+func (m *HealthMonitor) Healthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.healthy
+}
+
+// Err returns the error of the last check, or nil if it succeeded or the upstream was not checked yet
+func (m *HealthMonitor) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+// run checks the upstream periodically until the given [context.Context] is done
+func (m *HealthMonitor) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for {
+		m.check(ctx)
+
+		delay := m.interval
+		if m.jitter > 0 {
+			delay += rand.N(m.jitter)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// check checks the upstream once and calls the callback if the health changed
+func (m *HealthMonitor) check(ctx context.Context) {
+	err := m.client.HealthCheck(ctx, m.path, m.expect)
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	changed := !m.checked || m.healthy != (err == nil)
+	m.checked, m.healthy, m.err = true, err == nil, err
+	m.mu.Unlock()
+
+	if changed && m.onChange != nil {
+		m.onChange(err == nil, err)
+	}
+}
+
+// ---------------------------------------------- //
+// LatencyBalancer                                //
+// ---------------------------------------------- //
+
+// NewLatencyBalancer creates a new [LatencyBalancer] selecting from the given base URLs, which measures their latencies
+// with HEAD requests sent by the client. It has to be set on a client by calling [Client.SetLatencyBalancer] and started
+// by calling [LatencyBalancer.Start]. The first base URL is selected until the first measurement
+func (c *Client) NewLatencyBalancer(baseUrls ...string) *LatencyBalancer {
+	return &LatencyBalancer{
+		client:     c,
+		baseUrls:   slices.Clone(baseUrls),
+		interval:   DefaultBalancerInterval,
+		samples:    DefaultBalancerSamples,
+		hysteresis: DefaultBalancerHysteresis,
+		stats:      make([]LatencyStats, len(baseUrls)),
+	}
+}
+
+// SetInterval sets the delay between the measurements, which defaults to [DefaultBalancerInterval]
+func (b *LatencyBalancer) SetInterval(interval time.Duration) *LatencyBalancer {
+	b.interval = interval
+	return b
+}
+
+// SetSamples sets the number of requests per base URL in a measurement, which defaults to [DefaultBalancerSamples]
+func (b *LatencyBalancer) SetSamples(samples int) *LatencyBalancer {
+	b.samples = max(samples, 1)
+	return b
+}
+
+// SetHysteresis sets the fraction by which the average latency of another base URL must be lower to switch to it,
+// which defaults to [DefaultBalancerHysteresis]. It prevents flapping between base URLs with similar latencies.
+// The balancer switches regardless of the hysteresis if every request to the selected base URL failed
+func (b *LatencyBalancer) SetHysteresis(hysteresis float64) *LatencyBalancer {
+	b.hysteresis = min(max(hysteresis, 0), 1)
+	return b
+}
+
+// OnSwitch sets the callback called when the selected base URL changes
+func (b *LatencyBalancer) OnSwitch(fn func(from, to string)) *LatencyBalancer {
+	b.onSwitch = fn
+	return b
+}
+
+// Current returns the selected base URL
+func (b *LatencyBalancer) Current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.baseUrls) == 0 {
+		return ""
+	}
+
+	return b.baseUrls[b.current]
+}
+
+// Stats returns the latencies of the last measurement by base URL
+func (b *LatencyBalancer) Stats() map[string]LatencyStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make(map[string]LatencyStats, len(b.baseUrls))
+	for i, baseUrl := range b.baseUrls {
+		stats[baseUrl] = b.stats[i]
+	}
+
+	return stats
+}
+
+// Start starts measuring the latencies in the background until the given [context.Context] is done or [LatencyBalancer.Stop]
+// is called. The first measurement is performed immediately. The measurements are sent with a copy of the client created
+// by calling [Client.Clone] when the balancer is started, so the client can be configured further afterwards.
+// Calling it on a running balancer has no effect
+func (b *LatencyBalancer) Start(ctx context.Context) *LatencyBalancer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stop != nil {
+		return b
+	}
+
+	// the measurements are not balanced and not logged
+	probe := b.client.Clone().SetLatencyBalancer(nil).SetLogEnabled(false)
+
+	ctx, b.stop = context.WithCancel(ctx)
+	b.done = make(chan struct{})
+	go b.run(ctx, probe, b.done)
+	return b
+}
+
+// Stop stops the balancer and waits until the measurement in progress finishes
+func (b *LatencyBalancer) Stop() {
+	b.mu.Lock()
+	stop, done := b.stop, b.done
+	b.stop, b.done = nil, nil
+	b.mu.Unlock()
+
+	if stop != nil {
+		stop()
+		<-done
+	}
+}
+
+// run measures the latencies periodically with the given client until the given [context.Context] is done
+func (b *LatencyBalancer) run(ctx context.Context, probe *Client, done chan struct{}) {
+	defer close(done)
+
+	for {
+		b.measure(ctx, probe)
+
+		timer := time.NewTimer(b.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// measure measures the latencies of the base URLs with the given client and selects the fastest healthy one
+func (b *LatencyBalancer) measure(ctx context.Context, probe *Client) {
+	stats := make([]LatencyStats, len(b.baseUrls))
+	for i, baseUrl := range b.baseUrls {
+		stats[i] = probe.Head("").SetBaseUrl(baseUrl).MeasureLatency(ctx, b.samples)
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	healthy := func(s LatencyStats) bool {
+		return s.Errors < s.Requests
+	}
+
+	best := -1
+	for i, s := range stats {
+		if healthy(s) && (best < 0 || s.Avg < stats[best].Avg) {
+			best = i
+		}
+	}
+
+	b.mu.Lock()
+	b.stats = stats
+	from := b.current
+	if best >= 0 && best != from {
+		current := stats[from]
+		if !healthy(current) || float64(stats[best].Avg) < float64(current.Avg)*(1-b.hysteresis) {
+			b.current = best
+		}
+	}
+	to := b.current
+	b.mu.Unlock()
+
+	if from != to && b.onSwitch != nil {
+		b.onSwitch(b.baseUrls[from], b.baseUrls[to])
+	}
+}
+
+// ---------------------------------------------- //
+// Session                                        //
+// ---------------------------------------------- //
+
+// NewSession creates a new [Session] sending its requests with a derived client created by calling [Client.Clone].
+// By default a response with 401 Unauthorized status code is considered as the expiry of the session
+func (c *Client) NewSession() *Session {
+	s := &Session{
+		client:     c.Clone(),
+		jar:        newSessionJar(),
+		csrfHeader: DefaultCSRFHeader,
+		isExpired: func(resp *http.Response) bool {
+			return resp.StatusCode == http.StatusUnauthorized
+		},
+	}
+
+	s.client.client.Jar = s.jar
+	s.client.Use(s.middleware)
+
+	return s
+}
+
+// SetCSRF sets the header in which the CSRF token is sent and the extractor of the token,
+// which is called with the responses of [Session.Login] and [Session.RefreshCSRF]
+func (s *Session) SetCSRF(header string, extract CSRFExtractor) *Session {
+	s.csrfHeader = header
+	s.csrfExtract = extract
+	return s
+}
+
+// SetExpiryCheck sets the function reporting whether a response signals that the session expired
+func (s *Session) SetExpiryCheck(isExpired func(resp *http.Response) bool) *Session {
+	s.isExpired = isExpired
+	return s
+}
+
+// OnExpired sets the function called when the session expires. The cookies and the CSRF token are cleared before calling it
+func (s *Session) OnExpired(fn func()) *Session {
+	s.onExpired = fn
+	return s
+}
+
+// Client returns the client sending the requests of the session, which should be used to create the requests of the session
+func (s *Session) Client() *Client {
+	return s.client
+}
+
+// Login performs the given login request with the given [context.Context] in the session. The cookies set by the response are
+// stored and the CSRF token is extracted from it if an extractor is set. If the response is considered to be an error,
+// then the [*ResponseError] is returned. If no token can be extracted, then the token fetched earlier by calling
+// [Session.RefreshCSRF] is kept, or the error of the extractor is returned if there is none
+func (s *Session) Login(ctx context.Context, req *Request) (*Response, error) {
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	token, err := s.extractCSRF(resp)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil && s.csrfToken == "" {
+		return resp, err
+	}
+
+	if token != "" {
+		s.csrfToken = token
+	}
+	s.loggedIn = true
+
+	return resp, nil
+}
+
+// RefreshCSRF performs the given request with the given [context.Context] in the session and replaces the CSRF token
+// with the one extracted from its response e.g.: to fetch the token from the login page before logging in
+func (s *Session) RefreshCSRF(ctx context.Context, req *Request) error {
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.extractCSRF(resp)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.csrfToken = token
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Logout performs the given logout request with the given [context.Context] in the session if it is not nil,
+// then clears the cookies and the CSRF token of the session even if the request failed
+func (s *Session) Logout(ctx context.Context, req *Request) error {
+	var err error
+	if req != nil {
+		_, err = s.do(ctx, req)
+	}
+
+	s.clear()
+
+	return err
+}
+
+// LoggedIn reports whether the session is logged in and did not expire since
+func (s *Session) LoggedIn() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.loggedIn
+}
+
+// CSRFToken returns the current CSRF token of the session
+func (s *Session) CSRFToken() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.csrfToken
+}
+
+// Cookies returns the cookies of the session sent to the given URL
+func (s *Session) Cookies(rawUrl string) []*http.Cookie {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil
+	}
+
+	return s.jar.Cookies(u)
+}
+
+// do performs the given request with the client of the session
+func (s *Session) do(ctx context.Context, req *Request) (*Response, error) {
+	r := req.Clone()
+	r.client = s.client
+
+	resp, err := r.DoCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, resp.IsError()
+}
+
+// extractCSRF extracts the CSRF token from the given response, an empty token is returned if there is no extractor
+func (s *Session) extractCSRF(resp *Response) (string, error) {
+	if s.csrfExtract == nil {
+		return "", nil
+	}
+
+	return s.csrfExtract(resp)
+}
+
+// middleware adds the CSRF token to the requests and detects the expiry of the session from the responses
+func (s *Session) middleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if token := s.CSRFToken(); token != "" && req.Header.Get(s.csrfHeader) == "" {
+			req = req.Clone(req.Context())
+			req.Header.Set(s.csrfHeader, token)
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err == nil && s.isExpired != nil && s.LoggedIn() && s.isExpired(resp) {
+			s.clear()
+			if s.onExpired != nil {
+				s.onExpired()
+			}
+		}
+
+		return resp, err
+	})
+}
+
+// clear logs the session out and clears its cookies and CSRF token
+func (s *Session) clear() {
+	s.mu.Lock()
+	s.loggedIn = false
+	s.csrfToken = ""
+	s.mu.Unlock()
+
+	s.jar.clear()
+}
+
+// newSessionJar creates a new empty [sessionJar]
+func newSessionJar() *sessionJar {
+	j := &sessionJar{}
+	j.clear()
+	return j
+}
+
+// SetCookies implements the [net/http.CookieJar] interface
+func (j *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	j.jar.SetCookies(u, cookies)
+}
+
+// Cookies implements the [net/http.CookieJar] interface
+func (j *sessionJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return j.jar.Cookies(u)
+}
+
+// clear removes every cookie
+func (j *sessionJar) clear() {
+	jar, _ := cookiejar.New(nil) // never fails without options
+
+	j.mu.Lock()
+	j.jar = jar
+	j.mu.Unlock()
+}
+
+// CSRFFromJson returns a [CSRFExtractor] extracting the CSRF token from the given top-level string field of a JSON object body
+func CSRFFromJson(field string) CSRFExtractor {
+	return func(resp *Response) (string, error) {
+		var body map[string]any
+		if err := json.Unmarshal(resp.body, &body); err != nil {
+			return "", err
+		}
+
+		token, ok := body[field].(string)
+		if !ok || token == "" {
+			return "", fmt.Errorf("%w: no field %q", ErrCSRFTokenNotFound, field)
+		}
+
+		return token, nil
+	}
+}
+
+// CSRFFromHeader returns a [CSRFExtractor] extracting the CSRF token from the given header of the response
+func CSRFFromHeader(key string) CSRFExtractor {
+	return func(resp *Response) (string, error) {
+		token := resp.GetHeader(key)
+		if token == "" {
+			return "", fmt.Errorf("%w: no header %q", ErrCSRFTokenNotFound, key)
+		}
+
+		return token, nil
+	}
+}
+
+// CSRFFromMetaTag returns a [CSRFExtractor] extracting the CSRF token from the content attribute of the meta tag
+// with the given name in an HTML body e.g.: <meta name="csrf-token" content="...">.
+// The body is searched without parsing the document, see the pingohtml package for parsing HTML
+func CSRFFromMetaTag(name string) CSRFExtractor {
+	return func(resp *Response) (string, error) {
+		for _, tag := range metaTagPattern.FindAll(resp.body, -1) {
+			attrs := make(map[string]string)
+			for _, m := range htmlAttrPattern.FindAllSubmatch(tag, -1) {
+				attrs[strings.ToLower(string(m[1]))] = html.UnescapeString(string(m[2]) + string(m[3]) + string(m[4]))
+			}
+
+			if attrs["name"] == name && attrs["content"] != "" {
+				return attrs["content"], nil
+			}
+		}
+
+		return "", fmt.Errorf("%w: no meta tag %q", ErrCSRFTokenNotFound, name)
+	}
+}
+
+// ---------------------------------------------- //
+// Batch                                          //
+// ---------------------------------------------- //
+
+// NewBatch creates a new [Batch] sent to the batch endpoint at the given path
+func (c *Client) NewBatch(path string) *Batch {
+	return &Batch{
+		client: c,
+		path:   path,
+	}
+}
+
+// Add adds the given requests to the batch. The requests are encoded with their method, URL, query parameters, headers
+// and body only, the other settings e.g.: the retries, the timeouts and the host configurations do not apply to them
+func (b *Batch) Add(requests ...*Request) *Batch {
+	b.requests = append(b.requests, requests...)
+	return b
+}
+
+// Do sends the batch with the given [context.Context] and returns the responses of the requests in the order they were added.
+// The responses are matched to the requests by their Content-ID headers if present, or by their order otherwise.
+// If the response of the batch is considered to be an error, then the [*ResponseError] is returned.
+// It returns an error wrapping [ErrInvalidBatch] if the response is not a multipart response with a part per request.
+// The responses of the requests must be checked individually e.g.: by calling [Response.IsError]
+func (b *Batch) Do(ctx context.Context) ([]*Response, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for i, r := range b.requests {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			headerContentType:           {"application/http"},
+			"Content-Transfer-Encoding": {"binary"},
+			"Content-Id":                {fmt.Sprintf("<%d>", i+1)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := r.writeBatchPart(part); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	resp, err := b.client.NewRequest().
+		SetMethod(http.MethodPost).
+		SetPath(b.path).
+		BodyWithContentType(body.Bytes(), "multipart/mixed; boundary="+w.Boundary()).
+		DoCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resp.IsError(); err != nil {
+		return nil, err
+	}
+
+	mediaType, params := resp.ContentType()
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, fmt.Errorf("%w: unexpected content type %q", ErrInvalidBatch, mediaType)
+	}
+
+	responses := make([]*Response, len(b.requests))
+	mr := multipart.NewReader(bytes.NewReader(resp.body), params["boundary"])
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidBatch, err)
+		}
+
+		index := i
+		id := strings.TrimPrefix(strings.Trim(part.Header.Get("Content-Id"), "<>"), "response-")
+		if n, err := strconv.Atoi(id); err == nil {
+			index = n - 1
+		}
+
+		if index < 0 || index >= len(responses) || responses[index] != nil {
+			return nil, fmt.Errorf("%w: unexpected part %d", ErrInvalidBatch, i+1)
+		}
+
+		partResp, err := b.readBatchPart(part, resp, b.requests[index])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidBatch, err)
+		}
+		responses[index] = partResp
+	}
+
+	if missing := slices.Index(responses, nil); missing >= 0 {
+		return nil, fmt.Errorf("%w: no response to request %d", ErrInvalidBatch, missing+1)
+	}
+
+	return responses, nil
+}
+
+// readBatchPart reads the response of the given request from a part of the response of the batch
+func (b *Batch) readBatchPart(part io.Reader, batch *Response, r *Request) (*Response, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{
+		responseHeader: responseHeader{
+			status:     resp.Status,
+			statusCode: resp.StatusCode,
+			headers:    resp.Header,
+			requestId:  batch.requestId,
+			tls:        batch.tls,
+			receivedAt: batch.receivedAt,
+			url:        r.requestUrl(r.baseUrl),
+		},
+		body:          body,
+		schema:        b.client.schema(r.endpoint),
+		duration:      batch.duration,
+		attempts:      batch.attempts,
+		isSuccess:     b.client.isSuccess,
+		jsonDecoder:   b.client.jsonDecoder(),
+		zeroCopy:      b.client.zeroCopy,
+		charsets:      b.client.charsets,
+		decoders:      b.client.decoders,
+		recoverPanics: b.client.recoverPanics,
+	}, nil
+}
+
+// writeBatchPart writes the request in the application/http format of the parts of a batch
+func (r *Request) writeBatchPart(w io.Writer) error {
+	if r.bodyErr != nil {
+		return r.bodyErr
+	}
+
+	if r.bodyStream != nil {
+		return ErrBodyNotReplayable
+	}
+
+	u, err := url.Parse(r.requestUrl(r.baseUrl))
+	if err != nil {
+		return err
+	}
+	u.RawQuery = r.encodeQuery(u.RawQuery, r.queryParams)
+
+	headers := r.headers.Clone()
+	if ua := r.userAgentHeader(); ua != "" {
+		headers.Set(headerUserAgent, ua)
+	}
+
+	var body []byte
+	if r.body != nil {
+		body = r.body.Bytes()
+	}
+	if len(body) > 0 {
+		headers.Set(headerContentLength, strconv.Itoa(len(body)))
+	}
+
+	if _, err := fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", r.method, u.RequestURI()); err != nil {
+		return err
+	}
+
+	if err := headers.Write(w); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, "\r\n"); err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// ---------------------------------------------- //
+// HostConfig                                     //
+// ---------------------------------------------- //
+
+// SetHeaders sets the header values
+func (h *HostConfig) SetHeaders(headers http.Header) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	setValues(headers, h.headers)
+	return h
+}
+
+// SetHeader sets a single header value
+func (h *HostConfig) SetHeader(key, value string) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.headers.Set(key, value)
+	return h
+}
+
+// AddHeaders adds the header values
+func (h *HostConfig) AddHeaders(headers http.Header) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addValues(headers, h.headers)
+	return h
+}
+
+// AddHeader adds a single header value
+func (h *HostConfig) AddHeader(key, value string) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.headers.Add(key, value)
+	return h
+}
+
+// SetQueryParams sets the query parameters
+func (h *HostConfig) SetQueryParams(queryParams url.Values) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	setValues(queryParams, h.queryParams)
+	return h
+}
+
+// SetQueryParam sets a single query parameter
+func (h *HostConfig) SetQueryParam(key, value string) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queryParams.Set(key, value)
+	return h
+}
+
+// AddQueryParams adds the query parameters
+func (h *HostConfig) AddQueryParams(queryParams url.Values) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addValues(queryParams, h.queryParams)
+	return h
+}
+
+// AddQueryParam adds a single query parameter
+func (h *HostConfig) AddQueryParam(key, value string) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queryParams.Add(key, value)
+	return h
+}
+
+// SetTimeout sets the timeout
+func (h *HostConfig) SetTimeout(timeout time.Duration) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.timeout = timeout
+	return h
+}
+
+// SetRateLimit limits the requests sent to the host to rate requests per second,
+// allowing bursts of up to burst requests. A rate less than or equal to zero disables the limit
+func (h *HostConfig) SetRateLimit(rate float64, burst int) *HostConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rate <= 0 {
+		h.limiter = nil
+		return h
+	}
+
+	h.limiter = newRateLimiter(rate, burst)
+	return h
+}
+
+// apply applies the host settings on top of the given request settings.
+// Values that were overridden on the request are left untouched
+func (h *HostConfig) apply(r *Request, headers http.Header, queryParams url.Values, timeout time.Duration) (http.Header, url.Values, time.Duration) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	headers = mergeValues(h.headers, headers, r.setHeaders)
+	queryParams = mergeValues(h.queryParams, queryParams, r.setQueryParams)
+
+	if h.timeout > 0 && !r.timeoutSet {
+		timeout = h.timeout
+	}
+
+	return headers, queryParams, timeout
+}
+
+// wait blocks until the rate limit of the host allows a request to be sent
+func (h *HostConfig) wait(ctx context.Context) error {
+	h.mu.RLock()
+	limiter := h.limiter
+	h.mu.RUnlock()
+
+	if limiter == nil {
+		return nil
+	}
+
+	return limiter.wait(ctx, 1)
+}
+
+// ---------------------------------------------- //
+// Concurrency limiter                            //
+// ---------------------------------------------- //
+
+// acquire waits for a free slot until the given [context.Context] is done
+func (l *concurrencyLimiter) acquire(ctx context.Context, priority Priority) error {
+	l.mu.Lock()
+	if l.active < l.limit {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+
+	i := int(min(max(priority, PriorityLow), PriorityHigh) - PriorityLow)
+	ready := make(chan struct{})
+	l.waiting[i] = append(l.waiting[i], ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	n := len(l.waiting[i])
+	l.waiting[i] = slices.DeleteFunc(l.waiting[i], func(c chan struct{}) bool {
+		return c == ready
+	})
+	granted := len(l.waiting[i]) == n
+	l.mu.Unlock()
+
+	// the slot was handed over while the context was done
+	if granted {
+		l.release()
+	}
+
+	return ctx.Err()
+}
+
+// release releases a slot, which is handed over to the waiting request with the highest priority if there is any
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := len(l.waiting) - 1; i >= 0; i-- {
+		if len(l.waiting[i]) > 0 {
+			close(l.waiting[i][0])
+			l.waiting[i] = l.waiting[i][1:]
+			return
+		}
+	}
+
+	l.active--
+}
+
+// Close closes the body and releases the slot of the request
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// ---------------------------------------------- //
+// In-flight tracker                              //
+// ---------------------------------------------- //
+
+// add starts tracking a request, it reports false if the tracker is closed
+func (t *inFlightTracker) add(entry *inFlightEntry) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+
+	if t.requests == nil {
+		t.requests = make(map[*inFlightEntry]struct{})
+	}
+	t.requests[entry] = struct{}{}
+	return true
+}
+
+// done stops tracking a request and releases its context
+func (t *inFlightTracker) done(entry *inFlightEntry) {
+	entry.cancel(nil)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.requests, entry)
+	if t.closed && len(t.requests) == 0 {
+		close(t.drained)
+	}
+}
+
+// list returns the descriptions of the requests in flight ordered by their start time
+func (t *inFlightTracker) list() []InFlightRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	requests := make([]InFlightRequest, 0, len(t.requests))
+	for entry := range t.requests {
+		req := entry.InFlightRequest
+		req.Elapsed = now.Sub(req.Started)
+		requests = append(requests, req)
+	}
+
+	slices.SortFunc(requests, func(a, b InFlightRequest) int {
+		return a.Started.Compare(b.Started)
+	})
+	return requests
+}
+
+// cancelAll cancels the requests in flight with the given cause
+func (t *inFlightTracker) cancelAll(cause error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for entry := range t.requests {
+		entry.cancel(cause)
+	}
+}
+
+// close closes the tracker and returns a channel, which is closed when no request is in flight
+func (t *inFlightTracker) close() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		t.drained = make(chan struct{})
+		if len(t.requests) == 0 {
+			close(t.drained)
+		}
+	}
+
+	return t.drained
+}
+
+// ---------------------------------------------- //
+// Rate limiter                                   //
+// ---------------------------------------------- //
+
+// newRateLimiter creates a new rate limiter with the given rate per second and burst
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait reserves n tokens and blocks until they are available or the [context.Context] is done
+func (l *rateLimiter) wait(ctx context.Context, n float64) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= n
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// give back the reserved tokens
+		l.mu.Lock()
+		l.tokens += n
+		l.mu.Unlock()
+		return context.Cause(ctx)
+	}
+}
+
+// ---------------------------------------------- //
+// Request                                        //
+// ---------------------------------------------- //
+
+// NewRequest creates a new request on the default client
+func NewRequest() *Request {
+	return defaultClient.NewRequest()
+}
+
+// SetDebug sets the debug mode
+func (r *Request) SetDebug(debug, includeBody bool) *Request {
+	r.debug = debug
+	r.debugBody = includeBody
+	return r
+}
+
+// SetDebugFormat sets the format of the debug output, which defaults to [DebugFormatText]
+func (r *Request) SetDebugFormat(format DebugFormat) *Request {
+	r.debugFormat = format
+	return r
+}
+
+// SetDebugBodyLimit sets the maximum number of body bytes included in the debug output, see [Client.SetDebugBodyLimit]
+func (r *Request) SetDebugBodyLimit(limit int) *Request {
+	r.debugBodyLimit = limit
+	return r
+}
+
+// SetLogEnabled sets the log mode
+func (r *Request) SetLogEnabled(enabled bool) *Request {
+	r.isLogEnabled = enabled
+	return r
+}
+
+// SetMethod sets the request method
+// e.g.: "GET", "POST", "PUT"
+func (r *Request) SetMethod(method string) *Request {
+	if method != "" {
+		r.method = method
+	}
+	return r
+}
+
+// SetBaseUrl sets the base URL
+func (r *Request) SetBaseUrl(baseUrl string) *Request {
+	r.baseUrl = baseUrl
+	return r
+}
+
+// SetPath sets the request path
+func (r *Request) SetPath(path string) *Request {
+	r.path = path
+	return r
+}
+
+// JoinPath appends the given segments to the request path separated by slashes.
+// Segments are expected to be already escaped, the same way as with [url.JoinPath]
+func (r *Request) JoinPath(segments ...string) *Request {
+	for _, segment := range segments {
+		r.path = strings.TrimRight(r.path, "/") + "/" + strings.TrimLeft(segment, "/")
+	}
+
+	return r
+}
+
+// SetUrl sets the full URL of the request, which is used as is instead of joining the base URL and the path.
+// Path parameters are still substituted in the URL
+func (r *Request) SetUrl(fullUrl string) *Request {
+	r.url = fullUrl
+	return r
+}
+
+// SetPathParam sets a single path parameter, which substitutes "{key}" in the path.
+// The value is escaped with [net/url.PathEscape]
+func (r *Request) SetPathParam(key, value string) *Request {
+	if r.pathParams == nil {
+		r.pathParams = make(map[string]string)
+	}
+
+	r.pathParams[key] = value
+	return r
+}
+
+// SetPathParams sets the path parameters
+func (r *Request) SetPathParams(params map[string]string) *Request {
+	for k, v := range params {
+		r.SetPathParam(k, v)
+	}
+	return r
+}
+
+// Endpoint returns the name of the endpoint the request was created from.
+// It returns an empty string if the request was not created by calling [Client.Request]
+func (r *Request) Endpoint() string {
+	return r.endpoint
+}
+
+// SetHeaders sets the header values
+func (r *Request) SetHeaders(headers http.Header) *Request {
+	for k := range headers {
+		r.markHeader(k)
+	}
+	setValues(headers, r.headers)
+	return r
+}
+
+// SetHeader sets a single header value
+func (r *Request) SetHeader(key, value string) *Request {
+	r.markHeader(key)
+	r.headers.Set(key, value)
+	return r
+}
+
+// DelHeader deletes the header, including the one inherited from the client, without modifying the client
+func (r *Request) DelHeader(key string) *Request {
+	r.markHeader(key)
+	r.headers.Del(key)
+	return r
+}
+
+// SetUserAgent sets the User-Agent header, which overwrites the User-Agent set by calling [Client.SetUserAgent]
+func (r *Request) SetUserAgent(userAgent string) *Request {
+	r.userAgent = userAgent
+	r.markHeader(headerUserAgent)
+	r.headers.Set(headerUserAgent, userAgent)
+	return r
+}
+
+// userAgentHeader returns the User-Agent which must be sent regardless of the headers of the request, if any
+func (r *Request) userAgentHeader() string {
+	if r.userAgent != "" {
+		return r.userAgent
+	}
+
+	return r.client.userAgent
+}
+
+// AddHeaders adds the header values
+func (r *Request) AddHeaders(headers http.Header) *Request {
+	for k := range headers {
+		r.markHeader(k)
+	}
+	addValues(headers, r.headers)
+	return r
+}
+
+// AddHeader adds a single header value
+func (r *Request) AddHeader(key, value string) *Request {
+	r.markHeader(key)
+	r.headers.Add(key, value)
+	return r
+}
+
+// SetQueryParams sets the query parameters
+func (r *Request) SetQueryParams(queryParams url.Values) *Request {
+	for k := range queryParams {
+		r.markQueryParam(k)
+	}
+	setValues(queryParams, r.queryParams)
+	return r
+}
+
+// SetQueryParam sets a single query parameter
+func (r *Request) SetQueryParam(key, value string) *Request {
+	r.markQueryParam(key)
+	r.queryParams.Set(key, value)
+	return r
+}
+
+// AddQueryParams adds the query parameters
+func (r *Request) AddQueryParams(queryParams url.Values) *Request {
+	for k := range queryParams {
+		r.markQueryParam(k)
+	}
+	addValues(queryParams, r.queryParams)
+	return r
+}
+
+// AddQueryParam adds a single query parameter
+func (r *Request) AddQueryParam(key, value string) *Request {
+	r.markQueryParam(key)
+	r.queryParams.Add(key, value)
+	return r
+}
+
+// DelQueryParam deletes the query parameter, including the one inherited from the client, without modifying the client
+func (r *Request) DelQueryParam(key string) *Request {
+	r.markQueryParam(key)
+	r.queryParams.Del(key)
+	return r
+}
+
+// markHeader marks the header as set on the request, so the host settings do not override it.
+// The headers shared with the client are copied before they are modified for the first time
+func (r *Request) markHeader(key string) {
+	if !r.headersCopied {
+		r.headers = cloneValues(r.headers)
+		r.headersCopied = true
+	}
+
+	if r.setHeaders == nil {
+		r.setHeaders = make(map[string]struct{})
+	}
+	r.setHeaders[http.CanonicalHeaderKey(key)] = struct{}{}
+}
+
+// markQueryParam marks the query parameter as set on the request, so the host settings do not override it.
+// The query parameters shared with the client are copied before they are modified for the first time
+func (r *Request) markQueryParam(key string) {
+	if !r.queryParamsCopied {
+		r.queryParams = cloneValues(r.queryParams)
+		r.queryParamsCopied = true
+	}
+
+	if r.setQueryParams == nil {
+		r.setQueryParams = make(map[string]struct{})
+	}
+	r.setQueryParams[key] = struct{}{}
+}
+
+// SetPriority sets the priority of the request, which decides the order of the requests waiting for a free slot
+// when the concurrency of the client is limited by calling [Client.SetMaxConcurrency]
+func (r *Request) SetPriority(priority Priority) *Request {
+	r.priority = priority
+	return r
+}
+
+// SetPriorityHint sets the Priority header defined by RFC 9218, which hints the server about the urgency of the response
+// from 0 (highest) to 7 (lowest), the default being 3, and whether the response can be processed incrementally
+func (r *Request) SetPriorityHint(urgency int, incremental bool) *Request {
+	value := "u=" + strconv.Itoa(min(max(urgency, 0), 7))
+	if incremental {
+		value += ", i"
+	}
+
+	r.SetHeader(headerPriority, value)
+	return r
+}
+
+// SetFetchMetadata sets the Sec-Fetch-* headers sent by browsers, the empty fields are removed
+func (r *Request) SetFetchMetadata(metadata FetchMetadata) *Request {
+	for key, value := range map[string]string{
+		headerSecFetchSite: metadata.Site,
+		headerSecFetchMode: metadata.Mode,
+		headerSecFetchDest: metadata.Dest,
+	} {
+		if value == "" {
+			r.DelHeader(key)
+		} else {
+			r.SetHeader(key, value)
+		}
+	}
+
+	if metadata.User {
+		r.SetHeader(headerSecFetchUser, "?1")
+	} else {
+		r.DelHeader(headerSecFetchUser)
+	}
+
+	return r
+}
+
+// SetPreserveRawQuery sets whether the already encoded query of the URL is preserved as is.
+// If enabled, the query parameters are encoded and appended to the query of the URL without re-encoding it
+func (r *Request) SetPreserveRawQuery(preserve bool) *Request {
+	r.preserveRawQuery = preserve
+	return r
+}
+
+// AddRawQuery appends an already encoded query fragment e.g.: "b=2&a=1" to the query as is, without encoding or reordering it.
+// The fragments are appended in the order of the calls after the query parameters, which are sorted by key
+func (r *Request) AddRawQuery(fragment string) *Request {
+	r.rawQueries = append(r.rawQueries, fragment)
+	return r
+}
+
+// SetQuerySeparator sets the separator of the query parameters e.g.: ";". Defaults to "&"
+func (r *Request) SetQuerySeparator(separator string) *Request {
+	r.querySeparator = separator
+	return r
+}
+
+// SetTransport sets the [net/http.RoundTripper] used by the request instead of the transport of the client
+// without modifying the client e.g.: a test double or a special proxy for a single request.
+// The middlewares and the other settings of the client still apply
+func (r *Request) SetTransport(rt http.RoundTripper) *Request {
+	r.transport = rt
+	return r
+}
+
+// WithHttpRequest adds a hook that is called with the underlying [net/http.Request] right before it is sent,
+// which allows setting fields that are not modeled by [Request] e.g.: Close or Host.
+// Hooks are called in the order they were added on every attempt of the request
+func (r *Request) WithHttpRequest(hook func(req *http.Request)) *Request {
+	r.httpRequestHooks = append(r.httpRequestHooks, hook)
+	return r
+}
+
+// SetProfile sets whether the timings of the phases of the request are logged after the response body is read,
+// which is cheaper than the debug mode for performance investigations. See [Response.Timings]
+func (r *Request) SetProfile(profile bool) *Request {
+	r.profile = profile
+	return r
+}
+
+// SetRetry sets the maximum number of retries of the request if it fails and the delay before the first retry,
+// see [Client.SetRetry] for details
+func (r *Request) SetRetry(maxRetries int, backoff time.Duration) *Request {
+	r.maxRetries = max(maxRetries, 0)
+	r.retryBackoff = backoff
+	return r
+}
+
+// SetTimeout sets the timeout
+func (r *Request) SetTimeout(timeout time.Duration) *Request {
+	r.timeout = timeout
+	r.timeoutSet = true
+	return r
+}
+
+// SetConnectTimeout sets the timeout of establishing a connection.
+// If it is exceeded, then the request fails with [ErrConnectTimeout]
+func (r *Request) SetConnectTimeout(timeout time.Duration) *Request {
+	r.connectTimeout = timeout
+	return r
+}
+
+// SetTLSHandshakeTimeout sets the timeout of the TLS handshake.
+// If it is exceeded, then the request fails with [ErrTLSHandshakeTimeout]
+func (r *Request) SetTLSHandshakeTimeout(timeout time.Duration) *Request {
+	r.tlsHandshakeTimeout = timeout
+	return r
+}
+
+// SetResponseHeaderTimeout sets the timeout of waiting for the response headers after the request is written.
+// If it is exceeded, then the request fails with [ErrResponseHeaderTimeout]
+func (r *Request) SetResponseHeaderTimeout(timeout time.Duration) *Request {
+	r.responseHeaderTimeout = timeout
+	return r
+}
+
+// SetTrailer sets a single trailer value. Setting trailers forces the request body to be sent with chunked
+// transfer encoding, as trailers are sent after the body
+func (r *Request) SetTrailer(key, value string) *Request {
+	if r.trailers == nil {
+		r.trailers = make(http.Header)
+	}
+
+	r.trailers.Set(key, value)
+	return r
+}
+
+// SetTrailers sets the trailer values. Setting trailers forces the request body to be sent with chunked
+// transfer encoding, as trailers are sent after the body
+func (r *Request) SetTrailers(trailers http.Header) *Request {
+	if r.trailers == nil {
+		r.trailers = make(http.Header)
+	}
+
+	setValues(trailers, r.trailers)
+	return r
+}
+
+// SetIfNoneMatch sets the If-None-Match header to the given entity tag e.g.: the value of [Response.ETag]
+// of a previous response. If the resource has not changed, then the response has status code 304 and
+// the error returned by [Response.IsError] matches [ErrNotModified]
+func (r *Request) SetIfNoneMatch(etag string) *Request {
+	r.markHeader(headerIfNoneMatch)
+	r.headers.Set(headerIfNoneMatch, etag)
+	return r
+}
+
+// SetIfModifiedSince sets the If-Modified-Since header to the given time e.g.: the value of [Response.LastModified]
+// of a previous response. If the resource has not changed, then the response has status code 304 and
+// the error returned by [Response.IsError] matches [ErrNotModified]
+func (r *Request) SetIfModifiedSince(t time.Time) *Request {
+	r.markHeader(headerIfModifiedSince)
+	r.headers.Set(headerIfModifiedSince, t.UTC().Format(http.TimeFormat))
+	return r
+}
+
+// BodyJson prepares the body as a JSON request with the given data.
+// Content-Type header is automatically set to "application/json"
+func (r *Request) BodyJson(data any) *Request {
+	r.resetBody()
+	r.SetHeader(headerContentType, ContentTypeJson)
+
+	b, err := r.client.marshalJson(data)
+	if err != nil {
+		r.bodyErr = err
+		return r
+	}
+
+	r.body = bytes.NewBuffer(b)
+	return r
+}
+
+// BodyXml prepares the body as an XML request with the given data.
+// Content-Type header is automatically set to "application/xml"
+func (r *Request) BodyXml(data any) *Request {
+	r.resetBody()
+	r.SetHeader(headerContentType, ContentTypeXml)
+
+	b, err := xml.Marshal(data)
+	if err != nil {
+		r.bodyErr = err
+		return r
+	}
+
+	r.body = bytes.NewBuffer(b)
+	return r
+}
 
 // BodyFormUrlEncoded prepares the body as a form URL encoded request with the given data.
 // Content-Type header is automatically set to "application/x-www-form-urlencoded"
 func (r *Request) BodyFormUrlEncoded(data url.Values) *Request {
 	r.resetBody()
-	r.SetHeader(headerContentType, ContentTypeFormUrlEncoded)
+	r.SetHeader(headerContentType, ContentTypeFormUrlEncoded)
+
+	r.body = bytes.NewBufferString(data.Encode())
+	return r
+}
+
+// Body prepares the body based on the type of the given data:
+// nil means no body, []byte, string and [io.Reader] are sent as raw data,
+// [net/url.Values] is sent as form URL encoded and anything else is sent as JSON
+func (r *Request) Body(data any) *Request {
+	switch data := data.(type) {
+	case nil:
+		r.resetBody()
+		return r
+	case []byte:
+		return r.BodyRaw(data)
+	case string:
+		return r.BodyRaw([]byte(data))
+	case url.Values:
+		return r.BodyFormUrlEncoded(data)
+	case io.Reader:
+		return r.BodyCustom(func() (*bytes.Buffer, error) {
+			body := &bytes.Buffer{}
+			_, err := body.ReadFrom(data)
+			return body, err
+		})
+	default:
+		return r.BodyJson(data)
+	}
+}
+
+// BodyCustom prepares the body with the given callback function
+func (r *Request) BodyCustom(f func() (*bytes.Buffer, error)) *Request {
+	r.resetBody()
+
+	body, err := f()
+	if err != nil {
+		r.bodyErr = err
+		return r
+	}
+
+	r.body = body
+	return r
+}
+
+// BodyRaw prepares the body with the given raw data bytes
+func (r *Request) BodyRaw(data []byte) *Request {
+	r.resetBody()
+	r.body = bytes.NewBuffer(data)
+	return r
+}
+
+// BodyText prepares the body as a plain text request with the given string.
+// Content-Type header is automatically set to "text/plain; charset=utf-8"
+func (r *Request) BodyText(s string) *Request {
+	return r.BodyWithContentType([]byte(s), ContentTypeText)
+}
+
+// BodyHtml prepares the body as an HTML request with the given string.
+// Content-Type header is automatically set to "text/html; charset=utf-8"
+func (r *Request) BodyHtml(s string) *Request {
+	return r.BodyWithContentType([]byte(s), ContentTypeHtml)
+}
+
+// BodyWithContentType prepares the body with the given raw data bytes and sets the Content-Type header to the given content type
+func (r *Request) BodyWithContentType(data []byte, contentType string) *Request {
+	r.BodyRaw(data)
+	r.SetHeader(headerContentType, contentType)
+	return r
+}
+
+// BodyTemplate prepares the body by executing the given [text/template] with the given data and sets the Content-Type header
+// to the given content type, which is useful for XML, SOAP or text protocols where marshaling structs is awkward
+func (r *Request) BodyTemplate(tmpl string, data any, contentType string) *Request {
+	t, err := template.New("body").Parse(tmpl)
+	if err != nil {
+		r.resetBody()
+		r.bodyErr = err
+		return r
+	}
+
+	return r.bodyTemplate(t, data, contentType)
+}
+
+// BodyTemplateFS prepares the body by executing the [text/template] files matching the given patterns in the given file system
+// e.g.: an [embed.FS] with the given data and sets the Content-Type header to the given content type.
+// The first matching file is executed, the others can be used as associated templates, see [text/template.ParseFS]
+func (r *Request) BodyTemplateFS(fsys fs.FS, data any, contentType string, patterns ...string) *Request {
+	t, err := template.ParseFS(fsys, patterns...)
+	if err != nil {
+		r.resetBody()
+		r.bodyErr = err
+		return r
+	}
+
+	return r.bodyTemplate(t, data, contentType)
+}
+
+// bodyTemplate prepares the body by executing the given template with the given data
+func (r *Request) bodyTemplate(t *template.Template, data any, contentType string) *Request {
+	r.resetBody()
+
+	body := new(bytes.Buffer)
+	if err := t.Execute(body, data); err != nil {
+		r.bodyErr = err
+		return r
+	}
+
+	r.body = body
+	r.SetHeader(headerContentType, contentType)
+	return r
+}
+
+// BodyPipe prepares the body to be fed incrementally by writing to the returned [io.WriteCloser] while the request is in flight,
+// e.g.: to ship logs or to stream messages in both directions together with [Request.DoStream]. The request is sent with
+// chunked transfer encoding and it ends when the writer is closed. Writes block until the data is consumed by the transport,
+// so with [Request.Do] the writer must be used from another goroutine, while [Request.DoStream] returns as soon as the
+// response headers arrive and the writer can be used alongside the stream if the server responds before reading the body.
+// Since the body can be sent only once, the retries and redirects requiring the body fail with [ErrBodyNotReplayable]
+func (r *Request) BodyPipe() io.WriteCloser {
+	r.resetBody()
+
+	pr, pw := io.Pipe()
+	var used atomic.Bool
+	r.bodyStream = func() (io.ReadCloser, error) {
+		if used.Swap(true) {
+			return nil, ErrBodyNotReplayable
+		}
+		return pr, nil
+	}
+
+	return pw
+}
+
+// BodyMultipartForm prepares the body as a multipartform request with the given data and files.
+// Content-Type header is automatically set to "multipart/form-data" with the proper boundary.
+// Use [NewMultipartFormFile] or [NewMultipartFormFileReader] to pass files for file upload
+func (r *Request) BodyMultipartForm(data map[string]any, files ...multipartFormFile) *Request {
+	r.resetBody()
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	// handle data
+	for fieldName, value := range data {
+		err := w.WriteField(fieldName, fmt.Sprint(value))
+		if err != nil {
+			r.bodyErr = err
+			w.Close()
+			return r
+		}
+	}
+
+	// handle files
+	for _, file := range files {
+		err := file.write(w)
+		if err != nil {
+			r.bodyErr = err
+			w.Close()
+			return r
+		}
+	}
+
+	err := w.Close()
+	if err != nil {
+		r.bodyErr = err
+		return r
+	}
+
+	r.body = body
+	r.SetHeader(headerContentType, w.FormDataContentType())
+	return r
+}
+
+// BodyTarGz prepares the body as a gzip compressed tar archive of the given files and directories.
+// The archive is streamed while the request is sent instead of being built in memory, and it is built again for every attempt.
+// Directories are added recursively and every path is stored under its base name in the archive.
+// Content-Type header is automatically set to "application/gzip"
+func (r *Request) BodyTarGz(paths ...string) *Request {
+	r.resetBody()
+	r.SetHeader(headerContentType, ContentTypeGzip)
+
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			r.bodyErr = err
+			return r
+		}
+	}
+
+	paths = slices.Clone(paths)
+	r.bodyStream = func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeTarGz(pw, paths))
+		}()
+
+		return pr, nil
+	}
+
+	return r
+}
+
+// do performs the request with the given [context.Context].
+// If the request fails with a connection error and the client has a fallback base URL,
+// then the request is performed again against the fallback base URL
+func (r *Request) do(ctx context.Context) (*http.Response, *requestTrace, error) {
+	baseUrls := []string{r.baseUrl}
+	if r.baseUrl == r.client.baseUrl && r.url == "" {
+		if b := r.client.balancer; b != nil && len(b.baseUrls) > 0 {
+			baseUrls[0] = b.Current()
+		}
+
+		if r.client.fallbackBaseUrl != "" {
+			baseUrls = append(baseUrls, r.client.fallbackBaseUrl)
+		}
+	}
+
+	var (
+		resp  *http.Response
+		err   error
+		trace = &requestTrace{
+			start:     time.Now(),
+			requestId: r.requestId(),
+			events:    r.client.recoveredConnEvents(r.client.connEvents),
+		}
+	)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	entry := &inFlightEntry{
+		InFlightRequest: InFlightRequest{
+			Method:    strings.ToUpper(r.method),
+			Url:       r.requestUrl(r.baseUrl),
+			RequestId: trace.requestId,
+			Started:   trace.start,
+		},
+		cancel: cancel,
+	}
+	if !r.client.inFlight.add(entry) {
+		cancel(nil)
+		return nil, nil, newError(r.method, entry.Url, ErrClientShutdown)
+	}
+
+	budget := r.client.retryBudget
+	if budget != nil {
+		budget.deposit()
+	}
+
+	backoff := r.retryBackoff
+	for retry := 0; ; retry++ {
+		for i, baseUrl := range baseUrls {
+			trace.attempt++
+			resp, err = r.send(ctx, baseUrl, trace)
+			if err == nil || i == len(baseUrls)-1 || ctx.Err() != nil || !isConnectionError(err) {
+				break
+			}
+
+			if r.cancel != nil {
+				r.cancel()
+			}
+		}
+
+		if retry >= r.maxRetries || ctx.Err() != nil || !isRetryable(resp, err) {
+			break
+		}
+
+		if budget != nil && !budget.withdraw() {
+			break
+		}
+
+		delay := backoff
+		if resp != nil {
+			delay = retryAfter(resp.Header, backoff)
+			resp.Body.Close()
+		}
+
+		if limit := r.client.maxRetryDelay; limit > 0 {
+			delay = min(delay, limit)
+		}
+
+		if r.cancel != nil {
+			r.cancel()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.client.inFlight.done(entry)
+			return nil, trace, context.Cause(ctx)
+		case <-timer.C:
+		}
+
+		backoff *= 2
+	}
+
+	if err != nil {
+		r.client.inFlight.done(entry)
+		return resp, trace, err
+	}
+
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { r.client.inFlight.done(entry) }}
+	return resp, trace, nil
+}
+
+// isRetryable reports whether a request should be retried after the given response or error
+func isRetryable(resp *http.Response, err error) bool {
+	if resp != nil {
+		return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	}
+
+	if errors.Is(err, ErrHostNotAllowed) || errors.Is(err, ErrAddressBlocked) || errors.Is(err, ErrOffline) {
+		return false
+	}
+
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		return false
+	}
+
+	var e *Error
+	return errors.As(err, &e) && e.Class != ErrClassCanceled
+}
+
+// logMode reports whether logging and the debug mode are enabled for the request, taking the [LogLevel] of the client into account
+func (r *Request) logMode() (enabled, debug bool) {
+	switch r.client.LogLevel() {
+	case LogLevelOff:
+		return false, false
+	case LogLevelInfo:
+		return true, false
+	case LogLevelDebug:
+		return true, true
+	default:
+		return r.isLogEnabled, r.debug
+	}
+}
+
+// send performs a single attempt of the request against the given base URL
+func (r *Request) send(ctx context.Context, baseUrl string, trace *requestTrace) (*http.Response, error) {
+	var (
+		reqDump, resDump []byte
+		reqMsg, resMsg   *debugMessage
+		now              = time.Now()
+		statusCode       int
+		proxy            string
+		sent             bool
+		err              error
+
+		logEnabled, debug = r.logMode()
+	)
+
+	requestUrl := r.requestUrl(baseUrl)
+
+	defer func() {
+		duration := time.Since(now)
+		if sent {
+			r.client.latency.record(duration)
+			if r.client.onSlow != nil && duration > r.client.slowThreshold {
+				r.client.callHook(func() { r.client.onSlow(r.method, requestUrl, statusCode, duration) })
+			}
+		}
+
+		if (err == nil || sent) && logEnabled && r.client.shouldLog(r.method, requestUrl, statusCode, duration, err) {
+			if l := r.client.leveled; l != nil {
+				summary := createSummary(r.method, statusCode, requestUrl, duration, debug, proxy, trace.attempt, trace.requestId, err)
+				switch {
+				case err != nil:
+					l.Error(summary)
+				case !r.client.isSuccessStatus(statusCode):
+					l.Warn(summary)
+				default:
+					l.Info(summary)
+				}
+
+				if debug && r.debugFormat == DebugFormatJson {
+					l.Debug(createJsonLog(r.method, statusCode, requestUrl, duration, reqMsg, resMsg, proxy, trace, err))
+				} else if debug {
+					l.Debug(strings.TrimPrefix(debugLog(reqDump, resDump), "\n"))
+				}
+				return
+			}
+
+			if debug && r.debugFormat == DebugFormatJson {
+				r.client.logger.log("%s", createJsonLog(r.method, statusCode, requestUrl, duration, reqMsg, resMsg, proxy, trace, err))
+				return
+			}
+
+			r.client.logger.log("%s", createLog(r.method, statusCode, requestUrl, duration, reqDump, resDump, debug, proxy, trace.attempt, trace.requestId, err))
+		}
+	}()
+
+	if r.err != nil {
+		err = r.err
+		return nil, err
+	}
+
+	if err = validateUrl(requestUrl); err != nil {
+		return nil, err
+	}
+
+	getBody, err := r.requestBody()
+	if err != nil {
+		return nil, err
+	}
+
+	host := r.client.hostConfig(requestUrl)
+
+	req, err := r.createRequest(ctx, requestUrl, getBody, host, trace)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil && !sent && req.Body != nil {
+			req.Body.Close()
+		}
+	}()
+
+	offline := r.client.offline.Load()
+	if host != nil && !offline {
+		err = host.wait(req.Context())
+		if err != nil {
+			err = newError(r.method, requestUrl, trace.timeoutError(err))
+			return nil, err
+		}
+	}
+
+	if limiter := r.client.pathLimiter(req.URL.Path); limiter != nil && !offline {
+		err = limiter.wait(req.Context(), 1)
+		if err != nil {
+			err = newError(r.method, requestUrl, trace.timeoutError(err))
+			return nil, err
+		}
+	}
+
+	if ts := r.client.tokenSource; ts != nil && !offline && req.Header.Get(headerAuthorization) == "" {
+		var token string
+		token, err = ts.Token(req.Context())
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header = req.Header.Clone()
+		req.Header.Set(headerAuthorization, "Bearer "+token)
+	}
+
+	for _, hook := range r.httpRequestHooks {
+		if err = r.client.callHook(func() { hook(req) }); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = r.client.validate(req); err != nil {
+		return nil, err
+	}
+
+	var dump func(req *http.Request) *http.Request
+	if logEnabled && debug {
+		dump = func(req *http.Request) *http.Request {
+			if r.debugFormat == DebugFormatJson {
+				reqMsg, req = newDebugRequest(req, r.debugBody, r.debugBodyLimit)
+				return req
+			}
+
+			// the body is replaced by an in-memory copy when it is dumped
+			if r.debugBody {
+				req = req.Clone(req.Context())
+			}
+			reqDump, _ = httputil.DumpRequestOut(req, r.debugBody)
+			reqDump = formatDumpBody(reqDump, req.Header.Get(headerContentType), r.debugBodyLimit)
+			return req
+		}
+		proxy = r.client.proxyFor(req)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &countingBody{ReadCloser: req.Body, n: &r.client.stats.bytesSent}
+	}
+
+	limiter := r.client.concurrency
+	if limiter != nil {
+		if err = limiter.acquire(req.Context(), r.priority); err != nil {
+			err = newError(r.method, requestUrl, context.Cause(req.Context()))
+			return nil, err
+		}
+	}
+
+	sent = true
+	trace.startSend()
+	r.client.stats.requests.Add(1)
+	resp, err := r.client.doRequest(req, r.transport, dump)
+	if err != nil {
+		if limiter != nil {
+			limiter.release()
+		}
+
+		r.client.stats.errors.Add(1)
+		select {
+		case <-r.ctx.Done():
+			err = context.Cause(r.ctx)
+		default:
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+		}
+
+		err = newError(r.method, requestUrl, trace.timeoutError(err))
+		return nil, err
+	}
+
+	if limiter != nil {
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: limiter.release}
+	}
+
+	statusCode = resp.StatusCode
+	if statusCode >= 400 {
+		r.client.stats.errors.Add(1)
+	}
+
+	if r.client.bandwidth != nil {
+		resp.Body = newThrottledBody(req.Context(), resp.Body, r.client.bandwidth)
+	}
+
+	resp.Body = &countingBody{ReadCloser: resp.Body, n: &r.client.stats.bytesReceived}
+
+	if logEnabled && debug {
+		if r.debugFormat == DebugFormatJson {
+			resMsg = newDebugResponse(resp, r.debugBody, r.debugBodyLimit)
+		} else {
+			resDump, _ = httputil.DumpResponse(resp, r.debugBody)
+			resDump = formatDumpBody(resDump, resp.Header.Get(headerContentType), r.debugBodyLimit)
+		}
+	}
+
+	return resp, nil
+}
+
+// DoCtx performs the request with the given [context.Context] and returns a response
+func (r *Request) DoCtx(ctx context.Context) (*Response, error) {
+	resp, trace, err := r.do(ctx)
+	if r.cancel != nil {
+		defer r.cancel()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		select {
+		case <-r.ctx.Done():
+			err = context.Cause(r.ctx)
+		default:
+		}
+
+		return nil, newError(r.method, resp.Request.URL.String(), trace.timeoutError(err))
+	}
+
+	now := time.Now()
+	timings := trace.timings(now)
+	if logEnabled, _ := r.logMode(); r.profile && logEnabled {
+		if l := r.client.leveled; l != nil {
+			l.Info(createProfileLog(r.method, resp.StatusCode, resp.Request.URL.String(), timings))
+		} else {
+			r.client.logger.log("%s", createProfileLog(r.method, resp.StatusCode, resp.Request.URL.String(), timings))
+		}
+	}
+
+	return &Response{
+		responseHeader: newResponseHeader(resp, trace),
+		body:           responseBody,
+		schema:         r.client.schema(r.endpoint),
+		trailers:       resp.Trailer,
+		timings:        timings,
+		duration:       now.Sub(trace.start),
+		attempts:       trace.attempt,
+		isSuccess:      r.client.isSuccess,
+		jsonDecoder:    r.client.jsonDecoder(),
+		zeroCopy:       r.client.zeroCopy,
+		charsets:       r.client.charsets,
+		decoders:       r.client.decoders,
+		recoverPanics:  r.client.recoverPanics,
+	}, nil
+}
+
+// Clone returns a deep copy of the request, which can be modified and performed independently of the original.
+// A request can be performed multiple times sequentially, but it must be cloned to be performed concurrently
+// since the state of an execution e.g.: its [context.Context] is stored on the request
+func (r *Request) Clone() *Request {
+	c := *r
+	c.cancel = nil
+	c.ctx = nil
+	c.headers = cloneValues(r.headers)
+	c.queryParams = cloneValues(r.queryParams)
+	c.headersCopied = true
+	c.queryParamsCopied = true
+	c.setHeaders = maps.Clone(r.setHeaders)
+	c.setQueryParams = maps.Clone(r.setQueryParams)
+	c.pathParams = maps.Clone(r.pathParams)
+	c.trailers = cloneValues(r.trailers)
+	c.httpRequestHooks = slices.Clone(r.httpRequestHooks)
+	c.rawQueries = slices.Clone(r.rawQueries)
+
+	if r.body != nil {
+		c.body = bytes.NewBuffer(bytes.Clone(r.body.Bytes()))
+	}
+
+	return &c
+}
+
+// ExecuteN performs the request n times sequentially with the given [context.Context] and returns the responses.
+// It stops at the first failed request and returns the responses received so far with the error
+func (r *Request) ExecuteN(ctx context.Context, n int) ([]*Response, error) {
+	responses := make([]*Response, 0, n)
+	for range n {
+		resp, err := r.DoCtx(ctx)
+		if err != nil {
+			return responses, err
+		}
+
+		responses = append(responses, resp)
+	}
+
+	return responses, nil
+}
+
+// MeasureLatency performs the request n times sequentially with the given [context.Context] without retries
+// and returns the statistics of the latencies. Failed requests and responses with an error status code are counted
+// as errors and are excluded from the latencies. It stops early if the context is done. A negative n is treated as zero
+func (r *Request) MeasureLatency(ctx context.Context, n int) LatencyStats {
+	n = max(n, 0)
+	req := r.Clone().SetRetry(0, 0)
+
+	var (
+		stats     LatencyStats
+		latencies = make([]time.Duration, 0, n)
+		total     time.Duration
+	)
+	for range n {
+		if ctx.Err() != nil {
+			break
+		}
+
+		stats.Requests++
+		resp, err := req.DoCtx(ctx)
+		if err == nil {
+			err = resp.IsError()
+		}
+
+		if err != nil {
+			stats.Errors++
+			continue
+		}
+
+		latencies = append(latencies, resp.Duration())
+		total += resp.Duration()
+	}
+
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+	}
+
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		stats.Min = latencies[0]
+		stats.Max = latencies[len(latencies)-1]
+		stats.Avg = total / time.Duration(len(latencies))
+		stats.P95 = quantile(latencies, 0.95)
+	}
+
+	return stats
+}
+
+// Do performs the request using [context.Background]
+func (r *Request) Do() (*Response, error) {
+	return r.DoCtx(context.Background())
+}
+
+// DoAsyncCtx performs an async request with the given [context.Context].
+// It returns an [AsyncResponse] channel which will receive the response when the request completes
+func (r *Request) DoAsyncCtx(ctx context.Context) <-chan AsyncResponse {
+	asyncResp := make(chan AsyncResponse, 1)
+
+	go func() {
+		resp, err := r.DoCtx(ctx)
+		asyncResp <- AsyncResponse{
+			Response: resp,
+			Err:      err,
+		}
+		close(asyncResp)
+	}()
+
+	return asyncResp
+}
+
+// DoAsync performs an async request using [context.Background].
+// It returns an [AsyncResponse] channel which will receive the response when the request completes
+func (r *Request) DoAsync() <-chan AsyncResponse {
+	return r.DoAsyncCtx(context.Background())
+}
+
+// DoStream performs a request using the given [context.Context] and returns a streaming response
+func (r *Request) DoStream(ctx context.Context) (*ResponseStream, error) {
+	r.markHeader(headerAccept)
+	r.markHeader(headerCacheControl)
+	r.markHeader(headerConnection)
+	r.headers.Set(headerAccept, ContentTypeTextEventStream)
+	r.headers.Set(headerCacheControl, "no-cache")
+	r.headers.Set(headerConnection, "keep-alive")
+
+	return r.doStream(ctx)
+}
+
+// DoJsonDecode performs a request using the given [context.Context] and decodes the response body as a JSON array
+// element by element from the live body instead of reading it into memory. The handler is called with every element
+// and returning an error from it stops the decoding. If the response is considered as an error, then a [*ResponseError] is returned.
+// Decoding errors are [*Error] of class [ErrClassDecode]
+func (r *Request) DoJsonDecode(ctx context.Context, handler func(element json.RawMessage) error) error {
+	r.markHeader(headerAccept)
+	r.headers.Set(headerAccept, ContentTypeJson)
+
+	stream, err := r.doStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if !r.client.isSuccessStatus(stream.statusCode) {
+		body, _ := io.ReadAll(stream.reader)
+		return &ResponseError{
+			responseHeader: stream.responseHeader,
+			body:           body,
+			jsonDecoder:    r.client.jsonDecoder(),
+			decoders:       r.client.decoders,
+		}
+	}
+
+	dec := stream.NewJsonDecoder()
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		if err == nil {
+			err = fmt.Errorf("expected a JSON array, got %v", t)
+		}
+		return decodeError(err)
+	}
+
+	for dec.More() {
+		var element json.RawMessage
+		if err := dec.Decode(&element); err != nil {
+			return decodeError(err)
+		}
+
+		if err := handler(element); err != nil {
+			return err
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return decodeError(err)
+	}
+
+	return nil
+}
+
+// doStream performs a request using the given [context.Context] and returns a streaming response
+func (r *Request) doStream(ctx context.Context) (*ResponseStream, error) {
+	ctx, abort := context.WithCancelCause(ctx)
+
+	resp, trace, err := r.do(ctx)
+	if err != nil {
+		if r.cancel != nil {
+			r.cancel()
+		}
+		abort(nil)
+		return nil, err
+	}
+
+	body := &streamBody{
+		reader: resp.Body,
+		abort:  abort,
+	}
+
+	var decoding *decodingReader
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get(headerContentEncoding))); encoding {
+	case "gzip", "x-gzip", "deflate":
+		decoding = &decodingReader{body: resp.Body, encoding: encoding}
+		body.reader = decoding
+	}
+
+	deadline := &deadlineReader{reader: body}
+
+	return &ResponseStream{
+		responseHeader: newResponseHeader(resp, trace),
+		reader:         bufio.NewReader(deadline),
+		response:       resp,
+		cancel:         r.cancel,
+		body:           body,
+		decoding:       decoding,
+		deadline:       deadline,
+		jsonUseNumber:  r.client.jsonUseNumber,
+		jsonStrict:     r.client.jsonStrict,
+		recoverPanics:  r.client.recoverPanics,
+	}, nil
+}
+
+// requestUrl creates the request url using the given base URL
+func (r *Request) requestUrl(baseUrl string) string {
+	if r.url != "" {
+		return r.substitutePathParams(r.url)
+	}
+
+	path := r.substitutePathParams(r.path)
+
+	base, err := url.Parse(baseUrl)
+	if err != nil {
+		// leave the malformed URL to be reported by validation
+		return strings.TrimRight(baseUrl, "/") + "/" + strings.TrimLeft(path, "/")
+	}
+
+	ref, err := url.Parse(path)
+	if err != nil {
+		return strings.TrimRight(baseUrl, "/") + "/" + strings.TrimLeft(path, "/")
+	}
+
+	// an absolute path URL replaces the base URL entirely
+	if ref.IsAbs() {
+		return base.ResolveReference(ref).String()
+	}
+
+	u := base
+	if p := ref.EscapedPath(); p != "" {
+		u = base.JoinPath(p)
+	}
+
+	if ref.RawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += r.separator()
+		}
+		u.RawQuery += ref.RawQuery
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	return u.String()
+}
+
+// separator returns the separator of the query parameters
+func (r *Request) separator() string {
+	if r.querySeparator == "" {
+		return "&"
+	}
+
+	return r.querySeparator
+}
+
+// encodeQuery merges the query parameters into the raw query of the URL and encodes them.
+// Query parameters replace the values of the same keys in the raw query, but repeated values are kept.
+// The fragments added by calling [Request.AddRawQuery] are appended as is
+func (r *Request) encodeQuery(rawQuery string, queryParams url.Values) string {
+	sep := r.separator()
+
+	var parts []string
+	if r.preserveRawQuery {
+		parts = []string{rawQuery, encodeQuery(queryParams, sep)}
+	} else {
+		query := parseQuery(rawQuery, sep)
+		for k, vs := range queryParams {
+			query[k] = slices.Clone(vs)
+		}
+
+		parts = []string{encodeQuery(query, sep)}
+	}
+
+	parts = append(parts, r.rawQueries...)
+	parts = slices.DeleteFunc(parts, func(part string) bool {
+		return part == ""
+	})
+
+	return strings.Join(parts, sep)
+}
+
+// parseQuery parses the raw query using the given separator.
+// Unlike [url.ParseQuery], malformed pairs are kept as is instead of being dropped
+func parseQuery(rawQuery, sep string) url.Values {
+	query := make(url.Values)
+	for _, pair := range strings.Split(rawQuery, sep) {
+		if pair == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(pair, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+
+		query.Add(key, value)
+	}
+
+	return query
+}
+
+// encodeQuery encodes the query sorted by key using the given separator
+func encodeQuery(query url.Values, sep string) string {
+	if sep == "&" {
+		return query.Encode()
+	}
+
+	b := strings.Builder{}
+	for _, k := range slices.Sorted(maps.Keys(query)) {
+		key := url.QueryEscape(k)
+		for _, v := range query[k] {
+			if b.Len() > 0 {
+				b.WriteString(sep)
+			}
+			b.WriteString(key)
+			b.WriteString("=")
+			b.WriteString(url.QueryEscape(v))
+		}
+	}
+
+	return b.String()
+}
+
+// substitutePathParams substitutes the path parameters in the given path
+func (r *Request) substitutePathParams(path string) string {
+	for k, v := range r.pathParams {
+		path = strings.ReplaceAll(path, "{"+k+"}", url.PathEscape(v))
+	}
+
+	return path
+}
+
+// validateUrl returns an error wrapping [ErrInvalidUrl] if the given URL is malformed or it is not absolute
+func validateUrl(requestUrl string) error {
+	u, err := url.Parse(requestUrl)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+
+		return fmt.Errorf("%w %q: %v", ErrInvalidUrl, requestUrl, err)
+	}
+
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("%w %q: URL must be absolute e.g.: \"https://example.com/path\"", ErrInvalidUrl, requestUrl)
+	}
+
+	return nil
+}
+
+// requestBody returns a function creating a new reader of the request body or nil if the request has no body
+func (r *Request) requestBody() (func() (io.ReadCloser, error), error) {
+	if r.bodyErr != nil {
+		return nil, r.bodyErr
+	}
+
+	if r.bodyStream != nil {
+		return r.bodyStream, nil
+	}
+
+	if r.body == nil || r.body.Len() == 0 {
+		return nil, nil
+	}
+
+	// a new reader is created for every attempt, retry and redirect so that the whole body is sent each time
+	data := r.body.Bytes()
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, nil
+}
+
+// createRequest creates a [net/http.Request]. Settings of the given host are applied if it is not nil.
+// The given trace is attached to the request
+func (r *Request) createRequest(ctx context.Context, url string, getBody func() (io.ReadCloser, error), host *HostConfig, trace *requestTrace) (*http.Request, error) {
+	var (
+		req  *http.Request
+		err  error
+		rctx context.Context
+
+		headers     = r.headers
+		queryParams = r.queryParams
+		timeout     = r.timeout
+	)
+
+	if host != nil {
+		headers, queryParams, timeout = host.apply(r, headers, queryParams, timeout)
+	}
+
+	if timeout > 0 {
+		tctx, cancel := context.WithTimeoutCause(ctx, timeout, ErrRequestTimedOut)
+		r.cancel = cancel
+		rctx = tctx
+	} else {
+		r.cancel = nil
+		rctx = ctx
+	}
+
+	trace.setPhase("")
+	trace.setTimeouts(r.connectTimeout, r.tlsHandshakeTimeout, r.responseHeaderTimeout)
+	if r.connectTimeout > 0 || r.tlsHandshakeTimeout > 0 || r.responseHeaderTimeout > 0 {
+		pctx, abort := context.WithCancelCause(rctx)
+		cancel := r.cancel
+		r.cancel = func() {
+			abort(nil)
+			if cancel != nil {
+				cancel()
+			}
+		}
+		trace.abort = abort
+		rctx = pctx
+	}
+
+	r.ctx = rctx
+	req, err = http.NewRequestWithContext(httptrace.WithClientTrace(rctx, trace.clientTrace()), r.method, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if getBody != nil {
+		req.Body, err = getBody()
+		if err != nil {
+			return nil, err
+		}
+		req.GetBody = getBody
+		req.ContentLength = -1
+		if r.bodyStream == nil {
+			req.ContentLength = int64(r.body.Len())
+		}
+	}
+
+	req.Header = headers.Clone()
+	if ua := r.userAgentHeader(); ua != "" {
+		req.Header.Set(headerUserAgent, ua)
+	}
+
+	if trace.requestId != "" {
+		req.Header.Set(r.client.requestIdHeader, trace.requestId)
+	}
+
+	if len(r.trailers) > 0 {
+		req.Trailer = cloneValues(r.trailers)
+		req.ContentLength = -1
+	}
+
+	req.URL.RawQuery = r.encodeQuery(req.URL.RawQuery, queryParams)
+
+	if mode := r.client.methodOverride; mode != MethodOverrideNone {
+		switch method := req.Method; method {
+		case http.MethodGet, http.MethodHead, http.MethodPost:
+		default:
+			req.Method = http.MethodPost
+			if mode == MethodOverrideQuery {
+				param := methodOverrideQuery(method)
+				if req.URL.RawQuery == "" {
+					req.URL.RawQuery = param
+				} else {
+					req.URL.RawQuery += r.separator() + param
+				}
+			} else {
+				req.Header = req.Header.Clone()
+				req.Header.Set(headerMethodOverride, method)
+			}
+		}
+	}
+
+	if limiter := r.client.bandwidth; limiter != nil && req.Body != nil && req.Body != http.NoBody {
+		req.Body = newThrottledBody(rctx, req.Body, limiter)
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return newThrottledBody(rctx, body, limiter), nil
+			}
+		}
+	}
+
+	return req, nil
+}
+
+// methodOverrideQuery returns the encoded query parameter overriding the method of a request
+func methodOverrideQuery(method string) string {
+	return url.Values{queryMethodOverride: {method}}.Encode()
+}
+
+// resetBody resets the request body and bodyErr if subsequent SetBody* functions are called on the request
+func (r *Request) resetBody() {
+	r.body = nil
+	r.bodyErr = nil
+	r.bodyStream = nil
+}
+
+// ---------------------------------------------- //
+// Latency recorder                               //
+// ---------------------------------------------- //
+
+// record records a latency, replacing the oldest one if the window is full
+func (l *latencyRecorder) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < DefaultLatencyWindow {
+		l.samples = append(l.samples, d)
+		return
+	}
+
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % len(l.samples)
+}
+
+// quantile returns the given quantile of the recorded latencies using the nearest-rank method
+func (l *latencyRecorder) quantile(q float64) time.Duration {
+	l.mu.Lock()
+	samples := slices.Clone(l.samples)
+	l.mu.Unlock()
+
+	slices.Sort(samples)
+	return quantile(samples, q)
+}
+
+// quantile returns the given quantile of the given sorted latencies using the nearest-rank method, or 0 if there are none
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(min(max(q, 0), 1)*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+// ---------------------------------------------- //
+// ConnectionPool                                 //
+// ---------------------------------------------- //
+
+// NewConnectionPool creates a new [ConnectionPool] with the settings of [net/http.DefaultTransport]
+func NewConnectionPool() *ConnectionPool {
+	p := &ConnectionPool{
+		transport: http.DefaultTransport.(*http.Transport).Clone(),
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+
+	p.transport.DialContext = p.dialContext
+	return p
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections across all hosts, zero means no limit
+func (p *ConnectionPool) SetMaxIdleConns(n int) *ConnectionPool {
+	p.transport.MaxIdleConns = n
+	return p
+}
+
+// SetMaxIdleConnsPerHost sets the maximum number of idle connections per host,
+// zero means [net/http.DefaultMaxIdleConnsPerHost]
+func (p *ConnectionPool) SetMaxIdleConnsPerHost(n int) *ConnectionPool {
+	p.transport.MaxIdleConnsPerHost = n
+	return p
+}
+
+// SetMaxConnsPerHost sets the maximum number of connections per host including the ones in use, zero means no limit
+func (p *ConnectionPool) SetMaxConnsPerHost(n int) *ConnectionPool {
+	p.transport.MaxConnsPerHost = n
+	return p
+}
+
+// SetIdleConnTimeout sets the duration after which an idle connection is closed, zero means no limit
+func (p *ConnectionPool) SetIdleConnTimeout(timeout time.Duration) *ConnectionPool {
+	p.transport.IdleConnTimeout = timeout
+	return p
+}
+
+// SetTLSClientConfig sets the TLS configuration of the connections
+func (p *ConnectionPool) SetTLSClientConfig(config *tls.Config) *ConnectionPool {
+	p.transport.TLSClientConfig = config
+	return p
+}
+
+// CloseIdleConnections closes the idle connections of the pool
+func (p *ConnectionPool) CloseIdleConnections() {
+	p.transport.CloseIdleConnections()
+}
+
+// Stats returns the statistics of the pool
+func (p *ConnectionPool) Stats() PoolStats {
+	opened, closed := p.opened.Load(), p.closed.Load()
+	return PoolStats{
+		Requests:    p.requests.Load(),
+		Reused:      p.reused.Load(),
+		OpenedConns: opened,
+		ClosedConns: closed,
+		OpenConns:   opened - closed,
+	}
+}
+
+// RoundTrip implements the [net/http.RoundTripper] interface
+func (p *ConnectionPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	p.requests.Add(1)
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				p.reused.Add(1)
+			}
+		},
+	})
+
+	return p.transport.RoundTrip(req.WithContext(ctx))
+}
+
+// dialContext dials a connection counted by the pool
+func (p *ConnectionPool) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.opened.Add(1)
+	return &eventConn{
+		Conn:    conn,
+		onClose: func(network, addr string) { p.closed.Add(1) },
+	}, nil
+}
+
+// ---------------------------------------------- //
+// RetryBudget                                    //
+// ---------------------------------------------- //
+
+// NewRetryBudget creates a new [RetryBudget] which allows the given fraction of the requests to be retries e.g.: 0.2.
+// The balance of the budget starts from and is capped at burst, which allows retries when the traffic is low
+func NewRetryBudget(ratio float64, burst int) *RetryBudget {
+	return &RetryBudget{
+		ratio: ratio,
+		burst: float64(burst),
+		state: RetryBudgetState{
+			Balance: float64(burst),
+		},
+	}
+}
+
+// SetMetricHook sets the hook which is called with the state of the budget after every decision about a retry
+// and whether the retry was allowed, e.g.: to export the state as metrics
+func (b *RetryBudget) SetMetricHook(hook func(state RetryBudgetState, allowed bool)) *RetryBudget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.hook = hook
+	return b
+}
+
+// State returns the current state of the budget
+func (b *RetryBudget) State() RetryBudgetState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// deposit deposits the ratio into the budget for a request
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state.Requests++
+	b.state.Balance = min(b.state.Balance+b.ratio, b.burst)
+}
+
+// withdraw withdraws 1 from the budget for a retry and reports whether the retry is allowed
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	allowed := b.state.Balance >= 1
+	if allowed {
+		b.state.Balance--
+		b.state.Retries++
+	} else {
+		b.state.Denied++
+	}
+	state, hook := b.state, b.hook
+	b.mu.Unlock()
+
+	if hook != nil {
+		hook(state, allowed)
+	}
+
+	return allowed
+}
+
+// ---------------------------------------------- //
+// ResponseCache                                  //
+// ---------------------------------------------- //
+
+// NewResponseCache creates a new [ResponseCache]. Responses are fresh for the duration given by their Cache-Control max-age
+// directive or Expires header, or for the given time to live otherwise. Zero time to live stores only the responses with
+// explicit freshness. Only 200 OK responses are stored and the no-store and no-cache directives are respected.
+// The responses are stored per user, the Authorization and Cookie headers are always included in the variants as SHA-256 hashes
+func NewResponseCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		ttl:           ttl,
+		maxEntries:    DefaultCacheMaxEntries,
+		hashedHeaders: slices.Clone(credentialHeaders),
+		entries:       make(map[string][]*cacheEntry),
+	}
+}
+
+// SetMaxEntries sets the maximum number of stored responses, the oldest response is removed when it is exceeded
+func (c *ResponseCache) SetMaxEntries(n int) *ResponseCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxEntries = max(n, 1)
+	c.evict()
+	return c
+}
+
+// SetVaryHeaders sets the request headers which are included in the variants of every response in addition to
+// the headers listed in its Vary header e.g.: a tenant header. It should be called before storing any response
+func (c *ResponseCache) SetVaryHeaders(keys ...string) *ResponseCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.varyHeaders = canonicalKeys(keys)
+	return c
+}
+
+// SetHashedVaryHeaders sets the request headers which are included in the variants of every response as SHA-256 hashes
+// in addition to the Authorization and Cookie headers, so that e.g.: the responses are stored per API key without keeping
+// the keys. It should be called before storing any response
+func (c *ResponseCache) SetHashedVaryHeaders(keys ...string) *ResponseCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hashedHeaders = slices.Concat(credentialHeaders, canonicalKeys(keys))
+	return c
+}
+
+// Len returns the number of stored responses
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.count
+}
+
+// Clear removes every stored response
+func (c *ResponseCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string][]*cacheEntry)
+	c.count = 0
+}
+
+// roundTrip serves the request from the cache if there is a fresh response to it, otherwise it sends the request
+// with the given function and stores the response once its body is read if it can be stored
+func (c *ResponseCache) roundTrip(req *http.Request, next func(req *http.Request) (*http.Response, error)) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return next(req)
+	}
+
+	directives := cacheControl(req.Header)
+	_, noStore := directives["no-store"]
+	_, noCache := directives["no-cache"]
+
+	if !noStore && !noCache {
+		if e := c.lookup(req, time.Now()); e != nil {
+			return e.response(req), nil
+		}
+	}
+
+	resp, err := next(req)
+	if err != nil || noStore {
+		return resp, err
+	}
+
+	received := time.Now()
+	expires, vary, ok := c.storable(resp, received)
+	if !ok {
+		return resp, nil
+	}
+
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		store: func(body []byte) {
+			c.store(req, resp, vary, body, received, expires)
+		},
+	}
+
+	return resp, nil
+}
+
+// lookup returns the variant of the response to the request which is fresh at the given time, or nil if there is none.
+// Stale responses are returned as well if the time is zero
+func (c *ResponseCache) lookup(req *http.Request, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.entries[req.Method+" "+req.URL.String()] {
+		if !now.IsZero() && !now.Before(e.expires) {
+			continue
+		}
+
+		if c.matches(e, req) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// storable returns the expiry of the response and the request headers it varies on, and reports whether it can be stored
+func (c *ResponseCache) storable(resp *http.Response, now time.Time) (time.Time, []string, bool) {
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, nil, false
+	}
+
+	directives := cacheControl(resp.Header)
+	if _, ok := directives["no-store"]; ok {
+		return time.Time{}, nil, false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return time.Time{}, nil, false
+	}
+
+	var vary []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key == "*" {
+				return time.Time{}, nil, false
+			} else if key != "" {
+				vary = append(vary, textproto.CanonicalMIMEHeaderKey(key))
+			}
+		}
+	}
+
+	c.mu.Lock()
+	ttl := c.ttl
+	c.mu.Unlock()
+
+	expires := now.Add(ttl)
+	if maxAge, err := strconv.Atoi(directives["max-age"]); err == nil {
+		expires = now.Add(time.Duration(maxAge) * time.Second)
+	} else if t, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(resp.Header.Get(headerDate))
+		if err != nil {
+			date = now
+		}
+		expires = now.Add(t.Sub(date))
+	}
+
+	return expires, vary, expires.After(now)
+}
+
+// store stores the response to the request with the given body
+func (c *ResponseCache) store(req *http.Request, resp *http.Response, vary []string, body []byte, stored, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &cacheEntry{
+		key:        req.Method + " " + req.URL.String(),
+		vary:       make(map[string]string),
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		headers:    resp.Header.Clone(),
+		body:       body,
+		stored:     stored,
+		expires:    expires,
+	}
+
+	for _, key := range slices.Concat(vary, c.varyHeaders, c.hashedHeaders) {
+		e.vary[key] = c.headerValue(req, key)
+	}
+
+	variants := slices.DeleteFunc(c.entries[e.key], func(v *cacheEntry) bool {
+		return maps.Equal(v.vary, e.vary)
+	})
+	c.count -= len(c.entries[e.key]) - len(variants)
+	c.entries[e.key] = append(variants, e)
+	c.count++
+
+	c.evict()
+}
+
+// evict removes the oldest responses while there are more than the maximum
+func (c *ResponseCache) evict() {
+	for c.count > c.maxEntries {
+		var oldest *cacheEntry
+		for _, variants := range c.entries {
+			for _, e := range variants {
+				if oldest == nil || e.stored.Before(oldest.stored) {
+					oldest = e
+				}
+			}
+		}
+
+		variants := slices.DeleteFunc(c.entries[oldest.key], func(e *cacheEntry) bool {
+			return e == oldest
+		})
+		if len(variants) == 0 {
+			delete(c.entries, oldest.key)
+		} else {
+			c.entries[oldest.key] = variants
+		}
+		c.count--
+	}
+}
+
+// matches reports whether the request has the header values the response was stored for
+func (c *ResponseCache) matches(e *cacheEntry, req *http.Request) bool {
+	for key, value := range e.vary {
+		if c.headerValue(req, key) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// headerValue returns the values of the request header joined, hashed if the header is configured to be hashed
+func (c *ResponseCache) headerValue(req *http.Request, key string) string {
+	value := strings.Join(req.Header.Values(key), ", ")
+	if slices.Contains(c.hashedHeaders, key) {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	}
+
+	return value
+}
+
+// response creates a response to the request from the stored response with the Age header set
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	headers := e.headers.Clone()
+	headers.Set(headerAge, strconv.FormatInt(int64(time.Since(e.stored)/time.Second), 10))
+
+	return &http.Response{
+		Status:        e.status,
+		StatusCode:    e.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        headers,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// Read implements the [io.Reader] interface
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.store == nil {
+		return n, err
+	}
+
+	b.buf.Write(p[:n])
+	switch {
+	case b.buf.Len() > cacheMaxBodySize:
+		b.store = nil
+		b.buf = bytes.Buffer{}
+	case err == io.EOF:
+		b.store(bytes.Clone(b.buf.Bytes()))
+		b.store = nil
+	}
+
+	return n, err
+}
+
+// cacheControl returns the directives of the Cache-Control headers by their lowercase names
+func cacheControl(headers http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range headers.Values(headerCacheControl) {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+
+	return directives
+}
+
+// canonicalKeys returns the canonical format of the given header keys
+func canonicalKeys(keys []string) []string {
+	canonical := make([]string, len(keys))
+	for i, key := range keys {
+		canonical[i] = textproto.CanonicalMIMEHeaderKey(key)
+	}
+
+	return canonical
+}
+
+// ---------------------------------------------- //
+// Middleware                                     //
+// ---------------------------------------------- //
+
+// RoundTrip implements the [net/http.RoundTripper] interface
+func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// SigningMiddleware returns a [Middleware] that adds the X-Timestamp header with the current Unix time in seconds
+// and the X-Nonce header with a random nonce to every request. If the secret is not empty, then the X-Signature header
+// is added as well, which is the hex encoded HMAC-SHA256 of the timestamp, the nonce, the method, the path with the query
+// and the body of the request, each separated by a newline. The clock skew of the server up to [DefaultMaxClockSkew]
+// is corrected, see [SigningMiddlewareWithMaxSkew]
+func SigningMiddleware(secret []byte) Middleware {
+	return SigningMiddlewareWithMaxSkew(secret, DefaultMaxClockSkew)
+}
+
+// SigningMiddlewareWithMaxSkew returns a [SigningMiddleware] correcting the clock skew of the server up to the given maximum.
+// The skew is estimated from the Date headers of the responses and the timestamps of the following requests are adjusted
+// by it, so that they are not refused by servers rejecting requests with skewed timestamps. Skews below a second are
+// ignored due to the precision of the Date header and skews above the maximum are considered invalid. Zero disables the correction
+func SigningMiddlewareWithMaxSkew(secret []byte, maxSkew time.Duration) Middleware {
+	skew := &clockSkew{maxSkew: maxSkew}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			nonce := make([]byte, 16)
+			if _, err := cryptorand.Read(nonce); err != nil {
+				return nil, err
+			}
+
+			sent := time.Now()
+			timestamp := strconv.FormatInt(skew.now(sent).Unix(), 10)
+			nonceHex := hex.EncodeToString(nonce)
+			req = req.Clone(req.Context())
+			req.Header.Set(headerTimestamp, timestamp)
+			req.Header.Set(headerNonce, nonceHex)
+
+			if len(secret) > 0 {
+				body, peeked, err := peekBody(req)
+				if err != nil {
+					return nil, err
+				}
+				req = peeked
+
+				mac := hmac.New(sha256.New, secret)
+				mac.Write([]byte(strings.Join([]string{timestamp, nonceHex, req.Method, req.URL.RequestURI(), ""}, "\n")))
+				mac.Write(body)
+
+				req.Header.Set(headerSignature, hex.EncodeToString(mac.Sum(nil)))
+			}
+
+			resp, err := next.RoundTrip(req)
+			if err == nil {
+				skew.observe(resp.Header.Get(headerDate), sent, time.Now())
+			}
+
+			return resp, err
+		})
+	}
+}
+
+// now returns the given local time adjusted by the estimated offset of the server clock
+func (s *clockSkew) now(t time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return t.Add(s.offset)
+}
+
+// observe updates the estimated offset from the Date header of a response to a request sent and received at the given times
+func (s *clockSkew) observe(date string, sent, received time.Time) {
+	if s.maxSkew <= 0 {
+		return
+	}
+
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+
+	// the Date header is truncated to seconds and the server generated it between sending and receiving
+	offset := serverTime.Add(time.Second / 2).Sub(sent.Add(received.Sub(sent) / 2))
+	if offset.Abs() > s.maxSkew {
+		return
+	}
+
+	if offset.Abs() < time.Second {
+		offset = 0
+	}
+
+	s.mu.Lock()
+	s.offset = offset
+	s.mu.Unlock()
+}
+
+// CSRFMiddleware returns a [Middleware] that adds a CSRF token to the mutating requests i.e.: the requests with methods
+// other than GET, HEAD, OPTIONS and TRACE sent to the sites configured by their hostnames e.g.: "example.com".
+// The token of a site is fetched from its token URL with the cookies and the authorization of the request when it is first
+// needed and cached. If a request with a cached token is rejected with 403 Forbidden or 419 status code, then the token
+// is fetched again and the request is retried once if its body can be replayed. Requests to other hosts are sent unchanged
+func CSRFMiddleware(sites map[string]CSRFConfig) Middleware {
+	states := make(map[string]*csrfSite, len(sites))
+	for host, config := range sites {
+		if config.Header == "" && config.FormField == "" {
+			config.Header = DefaultCSRFHeader
+		}
+		states[strings.ToLower(host)] = &csrfSite{config: config}
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			site := states[strings.ToLower(req.URL.Hostname())]
+			if site == nil || !isMutatingMethod(req.Method) {
+				return next.RoundTrip(req)
+			}
+
+			token, cached, err := site.get(next, req, "")
+			if err != nil {
+				return nil, err
+			}
+
+			resp, err := site.send(next, req, token)
+			if err != nil || !cached || (resp.StatusCode != http.StatusForbidden && resp.StatusCode != statusCSRFExpired) {
+				return resp, err
+			}
+
+			if req.Body != nil && req.Body != http.NoBody {
+				if req.GetBody == nil {
+					return resp, nil
+				}
+
+				body, err := req.GetBody()
+				if err != nil {
+					return resp, nil
+				}
+				req = req.Clone(req.Context())
+				req.Body = body
+			}
+
+			resp.Body.Close()
+
+			if token, _, err = site.get(next, req, token); err != nil {
+				return nil, err
+			}
+
+			return site.send(next, req, token)
+		})
+	}
+}
+
+// isMutatingMethod reports whether the method may change the state of the server, which requires a CSRF token
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	default:
+		return true
+	}
+}
+
+// get returns the token of the site and whether it was cached. The token is fetched if there is none
+// or it is the given rejected token
+func (s *csrfSite) get(next http.RoundTripper, req *http.Request, rejected string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && s.token != rejected {
+		return s.token, rejected == "", nil
+	}
+
+	tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, resolveUrl(req.URL.String(), s.config.TokenUrl), nil)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, key := range credentialHeaders {
+		if values := req.Header.Values(key); len(values) > 0 {
+			tokenReq.Header[key] = slices.Clone(values)
+		}
+	}
+
+	resp, err := next.RoundTrip(tokenReq)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+
+	token, err := s.config.Extract(&Response{
+		responseHeader: responseHeader{
+			status:     resp.Status,
+			statusCode: resp.StatusCode,
+			headers:    resp.Header,
+			tls:        newTLSInfo(resp.TLS),
+		},
+		body: body,
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	s.token = token
+	return token, false, nil
+}
+
+// send sends a copy of the request with the given token in the configured header and form field
+func (s *csrfSite) send(next http.RoundTripper, req *http.Request, token string) (*http.Response, error) {
+	r := req.Clone(req.Context())
+
+	if s.config.Header != "" {
+		r.Header.Set(s.config.Header, token)
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get(headerContentType)); s.config.FormField != "" && mediaType == "application/x-www-form-urlencoded" {
+		body, _, err := peekBody(r)
+		if err != nil {
+			return nil, err
+		}
+
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		form.Set(s.config.FormField, token)
+
+		encoded := []byte(form.Encode())
+		r.Body = io.NopCloser(bytes.NewReader(encoded))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(encoded)), nil
+		}
+		r.ContentLength = int64(len(encoded))
+	}
+
+	return next.RoundTrip(r)
+}
+
+// CSRFFromCookie returns a [CSRFExtractor] extracting the CSRF token from the cookie with the given name set by the response
+func CSRFFromCookie(name string) CSRFExtractor {
+	return func(resp *Response) (string, error) {
+		for _, cookie := range (&http.Response{Header: resp.headers}).Cookies() {
+			if cookie.Name == name && cookie.Value != "" {
+				return cookie.Value, nil
+			}
+		}
+
+		return "", fmt.Errorf("%w: no cookie %q", ErrCSRFTokenNotFound, name)
+	}
+}
+
+// ContextHeaderMiddleware returns a [Middleware] that sets headers of the requests from the values of their [context.Context]
+// e.g.: the tenant ID, the user ID or the locale of multi-tenant backends. The mapping maps the header names to the context keys
+// and the values are formatted with [fmt.Sprint]. Missing values and headers already set on the request are skipped
+func ContextHeaderMiddleware(mapping map[string]any) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			for header, key := range mapping {
+				if req.Header.Get(header) != "" {
+					continue
+				}
+
+				if value := req.Context().Value(key); value != nil {
+					req.Header.Set(header, fmt.Sprint(value))
+				}
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// peekBody returns the body of the request and the request to be sent instead of it. If the body cannot be read
+// without consuming it, then the returned request is a copy of the given one with an in-memory copy of the body
+func peekBody(req *http.Request) ([]byte, *http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, req, nil
+	}
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, req, err
+		}
+		defer body.Close()
+
+		b, err := io.ReadAll(body)
+		return b, req, err
+	}
+
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, req, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	return b, req, nil
+}
+
+// ---------------------------------------------- //
+// CountingBody                                   //
+// ---------------------------------------------- //
+
+// Read implements the [io.Reader] interface
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// ---------------------------------------------- //
+// ThrottledBody                                  //
+// ---------------------------------------------- //
+
+// newThrottledBody creates a new body whose reading is limited by the given rate limiter
+func newThrottledBody(ctx context.Context, body io.ReadCloser, limiter *rateLimiter) *throttledBody {
+	return &throttledBody{
+		ReadCloser: body,
+		ctx:        ctx,
+		limiter:    limiter,
+	}
+}
+
+// Read implements the [io.Reader] interface
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if burst := int(b.limiter.burst); len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.limiter.wait(b.ctx, float64(n)); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+// ---------------------------------------------- //
+// ResponseHeader                                 //
+// ---------------------------------------------- //
+
+// newResponseHeader creates the response header info of the given [net/http.Response]
+func newResponseHeader(resp *http.Response, trace *requestTrace) responseHeader {
+	var requestUrl string
+	if resp.Request != nil {
+		requestUrl = resp.Request.URL.String()
+	}
+
+	return responseHeader{
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		headers:    resp.Header,
+		connInfo:   trace.connInfo,
+		requestId:  trace.requestId,
+		tls:        newTLSInfo(resp.TLS),
+		receivedAt: trace.receivedAt(),
+		url:        requestUrl,
+	}
+}
+
+// newTLSInfo creates a new [TLSInfo] from the given connection state, or returns nil if it is nil
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+
+	return &TLSInfo{
+		Version:            state.Version,
+		CipherSuite:        state.CipherSuite,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		ServerName:         state.ServerName,
+		PeerCertificates:   state.PeerCertificates,
+		OCSPStapled:        len(state.OCSPResponse) > 0,
+		OCSPResponse:       state.OCSPResponse,
+	}
+}
+
+// TLS returns information about the TLS connection the response was received on, e.g.: the negotiated TLS version
+// and cipher suite. It returns nil if the response was not received over TLS
+func (r *responseHeader) TLS() *TLSInfo {
+	return r.tls
+}
+
+// VersionName returns the name of the TLS version e.g.: "TLS 1.3"
+func (i *TLSInfo) VersionName() string {
+	return tls.VersionName(i.Version)
+}
+
+// CipherSuiteName returns the name of the cipher suite e.g.: "TLS_AES_128_GCM_SHA256"
+func (i *TLSInfo) CipherSuiteName() string {
+	return tls.CipherSuiteName(i.CipherSuite)
+}
+
+// RequestId returns the ID sent with the request, or an empty string if request IDs are not enabled
+// by calling [Client.SetRequestId]
+func (r *responseHeader) RequestId() string {
+	return r.requestId
+}
+
+// Status returns the status of a response
+func (r *responseHeader) Status() string {
+	return r.status
+}
+
+// StatusCode returns the status code of a response
+func (r *responseHeader) StatusCode() int {
+	return r.statusCode
+}
+
+// Headers returns the response headers
+func (r *responseHeader) Headers() http.Header {
+	return r.headers
+}
+
+// GetHeader is a convenience method to retrieve a single response header value
+func (r *responseHeader) GetHeader(key string) string {
+	return r.headers.Get(key)
+}
+
+// ConnInfo returns information about the connection used to perform the request
+// e.g.: whether the connection was reused
+func (r *responseHeader) ConnInfo() ConnInfo {
+	return r.connInfo
+}
+
+// ETag returns the value of the ETag response header
+func (r *responseHeader) ETag() string {
+	return r.headers.Get(headerETag)
+}
+
+// LastModified returns the time of the Last-Modified response header.
+// It returns the zero time if the header is missing or invalid
+func (r *responseHeader) LastModified() time.Time {
+	t, err := http.ParseTime(r.headers.Get(headerLastModified))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+// ReceivedAt returns the time the response was received
+func (r *responseHeader) ReceivedAt() time.Time {
+	return r.receivedAt
+}
+
+// Date returns the time the response was generated by the server based on the Date header,
+// or the zero time if the header is missing or invalid
+func (r *responseHeader) Date() time.Time {
+	t, err := http.ParseTime(r.headers.Get(headerDate))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+// Age returns the time the response spent in caches based on the Age header,
+// or 0 if the header is missing or invalid
+func (r *responseHeader) Age() time.Duration {
+	age, err := strconv.ParseInt(strings.TrimSpace(r.headers.Get(headerAge)), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+
+	// values above 2^31 are capped as recommended by RFC 9111
+	return time.Duration(min(age, 1<<31)) * time.Second
+}
+
+// ContentLength returns the length of the body given in the Content-Length header, or -1 if the header is missing or invalid
+func (r *responseHeader) ContentLength() int64 {
+	length, err := strconv.ParseInt(strings.TrimSpace(r.headers.Get(headerContentLength)), 10, 64)
+	if err != nil || length < 0 {
+		return -1
+	}
+
+	return length
+}
+
+// ContentType returns the lowercase media type and the parameters of the Content-Type header
+// e.g.: "text/html" and {"charset": "utf-8"}. It returns an empty media type if the header is missing or invalid
+func (r *responseHeader) ContentType() (string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(r.headers.Get(headerContentType))
+	if err != nil {
+		return "", nil
+	}
+
+	return mediaType, params
+}
+
+// Location returns the URL of the Location header resolved against the URL of the request,
+// or an empty string if the header is missing
+func (r *responseHeader) Location() string {
+	location := r.headers.Get(headerLocation)
+	if location == "" || r.url == "" {
+		return location
+	}
+
+	return resolveUrl(r.url, location)
+}
+
+// RetryAfter returns the delay requested by the Retry-After header given either in seconds or as an HTTP date,
+// which is converted relative to the current time. It returns 0 if the header is missing, invalid or the date passed
+func (r *responseHeader) RetryAfter() time.Duration {
+	return retryAfter(r.headers, 0)
+}
+
+// ContentDisposition returns the lowercase disposition type e.g.: "attachment" and the filename of the Content-Disposition header.
+// The extended filename* parameter is preferred and decoded. It returns empty strings if the header is missing or invalid.
+// The filename is returned as sent, it must be sanitized before using it as a path
+func (r *responseHeader) ContentDisposition() (disposition, filename string) {
+	disposition, params, err := mime.ParseMediaType(r.headers.Get(headerContentDisposition))
+	if err != nil {
+		return "", ""
+	}
+
+	return disposition, params["filename"]
+}
+
+// ContentLanguage returns the language tags of the Content-Language header e.g.: ["en-US"], or nil if the header is missing
+func (r *responseHeader) ContentLanguage() []string {
+	var tags []string
+	for _, value := range r.headers.Values(headerContentLanguage) {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return tags
+}
+
+// ---------------------------------------------- //
+// Error                                          //
+// ---------------------------------------------- //
+
+// newError creates a new [*Error] of the given request, classifying the given error
+func newError(method, url string, err error) *Error {
+	return &Error{
+		Class:  ClassifyError(err),
+		Method: strings.ToUpper(method),
+		Url:    url,
+		Err:    err,
+	}
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.Method == "" && e.Url == "" {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%v \"%v\": %v", e.Method, e.Url, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// String implements the [fmt.Stringer] interface
+func (c ErrClass) String() string {
+	switch c {
+	case ErrClassNetwork:
+		return "network"
+	case ErrClassDNS:
+		return "dns"
+	case ErrClassTLS:
+		return "tls"
+	case ErrClassTimeout:
+		return "timeout"
+	case ErrClassCanceled:
+		return "canceled"
+	case ErrClassHTTPStatus:
+		return "http status"
+	case ErrClassDecode:
+		return "decode"
+	default:
+		return "unknown"
+	}
+}
+
+// ClassifyError returns the class of the given error
+func ClassifyError(err error) ErrClass {
+	var (
+		e          *Error
+		respErr    *ResponseError
+		schemaErr  *SchemaError
+		timeoutErr *TimeoutError
+		dnsErr     *net.DNSError
+		netErr     net.Error
+		opErr      *net.OpError
+		recordErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		certErr    *tls.CertificateVerificationError
+		authErr    x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+	)
+
+	switch {
+	case err == nil:
+		return ErrClassUnknown
+	case errors.As(err, &e) && e.Class != ErrClassUnknown:
+		return e.Class
+	case errors.As(err, &respErr):
+		return ErrClassHTTPStatus
+	case errors.As(err, &schemaErr):
+		return ErrClassDecode
+	case errors.As(err, &timeoutErr), errors.Is(err, context.DeadlineExceeded):
+		return ErrClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrClassCanceled
+	case errors.As(err, &dnsErr):
+		return ErrClassDNS
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &certErr),
+		errors.As(err, &authErr), errors.As(err, &hostErr), errors.As(err, &invalidErr):
+		return ErrClassTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrClassTimeout
+	case errors.As(err, &opErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return ErrClassNetwork
+	}
+
+	return ErrClassUnknown
+}
+
+// IsTimeout reports whether the error signals that the request timed out
+func IsTimeout(err error) bool {
+	return ClassifyError(err) == ErrClassTimeout
+}
+
+// IsTemporary reports whether the error is likely temporary and the request may succeed if it is performed again
+// e.g.: timeouts, network errors or responses with status codes 408, 429, 502, 503 and 504
+func IsTemporary(err error) bool {
+	switch ClassifyError(err) {
+	case ErrClassTimeout, ErrClassNetwork:
+		return true
+	case ErrClassDNS:
+		var dnsErr *net.DNSError
+		return errors.As(err, &dnsErr) && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+	case ErrClassHTTPStatus:
+		return IsStatus(err, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout)
+	}
+
+	return false
+}
+
+// IsStatus reports whether the error is a [*ResponseError] with one of the given status codes
+func IsStatus(err error, statusCodes ...int) bool {
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+
+	return slices.Contains(statusCodes, respErr.statusCode)
+}
+
+// ---------------------------------------------- //
+// TimeoutError                                   //
+// ---------------------------------------------- //
+
+// Error implements the error interface
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v (phase: %s, attempt: %d, elapsed: %v)", e.Err, e.Phase, e.Attempt, e.Elapsed)
+}
+
+// Unwrap returns the cause of the timeout
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// ---------------------------------------------- //
+// PanicError                                     //
+// ---------------------------------------------- //
+
+// Error implements the error interface
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the value passed to panic if it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// recoverPanic stores the recovered panic as a [*PanicError] in err if enabled, it must be deferred directly
+func recoverPanic(enabled bool, err *error) {
+	if !enabled {
+		return
+	}
+
+	if v := recover(); v != nil {
+		*err = &PanicError{
+			Value: v,
+			Stack: runtimedebug.Stack(),
+		}
+	}
+}
+
+// ---------------------------------------------- //
+// RequestTrace                                   //
+// ---------------------------------------------- //
+
+// clientTrace creates the [net/http/httptrace.ClientTrace] that collects the information of the request
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			t.setPhase("dial")
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.setPhase("dns")
+			t.mark(&t.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mark(&t.dnsDone)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.setPhase("write")
+			t.connInfo = ConnInfo{
+				Reused:   info.Reused,
+				WasIdle:  info.WasIdle,
+				IdleTime: info.IdleTime,
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			t.setPhase("dial")
+			t.startTimer(&t.connectTimer, t.connectTimeout, ErrConnectTimeout)
+			t.markOnce(&t.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.stopTimer(&t.connectTimer)
+			t.mark(&t.connectDone)
+
+			t.mu.Lock()
+			t.connAddr = addr
+			duration := t.connectDone.Sub(t.connectStart)
+			t.mu.Unlock()
+
+			if f := t.events.OnConnect; f != nil {
+				f(network, addr, duration, err)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.setPhase("tls")
+			t.startTimer(&t.tlsHandshakeTimer, t.tlsHandshakeTimeout, ErrTLSHandshakeTimeout)
+			t.mark(&t.tlsStart)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.stopTimer(&t.tlsHandshakeTimer)
+			t.mark(&t.tlsDone)
+
+			if f := t.events.OnTLSHandshake; f != nil {
+				t.mu.Lock()
+				addr := t.connAddr
+				t.mu.Unlock()
+
+				f(addr, state, err)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.setPhase("headers")
+			t.startTimer(&t.responseHeaderTimer, t.responseHeaderTimeout, ErrResponseHeaderTimeout)
+		},
+		GotFirstResponseByte: func() {
+			t.setPhase("body")
+			t.stopTimer(&t.responseHeaderTimer)
+			t.mark(&t.firstByte)
+		},
+	}
+}
+
+// mark sets the given time of a phase to the current time
+func (t *requestTrace) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*at = time.Now()
+}
+
+// markOnce sets the given time of a phase to the current time if it is not set yet
+func (t *requestTrace) markOnce(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+// startSend resets the times of the phases of a previous attempt and marks the time the request is sent
+func (t *requestTrace) startSend() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sendStart = time.Now()
+	t.dnsStart, t.dnsDone = time.Time{}, time.Time{}
+	t.connectStart, t.connectDone = time.Time{}, time.Time{}
+	t.tlsStart, t.tlsDone = time.Time{}, time.Time{}
+	t.firstByte = time.Time{}
+}
+
+// receivedAt returns the time the first byte of the response was received, or the current time if it is unknown
+func (t *requestTrace) receivedAt() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.firstByte.IsZero() {
+		return time.Now()
+	}
+
+	return t.firstByte
+}
+
+// timings returns the durations of the phases of the request, which finished at the given time
+func (t *requestTrace) timings(end time.Time) Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	since := func(start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() {
+			return 0
+		}
+		return end.Sub(start)
+	}
+
+	return Timings{
+		DNS:      since(t.dnsStart, t.dnsDone),
+		Connect:  since(t.connectStart, t.connectDone),
+		TLS:      since(t.tlsStart, t.tlsDone),
+		TTFB:     since(t.sendStart, t.firstByte),
+		Transfer: since(t.firstByte, end),
+		Total:    since(t.sendStart, end),
+	}
+}
+
+// setPhase sets the current phase of the request
+func (t *requestTrace) setPhase(phase string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phase = phase
+}
+
+// timeoutError wraps the given error into a [*TimeoutError] if it signals a timeout,
+// otherwise the error is returned as is
+func (t *requestTrace) timeoutError(err error) error {
+	var netErr net.Error
+	isTimeout := errors.Is(err, ErrRequestTimedOut) ||
+		errors.Is(err, ErrConnectTimeout) ||
+		errors.Is(err, ErrTLSHandshakeTimeout) ||
+		errors.Is(err, ErrResponseHeaderTimeout) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+
+	if !isTimeout {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &TimeoutError{
+		Phase:   t.phase,
+		Attempt: t.attempt,
+		Elapsed: time.Since(t.start),
+		Err:     err,
+	}
+}
+
+// setTimeouts sets the timeouts of the phases of the request
+func (t *requestTrace) setTimeouts(connect, tlsHandshake, responseHeader time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.connectTimeout = connect
+	t.tlsHandshakeTimeout = tlsHandshake
+	t.responseHeaderTimeout = responseHeader
+	t.abort = nil
+
+	// timers of a previous attempt are stopped
+	for _, timer := range []**time.Timer{&t.connectTimer, &t.tlsHandshakeTimer, &t.responseHeaderTimer} {
+		if *timer != nil {
+			(*timer).Stop()
+			*timer = nil
+		}
+	}
+}
+
+// startTimer starts the timer of a phase which aborts the request with the given cause when the timeout is exceeded
+func (t *requestTrace) startTimer(timer **time.Timer, timeout time.Duration, cause error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if timeout <= 0 || t.abort == nil || *timer != nil {
+		return
+	}
+
+	abort := t.abort
+	*timer = time.AfterFunc(timeout, func() {
+		abort(cause)
+	})
+}
+
+// stopTimer stops the timer of a phase
+func (t *requestTrace) stopTimer(timer **time.Timer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+}
+
+// ---------------------------------------------- //
+// Response                                       //
+// ---------------------------------------------- //
+
+// BodyRaw returns the response body as a byte slice. The slice is not copied, it is owned by the response
+// and must not be modified if the response is used afterwards
+func (r *Response) BodyRaw() []byte {
+	return r.body
+}
+
+// BodyReader returns a reader of the response body, which reads the body owned by the response without copying it
+func (r *Response) BodyReader() *bytes.Reader {
+	return bytes.NewReader(r.body)
+}
+
+// BodyString returns the response body as string. The body is copied, unless zero-copy strings are enabled
+// by calling [Client.SetZeroCopyStrings]
+func (r *Response) BodyString() string {
+	if r.zeroCopy && len(r.body) > 0 {
+		return unsafe.String(unsafe.SliceData(r.body), len(r.body))
+	}
+
+	return string(r.body)
+}
+
+// Trailers returns the trailers of the response, which were sent by the server after the body
+func (r *Response) Trailers() http.Header {
+	return r.trailers
+}
+
+// Timings returns the durations of the phases of the request
+func (r *Response) Timings() Timings {
+	return r.timings
+}
+
+// Duration returns the time spent on the request from starting it until its response body was read,
+// including every attempt and the delays between the retries
+func (r *Response) Duration() time.Duration {
+	return r.duration
+}
+
+// Attempts returns the number of attempts of the request, which is 1 if the request was not retried
+func (r *Response) Attempts() int {
+	return r.attempts
+}
+
+// MarshalBinary implements the [encoding.BinaryMarshaler] interface. It serializes the status, the headers, the trailers,
+// the body, the request ID, the timings, the duration, the attempts, the receiving time and the request URL of the response, so that it can be persisted e.g.: in a cache or a job queue
+// and restored later by calling [Response.UnmarshalBinary]. The connection and the TLS information are not serialized
+func (r *Response) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(responseSnapshot{
+		Version:    responseSnapshotVersion,
+		Status:     r.status,
+		StatusCode: r.statusCode,
+		Headers:    r.headers,
+		Trailers:   r.trailers,
+		Body:       r.body,
+		RequestId:  r.requestId,
+		Timings:    r.timings,
+		Duration:   r.duration,
+		Attempts:   r.attempts,
+		ReceivedAt: r.receivedAt,
+		Url:        r.url,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements the [encoding.BinaryUnmarshaler] interface. It restores a response serialized by calling
+// [Response.MarshalBinary], which can be used like the original one. The settings of the client that created the original
+// response e.g.: [Client.SetSuccessFunc] are not restored. It returns an error wrapping [ErrInvalidSnapshot] if the data is invalid
+func (r *Response) UnmarshalBinary(data []byte) error {
+	var snapshot responseSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+
+	if snapshot.Version != responseSnapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, snapshot.Version)
+	}
+
+	if snapshot.Headers == nil {
+		snapshot.Headers = make(http.Header)
+	}
+
+	*r = Response{
+		responseHeader: responseHeader{
+			status:     snapshot.Status,
+			statusCode: snapshot.StatusCode,
+			headers:    snapshot.Headers,
+			requestId:  snapshot.RequestId,
+			receivedAt: snapshot.ReceivedAt,
+			url:        snapshot.Url,
+		},
+		body:     snapshot.Body,
+		trailers: snapshot.Trailers,
+		timings:  snapshot.Timings,
+		duration: snapshot.Duration,
+		attempts: snapshot.Attempts,
+	}
+	return nil
+}
+
+// BodyText returns the response body as a UTF-8 string, converted from the charset given in the Content-Type header.
+// If the header has no charset, then it is sniffed from the body and UTF-8 is assumed if it cannot be determined.
+// UTF-8, US-ASCII, ISO-8859-1, Windows-1252 and UTF-16 are supported by default, other charsets
+// can be added with [Client.SetCharsetDecoder]. It returns an error wrapping [ErrUnsupportedCharset] for unknown charsets
+func (r *Response) BodyText() (string, error) {
+	return decodeText(r.headers.Get(headerContentType), r.body, r.charsets)
+}
+
+// IsError returns a non nil error if the response is considered as an error based on the status code.
+// The error's type will be [*ResponseError]. By default [IsSuccessStatus] decides which status codes are successful,
+// which can be changed by calling [Client.SetSuccessFunc]
+func (r *Response) IsError() error {
+	isSuccess := r.isSuccess
+	if isSuccess == nil {
+		isSuccess = IsSuccessStatus
+	}
+
+	if !isSuccess(r.statusCode) {
+		return &ResponseError{
+			responseHeader: r.responseHeader,
+			body:           r.body,
+			jsonDecoder:    r.jsonDecoder,
+			decoders:       r.decoders,
+		}
+	}
+
+	return nil
+}
+
+// IsSuccessStatus is the default predicate of the successful status codes used by [Response.IsError].
+// Status codes from 200 to 399 are successful, except 304, which is considered as an error matching [ErrNotModified]
+// so that conditional requests can be handled
+func IsSuccessStatus(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 400 && statusCode != http.StatusNotModified
+}
+
+// ValidateSchema validates the response body against the given JSON Schema.
+// The returned error is a [*SchemaError] listing every violation if the body does not conform to the schema.
+// The following subset of JSON Schema is supported: type, enum, const, properties, required, additionalProperties,
+// patternProperties, items, minItems, maxItems, uniqueItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, multipleOf, allOf, anyOf, oneOf, not and local $ref references
+func (r *Response) ValidateSchema(schemaJSON []byte) error {
+	return pingoschema.Validate(schemaJSON, r.body)
+}
+
+// Validate validates the response body against the JSON Schema registered for the endpoint
+// the request was created from by calling [Client.SetSchema]. It returns nil if there is no such schema
+func (r *Response) Validate() error {
+	if r.schema == nil {
+		return nil
+	}
+
+	return r.ValidateSchema(r.schema)
+}
+
+// Unmarshal is a convenience method that can receive a [ResponseUnmarshaler] callback
+// function that performs the unmarshalling of the response body.
+// The returned error is an [*Error] of class [ErrClassDecode]
+func (r *Response) Unmarshal(u ResponseUnmarshaler) (err error) {
+	defer recoverPanic(r.recoverPanics, &err)
+	return decodeError(u(r))
+}
+
+// Decode decodes the response body into the value pointed to by v using the decoder
+// selected by the Content-Type header of the response. JSON and XML are supported by default,
+// other media types can be added with [Client.SetBodyDecoder]. The returned error is an [*Error] of class [ErrClassDecode]
+// which wraps [ErrUnsupportedMedia] if there is no decoder for the media type
+func (r *Response) Decode(v any) error {
+	return decodeError(decodeBody(r.headers.Get(headerContentType), r.body, v, r.jsonDecoder, r.decoders))
+}
+
+// UnmarshalJson unmarshals the response body as JSON into the value pointed to by v.
+// The returned error is an [*Error] of class [ErrClassDecode]
+func (r *Response) UnmarshalJson(v any) error {
+	return decodeError(unmarshalJson(r.body, v, r.jsonDecoder))
+}
+
+// UnmarshalXml unmarshals the response body as XML into the value pointed to by v.
+// The returned error is an [*Error] of class [ErrClassDecode]
+func (r *Response) UnmarshalXml(v any) error {
+	return decodeError(xml.Unmarshal(r.body, v))
+}
+
+// UnmarshalAuto unmarshals the response body into the value pointed to by v based on the Content-Type header,
+// see [Response.Decode] for details
+func (r *Response) UnmarshalAuto(v any) error {
+	return r.Decode(v)
+}
+
+// ExtractZip extracts the response body as a zip archive into destDir, which is created if it does not exist.
+// Entries with absolute paths or paths outside of destDir and links are rejected with [ErrUnsafeArchivePath],
+// and exceeding the limits fails with [ErrArchiveTooLarge]. Files extracted before a failure are not removed
+func (r *Response) ExtractZip(destDir string, limits ExtractLimits) error {
+	zr, err := zip.NewReader(bytes.NewReader(r.body), int64(len(r.body)))
+	if err != nil {
+		return err
+	}
+
+	x := newExtractor(destDir, limits)
+	for _, f := range zr.File {
+		if err := x.extract(f.Name, f.Mode(), f.Open); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExtractTarGz extracts the response body as a gzip compressed tar archive into destDir, the same way as [Response.ExtractZip]
+func (r *Response) ExtractTarGz(destDir string, limits ExtractLimits) error {
+	gr, err := gzip.NewReader(bytes.NewReader(r.body))
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	x := newExtractor(destDir, limits)
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeLink {
+			return fmt.Errorf("%w: %s", ErrUnsafeArchivePath, header.Name)
+		}
+
+		err = x.extract(header.Name, header.FileInfo().Mode(), func() (io.ReadCloser, error) {
+			return io.NopCloser(tr), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SaveToDir saves the response body into the given directory and returns the path of the file. The filename is taken
+// from the Content-Disposition header or the last segment of the URL path, see [Response.ContentDisposition], and it is
+// sanitized so that it cannot escape the directory. The body is written to a temporary file which is renamed to the filename,
+// so an existing file is replaced atomically and a partial file is never left behind
+func (r *Response) SaveToDir(dir string) (string, error) {
+	return saveToDir(dir, &r.responseHeader, bytes.NewReader(r.body))
+}
+
+// decodeError wraps the given error into an [*Error] of class [ErrClassDecode] if it is not nil
+func decodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{
+		Class: ErrClassDecode,
+		Err:   err,
+	}
+}
+
+// decodeBody decodes the body into v using the decoder of the given content type.
+// Structured syntax suffixes e.g.: "application/problem+json" fall back to the decoder of the suffix.
+// JSON bodies are decoded by the given JSON decoder instead of the registered one if it is not nil.
+// The given decoders take precedence over the built-in ones
+func decodeBody(contentType string, body []byte, v any, jsonDecoder BodyDecoder, decoders map[string]BodyDecoder) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrUnsupportedMedia, contentType)
+	}
+
+	if jsonDecoder != nil && (mediaType == ContentTypeJson || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")) {
+		return jsonDecoder(body, v)
+	}
+
+	decoder, ok := lookupDecoder(mediaType, decoders)
+	if !ok {
+		if _, suffix, found := strings.Cut(mediaType, "+"); found {
+			decoder, ok = lookupDecoder("application/"+suffix, decoders)
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnsupportedMedia, mediaType)
+	}
+
+	return decoder(body, v)
+}
+
+// ---------------------------------------------- //
+// Charset                                        //
+// ---------------------------------------------- //
+
+// lookupDecoder returns the decoder of the given media type, looking it up in the given decoders first
+func lookupDecoder(mediaType string, decoders map[string]BodyDecoder) (BodyDecoder, bool) {
+	if decoder, ok := decoders[mediaType]; ok {
+		return decoder, true
+	}
+
+	decoder, ok := bodyDecoders[mediaType]
+	return decoder, ok
+}
+
+// decodeText converts the given body to a UTF-8 string using the charset of the given content type.
+// The given charset decoders take precedence over the built-in ones
+func decodeText(contentType string, body []byte, charsets map[string]CharsetDecoder) (string, error) {
+	_, params, _ := mime.ParseMediaType(contentType)
+	charset := params["charset"]
+	if charset == "" {
+		_, params, _ = mime.ParseMediaType(http.DetectContentType(body))
+		charset = params["charset"]
+	}
+
+	if charset == "" {
+		charset = "utf-8"
+	}
+
+	charset = strings.ToLower(charset)
+	decoder, ok := charsets[charset]
+	if !ok {
+		decoder, ok = charsetDecoders[charset]
+	}
+
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedCharset, charset)
+	}
+
+	return decoder(body)
+}
+
+// decodeUtf8 decodes UTF-8 text, removing the byte order mark
+func decodeUtf8(b []byte) (string, error) {
+	return string(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))), nil
+}
+
+// decodeLatin1 decodes ISO-8859-1 text
+func decodeLatin1(b []byte) (string, error) {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+
+	return string(runes), nil
+}
+
+// decodeWindows1252 decodes Windows-1252 text, which differs from ISO-8859-1 in the range 0x80-0x9F
+func decodeWindows1252(b []byte) (string, error) {
+	table := [32]rune{
+		'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+		'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+	}
+
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		if c >= 0x80 && c < 0xa0 {
+			runes[i] = table[c-0x80]
+			continue
+		}
+
+		runes[i] = rune(c)
+	}
+
+	return string(runes), nil
+}
+
+// decodeUtf16 creates a decoder of UTF-16 text with the given byte order.
+// If the byte order is nil, then it is determined by the byte order mark, defaulting to big endian
+func decodeUtf16(order binary.ByteOrder) CharsetDecoder {
+	return func(b []byte) (string, error) {
+		if len(b)%2 != 0 {
+			return "", errors.New("invalid UTF-16 text: odd number of bytes")
+		}
+
+		o := order
+		switch {
+		case bytes.HasPrefix(b, []byte{0xfe, 0xff}) && o != binary.LittleEndian:
+			o, b = binary.BigEndian, b[2:]
+		case bytes.HasPrefix(b, []byte{0xff, 0xfe}) && o != binary.BigEndian:
+			o, b = binary.LittleEndian, b[2:]
+		case o == nil:
+			o = binary.BigEndian
+		}
+
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = o.Uint16(b[2*i:])
+		}
+
+		return string(utf16.Decode(units)), nil
+	}
+}
+
+// ---------------------------------------------- //
+// ResponseError                                  //
+// ---------------------------------------------- //
+
+// Error implements the error interface
+func (r ResponseError) Error() string {
+	return fmt.Sprintf("[%v] %s", r.status, r.body)
+}
+
+// Is reports whether the response error matches the target error.
+// A response error with status code 304 matches [ErrNotModified]
+func (r ResponseError) Is(target error) bool {
+	return target == ErrNotModified && r.statusCode == http.StatusNotModified
+}
+
+// BodyRaw returns the response body as a byte slice
+func (r *ResponseError) BodyRaw() []byte {
+	return r.body
+}
+
+// BodyString returns the response body as string
+func (r *ResponseError) BodyString() string {
+	return string(r.body)
+}
+
+// IsClientError reports whether the status code of the response is 4xx
+func (r *ResponseError) IsClientError() bool {
+	return r.statusCode >= 400 && r.statusCode < 500
+}
+
+// IsServerError reports whether the status code of the response is 5xx
+func (r *ResponseError) IsServerError() bool {
+	return r.statusCode >= 500 && r.statusCode < 600
+}
+
+// HasStatus reports whether the status code of the response is one of the given status codes.
+// It is named differently from [ResponseError.Is], which is used by [errors.Is]
+func (r *ResponseError) HasStatus(statusCodes ...int) bool {
+	return slices.Contains(statusCodes, r.statusCode)
+}
+
+// UnmarshalJson unmarshals the response body as JSON into the value pointed to by v.
+// The returned error is an [*Error] of class [ErrClassDecode]
+func (r *ResponseError) UnmarshalJson(v any) error {
+	return decodeError(unmarshalJson(r.body, v, r.jsonDecoder))
+}
+
+// UnmarshalXml unmarshals the response body as XML into the value pointed to by v.
+// The returned error is an [*Error] of class [ErrClassDecode]
+func (r *ResponseError) UnmarshalXml(v any) error {
+	return decodeError(xml.Unmarshal(r.body, v))
+}
+
+// UnmarshalAuto unmarshals the response body into the value pointed to by v based on the Content-Type header,
+// see [Response.Decode] for details
+func (r *ResponseError) UnmarshalAuto(v any) error {
+	return decodeError(decodeBody(r.headers.Get(headerContentType), r.body, v, r.jsonDecoder, r.decoders))
+}
+
+// ---------------------------------------------- //
+// ResponseStream                                 //
+// ---------------------------------------------- //
+
+// RecvFunc can receive a [StreamReceiver] callback function that performs
+// the stream reading of the streamed response body
+func (r *ResponseStream) RecvFunc(sr StreamReceiver) (err error) {
+	defer recoverPanic(r.recoverPanics, &err)
+	return sr(r.reader)
+}
+
+// Recv reads up to n bytes from a streamed response body
+func (r *ResponseStream) Recv(n uint) ([]byte, error) {
+	b := make([]byte, n)
+	nn, err := r.reader.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:nn], nil
+}
+
+// RecvWithTimeout reads up to n bytes from a streamed response body like [ResponseStream.Recv], but returns [ErrReadTimeout]
+// if no data arrives within the given timeout. Unlike the idle timeout set by [ResponseStream.SetIdleTimeout], the stream
+// is not aborted, so the read can be retried and no data is lost, which makes it possible to detect a stalled read
+func (r *ResponseStream) RecvWithTimeout(n uint, timeout time.Duration) ([]byte, error) {
+	r.deadline.timeout = timeout
+	defer func() { r.deadline.timeout = 0 }()
+
+	return r.Recv(n)
+}
+
+// RecvDelim returns an iterator over the frames of a streamed response body delimited by the given delimiter.
+// The frames do not contain the delimiter. Frames split across multiple reads are buffered until the delimiter arrives.
+// The last frame is yielded even if it is not terminated by the delimiter. Iteration stops after the first error
+func (r *ResponseStream) RecvDelim(delim byte) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		for {
+			b, err := r.reader.ReadBytes(delim)
+			if len(b) > 0 && b[len(b)-1] == delim {
+				b = b[:len(b)-1]
+			} else if err == io.EOF && len(b) == 0 {
+				return
+			}
+
+			if err != nil && err != io.EOF {
+				yield(b, err)
+				return
+			}
+
+			if !yield(b, nil) || err == io.EOF {
+				return
+			}
+		}
+	}
+}
+
+// Lines returns an iterator over the lines of a streamed response body.
+// The lines do not contain the trailing "\n" or "\r\n". Iteration stops after the first error
+func (r *ResponseStream) Lines() iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for b, err := range r.RecvDelim('\n') {
+			if !yield(string(bytes.TrimSuffix(b, []byte{'\r'})), err) {
+				return
+			}
+		}
+	}
+}
+
+// Chan reads the streamed response body in the background and sends the read chunks of up to chunkSize bytes
+// to the returned data channel, so that the stream can be consumed in a select statement alongside other events.
+// A chunkSize of zero reads chunks of up to 32 KiB. Both channels are closed when the body is read until [io.EOF], a read fails or the given [context.Context] is done.
+// The error channel receives the error of the failed read or the cause of the context before it is closed.
+// If the context is done, then the stream is aborted, but it still has to be closed by calling [ResponseStream.Close]
+func (r *ResponseStream) Chan(ctx context.Context, chunkSize uint) (<-chan []byte, <-chan error) {
+	data := make(chan []byte)
+	errs := make(chan error, 1)
+
+	if chunkSize == 0 {
+		chunkSize = defaultStreamChunkSize
+	}
+
+	go func() {
+		defer close(errs)
+		defer close(data)
+
+		stop := context.AfterFunc(ctx, func() {
+			r.body.abort(context.Cause(ctx))
+		})
+		defer stop()
+
+		for {
+			// the chunk read together with an error e.g.: [io.EOF] is sent as well
+			b := make([]byte, chunkSize)
+			n, err := r.reader.Read(b)
+			b = b[:n]
+			if len(b) > 0 {
+				select {
+				case data <- b:
+				case <-ctx.Done():
+					errs <- context.Cause(ctx)
+					return
+				}
+			}
+
+			if ctx.Err() != nil {
+				errs <- context.Cause(ctx)
+				return
+			}
+
+			if err == io.EOF {
+				return
+			}
+
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	return data, errs
+}
+
+// NewJsonDecoder returns a [encoding/json.Decoder] reading from the live body of the stream, e.g.: to decode a huge
+// JSON document token by token. It follows the JSON settings of the client
+func (r *ResponseStream) NewJsonDecoder() *json.Decoder {
+	dec := json.NewDecoder(r.reader)
+	if r.jsonUseNumber {
+		dec.UseNumber()
+	}
+	if r.jsonStrict {
+		dec.DisallowUnknownFields()
+	}
+
+	return dec
+}
+
+// Tee copies everything that is read from the streamed response body to the given [io.Writer],
+// which is useful for logging or auditing a stream while consuming it.
+// It should be called before reading from the stream. A write error aborts the reading of the stream
+func (r *ResponseStream) Tee(w io.Writer) *ResponseStream {
+	r.body.tees = append(r.body.tees, w)
+	return r
+}
+
+// TeeFile copies everything that is read from the streamed response body to the file at the given path.
+// The file is created or truncated and it is closed when the stream is closed
+func (r *ResponseStream) TeeFile(filePath string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+
+	r.body.closers = append(r.body.closers, f)
+	r.Tee(f)
+	return nil
+}
+
+// SaveToDir reads the rest of the streamed response body into a file in the given directory and returns its path,
+// the same way as [Response.SaveToDir]
+func (r *ResponseStream) SaveToDir(dir string) (string, error) {
+	return saveToDir(dir, &r.responseHeader, r.reader)
+}
+
+// Trailers returns the trailers of the streamed response, which were sent by the server after the body.
+// They are only available after the stream has been read until [io.EOF]
+func (r *ResponseStream) Trailers() http.Header {
+	return r.response.Trailer
+}
+
+// SetDecompression sets whether the streamed response body is decompressed according to its Content-Encoding header,
+// which is enabled by default for gzip and deflate. The Content-Encoding header of the response is kept as is.
+// It must be called before reading from the stream
+func (r *ResponseStream) SetDecompression(enabled bool) *ResponseStream {
+	if r.decoding != nil {
+		r.decoding.disabled = !enabled
+	}
+	return r
+}
+
+// SetIdleTimeout sets the idle timeout of the stream. If no data arrives within the idle timeout
+// while reading, then the stream is aborted and the read returns [ErrStreamIdle].
+// Unlike the request timeout, it does not limit the overall duration of the stream. Zero disables the idle timeout
+func (r *ResponseStream) SetIdleTimeout(timeout time.Duration) *ResponseStream {
+	r.body.idleTimeout.Store(int64(timeout))
+	return r
+}
+
+// Close closes the streamed response body and additionally frees up any
+// resources associated with the [context.Context] used to perform the streamed request
+func (r *ResponseStream) Close() {
+	r.response.Body.Close()
+	for _, c := range r.body.closers {
+		c.Close()
+	}
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+
+	r.body.abort(nil)
+}
+
+// Read implements the [io.Reader] interface
+func (b *streamBody) Read(p []byte) (int, error) {
+	if b.idle.Load() {
+		return 0, ErrStreamIdle
+	}
+
+	if timeout := time.Duration(b.idleTimeout.Load()); timeout > 0 {
+		t := time.AfterFunc(timeout, func() {
+			b.idle.Store(true)
+			b.abort(ErrStreamIdle)
+		})
+		defer t.Stop()
+	}
+
+	n, err := b.reader.Read(p)
+	if err != nil && b.idle.Load() {
+		return n, ErrStreamIdle
+	}
+
+	if n > 0 {
+		for _, w := range b.tees {
+			if _, werr := w.Write(p[:n]); werr != nil {
+				return n, werr
+			}
+		}
+	}
+
+	return n, err
+}
+
+// Read implements the [io.Reader] interface
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if len(d.buffered) > 0 {
+		n := copy(p, d.buffered)
+		d.buffered = d.buffered[n:]
+		return n, nil
+	}
+
+	if err := d.err; err != nil {
+		d.err = nil
+		return 0, err
+	}
+
+	if d.pending == nil {
+		if d.timeout <= 0 {
+			return d.reader.Read(p)
+		}
+
+		pending := make(chan readResult, 1)
+		go func(b []byte) {
+			n, err := d.reader.Read(b)
+			pending <- readResult{data: b[:n], err: err}
+		}(make([]byte, len(p)))
+		d.pending = pending
+	}
+
+	var res readResult
+	if d.timeout > 0 {
+		timer := time.NewTimer(d.timeout)
+		defer timer.Stop()
+
+		select {
+		case res = <-d.pending:
+		case <-timer.C:
+			return 0, ErrReadTimeout
+		}
+	} else {
+		res = <-d.pending
+	}
+
+	d.pending = nil
+	n := copy(p, res.data)
+	if d.buffered = res.data[n:]; len(d.buffered) > 0 {
+		d.err = res.err
+		return n, nil
+	}
+
+	return n, res.err
+}
+
+// Read implements the [io.Reader] interface
+func (d *decodingReader) Read(p []byte) (int, error) {
+	if d.decoder == nil {
+		var err error
+		switch {
+		case d.disabled:
+			d.decoder = d.body
+		case d.encoding == "deflate":
+			d.decoder, err = zlib.NewReader(d.body)
+		default:
+			d.decoder, err = gzip.NewReader(d.body)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return d.decoder.Read(p)
+}
+
+// ---------------------------------------------- //
+// MultipartFormFile                              //
+// ---------------------------------------------- //
+
+// NewMultipartFormFile creates a new multipartform file by reading the file from the given filepath
+func NewMultipartFormFile(name string, filePath string) multipartFormFile {
+	return multipartFormFile{
+		filePath:  filePath,
+		fieldName: name,
+	}
+}
+
+// NewMultipartFormFileReader creates a new multipartform file by using the given [io.Reader]
+func NewMultipartFormFileReader(name, fileName string, r io.Reader) multipartFormFile {
+	return multipartFormFile{
+		reader:    r,
+		fieldName: name,
+		fileName:  fileName,
+	}
+}
+
+// write writes the contents of the file to the given [mime/multipart.Writer]
+func (f *multipartFormFile) write(w *multipart.Writer) error {
+	if f.reader == nil {
+		ff, err := os.Open(f.filePath)
+		if err != nil {
+			return err
+		}
+		defer ff.Close()
+		f.reader = ff
+		f.fileName = path.Base(ff.Name())
+	}
+
+	pw, err := w.CreateFormFile(f.fieldName, f.fileName)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(pw, f.reader)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ---------------------------------------------- //
+// Pagination                                     //
+// ---------------------------------------------- //
+
+// CollectAll performs the request repeatedly with the given [context.Context] while there are more pages
+// and returns the items of every page concatenated. At most [DefaultMaxPages] pages are fetched,
+// see [CollectAllN] for details
+func CollectAll[T any](ctx context.Context, r *Request, extract PageExtractor[T]) ([]T, error) {
+	return CollectAllN(ctx, r, extract, DefaultMaxPages)
+}
+
+// CollectAllN performs the request repeatedly with the given [context.Context] while there are more pages
+// and returns the items of every page concatenated. The extractor extracts the items of each page and prepares
+// the request for the next one. If a response is considered to be an error, then the [*ResponseError] is returned.
+// If there are more than maxPages pages, then the items collected so far are returned with [ErrTooManyPages]
+func CollectAllN[T any](ctx context.Context, r *Request, extract PageExtractor[T], maxPages int) ([]T, error) {
+	var all []T
+
+	for page := 0; ; page++ {
+		if page >= maxPages {
+			return all, fmt.Errorf("%w: more than %d pages", ErrTooManyPages, maxPages)
+		}
+
+		resp, err := r.DoCtx(ctx)
+		if err != nil {
+			return all, err
+		}
+
+		if err := resp.IsError(); err != nil {
+			return all, err
+		}
+
+		items, hasNext, err := extract(resp, r)
+		if err != nil {
+			return all, err
+		}
+
+		all = append(all, items...)
+		if !hasNext {
+			return all, nil
+		}
+	}
+}
+
+// Paginate returns a [PageExtractor] of the pagination strategy with the given name, so that [CollectAll] works against
+// common API dialects without writing an extractor. The items are decoded from the JSON body with the JSON settings of the client.
+// The URLs of the next pages replace the URL and the query parameters of the request. An unknown strategy fails the extraction
+// with [ErrUnknownPagination]
+func Paginate[T any](strategy PaginationStrategy, config PaginationConfig) PageExtractor[T] {
+	switch strategy {
+	case PaginationNextLink:
+		config.Items = cmp.Or(config.Items, "value")
+		config.NextLink = cmp.Or(config.NextLink, "@odata.nextLink")
+	case PaginationCursor:
+		config.Items = cmp.Or(config.Items, "data")
+		config.Cursor = cmp.Or(config.Cursor, "next_cursor")
+		config.CursorParam = cmp.Or(config.CursorParam, "cursor")
+	case PaginationPage:
+		config.PageParam = cmp.Or(config.PageParam, "page")
+	case PaginationLinkHeader:
+	default:
+		return func(*Response, *Request) ([]T, bool, error) {
+			return nil, false, fmt.Errorf("%w: %q", ErrUnknownPagination, strategy)
+		}
+	}
+
+	return func(resp *Response, next *Request) ([]T, bool, error) {
+		var (
+			items  []T
+			fields map[string]json.RawMessage
+		)
+
+		if config.Items == "" {
+			if err := unmarshalJson(resp.body, &items, resp.jsonDecoder); err != nil {
+				return nil, false, decodeError(err)
+			}
+		} else {
+			if err := json.Unmarshal(resp.body, &fields); err != nil {
+				return nil, false, decodeError(err)
+			}
+
+			if raw, ok := fields[config.Items]; ok {
+				if err := unmarshalJson(raw, &items, resp.jsonDecoder); err != nil {
+					return nil, false, decodeError(err)
+				}
+			}
+		}
+
+		switch strategy {
+		case PaginationNextLink:
+			link := stringField(fields, config.NextLink)
+			if link == "" {
+				return items, false, nil
+			}
+			setNextPageUrl(next, resolveUrl(resp.url, link))
+
+		case PaginationLinkHeader:
+			link := linkTarget(resp.headers, "next")
+			if link == "" {
+				return items, false, nil
+			}
+			setNextPageUrl(next, resolveUrl(resp.url, link))
+
+		case PaginationCursor:
+			cursor := stringField(fields, config.Cursor)
+			if cursor == "" {
+				return items, false, nil
+			}
+			next.SetQueryParam(config.CursorParam, cursor)
+
+		case PaginationPage:
+			if len(items) == 0 || len(items) < config.PerPage {
+				return items, false, nil
+			}
+
+			page, err := strconv.Atoi(next.queryParams.Get(config.PageParam))
+			if err != nil {
+				page = 1
+			}
+			next.SetQueryParam(config.PageParam, strconv.Itoa(page+1))
+		}
+
+		return items, true, nil
+	}
+}
+
+// stringField returns the string value of the given field, or an empty string if it is missing or not a string
+func stringField(fields map[string]json.RawMessage, name string) string {
+	var s string
+	json.Unmarshal(fields[name], &s)
+	return s
+}
+
+// linkTarget returns the target URL of the link with the given relation type in the Link headers, or an empty string if there is none
+func linkTarget(headers http.Header, rel string) string {
+	for _, value := range headers.Values(headerLink) {
+		for _, link := range strings.Split(value, ",") {
+			target, params, _ := strings.Cut(link, ";")
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "rel") && slices.Contains(strings.Fields(strings.ToLower(strings.Trim(value, `"`))), rel) {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// setNextPageUrl sets the URL of the next page on the request, which replaces its query parameters
+func setNextPageUrl(next *Request, pageUrl string) {
+	next.SetUrl(pageUrl)
+	next.queryParams = make(url.Values)
+	next.queryParamsCopied = true
+	next.rawQueries = nil
+}
+
+// ---------------------------------------------- //
+// Job                                            //
+// ---------------------------------------------- //
+
+// RunJob runs an asynchronous job with the given [context.Context]. The job is started by performing the given request,
+// then its status is polled at the URL in the Location header of the response until it is done, and finally the result
+// is fetched and read. If the response starting the job has no Location header, then the result is read from it directly.
+// If a response is considered to be an error, then the [*ResponseError] is returned
+func RunJob[T any](ctx context.Context, submit *Request, config JobConfig[T]) (T, error) {
+	var result T
+
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultJobPollInterval
+	}
+
+	if config.Status == nil {
+		config.Status = jobStatus
+	}
+
+	if config.Result == nil {
+		config.Result = func(resp *Response) (T, error) {
+			var v T
+			err := resp.Decode(&v)
+			return v, err
+		}
+	}
+
+	resp, err := submit.DoCtx(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	if err := resp.IsError(); err != nil {
+		return result, err
+	}
+
+	location := resp.GetHeader("Location")
+	if location == "" {
+		return config.Result(resp)
+	}
+
+	statusUrl := resolveUrl(submit.requestUrl(submit.baseUrl), location)
+	delay := retryAfter(resp.headers, config.PollInterval)
+
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, context.Cause(ctx)
+		case <-timer.C:
+		}
+
+		resp, err = submit.client.NewRequest().SetUrl(statusUrl).DoCtx(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		if err := resp.IsError(); err != nil {
+			return result, err
+		}
+
+		done, resultUrl, err := config.Status(resp)
+		if err != nil {
+			return result, err
+		}
+
+		if !done {
+			delay = retryAfter(resp.headers, config.PollInterval)
+			continue
+		}
+
+		if resultUrl == "" {
+			return config.Result(resp)
+		}
+
+		resp, err = submit.client.NewRequest().SetUrl(resolveUrl(statusUrl, resultUrl)).DoCtx(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		if err := resp.IsError(); err != nil {
+			return result, err
+		}
+
+		return config.Result(resp)
+	}
+}
+
+// jobStatus is the default status check of [RunJob], which reports the job done if the status code is not 202
+// with the Location header as the URL of the result
+func jobStatus(resp *Response) (bool, string, error) {
+	if resp.StatusCode() == http.StatusAccepted {
+		return false, "", nil
+	}
+
+	return true, resp.GetHeader("Location"), nil
+}
+
+// retryAfter returns the delay given in the Retry-After header in seconds or as an HTTP date.
+// If the header is missing or invalid, then the given default is returned
+func retryAfter(headers http.Header, def time.Duration) time.Duration {
+	value := headers.Get("Retry-After")
+	if value == "" {
+		return def
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+
+	return def
+}
+
+// resolveUrl resolves the possibly relative reference against the given base URL
+func resolveUrl(base, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+
+	return b.ResolveReference(r).String()
+}
+
+// ---------------------------------------------- //
+// Endpoint                                       //
+// ---------------------------------------------- //
+
+// Call performs the endpoint with the given [context.Context] and client, encoding req into the request
+// and decoding the response value. If the response is considered to be an error, then the [*ResponseError] is returned
+func (e Endpoint[Req, Resp]) Call(ctx context.Context, c *Client, req Req) (Resp, error) {
+	var result Resp
+
+	r := c.NewRequest().SetMethod(e.Method).SetPath(e.Path)
+	if e.Encode != nil {
+		e.Encode(r, req)
+	} else if isMutatingMethod(r.method) {
+		r.Body(req)
+	}
+
+	resp, err := r.DoCtx(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	if err := resp.IsError(); err != nil {
+		return result, err
+	}
+
+	if e.Decode != nil {
+		return e.Decode(resp)
+	}
+
+	if len(resp.body) == 0 {
+		return result, nil
+	}
+
+	err = resp.Decode(&result)
+	return result, err
+}
+
+// ---------------------------------------------- //
+// Download                                       //
+// ---------------------------------------------- //
+
+// DownloadParallel downloads the file at the given URL to the given path with the default client,
+// see [Client.DownloadParallel] for details
+func DownloadParallel(ctx context.Context, url, filePath string, segments int) error {
+	return defaultClient.DownloadParallel(ctx, url, filePath, segments)
+}
+
+// DownloadParallel downloads the file at the given URL to the given path by fetching the given number
+// of byte ranges concurrently. If the server does not support range requests, then the file is downloaded
+// with a single request. Failed segments are retried, resuming from the last received byte.
+// The file is removed if the download fails
+func (c *Client) DownloadParallel(ctx context.Context, url, filePath string, segments int) (err error) {
+	resp, err := c.NewRequest().SetBaseUrl(url).SetMethod(http.MethodHead).DoCtx(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := resp.IsError(); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			os.Remove(filePath)
+		}
+	}()
+
+	size, _ := strconv.ParseInt(resp.GetHeader("Content-Length"), 10, 64)
+	if segments < 2 || size <= 0 || resp.GetHeader("Accept-Ranges") != "bytes" {
+		return c.downloadSegment(ctx, url, f, 0, -1)
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		wg        sync.WaitGroup
+		segment   = (size + int64(segments) - 1) / int64(segments)
+		errorOnce sync.Once
+		firstErr  error
+	)
+
+	for start := int64(0); start < size; start += segment {
+		end := min(start+segment, size) - 1
 
-	r.body = bytes.NewBufferString(data.Encode())
-	return r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := c.downloadSegment(ctx, url, f, start, end); err != nil {
+				errorOnce.Do(func() {
+					firstErr = err
+					cancel(err)
+				})
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
 }
 
-// BodyCustom prepares the body with the given callback function
-func (r *Request) BodyCustom(f func() (*bytes.Buffer, error)) *Request {
-	r.resetBody()
+// downloadSegment downloads the bytes from start to end (inclusive) of the file at the given URL
+// and writes them to the file at the same offset. If end is negative, then the whole file is downloaded
+// without a range request. The segment is retried on failure, resuming from the last received byte
+func (c *Client) downloadSegment(ctx context.Context, url string, f *os.File, start, end int64) error {
+	var (
+		offset = start
+		err    error
+	)
 
-	body, err := f()
+	for attempt := 0; attempt < downloadSegmentAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+
+		if end >= 0 && offset > end {
+			return nil
+		}
+
+		var n int64
+		n, err = c.downloadRange(ctx, url, io.NewOffsetWriter(f, offset), offset, end)
+		offset += n
+
+		if end < 0 {
+			if err == nil {
+				return f.Truncate(offset)
+			}
+
+			// a whole file download cannot be resumed
+			offset = 0
+			continue
+		}
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// downloadRange downloads the bytes from start to end (inclusive) of the file at the given URL to the given writer.
+// If end is negative, then the whole file is downloaded. It returns the number of bytes written
+func (c *Client) downloadRange(ctx context.Context, url string, w io.Writer, start, end int64) (int64, error) {
+	r := c.NewRequest().SetBaseUrl(url)
+	if end >= 0 {
+		r.SetHeader("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+
+	resp, _, err := r.do(ctx)
+	if r.cancel != nil {
+		defer r.cancel()
+	}
 	if err != nil {
-		r.bodyErr = err
-		return r
+		return 0, err
 	}
+	defer resp.Body.Close()
 
-	r.body = body
-	return r
+	switch {
+	case end >= 0 && resp.StatusCode != http.StatusPartialContent:
+		return 0, fmt.Errorf("%w: status %v", ErrRangeNotSatisfied, resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return 0, fmt.Errorf("download failed: status %v", resp.Status)
+	}
+
+	return io.Copy(w, resp.Body)
 }
 
-// BodyRaw prepares the body with the given raw data bytes
-func (r *Request) BodyRaw(data []byte) *Request {
-	r.resetBody()
-	r.body = bytes.NewBuffer(data)
-	return r
+// ---------------------------------------------- //
+// Webhook                                        //
+// ---------------------------------------------- //
+
+// NewWebhook creates a new [Webhook] with the default client, see [Client.NewWebhook] for details
+func NewWebhook(url string, secret []byte) *Webhook {
+	return defaultClient.NewWebhook(url, secret)
 }
 
-// BodyMultipartForm prepares the body as a multipartform request with the given data and files.
-// Content-Type header is automatically set to "multipart/form-data" with the proper boundary.
-// Use [NewMultipartFormFile] or [NewMultipartFormFileReader] to pass files for file upload
-func (r *Request) BodyMultipartForm(data map[string]any, files ...multipartFormFile) *Request {
-	r.resetBody()
-	body := &bytes.Buffer{}
-	w := multipart.NewWriter(body)
+// NewWebhook creates a new [Webhook] that sends JSON payloads to the given URL signed with the given secret.
+// By default the payloads are signed with HMAC-SHA256 in the [DefaultWebhookSignatureHeader] header
+// with the "sha256=" prefix, and sending is attempted 3 times with a backoff starting from 1 second
+func (c *Client) NewWebhook(url string, secret []byte) *Webhook {
+	return &Webhook{
+		client:          c,
+		url:             url,
+		secret:          secret,
+		signatureHeader: DefaultWebhookSignatureHeader,
+		signaturePrefix: "sha256=",
+		hash:            sha256.New,
+		attempts:        defaultWebhookAttempts,
+		backoff:         defaultWebhookBackoff,
+	}
+}
 
-	// handle data
-	for fieldName, value := range data {
-		err := w.WriteField(fieldName, fmt.Sprint(value))
-		if err != nil {
-			r.bodyErr = err
-			w.Close()
-			return r
-		}
+// SetSignature sets the header and the prefix of the signature and the hash function used by the HMAC signature
+// e.g.: SetSignature("X-Signature", "sha1=", sha1.New)
+func (w *Webhook) SetSignature(header, prefix string, hash func() hash.Hash) *Webhook {
+	w.signatureHeader = header
+	w.signaturePrefix = prefix
+	w.hash = hash
+	return w
+}
+
+// SetRetry sets the maximum number of attempts to send a payload and the delay before the first retry,
+// which is doubled after every retry
+func (w *Webhook) SetRetry(attempts int, backoff time.Duration) *Webhook {
+	w.attempts = max(attempts, 1)
+	w.backoff = backoff
+	return w
+}
+
+// SetDeadLetter sets the callback that receives the encoded payloads that could not be sent with the last error
+func (w *Webhook) SetDeadLetter(f func(payload []byte, err error)) *Webhook {
+	w.deadLetter = f
+	return w
+}
+
+// Send sends the payload encoded as JSON, see [Webhook.SendCtx] for details
+func (w *Webhook) Send(payload any) error {
+	return w.SendCtx(context.Background(), payload)
+}
+
+// SendCtx sends the payload encoded as JSON with the given [context.Context]. Failed requests, responses with
+// status code 429 or 5xx are retried with backoff. If every attempt fails, then the payload is passed to the
+// dead letter callback and the last error is returned
+func (w *Webhook) SendCtx(ctx context.Context, payload any) error {
+	body, err := w.client.marshalJson(payload)
+	if err != nil {
+		return err
 	}
 
-	// handle files
-	for _, file := range files {
-		err := file.write(w)
-		if err != nil {
-			r.bodyErr = err
-			w.Close()
-			return r
+	mac := hmac.New(w.hash, w.secret)
+	mac.Write(body)
+	signature := w.signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		var resp *Response
+		resp, err = w.client.NewRequest().
+			SetMethod(http.MethodPost).
+			SetUrl(w.url).
+			SetHeader(headerContentType, ContentTypeJson).
+			SetHeader(w.signatureHeader, signature).
+			BodyRaw(body).
+			DoCtx(ctx)
+		if err == nil {
+			err = resp.IsError()
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= w.attempts || !isRetryableError(err) || ctx.Err() != nil {
+			break
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = context.Cause(ctx)
+		case <-timer.C:
+		}
+
+		if ctx.Err() != nil {
+			break
 		}
+
+		backoff *= 2
 	}
 
-	err := w.Close()
-	if err != nil {
-		r.bodyErr = err
-		return r
+	if w.deadLetter != nil {
+		w.deadLetter(body, err)
 	}
 
-	r.body = body
-	r.SetHeader(headerContentType, w.FormDataContentType())
-	return r
+	return err
 }
 
-// do performs the request with the given [context.Context]
-func (r *Request) do(ctx context.Context) (*http.Response, error) {
-	var (
-		reqDump, resDump []byte
-		now              = time.Now()
-		statusCode       int
-		err              error
-	)
+// isRetryableError reports whether a request should be retried after the given error.
+// Requests failed without a response and responses with status code 429 or 5xx are retryable
+func isRetryableError(err error) bool {
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		return !errors.Is(err, ErrInvalidUrl)
+	}
+
+	return respErr.statusCode == http.StatusTooManyRequests || respErr.statusCode >= 500
+}
 
-	requestUrl := r.requestUrl()
+// ---------------------------------------------- //
+// Auth                                           //
+// ---------------------------------------------- //
 
-	defer func() {
-		if err == nil && r.isLogEnabled {
-			r.client.logger.log("%s", createLog(r.method, statusCode, requestUrl, time.Since(now), reqDump, resDump, r.debug))
-		}
-	}()
+// SetTokenSource sets the source of the Bearer tokens, which are sent in the Authorization header of every request
+// that does not have an Authorization header already. Failing to get a token fails the request without sending it
+func (c *Client) SetTokenSource(ts TokenSource) *Client {
+	c.tokenSource = ts
+	return c
+}
 
-	requestBody, err := r.requestBody()
+// NewJwtMinter creates a new [JwtMinter] which mints JWTs with the given claims template and lifetime.
+// The "iat" and "exp" claims are set when minting. The algorithm is chosen by the type of the key: []byte is signed
+// with HS256, [*crypto/rsa.PrivateKey] with RS256 and a P-256 [*crypto/ecdsa.PrivateKey] with ES256.
+// Other keys fail minting with [ErrUnsupportedKey]. A token is reused until 90% of its lifetime elapses by default
+func NewJwtMinter(key any, claims map[string]any, ttl time.Duration) *JwtMinter {
+	return &JwtMinter{
+		key:    key,
+		claims: maps.Clone(claims),
+		ttl:    ttl,
+	}
+}
+
+// SetKeyId sets the ID of the key sent in the "kid" header of the tokens
+func (m *JwtMinter) SetKeyId(keyId string) *JwtMinter {
+	m.keyId = keyId
+	return m
+}
+
+// SetPerRequest sets whether a new token is minted for every request instead of reusing it within its lifetime
+func (m *JwtMinter) SetPerRequest(perRequest bool) *JwtMinter {
+	m.perRequest = perRequest
+	return m
+}
+
+// Token implements the [TokenSource] interface
+func (m *JwtMinter) Token(context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if !m.perRequest && m.token != "" && now.Before(m.expiry.Add(-m.ttl/10)) {
+		return m.token, nil
+	}
+
+	token, err := m.mint(now)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	m.token = token
+	m.expiry = now.Add(m.ttl)
+	return token, nil
+}
+
+// mint mints a new token issued at the given time
+func (m *JwtMinter) mint(now time.Time) (string, error) {
+	var alg string
+	switch key := m.key.(type) {
+	case []byte:
+		alg = "HS256"
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		if key.Curve.Params().BitSize != 256 {
+			return "", fmt.Errorf("%w: ECDSA curve %s", ErrUnsupportedKey, key.Curve.Params().Name)
+		}
+		alg = "ES256"
+	default:
+		return "", fmt.Errorf("%w: %T", ErrUnsupportedKey, m.key)
 	}
 
-	req, err := r.createRequest(ctx, requestUrl, requestBody)
+	header := map[string]string{
+		"alg": alg,
+		"typ": "JWT",
+	}
+	if m.keyId != "" {
+		header["kid"] = m.keyId
+	}
+
+	claims := maps.Clone(m.claims)
+	if claims == nil {
+		claims = make(map[string]any)
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(m.ttl).Unix()
+
+	h, err := json.Marshal(header)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	if r.isLogEnabled && r.debug {
-		reqDump, _ = httputil.DumpRequestOut(req, r.debugBody)
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
 	}
 
-	resp, err := r.client.client.Do(req)
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	signature, err := signJwt(m.key, signingInput)
 	if err != nil {
-		select {
-		case <-r.ctx.Done():
-			err = fmt.Errorf("%v \"%v\": %w", strings.ToUpper(r.method), requestUrl, context.Cause(r.ctx))
-		default:
-		}
+		return "", err
+	}
 
-		return nil, err
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// signJwt signs the signing input of a JWT with the given key
+func signJwt(key any, signingInput string) ([]byte, error) {
+	if secret, ok := key.([]byte); ok {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		return mac.Sum(nil), nil
 	}
 
-	statusCode = resp.StatusCode
+	digest := sha256.Sum256([]byte(signingInput))
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(cryptorand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(cryptorand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
 
-	if r.isLogEnabled && r.debug {
-		resDump, _ = httputil.DumpResponse(resp, r.debugBody)
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
 	}
+}
 
-	return resp, nil
+// NewGcpTokenSource creates a new [MetadataTokenSource] that fetches the access tokens of the default service account
+// from the Google Cloud metadata server. If scopes are given, then the tokens are requested with those scopes
+func NewGcpTokenSource(scopes ...string) *MetadataTokenSource {
+	return newMetadataTokenSource(gcpMetadataUrl, func(ctx context.Context, c *Client) (string, time.Time, error) {
+		req := c.Get("/computeMetadata/v1/instance/service-accounts/default/token").
+			SetHeader("Metadata-Flavor", "Google")
+		if len(scopes) > 0 {
+			req.SetQueryParam("scopes", strings.Join(scopes, ","))
+		}
+
+		return fetchMetadataToken(ctx, req)
+	})
 }
 
-// DoCtx performs the request with the given [context.Context] and returns a response
-func (r *Request) DoCtx(ctx context.Context) (*Response, error) {
-	resp, err := r.do(ctx)
-	if err != nil {
-		return nil, err
+// NewAzureTokenSource creates a new [MetadataTokenSource] that fetches the access tokens of the managed identity
+// for the given resource e.g.: "https://management.azure.com/" from the Azure instance metadata service
+func NewAzureTokenSource(resource string) *MetadataTokenSource {
+	return newMetadataTokenSource(azureMetadataUrl, func(ctx context.Context, c *Client) (string, time.Time, error) {
+		req := c.Get("/metadata/identity/oauth2/token").
+			SetHeader("Metadata", "true").
+			SetQueryParam("api-version", "2018-02-01").
+			SetQueryParam("resource", resource)
+
+		return fetchMetadataToken(ctx, req)
+	})
+}
+
+// newMetadataTokenSource creates a new [MetadataTokenSource] with its own client, so that the tokens are not requested
+// through a client that uses the token source itself
+func newMetadataTokenSource(baseUrl string, fetch func(ctx context.Context, c *Client) (string, time.Time, error)) *MetadataTokenSource {
+	return &MetadataTokenSource{
+		client: newMetadataClient(baseUrl),
+		fetch:  fetch,
 	}
-	if r.cancel != nil {
-		r.cancel()
+}
+
+// Token implements the [TokenSource] interface
+func (s *MetadataTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expiry.Add(-metadataRefreshMargin)) {
+		return s.token, nil
 	}
-	defer resp.Body.Close()
 
-	responseBody, err := io.ReadAll(resp.Body)
+	token, expiry, err := s.fetch(ctx, s.client)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return &Response{
-		responseHeader: responseHeader{
-			status:     resp.Status,
-			statusCode: resp.StatusCode,
-			headers:    resp.Header,
-		},
-		body: responseBody,
-	}, nil
+	s.token = token
+	s.expiry = expiry
+	return token, nil
 }
 
-// Do performs the request using [context.Background]
-func (r *Request) Do() (*Response, error) {
-	return r.DoCtx(context.Background())
-}
+// fetchMetadataToken fetches an OAuth2 access token response from a metadata endpoint
+func fetchMetadataToken(ctx context.Context, req *Request) (string, time.Time, error) {
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
 
-// DoAsyncCtx performs an async request with the given [context.Context].
-// It returns an [AsyncResponse] channel which will receive the response when the request completes
-func (r *Request) DoAsyncCtx(ctx context.Context) <-chan AsyncResponse {
-	asyncResp := make(chan AsyncResponse, 1)
+	now := time.Now()
+	if err := fetchMetadata(ctx, req, &token); err != nil {
+		return "", time.Time{}, err
+	}
 
-	go func() {
-		resp, err := r.DoCtx(ctx)
-		asyncResp <- AsyncResponse{
-			Response: resp,
-			Err:      err,
-		}
-		close(asyncResp)
-	}()
+	expiresIn, err := token.ExpiresIn.Int64()
+	if err != nil {
+		return "", time.Time{}, err
+	}
 
-	return asyncResp
+	return token.AccessToken, now.Add(time.Duration(expiresIn) * time.Second), nil
 }
 
-// DoAsync performs an async request using [context.Background].
-// It returns an [AsyncResponse] channel which will receive the response when the request completes
-func (r *Request) DoAsync() <-chan AsyncResponse {
-	return r.DoAsyncCtx(context.Background())
+// NewAwsCredentialsProvider creates a new [AwsCredentialsProvider]
+func NewAwsCredentialsProvider() *AwsCredentialsProvider {
+	return &AwsCredentialsProvider{
+		client: newMetadataClient(awsMetadataUrl),
+	}
 }
 
-// DoStream performs a request using the given [context.Context] and returns a streaming response
-func (r *Request) DoStream(ctx context.Context) (*ResponseStream, error) {
-	r.headers.Set(headerAccept, ContentTypeTextEventStream)
-	r.headers.Set(headerCacheControl, "no-cache")
-	r.headers.Set(headerConnection, "keep-alive")
+// Credentials returns the credentials of the instance role, which are fetched again when they are about to expire
+func (p *AwsCredentialsProvider) Credentials(ctx context.Context) (AwsCredentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.credentials.AccessKeyId != "" && time.Now().Before(p.credentials.Expiration.Add(-metadataRefreshMargin)) {
+		return p.credentials, nil
+	}
 
-	resp, err := r.do(ctx)
+	resp, err := doMetadata(ctx, p.client.Put("/latest/api/token", nil).
+		SetHeader("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600"))
 	if err != nil {
-		return nil, err
+		return AwsCredentials{}, err
 	}
+	token := resp.BodyString()
 
-	return &ResponseStream{
-		responseHeader: responseHeader{
-			status:     resp.Status,
-			statusCode: resp.StatusCode,
-			headers:    resp.Header,
-		},
-		reader:   bufio.NewReader(resp.Body),
-		response: resp,
-		cancel:   r.cancel,
-	}, nil
+	resp, err = doMetadata(ctx, p.client.Get("/latest/meta-data/iam/security-credentials/").
+		SetHeader("X-Aws-Ec2-Metadata-Token", token))
+	if err != nil {
+		return AwsCredentials{}, err
+	}
+
+	role, _, _ := strings.Cut(strings.TrimSpace(resp.BodyString()), "\n")
+	if role == "" {
+		return AwsCredentials{}, errors.New("no instance role")
+	}
+
+	var credentials struct {
+		AccessKeyId     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+
+	req := p.client.Get("/latest/meta-data/iam/security-credentials/"+role).
+		SetHeader("X-Aws-Ec2-Metadata-Token", token)
+	if err := fetchMetadata(ctx, req, &credentials); err != nil {
+		return AwsCredentials{}, err
+	}
+
+	p.credentials = AwsCredentials{
+		AccessKeyId:     credentials.AccessKeyId,
+		SecretAccessKey: credentials.SecretAccessKey,
+		SessionToken:    credentials.Token,
+		Expiration:      credentials.Expiration,
+	}
+	return p.credentials, nil
 }
 
-// requestUrl creates the request url
-func (r *Request) requestUrl() string {
-	b := strings.Builder{}
+// newMetadataClient creates a new client for reaching a metadata endpoint
+func newMetadataClient(baseUrl string) *Client {
+	return NewClient().
+		SetBaseUrl(baseUrl).
+		SetTimeout(metadataTimeout).
+		SetLogEnabled(false)
+}
 
-	baseUrl := strings.TrimRight(r.baseUrl, "/")
-	if baseUrl != "" {
-		b.WriteString(baseUrl)
+// doMetadata performs the request to a metadata endpoint, a response with an error status code is returned as an error
+func doMetadata(ctx context.Context, req *Request) (*Response, error) {
+	resp, err := req.DoCtx(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	path := strings.TrimLeft(r.path, "/")
-	if path != "" {
+	if err := resp.IsError(); err != nil {
+		return nil, err
+	}
 
-		if b.Len() > 0 {
-			b.WriteString("/")
-		}
+	return resp, nil
+}
 
-		b.WriteString(path)
+// fetchMetadata performs the request to a metadata endpoint and unmarshals the JSON response into v
+func fetchMetadata(ctx context.Context, req *Request, v any) error {
+	resp, err := doMetadata(ctx, req)
+	if err != nil {
+		return err
 	}
 
-	return b.String()
+	return resp.UnmarshalJson(v)
 }
 
-// requestBody creates the request body
-func (r *Request) requestBody() (io.Reader, error) {
-	if r.bodyErr != nil {
-		return nil, r.bodyErr
+// ---------------------------------------------- //
+// Helpers                                        //
+// ---------------------------------------------- //
+
+// checkHost checks whether the given host matches any of the given patterns, any host is allowed if there are no patterns
+func checkHost(patterns []string, host string) error {
+	if len(patterns) == 0 {
+		return nil
 	}
 
-	if r.body == nil {
-		return http.NoBody, nil
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return nil
+		}
 	}
 
-	return r.body, nil
+	return fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
 }
 
-// createRequest creates a [net/http.Request]
-func (r *Request) createRequest(ctx context.Context, url string, body io.Reader) (*http.Request, error) {
-	var (
-		req  *http.Request
-		err  error
-		rctx context.Context
-	)
-
-	if r.timeout > 0 {
-		tctx, cancel := context.WithTimeoutCause(ctx, r.timeout, ErrRequestTimedOut)
-		r.cancel = cancel
-		rctx = tctx
-	} else {
-		rctx = ctx
+// qualityList joins the given values in the order of preference for a header like Accept, assigning descending quality values
+// to the values after the first one unless they already have a q parameter. The quality values decrease in steps of 0.1
+// for up to 10 values and in steps of 0.001 for more, down to 0.001
+func qualityList(values []string) string {
+	step := 100
+	if len(values) > 10 {
+		step = 1
 	}
 
-	r.ctx = rctx
-	req, err = http.NewRequestWithContext(rctx, r.method, url, body)
-	if err != nil {
-		return nil, err
+	list := make([]string, 0, len(values))
+	for i, v := range values {
+		if i > 0 && !hasQuality(v) {
+			q := max(1000-i*step, 1)
+			v = fmt.Sprintf("%s;q=0.%s", v, strings.TrimRight(fmt.Sprintf("%03d", q), "0"))
+		}
+
+		list = append(list, v)
 	}
 
-	req.Header = r.headers
+	return strings.Join(list, ", ")
+}
 
-	query := req.URL.Query()
-	for k, vs := range r.queryParams {
-		for _, v := range vs {
-			query.Set(k, v)
+// hasQuality reports whether the given value of a header like Accept has a q parameter
+func hasQuality(value string) bool {
+	_, params, _ := strings.Cut(value, ";")
+	for _, param := range strings.Split(params, ";") {
+		key, _, _ := strings.Cut(param, "=")
+		if strings.EqualFold(strings.TrimSpace(key), "q") {
+			return true
 		}
 	}
 
-	req.URL.RawQuery = query.Encode()
+	return false
+}
 
-	return req, nil
+// checkJsonFormat returns an error wrapping [ErrUnsupportedFormat] if the data does not start with the given JSON delimiter
+func checkJsonFormat(data []byte, delim byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != delim {
+		return fmt.Errorf("%w: expected JSON starting with %q", ErrUnsupportedFormat, delim)
+	}
+
+	return nil
 }
 
-// resetBody resets the request body and bodyErr if subsequent SetBody* functions are called on the request
-func (r *Request) resetBody() {
-	r.body = nil
-	r.bodyErr = nil
+// Read implements the [io.Reader] interface
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
 }
 
-// ---------------------------------------------- //
-// ResponseHeader                                 //
-// ---------------------------------------------- //
+// writeTarGz writes a gzip compressed tar archive of the given files and directories to w.
+// Entries which are neither regular files nor directories e.g.: symbolic links are skipped
+func writeTarGz(w io.Writer, paths []string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for _, root := range paths {
+		base := filepath.Dir(filepath.Clean(root))
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
 
-// Status returns the status of a response
-func (r *responseHeader) Status() string {
-	return r.status
-}
+			if !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
 
-// StatusCode returns the status code of a response
-func (r *responseHeader) StatusCode() int {
-	return r.statusCode
-}
+			name, err := filepath.Rel(base, p)
+			if err != nil || name == "." {
+				return err
+			}
 
-// Headers returns the response headers
-func (r *responseHeader) Headers() http.Header {
-	return r.headers
-}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
 
-// GetHeader is a convenience method to retrieve a single response header value
-func (r *responseHeader) GetHeader(key string) string {
-	return r.headers.Get(key)
-}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
 
-// ---------------------------------------------- //
-// Response                                       //
-// ---------------------------------------------- //
+			header.Name = filepath.ToSlash(name)
+			if d.IsDir() {
+				header.Name += "/"
+			}
 
-// BodyRaw returns the response body as a byte slice
-func (r *Response) BodyRaw() []byte {
-	return r.body
-}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
 
-// BodyString returns the response body as string
-func (r *Response) BodyString() string {
-	return string(r.body)
-}
+			if d.IsDir() {
+				return nil
+			}
 
-// IsError returns a non nil error if the response is considered as an error based on the status code.
-// The error's type will be [*ResponseError]
-func (r *Response) IsError() error {
-	if r.statusCode < 200 || r.statusCode >= 400 {
-		return &ResponseError{
-			responseHeader: r.responseHeader,
-			body:           r.body,
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
 		}
 	}
 
-	return nil
-}
+	if err := tw.Close(); err != nil {
+		return err
+	}
 
-// Unmarshal is a convenience method that can receive a [ResponseUnmarshaler] callback
-// function that performs the unmarshalling of the response body
-func (r *Response) Unmarshal(u ResponseUnmarshaler) error {
-	return u(r)
+	return gw.Close()
 }
 
-// ---------------------------------------------- //
-// ResponseError                                  //
-// ---------------------------------------------- //
+// newExtractor creates a new extractor, the zero limits are replaced by the defaults
+func newExtractor(dir string, limits ExtractLimits) *extractor {
+	if limits.MaxFiles <= 0 {
+		limits.MaxFiles = DefaultExtractMaxFiles
+	}
 
-// Error implements the error interface
-func (r ResponseError) Error() string {
-	return fmt.Sprintf("[%v] %s", r.status, r.body)
-}
+	if limits.MaxFileSize <= 0 {
+		limits.MaxFileSize = DefaultExtractMaxSize
+	}
 
-// BodyRaw returns the response body as a byte slice
-func (r *ResponseError) BodyRaw() []byte {
-	return r.body
-}
+	if limits.MaxTotalSize <= 0 {
+		limits.MaxTotalSize = DefaultExtractMaxSize
+	}
 
-// BodyString returns the response body as string
-func (r *ResponseError) BodyString() string {
-	return string(r.body)
+	return &extractor{
+		dir:    dir,
+		limits: limits,
+	}
 }
 
-// ---------------------------------------------- //
-// ResponseStream                                 //
-// ---------------------------------------------- //
+// extract extracts a single entry of the archive. Directories and regular files are extracted, links are rejected
+// and other entries are skipped
+func (x *extractor) extract(name string, mode fs.FileMode, open func() (io.ReadCloser, error)) error {
+	local := filepath.FromSlash(name)
+	if !filepath.IsLocal(local) || mode&fs.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %s", ErrUnsafeArchivePath, name)
+	}
 
-// RecvFunc can receive a [StreamReceiver] callback function that performs
-// the stream reading of the streamed response body
-func (r *ResponseStream) RecvFunc(sr StreamReceiver) error {
-	return sr(r.reader)
-}
+	target := filepath.Join(x.dir, local)
+	if mode.IsDir() {
+		return os.MkdirAll(target, 0o755)
+	}
 
-// Recv reads up to n bytes from a streamed response body
-func (r *ResponseStream) Recv(n uint) ([]byte, error) {
-	b := make([]byte, n)
-	nn, err := r.reader.Read(b)
+	if !mode.IsRegular() {
+		return nil
+	}
+
+	x.files++
+	if x.files > x.limits.MaxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrArchiveTooLarge, x.limits.MaxFiles)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	rc, err := open()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return b[:nn], nil
-}
+	defer rc.Close()
 
-// Close closes the streamed response body and additionally frees up any
-// resources associated with the [context.Context] used to perform the streamed request
-func (r *ResponseStream) Close() {
-	r.response.Body.Close()
-	if r.cancel != nil {
-		r.cancel()
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0o600)
+	if err != nil {
+		return err
 	}
-}
+	defer f.Close()
 
-// ---------------------------------------------- //
-// MultipartFormFile                              //
-// ---------------------------------------------- //
+	limit := min(x.limits.MaxFileSize, x.limits.MaxTotalSize-x.total)
+	n, err := io.CopyN(f, rc, limit+1)
+	x.total += n
+	if err != nil && err != io.EOF {
+		return err
+	}
 
-// NewMultipartFormFile creates a new multipartform file by reading the file from the given filepath
-func NewMultipartFormFile(name string, filePath string) multipartFormFile {
-	return multipartFormFile{
-		filePath:  filePath,
-		fieldName: name,
+	if n > limit {
+		return fmt.Errorf("%w: %s exceeds the size limit", ErrArchiveTooLarge, name)
 	}
+
+	return f.Close()
 }
 
-// NewMultipartFormFileReader creates a new multipartform file by using the given [io.Reader]
-func NewMultipartFormFileReader(name, fileName string, r io.Reader) multipartFormFile {
-	return multipartFormFile{
-		reader:    r,
-		fieldName: name,
-		fileName:  fileName,
+// saveToDir writes the body to a temporary file in the given directory and renames it to the name of the attachment
+func saveToDir(dir string, header *responseHeader, body io.Reader) (string, error) {
+	name := header.attachmentName()
+
+	f, err := os.CreateTemp(dir, ".pingo-*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	tmp := f.Name()
+	_, err = io.Copy(f, body)
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	filePath := filepath.Join(dir, name)
+	if err := os.Rename(tmp, filePath); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return filePath, nil
 }
 
-// write writes the contents of the file to the given [mime/multipart.Writer]
-func (f *multipartFormFile) write(w *multipart.Writer) error {
-	if f.reader == nil {
-		ff, err := os.Open(f.filePath)
-		if err != nil {
-			return err
+// attachmentName returns the sanitized filename of the Content-Disposition header or the last segment of the URL path,
+// or [defaultDownloadName] if neither is usable
+func (r *responseHeader) attachmentName() string {
+	if _, filename := r.ContentDisposition(); filename != "" {
+		if name := sanitizeFilename(filename); name != "" {
+			return name
 		}
-		defer ff.Close()
-		f.reader = ff
-		f.fileName = path.Base(ff.Name())
 	}
 
-	pw, err := w.CreateFormFile(f.fieldName, f.fileName)
-	if err != nil {
-		return err
+	if u, err := url.Parse(r.url); err == nil {
+		if name := sanitizeFilename(u.Path); name != "" {
+			return name
+		}
 	}
 
-	_, err = io.Copy(pw, f.reader)
-	if err != nil {
-		return err
+	return defaultDownloadName
+}
+
+// sanitizeFilename returns the last element of the given path without the characters which are not allowed in filenames
+// on common platforms, or an empty string if nothing usable remains
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.Trim(name, " .")
+	if len(name) > maxFilenameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > maxFilenameLength/2 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFilenameLength-len(ext)], "") + ext
 	}
 
-	return nil
+	return name
 }
 
-// ---------------------------------------------- //
-// Helpers                                        //
-// ---------------------------------------------- //
+// unmarshalJson unmarshals the JSON data into v using the given decoder, or [encoding/json.Unmarshal] if it is nil
+func unmarshalJson(data []byte, v any, decoder BodyDecoder) error {
+	if decoder == nil {
+		return json.Unmarshal(data, v)
+	}
+
+	return decoder(data, v)
+}
+
+// newRequestId creates a random version 4 UUID, which is the default request ID
+func newRequestId() string {
+	var b [16]byte
+	cryptorand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
 
 // setValues is a helper function that sets [net/http.Header] or [net/url.Values]
 func setValues[T http.Header | url.Values](src, dst T) {
@@ -1006,6 +9411,42 @@ func addValues[T http.Header | url.Values](src, dst T) {
 	}
 }
 
+// cloneValues is a helper function that creates a deep copy of [net/http.Header] or [net/url.Values]
+func cloneValues[T http.Header | url.Values](src T) T {
+	dst := make(T, len(src))
+	for k, vs := range src {
+		dst[k] = slices.Clone(vs)
+	}
+
+	return dst
+}
+
+// mergeValues is a helper function that merges src into a copy of dst.
+// Keys in overridden are left untouched
+func mergeValues[T http.Header | url.Values](src, dst T, overridden map[string]struct{}) T {
+	merged := cloneValues(dst)
+	for k, vs := range src {
+		if _, ok := overridden[k]; ok {
+			continue
+		}
+
+		merged[k] = slices.Clone(vs)
+	}
+
+	return merged
+}
+
+// isConnectionError reports whether the error signals that the host could not be reached
+func isConnectionError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
 // formatDump formats the given dump
 func formatDump(label string, dump []byte) string {
 	sb := strings.Builder{}
@@ -1058,13 +9499,183 @@ func debugLog(reqDump, resDump []byte) string {
 	return sb.String()
 }
 
-// createLog creates a log message for the request
-func createLog(method string, statusCode int, url string, duration time.Duration, reqDump, resDump []byte, debug bool) string {
+// createProfileLog creates a log message with the timings of the phases of the request
+func createProfileLog(method string, statusCode int, url string, t Timings) string {
+	return fmt.Sprintf("%v | %v | %v | %v | dns %v | connect %v | tls %v | ttfb %v | transfer %v",
+		method, statusCode, url, t.Total, t.DNS, t.Connect, t.TLS, t.TTFB, t.Transfer)
+}
+
+// newDebugRequest creates the debug output of the request and returns the request to be sent instead of it,
+// see [peekBody]. The body is read without consuming it if includeBody is true
+func newDebugRequest(req *http.Request, includeBody bool, limit int) (*debugMessage, *http.Request) {
+	msg := &debugMessage{
+		Headers: req.Header.Clone(),
+	}
+
+	if includeBody {
+		var body []byte
+		body, req, _ = peekBody(req)
+		msg.Body, msg.BodyTruncated = formatDebugBody(body, req.Header.Get(headerContentType), limit)
+	}
+
+	return msg, req
+}
+
+// newDebugResponse creates the debug output of the response. If includeBody is true, then the body is read
+// and replaced by an in-memory copy, the same way as [net/http/httputil.DumpResponse] does
+func newDebugResponse(resp *http.Response, includeBody bool, limit int) *debugMessage {
+	msg := &debugMessage{
+		Headers: resp.Header.Clone(),
+	}
+
+	if includeBody && resp.Body != nil && resp.Body != http.NoBody {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var r io.Reader = bytes.NewReader(body)
+		if err != nil {
+			// the read error is returned after the data read so far
+			r = io.MultiReader(r, &errReader{err: err})
+		}
+
+		resp.Body = io.NopCloser(r)
+		msg.Body, msg.BodyTruncated = formatDebugBody(body, resp.Header.Get(headerContentType), limit)
+	}
+
+	return msg
+}
+
+// formatDebugBody formats the body for the debug output. Binary bodies are replaced by a placeholder
+// and text bodies longer than the limit are truncated, which is reported by the returned bool
+func formatDebugBody(body []byte, contentType string, limit int) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+
+	if !isTextBody(body, contentType) {
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		return fmt.Sprintf("[binary: %d bytes, content-type %s]", len(body), contentType), false
+	}
+
+	if limit > 0 && len(body) > limit {
+		return strings.ToValidUTF8(string(body[:limit]), ""), true
+	}
+
+	return string(body), false
+}
+
+// formatDumpBody formats the body of the given request or response dump, see [formatDebugBody].
+// A note with the total size is appended to truncated bodies
+func formatDumpBody(dump []byte, contentType string, limit int) []byte {
+	header, body, found := bytes.Cut(dump, []byte("\r\n\r\n"))
+	if !found || len(body) == 0 {
+		return dump
+	}
+
+	formatted, truncated := formatDebugBody(body, contentType, limit)
+	if truncated {
+		formatted += fmt.Sprintf("... [truncated, %d bytes total]", len(body))
+	}
+
+	return slices.Concat(header, []byte("\r\n\r\n"), []byte(formatted))
+}
+
+// isTextBody reports whether the body is text based on the content type, or by sniffing it if the content type is empty
+func isTextBody(body []byte, contentType string) bool {
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return utf8.Valid(body)
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"),
+		strings.HasPrefix(mediaType, "multipart/form-data"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", ContentTypeFormUrlEncoded, "application/x-ndjson":
+		return true
+	}
+
+	return false
+}
+
+// createJsonLog creates a single line JSON log message for the request with the debug output
+func createJsonLog(method string, statusCode int, url string, duration time.Duration, reqMsg, resMsg *debugMessage, proxy string, trace *requestTrace, err error) string {
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	timings := trace.timings(time.Time{})
+	entry := debugEntry{
+		Method:     method,
+		Url:        url,
+		StatusCode: statusCode,
+		DurationMs: ms(duration),
+		Attempt:    trace.attempt,
+		RequestId:  trace.requestId,
+		Proxy:      proxy,
+		Request:    reqMsg,
+		Response:   resMsg,
+		Timings: debugTimings{
+			DNS:     ms(timings.DNS),
+			Connect: ms(timings.Connect),
+			TLS:     ms(timings.TLS),
+			TTFB:    ms(timings.TTFB),
+		},
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf("%v | %v | %v | %v | %v", method, statusCode, url, duration, err)
+	}
+
+	return string(b)
+}
+
+// createLog creates a log message for the request. The attempt number is included if it is not the first attempt
+// and the error is included if the request failed. The request ID is included if it is enabled and the proxy is included in debug mode
+func createLog(method string, statusCode int, url string, duration time.Duration, reqDump, resDump []byte, debug bool, proxy string, attempt int, requestId string, err error) string {
+	summary := createSummary(method, statusCode, url, duration, debug, proxy, attempt, requestId, err)
+	if !debug {
+		return summary
+	}
+
+	return fmt.Sprintf("%s\n%s", summary, debugLog(reqDump, resDump))
+}
+
+// createSummary creates the single line summary of a request
+func createSummary(method string, statusCode int, url string, duration time.Duration, debug bool, proxy string, attempt int, requestId string, err error) string {
 	sb := strings.Builder{}
 	fmt.Fprintf(&sb, "%v | %v | %v | %v", method, statusCode, url, duration)
 
 	if debug {
-		fmt.Fprintf(&sb, "\n%s", debugLog(reqDump, resDump))
+		fmt.Fprintf(&sb, " | proxy %v", proxy)
+	}
+
+	if attempt > 1 {
+		fmt.Fprintf(&sb, " | attempt %d", attempt)
+	}
+
+	if requestId != "" {
+		fmt.Fprintf(&sb, " | id %s", requestId)
+	}
+
+	if err != nil {
+		fmt.Fprintf(&sb, " | %v", err)
 	}
 
 	return sb.String()
@@ -1,21 +1,51 @@
 package pingo
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
+	"unsafe"
 )
 
 // assertEqual fails if the two values are not equal
@@ -68,6 +98,54 @@ func testServer(t *testing.T) *httptest.Server {
 		w.Write(b)
 	})
 
+	mux.HandleFunc("/negotiate", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Accept"), "application/xml") {
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<data><name>pingo</name></data>`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+		w.Write([]byte(`{"name":"pingo"}`))
+	})
+
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.URL.RawQuery))
+	})
+
+	mux.HandleFunc("/pages", func(w http.ResponseWriter, r *http.Request) {
+		cursor, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		next := ""
+		if cursor < 2 {
+			next = strconv.Itoa(cursor + 1)
+		}
+
+		w.Header().Set(headerContentType, ContentTypeJson)
+		json.NewEncoder(w).Encode(map[string]any{
+			"items": []int{cursor * 2, cursor*2 + 1},
+			"next":  next,
+		})
+	})
+
+	mux.HandleFunc("/etag", func(w http.ResponseWriter, r *http.Request) {
+		lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		http.ServeContent(w, r, "", lastModified, bytes.NewReader([]byte("content")))
+	})
+
+	mux.HandleFunc("/trailers", func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			sendError(w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Trailer", "X-Echo")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+		w.Header().Set("X-Echo", r.Trailer.Get("X-Checksum"))
+	})
+
 	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("pong"))
@@ -94,6 +172,27 @@ func testServer(t *testing.T) *httptest.Server {
 		}
 	})
 
+	mux.HandleFunc("/stream-idle", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data"))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	mux.HandleFunc("/lines", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range []string{"fo", "o\r\nb", "ar\n", "baz"} {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
 	mux.HandleFunc("/multipart-form", func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseMultipartForm(4096)
 		if err != nil {
@@ -214,6 +313,32 @@ func TestClientSettings(t *testing.T) {
 	assertEqual(t, c.logger.flags(), flags)
 }
 
+func TestLogCaller(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(Fshortfile).
+		SetBaseUrl(server.URL).
+		SetFallbackBaseUrl(server.URL)
+
+	_, err := c.Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Get("/ping").DoCtx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		assertEqual(t, strings.Contains(line, "] pingo_test.go:"), true)
+	}
+}
+
 func TestRequestSettings(t *testing.T) {
 	r := NewClient().NewRequest()
 
@@ -803,3 +928,4931 @@ func TestAsyncRequest(t *testing.T) {
 	assertEqual(t, e.BodyString(), "error")
 	assertEqual(t, e.StatusCode(), http.StatusInternalServerError)
 }
+
+func TestHostConfig(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetHeader("X-Client", "client").
+		SetHeader("X-Override", "client")
+
+	c.Host(u.Hostname()).
+		SetHeader("X-Host", "host").
+		SetHeader("X-Override", "host").
+		SetQueryParam("host", "1")
+
+	resp, err := c.NewRequest().
+		SetMethod(http.MethodPost).
+		SetPath("/echo").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("X-Client"), "client")
+	assertEqual(t, resp.GetHeader("X-Host"), "host")
+	assertEqual(t, resp.GetHeader("X-Override"), "host")
+
+	resp, err = c.NewRequest().
+		SetMethod(http.MethodPost).
+		SetPath("/echo").
+		SetHeader("X-Override", "request").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("X-Override"), "request")
+	assertEqual(t, c.headers.Get("X-Override"), "client")
+
+	resp, err = c.NewRequest().
+		SetMethod(http.MethodPost).
+		SetPath("/echo").
+		SetHeader("X-Override", "client").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("X-Override"), "client")
+
+	resp, err = c.NewRequest().SetPath("/query").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "host=1")
+
+	// ----------------------------------------------------
+
+	c.Host(u.Hostname()).SetTimeout(time.Nanosecond)
+
+	_, err = c.NewRequest().SetPath("/ping").Do()
+	assertEqual(t, errors.Is(err, ErrRequestTimedOut), true)
+
+	_, err = c.NewRequest().SetPath("/ping").SetTimeout(c.timeout).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Host(u.Hostname()).SetTimeout(0)
+
+	// ----------------------------------------------------
+
+	c.Host(u.Host).SetRateLimit(20, 1)
+
+	now := time.Now()
+	for range 3 {
+		_, err := c.NewRequest().SetPath("/ping").Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEqual(t, time.Since(now) >= 90*time.Millisecond, true)
+}
+
+func TestEndpoint(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Endpoint("ping", http.MethodGet, "/{name}").
+		Endpoint("echo", http.MethodPost, "/echo")
+
+	r := c.Request("ping").SetPathParam("name", "ping")
+	assertEqual(t, r.Endpoint(), "ping")
+
+	resp, err := r.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+
+	resp, err = c.Request("echo").BodyRaw([]byte("hello")).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "hello")
+
+	resp, err = c.Request("unknown").Do()
+	assertEqual(t, errors.Is(err, ErrEndpointNotFound), true)
+	assertEqual(t, resp, nil)
+}
+
+func TestFallbackBaseUrl(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl("http://127.0.0.1:1").
+		SetFallbackBaseUrl(server.URL)
+
+	resp, err := c.NewRequest().
+		SetMethod(http.MethodPost).
+		SetPath("/echo").
+		BodyRaw([]byte("hello")).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "hello")
+
+	// ----------------------------------------------------
+
+	_, err = c.NewRequest().
+		SetBaseUrl("http://127.0.0.1:2").
+		SetPath("/ping").
+		Do()
+	assertEqual(t, isConnectionError(err), true)
+}
+
+func TestStreamTee(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	resp, err := NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/stream").
+		DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := t.TempDir() + "/stream.txt"
+	if err := resp.TeeFile(filePath); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	resp.Tee(buf)
+
+	str := ""
+	for {
+		b, err := resp.Recv(128)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			t.Fatal(err)
+		}
+
+		str += string(b)
+	}
+	resp.Close()
+
+	file, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, str, "abcdefghijklmnopqrstuvwxyz0123456789")
+	assertEqual(t, buf.String(), str)
+	assertEqual(t, string(file), str)
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	resp, err := NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/stream-idle").
+		DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+
+	resp.SetIdleTimeout(100 * time.Millisecond)
+
+	b, err := resp.Recv(128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, string(b), "data")
+
+	now := time.Now()
+	_, err = resp.Recv(128)
+	assertEqual(t, errors.Is(err, ErrStreamIdle), true)
+	assertEqual(t, time.Since(now) < time.Second, true)
+}
+
+func TestStreamLines(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	resp, err := NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/lines").
+		DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+
+	lines := []string{}
+	for line, err := range resp.Lines() {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines = append(lines, line)
+	}
+
+	assertEqual(t, reflect.DeepEqual(lines, []string{"foo", "bar", "baz"}), true)
+
+	// ----------------------------------------------------
+
+	resp, err = NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/lines").
+		DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+
+	frames := []string{}
+	for b, err := range resp.RecvDelim('r') {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frames = append(frames, string(b))
+	}
+
+	assertEqual(t, reflect.DeepEqual(frames, []string{"foo\r\nba", "\nbaz"}), true)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	body := bytes.Repeat([]byte("a"), 60000)
+
+	now := time.Now()
+	resp, err := NewClient().
+		SetLogEnabled(false).
+		SetBandwidthLimit(50000).
+		NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/echo").
+		SetMethod(http.MethodPost).
+		BodyRaw(body).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, bytes.Equal(resp.BodyRaw(), body), true)
+	assertEqual(t, time.Since(now) >= time.Second, true)
+}
+
+func TestConnInfo(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	for i, reused := range []bool{false, true} {
+		resp, err := c.NewRequest().SetPath("/ping").Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, resp.ConnInfo().Reused, reused)
+		assertEqual(t, resp.ConnInfo().WasIdle, i > 0)
+	}
+
+	// ----------------------------------------------------
+
+	c = NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		DisableKeepAlives(true)
+
+	for range 2 {
+		resp, err := c.NewRequest().SetPath("/ping").Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, resp.ConnInfo().Reused, false)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport)
+	c = NewClient().
+		SetClient(http.DefaultClient).
+		DisableKeepAlives(true)
+
+	assertEqual(t, c.client != http.DefaultClient, true)
+	assertEqual(t, c.client.Transport != http.DefaultTransport, true)
+	assertEqual(t, http.DefaultClient.Transport, nil)
+	assertEqual(t, transport.DisableKeepAlives, false)
+
+	own := &http.Transport{}
+	c = NewClient().
+		SetClient(&http.Client{Transport: own}).
+		DisableKeepAlives(true)
+
+	assertEqual(t, own.DisableKeepAlives, false)
+	assertEqual(t, c.client.Transport.(*http.Transport).DisableKeepAlives, true)
+}
+
+func TestIPVersion(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	resp, err := NewClient().
+		SetLogEnabled(false).
+		SetIPVersion(IPv4Only).
+		NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/ping").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+
+	resp, err = NewClient().
+		SetLogEnabled(false).
+		SetIPVersion(IPv6Only).
+		NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/ping").
+		Do()
+
+	if err == nil {
+		t.Fatal("err is nil")
+	}
+
+	assertEqual(t, resp, nil)
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	r := NewRequest().
+		SetConnectTimeout(time.Second).
+		SetTLSHandshakeTimeout(2 * time.Second).
+		SetResponseHeaderTimeout(3 * time.Second)
+
+	assertEqual(t, r.connectTimeout, time.Second)
+	assertEqual(t, r.tlsHandshakeTimeout, 2*time.Second)
+	assertEqual(t, r.responseHeaderTimeout, 3*time.Second)
+
+	now := time.Now()
+	resp, err := NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/timeout").
+		SetResponseHeaderTimeout(100 * time.Millisecond).
+		Do()
+
+	assertEqual(t, resp, nil)
+	assertEqual(t, errors.Is(err, ErrResponseHeaderTimeout), true)
+	assertEqual(t, time.Since(now) < 500*time.Millisecond, true)
+
+	// ----------------------------------------------------
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetConnectTimeout(time.Second).
+		SetTLSHandshakeTimeout(2 * time.Second).
+		SetResponseHeaderTimeout(100 * time.Millisecond)
+
+	assertEqual(t, c.dialer.Timeout, time.Second)
+	assertEqual(t, c.transport().TLSHandshakeTimeout, 2*time.Second)
+
+	resp, err = c.NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/timeout").
+		Do()
+
+	if err == nil {
+		t.Fatal("err is nil")
+	}
+
+	assertEqual(t, resp, nil)
+}
+
+func TestTimeoutError(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	resp, err := NewClient().
+		SetLogOutput(buf).
+		NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/timeout").
+		SetTimeout(200 * time.Millisecond).
+		Do()
+
+	assertEqual(t, resp, nil)
+	assertEqual(t, errors.Is(err, ErrRequestTimedOut), true)
+
+	var e *TimeoutError
+	assertEqual(t, errors.As(err, &e), true)
+	assertEqual(t, e.Phase, "headers")
+	assertEqual(t, e.Attempt, 1)
+	assertEqual(t, e.Elapsed >= 200*time.Millisecond, true)
+	assertEqual(t, bytes.Contains(buf.Bytes(), []byte("phase: headers")), true)
+}
+
+func TestErrorClass(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	_, err := NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/timeout").
+		SetTimeout(100 * time.Millisecond).
+		Do()
+
+	var e *Error
+	assertEqual(t, errors.As(err, &e), true)
+	assertEqual(t, e.Class, ErrClassTimeout)
+	assertEqual(t, e.Method, http.MethodGet)
+	assertEqual(t, e.Url, server.URL+"/timeout")
+	assertEqual(t, IsTimeout(err), true)
+	assertEqual(t, IsTemporary(err), true)
+
+	_, err = NewRequest().
+		SetBaseUrl("http://127.0.0.1:1").
+		SetLogEnabled(false).
+		Do()
+	assertEqual(t, ClassifyError(err), ErrClassNetwork)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/ping").
+		DoCtx(ctx)
+	assertEqual(t, ClassifyError(err), ErrClassCanceled)
+
+	resp, err := NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/error").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = resp.IsError()
+	assertEqual(t, ClassifyError(err), ErrClassHTTPStatus)
+	assertEqual(t, IsStatus(err, http.StatusInternalServerError), true)
+	assertEqual(t, IsStatus(err, http.StatusNotFound), false)
+	assertEqual(t, IsTemporary(err), false)
+
+	err = resp.Unmarshal(func(r *Response) error {
+		return errors.New("yikes")
+	})
+	assertEqual(t, ClassifyError(err), ErrClassDecode)
+	assertEqual(t, err.Error(), "yikes")
+
+	assertEqual(t, ClassifyError(&net.DNSError{Err: "no such host"}), ErrClassDNS)
+	assertEqual(t, ClassifyError(x509.UnknownAuthorityError{}), ErrClassTLS)
+	assertEqual(t, ClassifyError(errors.New("yikes")), ErrClassUnknown)
+	assertEqual(t, ErrClassDNS.String(), "dns")
+}
+
+func TestValidateSchema(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	schema := []byte(`{
+		"type": "object",
+		"required": ["Success"],
+		"properties": {
+			"Success": {"$ref": "#/$defs/flag"}
+		},
+		"additionalProperties": false,
+		"$defs": {
+			"flag": {"type": "boolean", "const": true}
+		}
+	}`)
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Endpoint("json", http.MethodGet, "/json").
+		SetSchema("json", schema)
+
+	resp, err := c.Request("json").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.Validate(), nil)
+
+	err = resp.ValidateSchema([]byte(`{
+		"type": "object",
+		"required": ["id", "name"],
+		"properties": {
+			"Success": {"type": "string"}
+		}
+	}`))
+
+	var e *SchemaError
+	assertEqual(t, errors.As(err, &e), true)
+	assertEqual(t, ClassifyError(err), ErrClassDecode)
+	assertEqual(t, reflect.DeepEqual(e.Violations, []SchemaViolation{
+		{Path: "$", Message: `missing required property "id"`},
+		{Path: "$", Message: `missing required property "name"`},
+		{Path: "$.Success", Message: "expected type string, got boolean"},
+	}), true)
+
+	resp, err = c.NewRequest().SetPath("/json").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.Validate(), nil)
+}
+
+func TestBodyText(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		contentType string
+		body        []byte
+		want        string
+	}{
+		{"text/plain; charset=iso-8859-1", []byte{'c', 'a', 'f', 0xe9}, "café"},
+		{"text/plain; charset=windows-1252", []byte{0x80, '1'}, "€1"},
+		{"text/plain; charset=utf-16le", []byte{'h', 0, 'i', 0}, "hi"},
+		{"text/plain", []byte{0xfe, 0xff, 0, 'h', 0, 'i'}, "hi"},
+		{"text/plain", []byte("héllo"), "héllo"},
+	} {
+		resp, err := NewRequest().
+			SetBaseUrl(server.URL).
+			SetPath("/echo").
+			SetMethod(http.MethodPost).
+			SetHeader(headerContentType, tc.contentType).
+			BodyRaw(tc.body).
+			Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		text, err := resp.BodyText()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, text, tc.want)
+	}
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.NewRequest().
+		SetPath("/echo").
+		SetMethod(http.MethodPost).
+		SetHeader(headerContentType, "text/plain; charset=x-pingo").
+		BodyRaw([]byte("abc")).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = resp.BodyText()
+	assertEqual(t, errors.Is(err, ErrUnsupportedCharset), true)
+
+	c.SetCharsetDecoder("X-Pingo", func(b []byte) (string, error) {
+		return strings.ToUpper(string(b)), nil
+	})
+
+	_, err = resp.BodyText()
+	assertEqual(t, errors.Is(err, ErrUnsupportedCharset), true)
+
+	resp, err = c.NewRequest().
+		SetPath("/echo").
+		SetMethod(http.MethodPost).
+		SetHeader(headerContentType, "text/plain; charset=x-pingo").
+		BodyRaw([]byte("abc")).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := resp.BodyText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, text, "ABC")
+
+	resp, err = NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/echo").
+		SetMethod(http.MethodPost).
+		SetHeader(headerContentType, "text/plain; charset=x-pingo").
+		BodyRaw([]byte("abc")).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = resp.BodyText()
+	assertEqual(t, errors.Is(err, ErrUnsupportedCharset), true)
+}
+
+func TestCollectAll(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	extract := func(resp *Response, next *Request) ([]int, bool, error) {
+		var page struct {
+			Items []int  `json:"items"`
+			Next  string `json:"next"`
+		}
+
+		if err := json.Unmarshal(resp.BodyRaw(), &page); err != nil {
+			return nil, false, err
+		}
+
+		next.SetQueryParam("cursor", page.Next)
+		return page.Items, page.Next != "", nil
+	}
+
+	newRequest := func() *Request {
+		return NewRequest().
+			SetBaseUrl(server.URL).
+			SetPath("/pages").
+			SetLogEnabled(false)
+	}
+
+	items, err := CollectAll(context.Background(), newRequest(), extract)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, reflect.DeepEqual(items, []int{0, 1, 2, 3, 4, 5}), true)
+
+	items, err = CollectAllN(context.Background(), newRequest(), extract, 2)
+	assertEqual(t, errors.Is(err, ErrTooManyPages), true)
+	assertEqual(t, reflect.DeepEqual(items, []int{0, 1, 2, 3}), true)
+}
+
+func TestLoggerFlagValues(t *testing.T) {
+	assertEqual(t, Fshortfile, 8)
+	assertEqual(t, Flongfile, 16)
+	assertEqual(t, Ftime, 32)
+	assertEqual(t, FtimeUTC, 64)
+}
+
+func TestConditionalRequest(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerETag, `"v1"`)
+		if r.Header.Get(headerIfNoneMatch) == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("content"))
+	})
+	etagServer := httptest.NewServer(mux)
+	defer etagServer.Close()
+
+	c := NewClient().SetLogEnabled(false)
+
+	resp, err := c.NewRequest().SetBaseUrl(etagServer.URL).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.IsError(), nil)
+	assertEqual(t, resp.ETag(), `"v1"`)
+
+	resp, err = c.NewRequest().SetBaseUrl(etagServer.URL).SetIfNoneMatch(resp.ETag()).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.StatusCode(), http.StatusNotModified)
+	assertEqual(t, errors.Is(resp.IsError(), ErrNotModified), true)
+
+	// ----------------------------------------------------
+
+	resp, err = c.NewRequest().SetBaseUrl(server.URL).SetPath("/etag").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastModified := resp.LastModified()
+	assertEqual(t, lastModified.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)), true)
+
+	resp, err = c.NewRequest().SetBaseUrl(server.URL).SetPath("/etag").SetIfModifiedSince(lastModified).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, errors.Is(resp.IsError(), ErrNotModified), true)
+
+	resp, err = c.NewRequest().SetBaseUrl(server.URL).SetPath("/error").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, errors.Is(resp.IsError(), ErrNotModified), false)
+	assertEqual(t, resp.LastModified().IsZero(), true)
+}
+
+func TestDownloadParallel(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := !failed && r.Header.Get("Range") == "bytes=2500-4999"
+		failed = failed || fail
+		mu.Unlock()
+
+		if fail {
+			// send a part of the segment and then break the connection
+			w.Header().Set("Content-Length", "2500")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[2500:3000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		if r.URL.Path == "/no-range" {
+			w.Write(content)
+			return
+		}
+
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	c := NewClient().SetLogEnabled(false)
+
+	for _, path := range []string{"/range", "/no-range"} {
+		filePath := t.TempDir() + "/download"
+
+		err := c.DownloadParallel(context.Background(), server.URL+path, filePath, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, bytes.Equal(b, content), true)
+	}
+
+	assertEqual(t, failed, true)
+
+	filePath := t.TempDir() + "/download"
+	err := c.DownloadParallel(context.Background(), "http://127.0.0.1:1", filePath, 4)
+	if err == nil {
+		t.Fatal("err is nil")
+	}
+
+	_, err = os.Stat(filePath)
+	assertEqual(t, errors.Is(err, os.ErrNotExist), true)
+}
+
+func TestTrailers(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	resp, err := NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/trailers").
+		SetMethod(http.MethodPost).
+		SetTrailer("X-Checksum", "abc").
+		BodyRaw([]byte("hello")).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "hello")
+	assertEqual(t, resp.Trailers().Get("X-Echo"), "abc")
+
+	stream, err := NewRequest().
+		SetBaseUrl(server.URL).
+		SetPath("/trailers").
+		SetMethod(http.MethodPost).
+		SetTrailers(http.Header{"X-Checksum": []string{"def"}}).
+		BodyRaw([]byte("hello")).
+		DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	for _, err := range stream.Lines() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEqual(t, stream.Trailers().Get("X-Echo"), "def")
+}
+
+func TestVerbShortcuts(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+
+	for _, tc := range []struct {
+		body        any
+		want        string
+		contentType string
+	}{
+		{"raw", "raw", ""},
+		{[]byte("raw"), "raw", ""},
+		{strings.NewReader("reader"), "reader", ""},
+		{url.Values{"foo": []string{"bar"}}, "foo=bar", ContentTypeFormUrlEncoded},
+		{map[string]int{"foo": 1}, `{"foo":1}`, ContentTypeJson},
+		{nil, "", ""},
+	} {
+		resp, err := c.Post("/echo", tc.body).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, resp.BodyString(), tc.want)
+		if tc.contentType != "" {
+			assertEqual(t, resp.GetHeader(headerContentType), tc.contentType)
+		}
+	}
+
+	for _, r := range []*Request{
+		c.Head("/"), c.Options("/"), c.Delete("/"), c.Put("/", nil), c.Patch("/", nil),
+	} {
+		assertEqual(t, r.path, "/")
+	}
+
+	assertEqual(t, c.Head("/").method, http.MethodHead)
+	assertEqual(t, c.Options("/").method, http.MethodOptions)
+	assertEqual(t, c.Delete("/").method, http.MethodDelete)
+	assertEqual(t, c.Put("/", nil).method, http.MethodPut)
+	assertEqual(t, c.Patch("/", nil).method, http.MethodPatch)
+}
+
+func TestSetUrl(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl("http://127.0.0.1:1").
+		SetFallbackBaseUrl("http://127.0.0.1:2")
+
+	resp, err := c.NewRequest().
+		SetPath("/foo").
+		SetUrl(server.URL+"/{name}").
+		SetPathParam("name", "ping").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+
+	for _, u := range []string{"/relative", "127.0.0.1:8080/ping", "http://[::1", "http:///path"} {
+		resp, err = NewRequest().SetUrl(u).Do()
+		assertEqual(t, errors.Is(err, ErrInvalidUrl), true)
+		assertEqual(t, resp, nil)
+	}
+}
+
+func TestRequestUrl(t *testing.T) {
+	tests := []struct {
+		baseUrl  string
+		path     string
+		segments []string
+		expected string
+	}{
+		{"http://example.com", "", nil, "http://example.com"},
+		{"http://example.com/", "/ping", nil, "http://example.com/ping"},
+		{"http://example.com/api/", "/users/", nil, "http://example.com/api/users/"},
+		{"http://example.com/api?key=abc", "users", nil, "http://example.com/api/users?key=abc"},
+		{"http://example.com/api?key=abc", "search?q=foo&q=bar", nil, "http://example.com/api/search?key=abc&q=foo&q=bar"},
+		{"http://example.com", "files/a%2Fb", nil, "http://example.com/files/a%2Fb"},
+		{"http://example.com", "/users/{id}", nil, "http://example.com/users/a%2Fb"},
+		{"http://example.com", "https://other.com/ping", nil, "https://other.com/ping"},
+		{"", "http://example.com/ping", nil, "http://example.com/ping"},
+		{"http://example.com/api", "/v1", []string{"/users/", "{id}", "posts"}, "http://example.com/api/v1/users/a%2Fb/posts"},
+	}
+
+	for _, tt := range tests {
+		r := NewRequest().SetBaseUrl(tt.baseUrl).SetPath(tt.path).SetPathParam("id", "a/b").JoinPath(tt.segments...)
+		assertEqual(t, r.requestUrl(r.baseUrl), tt.expected)
+	}
+
+	server := testServer(t)
+	defer server.Close()
+
+	resp, err := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL + "?foo=bar").
+		NewRequest().
+		SetPath("query?baz=qux").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "baz=qux&foo=bar")
+}
+
+func TestQueryEncoding(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	tests := []struct {
+		request  *Request
+		expected string
+	}{
+		{
+			c.NewRequest().SetPath("/query").AddQueryParam("id", "1").AddQueryParam("id", "2"),
+			"id=1&id=2",
+		},
+		{
+			c.NewRequest().SetPath("/query?id=0&name=a%20b").SetQueryParam("id", "1"),
+			"id=1&name=a+b",
+		},
+		{
+			c.NewRequest().SetPath("/query?b=a%20b&a=x,y").SetPreserveRawQuery(true).SetQueryParam("c", "1"),
+			"b=a%20b&a=x,y&c=1",
+		},
+		{
+			c.NewRequest().SetPath("/query?b=1;a=2").SetQuerySeparator(";").AddQueryParam("c", "3").AddQueryParam("c", "4"),
+			"a=2;b=1;c=3;c=4",
+		},
+		{
+			c.NewRequest().SetPath("/query?z=0").SetQueryParam("y", "1").AddRawQuery("b=2&a=1").AddRawQuery("c=a%20b"),
+			"y=1&z=0&b=2&a=1&c=a%20b",
+		},
+		{
+			c.NewRequest().SetPath("/query").AddRawQuery("b=2").AddRawQuery("a=1"),
+			"b=2&a=1",
+		},
+	}
+
+	for _, tt := range tests {
+		resp, err := tt.request.Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, resp.BodyString(), tt.expected)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	type payload struct {
+		Name string `json:"name" xml:"name"`
+	}
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	for _, accept := range [][]string{{"application/json", "application/xml"}, {"application/xml", "application/json"}} {
+		resp, err := c.SetAccept(accept...).NewRequest().SetPath("/negotiate").Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var d payload
+		if err := resp.Decode(&d); err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, d.Name, "pingo")
+	}
+
+	assertEqual(t, c.headers.Get("Accept"), "application/xml, application/json;q=0.9")
+	assertEqual(t, c.SetAccept("text/html", "*/*;q=0.1", "text/plain").headers.Get("Accept"), "text/html, */*;q=0.1, text/plain;q=0.8")
+	assertEqual(t, c.SetAccept("text/html", "text/plain;seq=1", "*/*; Q=0.1").headers.Get("Accept"), "text/html, text/plain;seq=1;q=0.9, */*; Q=0.1")
+
+	types := make([]string, 12)
+	for i := range types {
+		types[i] = fmt.Sprintf("application/v%d", i)
+	}
+	accept := strings.Split(c.SetAccept(types...).headers.Get("Accept"), ", ")
+	assertEqual(t, accept[1], "application/v1;q=0.999")
+	assertEqual(t, accept[10], "application/v10;q=0.99")
+	assertEqual(t, accept[11], "application/v11;q=0.989")
+
+	resp, err := c.NewRequest().SetPath("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d payload
+	err = resp.Decode(&d)
+	assertEqual(t, errors.Is(err, ErrUnsupportedMedia), true)
+	assertEqual(t, ClassifyError(err), ErrClassDecode)
+
+	c.SetBodyDecoder("text/plain", func(data []byte, v any) error {
+		v.(*payload).Name = string(data)
+		return nil
+	})
+
+	err = resp.Decode(&d)
+	assertEqual(t, errors.Is(err, ErrUnsupportedMedia), true)
+
+	resp, err = c.NewRequest().SetPath("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resp.Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, d.Name, "pong")
+
+	resp, err = NewClient().SetLogEnabled(false).Get(server.URL + "/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = resp.Decode(&d)
+	assertEqual(t, errors.Is(err, ErrUnsupportedMedia), true)
+}
+
+func TestStats(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	_, err := c.Post("/echo", nil).BodyRaw([]byte("hello")).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Get("/error").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.NewRequest().SetUrl("http://127.0.0.1:1").Do()
+	assertEqual(t, err != nil, true)
+
+	assertEqual(t, c.Stats(), Stats{
+		Requests:      3,
+		Errors:        2,
+		BytesSent:     5,
+		BytesReceived: 10,
+	})
+
+	assertEqual(t, c.ResetStats().Stats(), Stats{})
+}
+
+func TestInjectFaults(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	_, err := c.InjectFaults(FaultConfig{ErrorRate: 1}).Get("/ping").Do()
+	assertEqual(t, errors.Is(err, ErrInjectedFault), true)
+
+	resp, err := c.InjectFaults(FaultConfig{
+		LatencyJitter:   10 * time.Millisecond,
+		StatusOverrides: map[int]float64{http.StatusServiceUnavailable: 1},
+	}).Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.StatusCode(), http.StatusServiceUnavailable)
+	assertEqual(t, resp.BodyString(), "")
+	assertEqual(t, IsStatus(resp.IsError(), http.StatusServiceUnavailable), true)
+
+	resp, err = c.InjectFaults(FaultConfig{}).Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+	assertEqual(t, c.faults, (*FaultConfig)(nil))
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		secret   = []byte("secret")
+		attempts atomic.Int32
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+
+		if r.Header.Get(DefaultWebhookSignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := NewClient().SetLogEnabled(false)
+
+	var deadLetters []string
+	deadLetter := func(payload []byte, err error) {
+		deadLetters = append(deadLetters, string(payload))
+	}
+
+	err := c.NewWebhook(server.URL, secret).
+		SetRetry(3, time.Millisecond).
+		SetDeadLetter(deadLetter).
+		Send(map[string]string{"event": "ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, attempts.Load(), int32(3))
+	assertEqual(t, len(deadLetters), 0)
+
+	err = c.NewWebhook(server.URL, []byte("wrong")).
+		SetRetry(3, time.Millisecond).
+		SetDeadLetter(deadLetter).
+		Send(map[string]string{"event": "ping"})
+	assertEqual(t, IsStatus(err, http.StatusUnauthorized), true)
+	assertEqual(t, attempts.Load(), int32(3))
+	assertEqual(t, len(deadLetters), 1)
+	assertEqual(t, deadLetters[0], `{"event":"ping"}`)
+}
+
+func TestRunJob(t *testing.T) {
+	var polls atomic.Int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/jobs/1")
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET /jobs/1", func(w http.ResponseWriter, r *http.Request) {
+		if polls.Add(1) < 3 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		w.Header().Set("Location", "1/result")
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /jobs/1/result", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1,"state":"done"}`))
+	})
+	mux.HandleFunc("POST /sync", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	type job struct {
+		Id    int    `json:"id"`
+		State string `json:"state"`
+	}
+
+	result, err := RunJob(context.Background(), c.Post("/jobs", nil), JobConfig[job]{
+		PollInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, result, job{Id: 1, State: "done"})
+	assertEqual(t, polls.Load(), int32(3))
+
+	text, err := RunJob(context.Background(), c.Post("/sync", nil), JobConfig[string]{
+		Result: func(resp *Response) (string, error) {
+			return resp.BodyString(), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, text, "done")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = RunJob(ctx, c.Post("/jobs", nil), JobConfig[job]{
+		Status: func(resp *Response) (bool, string, error) {
+			return false, "", nil
+		},
+	})
+	assertEqual(t, errors.Is(err, context.DeadlineExceeded), true)
+}
+
+func TestMiddleware(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var order []string
+	middleware := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+
+	secret := []byte("secret")
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Use(middleware("first"), middleware("second"), SigningMiddleware(secret))
+
+	resp, err := c.Post("/echo", nil).SetQueryParam("a", "1").BodyRaw([]byte("hello")).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "hello")
+	assertEqual(t, strings.Join(order, ","), "first,second")
+
+	timestamp := resp.GetHeader("X-Timestamp")
+	nonce := resp.GetHeader("X-Nonce")
+	assertEqual(t, len(nonce), 32)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n" + nonce + "\nPOST\n/echo?a=1\nhello"))
+	assertEqual(t, resp.GetHeader("X-Signature"), hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err = NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Use(SigningMiddleware(nil)).
+		Post("/echo", nil).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("X-Nonce") != "", true)
+	assertEqual(t, resp.GetHeader("X-Signature"), "")
+
+	logs := &bytes.Buffer{}
+	req := NewClient().
+		SetLogOutput(logs).
+		SetDebug(true, false).
+		SetBaseUrl(server.URL).
+		Use(SigningMiddleware(secret)).
+		Get("/ping")
+
+	for range 2 {
+		if _, err := req.Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEqual(t, req.headers.Get("X-Signature"), "")
+	assertEqual(t, strings.Count(logs.String(), "X-Nonce: "), 2)
+	assertEqual(t, strings.Contains(logs.String(), "X-Signature: "), true)
+}
+
+func TestRetry(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRetry(2, time.Hour)
+
+	resp, err := c.NewRequest().Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "ok")
+	assertEqual(t, calls.Load(), int32(3))
+
+	calls.Store(0)
+	resp, err = c.NewRequest().SetRetry(1, time.Millisecond).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.StatusCode(), http.StatusServiceUnavailable)
+	assertEqual(t, calls.Load(), int32(2))
+
+	start := time.Now()
+	_, err = NewClient().
+		SetLogEnabled(false).
+		NewRequest().
+		SetUrl("http://127.0.0.1:1").
+		SetRetry(2, 10*time.Millisecond).
+		Do()
+	assertEqual(t, ClassifyError(err), ErrClassNetwork)
+	assertEqual(t, time.Since(start) >= 30*time.Millisecond, true)
+
+	// ----------------------------------------------------
+
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	}))
+	defer limited.Close()
+
+	calls.Store(1)
+
+	start = time.Now()
+	resp, err = NewClientWithOptions(
+		WithBaseUrl(limited.URL),
+		WithLogger(nil, 0),
+		WithRetry(1, time.Hour),
+		WithMaxRetryDelay(10*time.Millisecond),
+	).NewRequest().Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "ok")
+	assertEqual(t, time.Since(start) < time.Second, true)
+}
+
+func TestClientOptions(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	c := NewClientWithOptions(
+		WithBaseUrl(server.URL),
+		WithTimeout(time.Second),
+		WithRetry(2, time.Millisecond),
+		WithHeader("X-Test", "test"),
+		WithQueryParam("foo", "bar"),
+		WithLogger(&logs, 0),
+	)
+
+	assertEqual(t, c.baseUrl, server.URL)
+	assertEqual(t, c.timeout, time.Second)
+	assertEqual(t, c.maxRetries, 2)
+	assertEqual(t, c.headers.Get("X-Test"), "test")
+
+	resp, err := c.Get("/query").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "foo=bar")
+	assertEqual(t, strings.Contains(logs.String(), "/query"), true)
+
+	c = NewClientWithOptions(WithBaseUrl(server.URL), WithLogger(nil, 0))
+	assertEqual(t, c.isLogEnabled, false)
+}
+
+func TestClientFromConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"baseUrl": "http://example.com",
+		"timeout": "5s",
+		"proxy": "http://proxy.example.com:8080",
+		"insecureSkipVerify": true,
+		"maxRetries": 3,
+		"retryBackoff": 1000000,
+		"headers": {"X-Api-Key": "key"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, cfg.Timeout, 5*time.Second)
+	assertEqual(t, cfg.RetryBackoff, time.Millisecond)
+
+	c, err := ClientFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, c.baseUrl, "http://example.com")
+	assertEqual(t, c.timeout, 5*time.Second)
+	assertEqual(t, c.maxRetries, 3)
+	assertEqual(t, c.retryBackoff, time.Millisecond)
+	assertEqual(t, c.headers.Get("X-Api-Key"), "key")
+	assertEqual(t, c.transport().TLSClientConfig.InsecureSkipVerify, true)
+
+	proxyUrl, err := c.transport().Proxy(httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, proxyUrl.String(), "http://proxy.example.com:8080")
+
+	err = json.Unmarshal([]byte(`{"timeout": "5 seconds"}`), &cfg)
+	assertEqual(t, err != nil, true)
+
+	_, err = ParseConfig([]byte("baseUrl: http://example.com\ntimeout: 5s\n"))
+	assertEqual(t, errors.Is(err, ErrUnsupportedFormat), true)
+}
+
+func TestClientFromEnv(t *testing.T) {
+	t.Setenv("TEST_BASE_URL", "http://example.com")
+	t.Setenv("TEST_TIMEOUT", "2s")
+	t.Setenv("TEST_MAX_RETRIES", "1")
+	t.Setenv("TEST_HEADER_X_API_KEY", "key")
+
+	c, err := ClientFromEnv("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, c.baseUrl, "http://example.com")
+	assertEqual(t, c.timeout, 2*time.Second)
+	assertEqual(t, c.maxRetries, 1)
+	assertEqual(t, c.headers.Get("X-Api-Key"), "key")
+
+	t.Setenv("TEST_MAX_RETRIES", "many")
+	_, err = ClientFromEnv("TEST_")
+	assertEqual(t, err != nil, true)
+}
+
+func TestProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+
+	var logs bytes.Buffer
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(0).
+		SetDebug(true, false).
+		SetProxy(proxyUrl)
+
+	resp, err := c.NewRequest().SetUrl("http://example.invalid/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "proxied http://example.invalid/ping")
+	assertEqual(t, strings.Contains(logs.String(), "| proxy "+proxy.URL), true)
+
+	server := testServer(t)
+	defer server.Close()
+
+	logs.Reset()
+	resp, err = c.SetNoProxy(".example.com", "127.0.0.1").NewRequest().SetUrl(server.URL + "/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+	assertEqual(t, strings.Contains(logs.String(), "| proxy direct"), true)
+	assertEqual(t, proxied.Load(), int32(1))
+
+	resp, err = c.SetProxy(nil).NewRequest().SetUrl(server.URL + "/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+	assertEqual(t, proxied.Load(), int32(1))
+
+	// ----------------------------------------------------
+
+	c = NewClient().
+		SetLogEnabled(false).
+		SetNoProxy("127.0.0.1").
+		SetProxy(proxyUrl)
+
+	resp, err = c.NewRequest().SetUrl(server.URL + "/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+	assertEqual(t, proxied.Load(), int32(1))
+
+	resp, err = c.SetNoProxy(".example.com").NewRequest().SetUrl(server.URL + "/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "proxied "+server.URL+"/ping")
+	assertEqual(t, proxied.Load(), int32(2))
+}
+
+func TestUnmarshalVariants(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	type data struct {
+		Name string `json:"name" xml:"name"`
+	}
+
+	resp, err := c.SetAccept("application/xml").Get("/negotiate").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d data
+	if err := resp.UnmarshalXml(&d); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, d.Name, "pingo")
+
+	d = data{}
+	if err := resp.UnmarshalAuto(&d); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, d.Name, "pingo")
+
+	err = resp.UnmarshalJson(&d)
+	assertEqual(t, ClassifyError(err), ErrClassDecode)
+
+	resp, err = c.Post("/echo", map[string]string{"name": "error"}).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respErr := &ResponseError{responseHeader: resp.responseHeader, body: resp.BodyRaw()}
+	d = data{}
+	if err := respErr.UnmarshalJson(&d); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, d.Name, "error")
+
+	d = data{}
+	if err := respErr.UnmarshalAuto(&d); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, d.Name, "error")
+	assertEqual(t, ClassifyError(respErr.UnmarshalXml(&d)), ErrClassDecode)
+}
+
+func TestResponseErrorStatus(t *testing.T) {
+	tests := []struct {
+		statusCode  int
+		clientError bool
+		serverError bool
+	}{
+		{http.StatusNotModified, false, false},
+		{http.StatusNotFound, true, false},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusInternalServerError, false, true},
+		{http.StatusServiceUnavailable, false, true},
+	}
+
+	for _, tt := range tests {
+		r := &ResponseError{responseHeader: responseHeader{statusCode: tt.statusCode}}
+		assertEqual(t, r.IsClientError(), tt.clientError)
+		assertEqual(t, r.IsServerError(), tt.serverError)
+		assertEqual(t, r.HasStatus(http.StatusOK, tt.statusCode), true)
+		assertEqual(t, r.HasStatus(http.StatusOK), false)
+	}
+}
+
+func TestSuccessFunc(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.Get("/etag").SetHeader("If-Modified-Since", "Tue, 02 Jan 2024 03:04:05 GMT").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.StatusCode(), http.StatusNotModified)
+	assertEqual(t, errors.Is(resp.IsError(), ErrNotModified), true)
+
+	c.SetSuccessFunc(func(statusCode int) bool {
+		return statusCode == http.StatusNotModified || IsSuccessStatus(statusCode)
+	})
+
+	resp, err = c.Get("/etag").SetHeader("If-Modified-Since", "Tue, 02 Jan 2024 03:04:05 GMT").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.IsError(), nil)
+
+	resp, err = c.SetSuccessFunc(nil).Get("/error").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, IsStatus(resp.IsError(), http.StatusInternalServerError), true)
+}
+
+func TestProfile(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(0).
+		SetBaseUrl(server.URL).
+		DisableKeepAlives(true)
+
+	resp, err := c.Get("/ping").SetProfile(true).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timings := resp.Timings()
+	assertEqual(t, timings.Connect > 0, true)
+	assertEqual(t, timings.TTFB > 0, true)
+	assertEqual(t, timings.Total >= timings.TTFB+timings.Transfer, true)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assertEqual(t, len(lines), 2)
+	assertEqual(t, strings.Contains(lines[1], "| dns "), true)
+	assertEqual(t, strings.Contains(lines[1], "| ttfb "), true)
+	assertEqual(t, strings.Contains(lines[1], "| transfer "), true)
+
+	logs.Reset()
+	_, err = c.Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, strings.Count(logs.String(), "\n"), 1)
+}
+
+func TestBodyResend(t *testing.T) {
+	var calls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/echo", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if calls.Add(1) == 1 && r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write(b)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.Post("/redirect", nil).BodyRaw([]byte("hello")).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "hello")
+
+	calls.Store(0)
+	resp, err = c.Post("/echo", nil).
+		SetQueryParam("fail", "1").
+		BodyMultipartForm(map[string]any{"field": "value"}).
+		SetRetry(1, time.Millisecond).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, calls.Load(), int32(2))
+	assertEqual(t, strings.Contains(resp.BodyString(), "value"), true)
+}
+
+func TestRequestReuse(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	r := c.Post("/echo", nil).SetHeader("X-Test", "original").BodyRaw([]byte("hello"))
+
+	responses, err := r.ExecuteN(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(responses), 3)
+	for _, resp := range responses {
+		assertEqual(t, resp.BodyString(), "hello")
+	}
+
+	clone := r.Clone().SetHeader("X-Test", "clone").BodyRaw([]byte("bye"))
+
+	resp, err := clone.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "bye")
+	assertEqual(t, resp.GetHeader("X-Test"), "clone")
+
+	resp, err = r.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "hello")
+	assertEqual(t, resp.GetHeader("X-Test"), "original")
+
+	responses, err = c.Get("/error").SetUrl("http://127.0.0.1:1").ExecuteN(context.Background(), 2)
+	assertEqual(t, err != nil, true)
+	assertEqual(t, len(responses), 0)
+}
+
+func TestWithHttpRequest(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.Header().Set("X-Close", strconv.FormatBool(r.Close))
+	}))
+	defer server.Close()
+
+	resp, err := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		NewRequest().
+		WithHttpRequest(func(req *http.Request) {
+			req.Host = "example.com"
+		}).
+		WithHttpRequest(func(req *http.Request) {
+			req.Close = true
+		}).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, host, "example.com")
+	assertEqual(t, resp.GetHeader("X-Close"), "true")
+}
+
+func TestRequestTransport(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.Get("/ping").SetTransport(RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusTeapot,
+			Status:     "418 I'm a teapot",
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("stubbed " + req.URL.Path)),
+			Request:    req,
+		}, nil
+	})).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.StatusCode(), http.StatusTeapot)
+	assertEqual(t, resp.BodyString(), "stubbed /ping")
+
+	resp, err = c.Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+}
+
+func TestDebugFormatJson(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(0).
+		SetBaseUrl(server.URL).
+		SetDebug(true, true).
+		SetDebugFormat(DebugFormatJson).
+		SetDebugBodyLimit(16)
+
+	resp, err := c.Post("/echo", nil).BodyRaw([]byte(strings.Repeat("a", 17))).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(resp.BodyRaw()), 17)
+
+	var entry struct {
+		Method     string  `json:"method"`
+		Url        string  `json:"url"`
+		StatusCode int     `json:"statusCode"`
+		DurationMs float64 `json:"durationMs"`
+		Request    struct {
+			Headers       http.Header `json:"headers"`
+			Body          string      `json:"body"`
+			BodyTruncated bool        `json:"bodyTruncated"`
+		} `json:"request"`
+		Response struct {
+			Body          string `json:"body"`
+			BodyTruncated bool   `json:"bodyTruncated"`
+		} `json:"response"`
+	}
+
+	_, line, _ := strings.Cut(logs.String(), "] ")
+	assertEqual(t, strings.Count(line, "\n"), 1)
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, entry.Method, http.MethodPost)
+	assertEqual(t, entry.Url, server.URL+"/echo")
+	assertEqual(t, entry.StatusCode, http.StatusOK)
+	assertEqual(t, entry.DurationMs > 0, true)
+	assertEqual(t, entry.Request.Headers.Get("User-Agent"), headerUserAgentDefaultValue)
+	assertEqual(t, len(entry.Request.Body), 16)
+	assertEqual(t, entry.Request.BodyTruncated, true)
+	assertEqual(t, len(entry.Response.Body), 16)
+	assertEqual(t, entry.Response.BodyTruncated, true)
+}
+
+func TestDebugBody(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(0).
+		SetBaseUrl(server.URL).
+		SetDebug(true, true).
+		SetDebugBodyLimit(8)
+
+	resp, err := c.Post("/echo", nil).BodyRaw([]byte("0123456789")).SetHeader("Content-Type", "text/plain").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "0123456789")
+	assertEqual(t, strings.Count(logs.String(), "01234567... [truncated, 10 bytes total]"), 2)
+
+	logs.Reset()
+	_, err = c.Post("/echo", nil).BodyRaw([]byte{0x89, 'P', 'N', 'G', 0, 1, 2}).SetHeader("Content-Type", "image/png").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, strings.Count(logs.String(), "[binary: 7 bytes, content-type image/png]"), 2)
+
+	formatted, truncated := formatDebugBody([]byte{0, 1, 2}, "", 0)
+	assertEqual(t, formatted, "[binary: 3 bytes, content-type application/octet-stream]")
+	assertEqual(t, truncated, false)
+
+	formatted, truncated = formatDebugBody([]byte(`{"a":1}`), "application/problem+json", 0)
+	assertEqual(t, formatted, `{"a":1}`)
+	assertEqual(t, truncated, false)
+}
+
+type testLeveledLogger struct {
+	entries []string
+}
+
+func (l *testLeveledLogger) Debug(msg string) { l.entries = append(l.entries, "DEBUG "+msg) }
+func (l *testLeveledLogger) Info(msg string)  { l.entries = append(l.entries, "INFO "+msg) }
+func (l *testLeveledLogger) Warn(msg string)  { l.entries = append(l.entries, "WARN "+msg) }
+func (l *testLeveledLogger) Error(msg string) { l.entries = append(l.entries, "ERROR "+msg) }
+
+func TestLeveledLogger(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	l := &testLeveledLogger{}
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogger(l).
+		SetBaseUrl(server.URL)
+
+	if _, err := c.Get("/ping").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get("/error").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get("/ping").SetDebug(true, true).Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(l.entries), 4)
+	assertEqual(t, strings.HasPrefix(l.entries[0], "INFO GET | 200 | "), true)
+	assertEqual(t, strings.HasPrefix(l.entries[1], "WARN GET | 500 | "), true)
+	assertEqual(t, strings.HasPrefix(l.entries[2], "INFO GET | 200 | "), true)
+	assertEqual(t, strings.Contains(l.entries[2], "\n"), false)
+	assertEqual(t, strings.HasPrefix(l.entries[3], "DEBUG "), true)
+	assertEqual(t, strings.Contains(l.entries[3], "GET /ping HTTP/1.1"), true)
+	assertEqual(t, logs.Len(), 0)
+
+	c.SetLogger(nil)
+	if _, err := c.Get("/ping").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(l.entries), 4)
+	assertEqual(t, strings.Contains(logs.String(), "GET | 200 | "), true)
+}
+
+func TestLogFilter(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(0).
+		SetBaseUrl(server.URL).
+		SetLogFilter(func(method, url string, status int, d time.Duration) bool {
+			return status >= 500
+		})
+
+	for _, path := range []string{"/ping", "/error", "/ping"} {
+		if _, err := c.Get(path).Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEqual(t, strings.Count(logs.String(), "\n"), 1)
+	assertEqual(t, strings.Contains(logs.String(), "GET | 500 | "), true)
+
+	logs.Reset()
+	c.SetLogFilter(nil).SetLogSampleRate(0)
+	if _, err := c.Get("/ping").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, logs.Len(), 0)
+
+	_, err := c.Get("/ping").SetBaseUrl("http://127.0.0.1:1").Do()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	assertEqual(t, strings.Count(logs.String(), "\n"), 1)
+}
+
+func TestRequestId(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ids []string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ids = append(ids, r.Header.Get("X-Request-ID"))
+		n := len(ids)
+		mu.Unlock()
+
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(0).
+		SetBaseUrl(server.URL).
+		SetRequestId("", nil).
+		SetRetry(1, time.Millisecond)
+
+	resp, err := c.Get("/").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(ids), 2)
+	assertEqual(t, ids[0], ids[1])
+	assertEqual(t, resp.RequestId(), ids[0])
+	assertEqual(t, len(resp.RequestId()), 36)
+	assertEqual(t, resp.RequestId()[14], byte('4'))
+	assertEqual(t, strings.Count(logs.String(), " | id "+ids[0]), 2)
+
+	resp, err = c.Get("/").SetHeader("X-Request-ID", "abc").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.RequestId(), "abc")
+	assertEqual(t, ids[2], "abc")
+
+	c.SetRequestId("X-Correlation-ID", func() string { return "fixed" })
+	resp, err = c.Get("/").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.RequestId(), "fixed")
+	assertEqual(t, ids[3], "")
+}
+
+func TestSetUserAgent(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetUserAgent("myapp", "1.0", "+https://example.com")
+
+	want := "myapp/1.0 (+https://example.com) pingo/" + strings.TrimPrefix(version, "v")
+
+	resp, err := c.Post("/echo", nil).SetHeader("User-Agent", "other").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader(headerUserAgent), want)
+
+	resp, err = c.Post("/echo", nil).SetUserAgent("other").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader(headerUserAgent), "other")
+
+	c.SetUserAgent("myapp", "", "")
+	resp, err = c.Post("/echo", nil).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader(headerUserAgent), "myapp pingo/"+strings.TrimPrefix(version, "v"))
+}
+
+func TestDelHeaderAndQueryParam(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetHeader("Authorization", "Bearer token").
+		SetQueryParam("key", "secret").
+		SetQueryParam("a", "1")
+
+	resp, err := c.Post("/echo", nil).DelHeader("Authorization").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("Authorization"), "")
+
+	resp, err = c.Get("/query").DelQueryParam("key").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "a=1")
+
+	resp, err = c.Post("/echo", nil).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("Authorization"), "Bearer token")
+
+	resp, err = c.Get("/query").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "a=1&key=secret")
+}
+
+func TestBodyTarGz(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "dist", "assets"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		filepath.Join(dir, "dist", "index.html"):       "<html></html>",
+		filepath.Join(dir, "dist", "assets", "app.js"): "console.log(1)",
+		filepath.Join(dir, "README"):                   "readme",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tr := tar.NewReader(gr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			content, _ := io.ReadAll(tr)
+			fmt.Fprintf(w, "%s=%s;%d\n", header.Name, content, r.ContentLength)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.Post("/", nil).BodyTarGz(filepath.Join(dir, "dist"), filepath.Join(dir, "README")).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "dist/=;-1\ndist/assets/=;-1\ndist/assets/app.js=console.log(1);-1\ndist/index.html=<html></html>;-1\nREADME=readme;-1\n")
+
+	_, err = c.Post("/", nil).BodyTarGz(filepath.Join(dir, "missing")).Do()
+	assertEqual(t, errors.Is(err, os.ErrNotExist), true)
+
+	errInvalid := errors.New("invalid")
+	c.AddValidationRules(func(req *http.Request) error { return errInvalid })
+
+	req := c.Post("/", nil)
+	w := req.BodyPipe()
+	_, err = req.Do()
+	assertEqual(t, errors.Is(err, errInvalid), true)
+
+	_, err = w.Write([]byte("data"))
+	assertEqual(t, errors.Is(err, io.ErrClosedPipe), true)
+}
+
+func TestBodyContentTypes(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	tests := []struct {
+		request     *Request
+		body        string
+		contentType string
+	}{
+		{c.Post("/echo", nil).BodyText("hello"), "hello", "text/plain; charset=utf-8"},
+		{c.Post("/echo", nil).BodyHtml("<p>hello</p>"), "<p>hello</p>", "text/html; charset=utf-8"},
+		{c.Post("/echo", nil).BodyWithContentType([]byte("a,b"), "text/csv"), "a,b", "text/csv"},
+	}
+
+	for _, tt := range tests {
+		resp, err := tt.request.Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, resp.BodyString(), tt.body)
+		assertEqual(t, resp.GetHeader(headerContentType), tt.contentType)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	zipArchive := func(files map[string]string) []byte {
+		var b bytes.Buffer
+		zw := zip.NewWriter(&b)
+		for name, content := range files {
+			w, _ := zw.Create(name)
+			w.Write([]byte(content))
+		}
+		zw.Close()
+		return b.Bytes()
+	}
+
+	var tarGz bytes.Buffer
+	gw := gzip.NewWriter(&tarGz)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "report/", Typeflag: tar.TypeDir, Mode: 0o755})
+	tw.WriteHeader(&tar.Header{Name: "report/data.csv", Typeflag: tar.TypeReg, Mode: 0o644, Size: 3})
+	tw.Write([]byte("a,b"))
+	tw.Close()
+	gw.Close()
+
+	var tarLink bytes.Buffer
+	gw = gzip.NewWriter(&tarLink)
+	tw = tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+	tw.Close()
+	gw.Close()
+
+	archives := map[string][]byte{
+		"/ok.zip":        zipArchive(map[string]string{"a.txt": "a", "dir/b.txt": "bb"}),
+		"/traversal.zip": zipArchive(map[string]string{"../evil.txt": "evil"}),
+		"/large.zip":     zipArchive(map[string]string{"big.txt": strings.Repeat("x", 100)}),
+		"/ok.tar.gz":     tarGz.Bytes(),
+		"/link.tar.gz":   tarLink.Bytes(),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archives[r.URL.Path])
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	get := func(path string) *Response {
+		resp, err := c.Get(path).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	dir := t.TempDir()
+	if err := get("/ok.zip").ExtractZip(dir, ExtractLimits{}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := os.ReadFile(filepath.Join(dir, "dir", "b.txt"))
+	assertEqual(t, string(b), "bb")
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	err := get("/traversal.zip").ExtractZip(dest, ExtractLimits{})
+	assertEqual(t, errors.Is(err, ErrUnsafeArchivePath), true)
+	_, err = os.Stat(filepath.Join(filepath.Dir(dest), "evil.txt"))
+	assertEqual(t, errors.Is(err, os.ErrNotExist), true)
+
+	err = get("/large.zip").ExtractZip(t.TempDir(), ExtractLimits{MaxFileSize: 10})
+	assertEqual(t, errors.Is(err, ErrArchiveTooLarge), true)
+
+	err = get("/ok.zip").ExtractZip(t.TempDir(), ExtractLimits{MaxFiles: 1})
+	assertEqual(t, errors.Is(err, ErrArchiveTooLarge), true)
+
+	dir = t.TempDir()
+	if err := get("/ok.tar.gz").ExtractTarGz(dir, ExtractLimits{}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ = os.ReadFile(filepath.Join(dir, "report", "data.csv"))
+	assertEqual(t, string(b), "a,b")
+
+	err = get("/link.tar.gz").ExtractTarGz(t.TempDir(), ExtractLimits{})
+	assertEqual(t, errors.Is(err, ErrUnsafeArchivePath), true)
+}
+
+func TestValidationRules(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		AddValidationRules(RequireHeader("Authorization"))
+
+	_, err := c.Get("/").Do()
+	assertEqual(t, errors.Is(err, ErrValidationFailed), true)
+	assertEqual(t, strings.Contains(err.Error(), "missing Authorization header"), true)
+	assertEqual(t, calls.Load(), int32(0))
+
+	_, err = c.Get("/").SetHeader("Authorization", "Bearer token").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, calls.Load(), int32(1))
+
+	errCustom := errors.New("custom")
+	c.AddValidationRules(RequireHttps(), func(req *http.Request) error {
+		return errCustom
+	})
+
+	_, err = c.Get("/").SetHeader("Authorization", "Bearer token").Do()
+	assertEqual(t, errors.Is(err, ErrValidationFailed), true)
+	assertEqual(t, strings.Contains(err.Error(), "only https"), true)
+	assertEqual(t, errors.Is(err, errCustom), false)
+	assertEqual(t, calls.Load(), int32(1))
+}
+
+func TestAllowedHostsAndBlockedNetworks(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl("http://localhost:"+u.Port()).
+		SetRetry(2, time.Millisecond)
+
+	c.SetAllowedHosts("*.example.com")
+	_, err := c.Get("/ping").Do()
+	assertEqual(t, errors.Is(err, ErrHostNotAllowed), true)
+
+	c.SetAllowedHosts("LOCALHOST")
+	if _, err := c.Get("/ping").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetAllowedHosts().SetBlockedNetworks("10.0.0.0/8", "127.0.0.0/8", "::1")
+	_, err = c.Get("/ping").Do()
+	assertEqual(t, errors.Is(err, ErrAddressBlocked), true)
+
+	c.SetBlockedNetworks("10.0.0.0/8")
+	if _, err := c.Get("/ping").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetBlockedNetworks("invalid")
+	_, err = c.Get("/ping").Do()
+	assertEqual(t, err != nil, true)
+
+	c.SetBlockedNetworks()
+	if _, err := c.Get("/ping").Do(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/external":
+			http.Redirect(w, r, "http://internal.example.com/", http.StatusFound)
+		}
+	}))
+	defer plain.Close()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL+"/", http.StatusFound)
+	}))
+	defer secure.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetInsecureSkipVerify(true)
+
+	if _, err := c.Get(secure.URL).Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetRedirectPolicy(RedirectPolicy{RefuseDowngrade: true})
+	_, err := c.Get(secure.URL).Do()
+	assertEqual(t, errors.Is(err, ErrRedirectRefused), true)
+
+	c.SetRedirectPolicy(RedirectPolicy{MaxRedirects: 3})
+	_, err = c.Get(plain.URL + "/loop").Do()
+	assertEqual(t, errors.Is(err, ErrRedirectRefused), true)
+	assertEqual(t, strings.Contains(err.Error(), "stopped after 3 redirects"), true)
+
+	c.SetAllowedHosts("127.0.0.1").SetRedirectPolicy(RedirectPolicy{AllowedHostsOnly: true})
+	_, err = c.Get(plain.URL + "/external").Do()
+	assertEqual(t, errors.Is(err, ErrRedirectRefused), true)
+	assertEqual(t, errors.Is(err, ErrHostNotAllowed), true)
+}
+
+func TestJwtMinter(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		tokens []string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	parse := func(token string) (header, claims map[string]any, signingInput string, signature []byte) {
+		parts := strings.Split(token, ".")
+		assertEqual(t, len(parts), 3)
+
+		h, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		c, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		signature, _ = base64.RawURLEncoding.DecodeString(parts[2])
+		json.Unmarshal(h, &header)
+		json.Unmarshal(c, &claims)
+		return header, claims, parts[0] + "." + parts[1], signature
+	}
+
+	secret := []byte("secret")
+	minter := NewJwtMinter(secret, map[string]any{"iss": "svc"}, time.Hour).SetKeyId("k1")
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetTokenSource(minter)
+
+	for range 2 {
+		if _, err := c.Get("/").Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.Get("/").SetHeader("Authorization", "Bearer explicit").Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, tokens[0], tokens[1])
+	assertEqual(t, tokens[2], "explicit")
+
+	header, claims, signingInput, signature := parse(tokens[0])
+	assertEqual(t, header["alg"], "HS256")
+	assertEqual(t, header["kid"], "k1")
+	assertEqual(t, claims["iss"], "svc")
+	assertEqual(t, claims["exp"].(float64)-claims["iat"].(float64), float64(3600))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	assertEqual(t, hmac.Equal(signature, mac.Sum(nil)), true)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token, err := NewJwtMinter(rsaKey, nil, time.Minute).Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, signingInput, signature = parse(token)
+	digest := sha256.Sum256([]byte(signingInput))
+	assertEqual(t, header["alg"], "RS256")
+	assertEqual(t, rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature), nil)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecMinter := NewJwtMinter(ecKey, nil, time.Minute).SetPerRequest(true)
+	token, err = ecMinter.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, signingInput, signature = parse(token)
+	digest = sha256.Sum256([]byte(signingInput))
+	assertEqual(t, header["alg"], "ES256")
+	assertEqual(t, ecdsa.Verify(&ecKey.PublicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])), true)
+
+	other, _ := ecMinter.Token(context.Background())
+	assertEqual(t, other != token, true)
+
+	_, err = c.SetTokenSource(NewJwtMinter("invalid", nil, time.Minute)).Get("/").Do()
+	assertEqual(t, errors.Is(err, ErrUnsupportedKey), true)
+}
+
+func TestMetadataCredentials(t *testing.T) {
+	var fetches atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/default/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		fetches.Add(1)
+		fmt.Fprintf(w, `{"access_token":"gcp-%s","expires_in":3599,"token_type":"Bearer"}`, r.URL.Query().Get("scopes"))
+	})
+	mux.HandleFunc("GET /metadata/identity/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintf(w, `{"access_token":"azure-%s","expires_in":"3599","token_type":"Bearer"}`, r.URL.Query().Get("resource"))
+	})
+	mux.HandleFunc("PUT /latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("imds-token"))
+	})
+	mux.HandleFunc("GET /latest/meta-data/iam/security-credentials/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte("role"))
+	})
+	mux.HandleFunc("GET /latest/meta-data/iam/security-credentials/role", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"session","Expiration":"2099-01-02T03:04:05Z"}`))
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	defer func(gcp, azure, aws string) {
+		gcpMetadataUrl, azureMetadataUrl, awsMetadataUrl = gcp, azure, aws
+	}(gcpMetadataUrl, azureMetadataUrl, awsMetadataUrl)
+	gcpMetadataUrl, azureMetadataUrl, awsMetadataUrl = server.URL, server.URL, server.URL
+
+	ctx := context.Background()
+	gcp := NewGcpTokenSource("a", "b")
+	for range 2 {
+		token, err := gcp.Token(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, token, "gcp-a,b")
+	}
+
+	assertEqual(t, fetches.Load(), int32(1))
+
+	token, err := NewAzureTokenSource("https://vault.azure.net").Token(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, token, "azure-https://vault.azure.net")
+
+	credentials, err := NewAwsCredentialsProvider().Credentials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, credentials, AwsCredentials{
+		AccessKeyId:     "AKID",
+		SecretAccessKey: "secret",
+		SessionToken:    "session",
+		Expiration:      time.Date(2099, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+}
+
+func TestJsonDecodeOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentTypeJson)
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(`{"id":9007199254740993,"extra":true}`))
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.Get("/").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]any
+	if err := resp.UnmarshalJson(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual[any](t, m["id"], float64(9007199254740992))
+
+	c.SetJsonUseNumber(true)
+	resp, err = c.Get("/").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, unmarshal := range []func(any) error{resp.UnmarshalJson, resp.Decode} {
+		m = nil
+		if err := unmarshal(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual[any](t, m["id"], json.Number("9007199254740993"))
+	}
+
+	var v struct {
+		Id int64 `json:"id"`
+	}
+
+	c.SetJsonStrict(true)
+	resp, err = c.Get("/").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = resp.UnmarshalJson(&v)
+	assertEqual(t, strings.Contains(err.Error(), `unknown field "extra"`), true)
+
+	resp, err = c.Get("/error").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var respErr *ResponseError
+	if !errors.As(resp.IsError(), &respErr) {
+		t.Fatal("expected response error")
+	}
+
+	assertEqual(t, respErr.UnmarshalAuto(&v) != nil, true)
+}
+
+func TestDoJsonDecode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items":
+			w.Write([]byte(`[`))
+			for i := range 3 {
+				if i > 0 {
+					w.Write([]byte(`,`))
+				}
+				fmt.Fprintf(w, `{"id":%d}`, i)
+				w.(http.Flusher).Flush()
+			}
+			w.Write([]byte(`]`))
+		case "/object":
+			w.Write([]byte(`{"id":1}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	var ids []int
+	err := c.Get("/items").DoJsonDecode(context.Background(), func(element json.RawMessage) error {
+		var item struct {
+			Id int `json:"id"`
+		}
+		if err := json.Unmarshal(element, &item); err != nil {
+			return err
+		}
+
+		ids = append(ids, item.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, fmt.Sprint(ids), "[0 1 2]")
+
+	errStop := errors.New("stop")
+	n := 0
+	err = c.Get("/items").DoJsonDecode(context.Background(), func(json.RawMessage) error {
+		n++
+		return errStop
+	})
+	assertEqual(t, errors.Is(err, errStop), true)
+	assertEqual(t, n, 1)
+
+	err = c.Get("/object").DoJsonDecode(context.Background(), func(json.RawMessage) error { return nil })
+	var e *Error
+	assertEqual(t, errors.As(err, &e) && e.Class == ErrClassDecode, true)
+
+	err = c.Get("/missing").DoJsonDecode(context.Background(), func(json.RawMessage) error { return nil })
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		t.Fatal("expected response error")
+	}
+
+	assertEqual(t, respErr.StatusCode(), http.StatusNotFound)
+	assertEqual(t, string(respErr.BodyRaw()), `{"message":"not found"}`)
+
+	stream, err := c.Get("/object").DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	var m map[string]any
+	if err := stream.NewJsonDecoder().Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual[any](t, m["id"], float64(1))
+}
+
+func TestJsonFuncs(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var marshals, unmarshals atomic.Int32
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetJsonFuncs(func(v any) ([]byte, error) {
+			marshals.Add(1)
+			return json.Marshal(v)
+		}, func(data []byte, v any) error {
+			unmarshals.Add(1)
+			return json.Unmarshal(data, v)
+		})
+
+	resp, err := c.Post("/echo", nil).BodyJson(map[string]int{"a": 1}).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]int
+	if err := resp.UnmarshalJson(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resp.Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, m["a"], 1)
+	assertEqual(t, marshals.Load(), int32(1))
+	assertEqual(t, unmarshals.Load(), int32(2))
+
+	c.SetJsonFuncs(nil, nil)
+	resp, err = c.Post("/echo", nil).BodyJson(map[string]int{"a": 2}).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resp.UnmarshalJson(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, m["a"], 2)
+	assertEqual(t, marshals.Load(), int32(1))
+	assertEqual(t, unmarshals.Load(), int32(2))
+}
+
+func TestZeroCopyBody(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.Post("/echo", nil).BodyRaw([]byte("hello")).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := io.ReadAll(resp.BodyReader())
+	assertEqual(t, string(b), "hello")
+
+	s := resp.BodyString()
+	resp.BodyRaw()[0] = 'j'
+	assertEqual(t, s, "hello")
+
+	c.SetZeroCopyStrings(true)
+	resp, err = c.Post("/echo", nil).BodyRaw([]byte("hello")).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = resp.BodyString()
+	assertEqual(t, s, "hello")
+	assertEqual(t, unsafe.StringData(s), unsafe.SliceData(resp.BodyRaw()))
+}
+
+func BenchmarkBodyString(b *testing.B) {
+	for _, zeroCopy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("zeroCopy=%v", zeroCopy), func(b *testing.B) {
+			resp := &Response{
+				body:     bytes.Repeat([]byte("a"), 1<<20),
+				zeroCopy: zeroCopy,
+			}
+
+			b.ReportAllocs()
+			for range b.N {
+				_ = resp.BodyString()
+			}
+		})
+	}
+}
+
+func TestConnEvents(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf(format, args...))
+	}
+
+	addr := server.Listener.Addr().String()
+	c := NewClient().
+		SetLogEnabled(false).
+		SetInsecureSkipVerify(true).
+		SetBaseUrl(server.URL).
+		SetConnEvents(ConnEvents{
+			OnConnect: func(network, addr string, duration time.Duration, err error) {
+				record("connect %s %s %v", network, addr, err)
+			},
+			OnTLSHandshake: func(addr string, state tls.ConnectionState, err error) {
+				record("tls %s %s %v", addr, tls.VersionName(state.Version), err)
+			},
+			OnConnClosed: func(network, addr string) {
+				record("closed %s %s", network, addr)
+			},
+		})
+
+	for range 2 {
+		if _, err := c.Get("/").Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.client.CloseIdleConnections()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assertEqual(t, strings.Join(events, "\n"), strings.Join([]string{
+		"connect tcp " + addr + " <nil>",
+		"tls " + addr + " TLS 1.3 <nil>",
+		"closed tcp " + addr,
+	}, "\n"))
+}
+
+func TestResponseTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	plain := testServer(t)
+	defer plain.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetInsecureSkipVerify(true)
+
+	resp, err := c.Get(server.URL).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := resp.TLS()
+	if info == nil {
+		t.Fatal("expected TLS info")
+	}
+
+	assertEqual(t, info.VersionName(), "TLS 1.3")
+	assertEqual(t, info.CipherSuiteName() != "", true)
+	assertEqual(t, info.PeerCertificates[0].Equal(server.Certificate()), true)
+	assertEqual(t, info.OCSPStapled, false)
+
+	resp, err = c.Get(plain.URL + "/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.TLS() == nil, true)
+}
+
+func TestRetryBudget(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	var denied atomic.Int32
+	budget := NewRetryBudget(0.5, 1).SetMetricHook(func(state RetryBudgetState, allowed bool) {
+		if !allowed {
+			denied.Add(1)
+		}
+	})
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRetry(3, time.Millisecond).
+		SetRetryBudget(budget)
+
+	for _, want := range []int32{2, 1, 2} {
+		calls.Store(0)
+		resp, err := c.Get("/").Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, resp.StatusCode(), http.StatusServiceUnavailable)
+		assertEqual(t, calls.Load(), want)
+	}
+
+	assertEqual(t, budget.State(), RetryBudgetState{
+		Balance:  0,
+		Requests: 3,
+		Retries:  2,
+		Denied:   3,
+	})
+	assertEqual(t, denied.Load(), int32(3))
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	hold := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			<-hold
+			return
+		}
+
+		mu.Lock()
+		order = append(order, r.URL.Path)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetMaxConcurrency(1)
+
+	held := make(chan error, 1)
+	go func() {
+		_, err := c.Get("/hold").Do()
+		held <- err
+	}()
+
+	waiting := func(n int) {
+		for {
+			c.concurrency.mu.Lock()
+			active, count := c.concurrency.active, 0
+			for _, w := range c.concurrency.waiting {
+				count += len(w)
+			}
+			c.concurrency.mu.Unlock()
+
+			if active == 1 && count == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waiting(0)
+
+	var wg sync.WaitGroup
+	for i, p := range []struct {
+		path     string
+		priority Priority
+	}{
+		{"/low", PriorityLow},
+		{"/normal", PriorityNormal},
+		{"/high", PriorityHigh},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get(p.path).SetPriority(p.priority).Do(); err != nil {
+				t.Error(err)
+			}
+		}()
+		waiting(i + 1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.Get("/canceled").DoCtx(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	waiting(3)
+
+	close(hold)
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	assertEqual(t, strings.Join(order, ","), "/high,/normal,/low")
+	assertEqual(t, c.concurrency.active, 0)
+}
+
+func TestShutdown(t *testing.T) {
+	hold := make(chan struct{})
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-hold
+		w.Write([]byte("done"))
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp := c.Get("/").DoAsync()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	_, err := c.Get("/").Do()
+	if !errors.Is(err, ErrClientShutdown) {
+		t.Fatalf("expected %v, got %v", ErrClientShutdown, err)
+	}
+
+	close(hold)
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-resp
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	assertEqual(t, r.Response.BodyString(), "done")
+}
+
+func TestInFlight(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRequestId("", nil)
+
+	resp := c.Get("/slow").DoAsync()
+	<-started
+
+	requests := c.InFlight()
+	assertEqual(t, len(requests), 1)
+	assertEqual(t, requests[0].Method, http.MethodGet)
+	assertEqual(t, requests[0].Url, server.URL+"/slow")
+	assertEqual(t, requests[0].RequestId != "", true)
+	assertEqual(t, requests[0].Elapsed > 0, true)
+
+	reason := errors.New("stuck")
+	c.CancelAll(reason)
+
+	r := <-resp
+	if !errors.Is(r.Err, reason) {
+		t.Fatalf("expected %v, got %v", reason, r.Err)
+	}
+	assertEqual(t, len(c.InFlight()), 0)
+}
+
+func TestLogLevel(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	c := NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(0).
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	tests := []struct {
+		level LogLevel
+		lines int
+		dump  bool
+	}{
+		{LogLevelDefault, 0, false},
+		{LogLevelInfo, 1, false},
+		{LogLevelDebug, 1, true},
+		{LogLevelOff, 0, false},
+	}
+
+	for _, tt := range tests {
+		logs.Reset()
+		c.SetLogLevel(tt.level)
+		assertEqual(t, c.LogLevel(), tt.level)
+
+		if _, err := c.Get("/ping").Do(); err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, strings.Count(logs.String(), "GET | 200 | "), tt.lines)
+		assertEqual(t, strings.Contains(logs.String(), "GET /ping HTTP/1.1"), tt.dump)
+	}
+
+	c.SetLogEnabled(true).SetLogLevel(LogLevelDefault)
+	logs.Reset()
+	if _, err := c.Get("/ping").Do(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Count(logs.String(), "GET | 200 | "), 1)
+}
+
+func TestResponseMarshalBinary(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	resp, err := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRequestId("", nil).
+		Get("/json").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restored Response
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, restored.Status(), resp.Status())
+	assertEqual(t, restored.StatusCode(), resp.StatusCode())
+	assertEqual(t, restored.GetHeader(headerContentType), resp.GetHeader(headerContentType))
+	assertEqual(t, restored.RequestId(), resp.RequestId())
+	assertEqual(t, restored.BodyString(), resp.BodyString())
+	assertEqual(t, restored.Timings(), resp.Timings())
+	assertEqual(t, restored.IsError() == nil, true)
+
+	var v map[string]any
+	if err := restored.UnmarshalJson(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	err = restored.UnmarshalBinary([]byte("garbage"))
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("expected %v, got %v", ErrInvalidSnapshot, err)
+	}
+}
+
+func TestClientClone(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl("http://127.0.0.1:1").
+		SetHeader("X-Tenant", "default").
+		SetRetry(2, time.Millisecond)
+	c.Host("127.0.0.1").SetHeader("X-Host", "a")
+
+	derived := c.With(WithBaseUrl(server.URL), WithHeader("X-Tenant", "acme"))
+	derived.Host("127.0.0.1").SetHeader("X-Host", "b")
+
+	assertEqual(t, derived.client.Transport != nil, true)
+	assertEqual(t, derived.client.Transport == c.client.Transport, true)
+	assertEqual(t, derived.client != c.client, true)
+	assertEqual(t, derived.baseUrl, server.URL)
+	assertEqual(t, derived.maxRetries, 2)
+	assertEqual(t, c.baseUrl, "http://127.0.0.1:1")
+	assertEqual(t, c.headers.Get("X-Tenant"), "default")
+	assertEqual(t, c.hosts["127.0.0.1"].headers.Get("X-Host"), "a")
+
+	resp, err := derived.Post("/echo", nil).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("X-Tenant"), "acme")
+	assertEqual(t, resp.GetHeader("X-Host"), "b")
+	assertEqual(t, derived.Stats().Requests, int64(1))
+	assertEqual(t, c.Stats().Requests, int64(0))
+
+	clone := c.SetLogLevel(LogLevelDebug).Clone()
+	assertEqual(t, clone.LogLevel(), LogLevelDebug)
+	clone.SetLogLevel(LogLevelOff)
+	assertEqual(t, c.LogLevel(), LogLevelDebug)
+
+	parent := NewClient().SetLogEnabled(false).SetBaseUrl(server.URL).SetRetry(0, 0)
+	shared := parent.Clone()
+	restricted := parent.Clone().SetAllowedHosts("*.example.com")
+	assertEqual(t, shared.client.Transport, parent.client.Transport)
+	assertEqual(t, restricted.client.Transport != parent.client.Transport, true)
+
+	_, err = restricted.Get("/ping").Do()
+	assertEqual(t, errors.Is(err, ErrHostNotAllowed), true)
+
+	parent.SetBlockedNetworks("127.0.0.0/8")
+	_, err = parent.Get("/ping").Do()
+	assertEqual(t, errors.Is(err, ErrAddressBlocked), true)
+
+	for _, c := range []*Client{shared, shared.Clone()} {
+		if _, err := c.Get("/ping").Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	pool := NewConnectionPool().
+		SetMaxIdleConnsPerHost(4).
+		SetIdleConnTimeout(time.Minute)
+
+	a := NewClient().SetLogEnabled(false).SetBaseUrl(server.URL).SetConnectionPool(pool)
+	b := NewClient().SetLogEnabled(false).SetBaseUrl(server.URL).SetConnectionPool(pool)
+
+	for _, c := range []*Client{a, b, a.Clone()} {
+		if _, err := c.Get("/ping").Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEqual(t, pool.Stats(), PoolStats{
+		Requests:    3,
+		Reused:      2,
+		OpenedConns: 1,
+		OpenConns:   1,
+	})
+
+	pool.CloseIdleConnections()
+	assertEqual(t, pool.Stats().ClosedConns, int64(1))
+	assertEqual(t, pool.Stats().OpenConns, int64(0))
+
+	_, err := a.Clone().SetAllowedHosts("example.com").Get("/ping").Do()
+	assertEqual(t, errors.Is(err, ErrPoolRestricted), true)
+
+	_, err = NewClient().SetLogEnabled(false).SetBlockedNetworks("127.0.0.0/8").SetConnectionPool(pool).Get(server.URL + "/ping").Do()
+	assertEqual(t, errors.Is(err, ErrPoolRestricted), true)
+	assertEqual(t, pool.Stats().Requests, int64(3))
+
+	NewClient().SetClient(http.DefaultClient).SetConnectionPool(pool)
+	assertEqual(t, http.DefaultClient.Transport, nil)
+}
+
+func TestLatencyRecorder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	var slow []string
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		OnSlowRequest(30*time.Millisecond, func(method, url string, status int, d time.Duration) {
+			slow = append(slow, fmt.Sprintf("%s %s %d", method, url, status))
+		})
+
+	assertEqual(t, c.LatencyP(0.99), time.Duration(0))
+
+	for _, path := range []string{"/fast", "/fast", "/slow", "/fast"} {
+		if _, err := c.Get(path).Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEqual(t, c.LatencyP(0.5) < 30*time.Millisecond, true)
+	assertEqual(t, c.LatencyP(0.99) >= 50*time.Millisecond, true)
+	assertEqual(t, strings.Join(slow, ","), "GET "+server.URL+"/slow 200")
+
+	var l latencyRecorder
+	for i := range DefaultLatencyWindow + 10 {
+		l.record(time.Duration(i))
+	}
+	assertEqual(t, len(l.samples), DefaultLatencyWindow)
+	assertEqual(t, l.quantile(0), time.Duration(10))
+	assertEqual(t, l.quantile(1), time.Duration(DefaultLatencyWindow+9))
+}
+
+func TestResponseDurationAndAttempts(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRetry(2, 20*time.Millisecond)
+
+	resp, err := c.Get("/").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.StatusCode(), http.StatusOK)
+	assertEqual(t, resp.Attempts(), 2)
+	assertEqual(t, resp.Duration() >= 20*time.Millisecond, true)
+	assertEqual(t, resp.Duration() >= resp.Timings().Total, true)
+
+	data, err := resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restored Response
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, restored.Attempts(), 2)
+	assertEqual(t, restored.Duration(), resp.Duration())
+}
+
+func TestResponseDateAndAge(t *testing.T) {
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", date.Format(http.TimeFormat))
+		w.Header().Set("Age", r.URL.Query().Get("age"))
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	before := time.Now()
+	resp, err := c.Get("/").SetQueryParam("age", "120").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.Date().Equal(date), true)
+	assertEqual(t, resp.Age(), 2*time.Minute)
+	assertEqual(t, resp.ReceivedAt().Before(before), false)
+	assertEqual(t, resp.ReceivedAt().After(time.Now()), false)
+
+	for _, age := range []string{"", "-1", "abc"} {
+		resp, err := c.Get("/").SetQueryParam("age", age).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, resp.Age(), time.Duration(0))
+	}
+}
+
+func TestSigningClockSkew(t *testing.T) {
+	var skew atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Duration(skew.Load())).UTC().Format(http.TimeFormat))
+		w.Header().Set("X-Timestamp", r.Header.Get("X-Timestamp"))
+	}))
+	defer server.Close()
+
+	timestamp := func(c *Client) time.Duration {
+		resp, err := c.Get("/").Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		unix, err := strconv.ParseInt(resp.GetHeader("X-Timestamp"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Unix(unix, 0).Sub(time.Now()).Round(time.Minute)
+	}
+
+	skew.Store(int64(10 * time.Minute))
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Use(SigningMiddleware([]byte("secret")))
+
+	assertEqual(t, timestamp(c), time.Duration(0))
+	assertEqual(t, timestamp(c), 10*time.Minute)
+
+	skew.Store(0)
+	timestamp(c)
+	assertEqual(t, timestamp(c), time.Duration(0))
+
+	skew.Store(int64(10 * time.Minute))
+	c = NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Use(SigningMiddlewareWithMaxSkew(nil, time.Minute))
+
+	timestamp(c)
+	assertEqual(t, timestamp(c), time.Duration(0))
+}
+
+func TestMethodOverride(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("X-HTTP-Method-Override"), r.URL.RawQuery)
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	tests := []struct {
+		mode    MethodOverride
+		request *Request
+		want    string
+	}{
+		{MethodOverrideNone, c.Put("/", nil), "PUT  "},
+		{MethodOverrideHeader, c.Patch("/", nil), "POST PATCH "},
+		{MethodOverrideHeader, c.Get("/"), "GET  "},
+		{MethodOverrideQuery, c.Delete("/").SetQueryParam("a", "1"), "POST  a=1&_method=DELETE"},
+		{MethodOverrideQuery, c.Put("/", nil), "POST  _method=PUT"},
+		{MethodOverrideQuery, c.Post("/", nil), "POST  "},
+	}
+
+	for _, tt := range tests {
+		c.SetMethodOverride(tt.mode)
+		resp, err := tt.request.Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, resp.BodyString(), tt.want)
+	}
+}
+
+func TestBodyTemplate(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	data := map[string]string{"Name": "pingo"}
+	resp, err := c.Post("/echo", nil).
+		BodyTemplate(`<hello name="{{.Name}}"/>`, data, ContentTypeXml).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), `<hello name="pingo"/>`)
+	assertEqual(t, resp.GetHeader(headerContentType), ContentTypeXml)
+
+	fsys := fstest.MapFS{
+		"templates/envelope.xml": {Data: []byte(`<envelope>{{template "body.xml" .}}</envelope>`)},
+		"templates/body.xml":     {Data: []byte(`<name>{{.Name}}</name>`)},
+	}
+	resp, err = c.Post("/echo", nil).
+		BodyTemplateFS(fsys, data, ContentTypeXml, "templates/envelope.xml", "templates/body.xml").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), `<envelope><name>pingo</name></envelope>`)
+
+	_, err = c.Post("/echo", nil).BodyTemplate("{{.Name", data, ContentTypeText).Do()
+	assertEqual(t, err != nil, true)
+
+	_, err = c.Post("/echo", nil).BodyTemplateFS(fsys, data, ContentTypeText, "missing/*.xml").Do()
+	assertEqual(t, err != nil, true)
+}
+
+func TestRunSpecs(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	specs, err := ParseSpecs([]byte(`[
+		{"name": "ping", "path": "/ping", "expect": {"bodyContains": "pong", "maxDuration": "10s"}},
+		{"name": "echo", "method": "post", "path": "/echo", "headers": {"X-Test": "1"}, "body": {"a": 1},
+			"expect": {"status": 200, "headers": {"X-Test": "1", "Content-Type": "application/json"}, "bodyContains": "\"a\": 1"}},
+		{"name": "text", "method": "POST", "path": "/echo", "body": "hello", "expect": {"bodyContains": "hello"}},
+		{"name": "error", "path": "/error", "expect": {"headers": {"X-Missing": "1"}}},
+		{"name": "unreachable", "path": "http://127.0.0.1:1/"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	results := c.RunSpecs(context.Background(), specs)
+	assertEqual(t, len(results), 5)
+
+	for _, r := range results[:3] {
+		if !r.Passed() {
+			t.Errorf("%s failed: %v %v", r.Name, r.Err, r.Failures)
+		}
+	}
+
+	assertEqual(t, results[1].Method, http.MethodPost)
+	assertEqual(t, results[1].Url, server.URL+"/echo")
+	assertEqual(t, results[3].StatusCode, http.StatusInternalServerError)
+	assertEqual(t, strings.Join(results[3].Failures, "; "),
+		`expected a successful status, got 500; expected header X-Missing to be "1", got ""`)
+	assertEqual(t, results[4].Err != nil, true)
+	assertEqual(t, results[4].Passed(), false)
+
+	_, err = ParseSpecs([]byte(`[{"expect": {"maxDuration": "soon"}}]`))
+	assertEqual(t, err != nil, true)
+
+	_, err = ParseSpecs([]byte("- method: GET\n  path: /ping\n"))
+	assertEqual(t, errors.Is(err, ErrUnsupportedFormat), true)
+}
+
+func TestHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	if err := c.HealthCheck(context.Background(), "/health", SpecExpectation{BodyContains: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.HealthCheck(context.Background(), "/health", SpecExpectation{Status: http.StatusNoContent})
+	if !errors.Is(err, ErrUnhealthy) {
+		t.Fatalf("expected %v, got %v", ErrUnhealthy, err)
+	}
+
+	changes := make(chan bool, 10)
+	monitor := c.NewHealthMonitor("/health", SpecExpectation{}, time.Millisecond).
+		SetJitter(time.Millisecond).
+		OnChange(func(healthy bool, err error) {
+			assertEqual(t, healthy, err == nil)
+			changes <- healthy
+		}).
+		Start(context.Background())
+	defer monitor.Stop()
+
+	assertEqual(t, <-changes, true)
+	assertEqual(t, monitor.Healthy(), true)
+
+	healthy.Store(false)
+	assertEqual(t, <-changes, false)
+	assertEqual(t, errors.Is(monitor.Err(), ErrUnhealthy), true)
+
+	healthy.Store(true)
+	assertEqual(t, <-changes, true)
+
+	monitor.Stop()
+	assertEqual(t, len(changes), 0)
+}
+
+func TestMeasureLatency(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if calls.Add(1)%4 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRetry(3, time.Millisecond)
+
+	stats := c.MeasureLatency(context.Background(), 8)
+	assertEqual(t, stats.Requests, 8)
+	assertEqual(t, stats.Errors, 2)
+	assertEqual(t, stats.ErrorRate, 0.25)
+	assertEqual(t, stats.Min >= time.Millisecond, true)
+	assertEqual(t, stats.Min <= stats.Avg && stats.Avg <= stats.Max, true)
+	assertEqual(t, stats.P95 <= stats.Max, true)
+
+	stats = c.Get("/").MeasureLatency(context.Background(), 2)
+	assertEqual(t, stats.ErrorRate, 1.0)
+	assertEqual(t, stats.Max, time.Duration(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assertEqual(t, c.MeasureLatency(ctx, 5), LatencyStats{})
+	assertEqual(t, c.MeasureLatency(context.Background(), -1), LatencyStats{})
+}
+
+func TestLatencyBalancer(t *testing.T) {
+	newServer := func(name string, delay *atomic.Int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Duration(delay.Load()))
+			w.Header().Set("X-Server", name)
+		}))
+	}
+
+	var slowDelay, fastDelay atomic.Int64
+	slowDelay.Store(int64(30 * time.Millisecond))
+	slow := newServer("slow", &slowDelay)
+	defer slow.Close()
+	fast := newServer("fast", &fastDelay)
+	defer fast.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl("http://unused")
+
+	switches := make(chan string, 10)
+	balancer := c.NewLatencyBalancer(slow.URL, fast.URL).
+		SetSamples(2).
+		SetInterval(time.Millisecond).
+		OnSwitch(func(from, to string) {
+			switches <- to
+		})
+	c.SetLatencyBalancer(balancer)
+
+	server := func() string {
+		resp, err := c.Get("/").Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.GetHeader("X-Server")
+	}
+
+	assertEqual(t, balancer.Current(), slow.URL)
+	assertEqual(t, server(), "slow")
+
+	balancer.Start(context.Background())
+	defer balancer.Stop()
+
+	assertEqual(t, <-switches, fast.URL)
+	assertEqual(t, server(), "fast")
+
+	// a slightly faster base URL is not selected due to the hysteresis
+	fastDelay.Store(int64(20 * time.Millisecond))
+	slowDelay.Store(int64(19 * time.Millisecond))
+	for range 3 {
+		balancer.measure(context.Background(), c.Clone().SetLatencyBalancer(nil))
+	}
+	assertEqual(t, balancer.Current(), fast.URL)
+	assertEqual(t, balancer.Stats()[slow.URL].Requests, 2)
+
+	// an unhealthy base URL is left regardless of the hysteresis
+	fast.Close()
+	assertEqual(t, <-switches, slow.URL)
+	assertEqual(t, server(), "slow")
+}
+
+func TestLatencyBalancerConfigureAfterStart(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	balancer := c.NewLatencyBalancer(server.URL).
+		SetSamples(1).
+		SetInterval(time.Millisecond).
+		Start(context.Background())
+	defer balancer.Stop()
+
+	c.SetLatencyBalancer(balancer).SetHeader("X-Test", "test")
+	for range 10 {
+		c.SetHeader("X-Test", "test")
+		time.Sleep(time.Millisecond)
+	}
+
+	resp, err := c.Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "pong")
+}
+
+func TestStreamDecompression(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", r.URL.Query().Get("encoding"))
+		var zw io.WriteCloser
+		if r.URL.Query().Get("encoding") == "deflate" {
+			zw = zlib.NewWriter(w)
+		} else {
+			zw = gzip.NewWriter(w)
+		}
+		zw.Write([]byte("{\"a\":1}\n{\"a\":2}\n"))
+		zw.Close()
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		stream, err := c.Get("/").
+			SetHeader("Accept-Encoding", encoding).
+			SetQueryParam("encoding", encoding).
+			DoStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var lines []string
+		for line, err := range stream.Lines() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line)
+		}
+		stream.Close()
+
+		assertEqual(t, strings.Join(lines, ","), `{"a":1},{"a":2}`)
+	}
+
+	stream, err := c.Get("/").
+		SetHeader("Accept-Encoding", "gzip").
+		SetQueryParam("encoding", "gzip").
+		DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	b, err := stream.SetDecompression(false).Recv(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(b), "\x1f\x8b")
+}
+
+func TestResponseStreamChan(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/hang" {
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	stream, err := c.Get("/").DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []byte
+	data, errs := stream.Chan(context.Background(), 2)
+	for b := range data {
+		received = append(received, b...)
+	}
+	assertEqual(t, string(received), "hello")
+	assertEqual(t, <-errs, nil)
+	stream.Close()
+
+	stream, err = c.Get("/").DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received = nil
+	data, errs = stream.Chan(context.Background(), 0)
+	for b := range data {
+		received = append(received, b...)
+	}
+	assertEqual(t, string(received), "hello")
+	assertEqual(t, <-errs, nil)
+	stream.Close()
+
+	stream, err = c.Get("/hang").DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	data, errs = stream.Chan(ctx, 16)
+	assertEqual(t, string(<-data), "hello")
+	cancel()
+
+	for range data {
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+}
+
+func TestRecvWithTimeout(t *testing.T) {
+	next := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, chunk := range []string{"first", "second"} {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer server.Close()
+
+	stream, err := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Get("/").
+		DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	b, err := stream.RecvWithTimeout(16, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(b), "first")
+
+	_, err = stream.RecvWithTimeout(16, 10*time.Millisecond)
+	assertEqual(t, err, ErrReadTimeout)
+
+	next <- struct{}{}
+	b, err = stream.RecvWithTimeout(3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(b), "sec")
+
+	close(next)
+	rest, err := io.ReadAll(stream.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(rest), "ond")
+}
+
+func TestBodyPipe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			fmt.Fprintf(w, "echo %s\n", scanner.Text())
+			rc.Flush()
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	req := c.Post("/", nil)
+	body := req.BodyPipe()
+
+	stream, err := req.DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	next, stop := iter.Pull2(stream.Lines())
+	defer stop()
+
+	for _, msg := range []string{"a", "b"} {
+		if _, err := fmt.Fprintln(body, msg); err != nil {
+			t.Fatal(err)
+		}
+
+		line, err, ok := next()
+		if !ok || err != nil {
+			t.Fatalf("expected a line, got %v", err)
+		}
+		assertEqual(t, line, "echo "+msg)
+	}
+
+	body.Close()
+	_, _, ok := next()
+	assertEqual(t, ok, false)
+
+	retried := c.Post("/", nil).SetRetry(1, time.Millisecond).SetBaseUrl("http://127.0.0.1:1")
+	retried.BodyPipe().Close()
+	_, err = retried.Do()
+	if !errors.Is(err, ErrBodyNotReplayable) {
+		t.Fatalf("expected %v, got %v", ErrBodyNotReplayable, err)
+	}
+}
+
+func TestFetchMetadataAndBrowserProfile(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetBrowserProfile(BrowserChrome)
+
+	resp, err := c.Post("/echo", nil).
+		SetHeader("User-Agent", "ignored").
+		SetPriorityHint(9, true).
+		SetFetchMetadata(FetchMetadata{Site: "none", Mode: "navigate", Dest: "document", User: true}).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("User-Agent"), BrowserChrome.UserAgent)
+	assertEqual(t, resp.GetHeader("Accept-Language"), BrowserChrome.AcceptLanguage)
+	assertEqual(t, resp.GetHeader("Sec-Ch-Ua-Mobile"), "?0")
+	assertEqual(t, resp.GetHeader("Priority"), "u=7, i")
+	assertEqual(t, resp.GetHeader("Sec-Fetch-Site"), "none")
+	assertEqual(t, resp.GetHeader("Sec-Fetch-Mode"), "navigate")
+	assertEqual(t, resp.GetHeader("Sec-Fetch-Dest"), "document")
+	assertEqual(t, resp.GetHeader("Sec-Fetch-User"), "?1")
+
+	resp, err = c.Post("/echo", nil).
+		SetPriorityHint(1, false).
+		SetFetchMetadata(FetchMetadata{Mode: "cors"}).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.GetHeader("Priority"), "u=1")
+	assertEqual(t, resp.GetHeader("Sec-Fetch-Mode"), "cors")
+	assertEqual(t, resp.GetHeader("Sec-Fetch-Site"), "")
+	assertEqual(t, resp.GetHeader("Sec-Fetch-User"), "")
+}
+
+func TestSession(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`<html><head><meta content="page&amp;token" name="csrf-token"></head></html>`))
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "abc", Path: "/"})
+			w.Write([]byte(`{"csrf":"json-token"}`))
+		case "/me":
+			cookie, err := r.Cookie("sid")
+			if err != nil || cookie.Value != "abc" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(r.Header.Get(DefaultCSRFHeader)))
+		case "/expire":
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	expired := 0
+	s := c.NewSession().
+		SetCSRF(DefaultCSRFHeader, CSRFFromMetaTag("csrf-token")).
+		OnExpired(func() { expired++ })
+
+	if err := s.RefreshCSRF(context.Background(), s.Client().Get("/login")); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, s.CSRFToken(), "page&token")
+
+	s.SetCSRF(DefaultCSRFHeader, CSRFFromJson("csrf"))
+	if _, err := s.Login(context.Background(), c.Post("/login", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, s.LoggedIn(), true)
+	assertEqual(t, len(s.Cookies(server.URL)), 1)
+
+	me := s.Client().Get("/me")
+	resp, err := me.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), "json-token")
+
+	s.SetCSRF(DefaultCSRFHeader, CSRFFromMetaTag("csrf-token"))
+	if err := s.RefreshCSRF(context.Background(), s.Client().Get("/login")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = me.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), "page&token")
+	s.SetCSRF(DefaultCSRFHeader, CSRFFromJson("csrf"))
+
+	resp, err = c.Get("/me").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.StatusCode(), http.StatusUnauthorized)
+
+	if _, err := s.Client().Get("/expire").Do(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, expired, 1)
+	assertEqual(t, s.LoggedIn(), false)
+	assertEqual(t, s.CSRFToken(), "")
+	assertEqual(t, len(s.Cookies(server.URL)), 0)
+
+	if _, err := s.Login(context.Background(), c.Post("/login", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Logout(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, s.LoggedIn(), false)
+	assertEqual(t, len(s.Cookies(server.URL)), 0)
+
+	_, err = CSRFFromHeader("X-Missing")(resp)
+	assertEqual(t, errors.Is(err, ErrCSRFTokenNotFound), true)
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	var valid atomic.Value
+	valid.Store("t1")
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/csrf":
+			fetches.Add(1)
+			http.SetCookie(w, &http.Cookie{Name: "XSRF-TOKEN", Value: valid.Load().(string)})
+		case "/submit":
+			r.ParseForm()
+			token := cmp.Or(r.Header.Get(DefaultCSRFHeader), r.PostForm.Get("_token"))
+			if token != valid.Load().(string) {
+				w.WriteHeader(419)
+				return
+			}
+			w.Write([]byte(r.Method + " " + r.PostForm.Get("name")))
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Use(CSRFMiddleware(map[string]CSRFConfig{
+			u.Hostname(): {TokenUrl: "/csrf", Extract: CSRFFromCookie("XSRF-TOKEN")},
+		}))
+
+	resp, err := c.Get("/submit").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.StatusCode(), 419)
+	assertEqual(t, fetches.Load(), int32(0))
+
+	resp, err = c.Post("/submit", nil).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), "POST ")
+
+	valid.Store("t2")
+	resp, err = c.Put("/submit", nil).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), "PUT ")
+	assertEqual(t, fetches.Load(), int32(2))
+
+	form := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Use(CSRFMiddleware(map[string]CSRFConfig{
+			u.Hostname(): {TokenUrl: server.URL + "/csrf", Extract: CSRFFromCookie("XSRF-TOKEN"), FormField: "_token"},
+		}))
+
+	resp, err = form.NewRequest().
+		SetMethod(http.MethodPost).
+		SetPath("/submit").
+		BodyFormUrlEncoded(url.Values{"name": {"pingo"}}).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), "POST pingo")
+
+	transport := CSRFMiddleware(map[string]CSRFConfig{
+		u.Hostname(): {TokenUrl: "/csrf", Extract: CSRFFromCookie("XSRF-TOKEN")},
+	})(http.DefaultTransport)
+
+	send := func(body io.ReadCloser, getBody func() (io.ReadCloser, error)) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/submit", body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.GetBody = getBody
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		assertEqual(t, string(data), "POST pingo")
+		assertEqual(t, req.Body, body)
+	}
+
+	body := io.NopCloser(strings.NewReader("name=pingo"))
+	send(body, nil)
+
+	valid.Store("t3")
+	body = io.NopCloser(strings.NewReader("name=pingo"))
+	send(body, func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("name=pingo")), nil
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	body = io.NopCloser(strings.NewReader("name=pingo"))
+	req.Body = body
+	data, peeked, err := peekBody(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), "name=pingo")
+	assertEqual(t, req.Body, body)
+	data, _ = io.ReadAll(peeked.Body)
+	assertEqual(t, string(data), "name=pingo")
+}
+
+func TestContextHeaderMiddleware(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	type tenantKey struct{}
+	type userKey struct{}
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Use(ContextHeaderMiddleware(map[string]any{
+			"X-Tenant-ID": tenantKey{},
+			"X-User-ID":   userKey{},
+		}))
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	ctx = context.WithValue(ctx, userKey{}, 42)
+
+	resp, err := c.Post("/echo", nil).DoCtx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.GetHeader("X-Tenant-ID"), "acme")
+	assertEqual(t, resp.GetHeader("X-User-ID"), "42")
+
+	resp, err = c.Post("/echo", nil).
+		SetHeader("X-Tenant-ID", "explicit").
+		DoCtx(context.WithValue(context.Background(), tenantKey{}, "acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.GetHeader("X-Tenant-ID"), "explicit")
+	assertEqual(t, resp.GetHeader("X-User-ID"), "")
+
+	req := c.Post("/echo", nil)
+	for _, tenant := range []string{"a", "b"} {
+		resp, err = req.DoCtx(context.WithValue(context.Background(), tenantKey{}, tenant))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, resp.GetHeader("X-Tenant-ID"), tenant)
+	}
+	assertEqual(t, req.headers.Get("X-Tenant-ID"), "")
+}
+
+func TestLocale(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Language", "de-DE, en")
+		w.Header().Add("Content-Language", "fr")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetLocale("de-DE", "de", "en;q=0.5")
+
+	resp, err := c.Get("/").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), "de-DE, de;q=0.9, en;q=0.5")
+	assertEqual(t, strings.Join(resp.ContentLanguage(), " "), "de-DE en fr")
+
+	assertEqual(t, c.SetLocale().headers.Get("Accept-Language"), "")
+}
+
+func TestTypedResponseHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=ISO-8859-1")
+		w.Header().Set("Location", "../next?page=2")
+		w.Header().Set("Retry-After", "120")
+		w.Header().Set("Content-Disposition", `attachment; filename="report.csv"; filename*=UTF-8''r%C3%A9sum%C3%A9.csv`)
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	resp, err := NewRequest().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetPath("/api/items/1").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params := resp.ContentType()
+	assertEqual(t, mediaType, "text/plain")
+	assertEqual(t, params["charset"], "ISO-8859-1")
+	assertEqual(t, resp.ContentLength(), int64(5))
+	assertEqual(t, resp.Location(), server.URL+"/api/next?page=2")
+	assertEqual(t, resp.RetryAfter(), 2*time.Minute)
+
+	disposition, filename := resp.ContentDisposition()
+	assertEqual(t, disposition, "attachment")
+	assertEqual(t, filename, "résumé.csv")
+
+	data, err := resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restored Response
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, restored.Location(), server.URL+"/api/next?page=2")
+
+	empty := &Response{responseHeader: responseHeader{headers: make(http.Header)}}
+	mediaType, params = empty.ContentType()
+	assertEqual(t, mediaType, "")
+	assertEqual(t, params == nil, true)
+	assertEqual(t, empty.ContentLength(), int64(-1))
+	assertEqual(t, empty.Location(), "")
+	assertEqual(t, empty.RetryAfter(), time.Duration(0))
+}
+
+func TestSaveToDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if disposition := r.URL.Query().Get("disposition"); disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	tests := []struct {
+		path        string
+		disposition string
+		want        string
+	}{
+		{"/files/report.pdf", "", "report.pdf"},
+		{"/files/x", `attachment; filename="../../etc/passwd"`, "passwd"},
+		{"/files/x", `attachment; filename="..\\evil<1>.txt"`, "evil1.txt"},
+		{"/files/x", `attachment; filename*=UTF-8''%C3%BCber.txt`, "über.txt"},
+		{"/", `attachment; filename=".."`, "download"},
+	}
+
+	for _, tt := range tests {
+		resp, err := c.Get(tt.path).SetQueryParam("disposition", tt.disposition).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filePath, err := resp.SaveToDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, filePath, filepath.Join(dir, tt.want))
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, string(data), "content of "+tt.path)
+	}
+
+	stream, err := c.Get("/files/stream.txt").DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	filePath, err := stream.SaveToDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, filePath, filepath.Join(dir, "stream.txt"))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(entries), 6)
+}
+
+func TestBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || r.URL.Path != "/batch" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var parts []string
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+
+			req, err := http.ReadRequest(bufio.NewReader(part))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+
+			status := http.StatusOK
+			if req.URL.Path == "/missing" {
+				status = http.StatusNotFound
+			}
+
+			resp := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\n\r\n%s %s %s %s",
+				status, http.StatusText(status), req.Method, req.URL.RequestURI(), req.Header.Get("X-Item"), body)
+			parts = append(parts, part.Header.Get("Content-ID")+"\n"+resp)
+		}
+
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		for _, p := range slices.Backward(parts) {
+			id, resp, _ := strings.Cut(p, "\n")
+			part, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type": {"application/http"},
+				"Content-ID":   {"<response-" + strings.Trim(id, "<>") + ">"},
+			})
+			part.Write([]byte(resp))
+		}
+		mw.Close()
+	}))
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	responses, err := c.NewBatch("/batch").
+		Add(
+			c.Get("/items/1").SetQueryParam("fields", "name").SetHeader("X-Item", "first"),
+			c.Post("/items", nil).BodyText("created"),
+			c.Delete("/missing"),
+		).
+		Do(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, len(responses), 3)
+	assertEqual(t, responses[0].BodyString(), "GET /items/1?fields=name first ")
+	assertEqual(t, responses[1].BodyString(), "POST /items  created")
+	assertEqual(t, responses[2].StatusCode(), http.StatusNotFound)
+	assertEqual(t, responses[2].IsError() != nil, true)
+	assertEqual(t, responses[0].Location(), "")
+
+	_, err = c.NewBatch("/other").Add(c.Get("/")).Do(context.Background())
+	assertEqual(t, IsStatus(err, http.StatusBadRequest), true)
+}
+
+func TestPaginate(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/odata", func(w http.ResponseWriter, r *http.Request) {
+		skip, _ := strconv.Atoi(r.URL.Query().Get("$skip"))
+		body := map[string]any{"value": []int{skip, skip + 1}}
+		if skip < 4 {
+			body["@odata.nextLink"] = fmt.Sprintf("odata?$top=2&$skip=%d", skip+2)
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+	mux.HandleFunc("/github", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 3 {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/github?page=%d>; rel="next", <%s/github?page=3>; rel="last"`, "http://"+r.Host, page+1, "http://"+r.Host))
+		}
+		json.NewEncoder(w).Encode([]int{page * 10})
+	})
+	mux.HandleFunc("/numbered", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		items := []int{page, page}
+		if page == 3 {
+			items = items[:1]
+		}
+		json.NewEncoder(w).Encode(items)
+	})
+	mux.HandleFunc("/cursor", func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("after")
+		next := map[string]string{"": "b", "b": "c"}[cursor]
+		json.NewEncoder(w).Encode(map[string]any{"items": []string{"item-" + cursor}, "next": next})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	ints, err := CollectAll(context.Background(), c.Get("/odata").SetQueryParam("$top", "2"), Paginate[int](PaginationNextLink, PaginationConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, reflect.DeepEqual(ints, []int{0, 1, 2, 3, 4, 5}), true)
+
+	ints, err = CollectAll(context.Background(), c.Get("/github").SetQueryParam("page", "1"), Paginate[int](PaginationLinkHeader, PaginationConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, reflect.DeepEqual(ints, []int{10, 20, 30}), true)
+
+	ints, err = CollectAll(context.Background(), c.Get("/numbered"), Paginate[int](PaginationPage, PaginationConfig{PerPage: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, reflect.DeepEqual(ints, []int{0, 0, 2, 2, 3}), true)
+
+	strs, err := CollectAll(context.Background(), c.Get("/cursor"), Paginate[string](PaginationCursor, PaginationConfig{
+		Items:       "items",
+		Cursor:      "next",
+		CursorParam: "after",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Join(strs, ","), "item-,item-b,item-c")
+
+	_, err = CollectAll(context.Background(), c.Get("/cursor"), Paginate[string]("offset", PaginationConfig{}))
+	assertEqual(t, errors.Is(err, ErrUnknownPagination), true)
+}
+
+func TestPathRateLimit(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetPathRateLimit("/search/*", 20, 1).
+		SetPathRateLimit("*", 1000, 10)
+
+	now := time.Now()
+	for range 3 {
+		if _, err := c.Get("/search/users/1").Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEqual(t, time.Since(now) >= 90*time.Millisecond, true)
+
+	now = time.Now()
+	for range 3 {
+		if _, err := c.Get("/ping").Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEqual(t, time.Since(now) < 90*time.Millisecond, true)
+
+	assertEqual(t, c.SetPathRateLimit("/search/*", 0, 0).pathLimiter("/search/users") == c.pathLimiter("/ping"), true)
+
+	assertEqual(t, matchPath("/search/*", "/search/a/b"), true)
+	assertEqual(t, matchPath("/search/*", "/search"), false)
+	assertEqual(t, matchPath("/users/*/posts", "/users/1/posts"), true)
+	assertEqual(t, matchPath("/users/*/posts", "/users/1/posts/2"), false)
+	assertEqual(t, matchPath("*", "/anything/at/all"), true)
+}
+
+func TestResponseCache(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/localized":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		fmt.Fprintf(w, "%s|%s|%s", r.URL.Path, r.Header.Get("Accept-Language"), r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	cache := NewResponseCache(time.Minute)
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetCache(cache)
+
+	get := func(path, language, authorization string) *Response {
+		t.Helper()
+		resp, err := c.Get(path).
+			SetHeader("Accept-Language", language).
+			SetHeader("Authorization", authorization).
+			Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	assertEqual(t, get("/localized", "en", "alice").BodyString(), "/localized|en|alice")
+	assertEqual(t, get("/localized", "de", "alice").BodyString(), "/localized|de|alice")
+	assertEqual(t, get("/localized", "en", "bob").BodyString(), "/localized|en|bob")
+	assertEqual(t, hits.Load(), int32(3))
+
+	resp := get("/localized", "en", "alice")
+	assertEqual(t, resp.BodyString(), "/localized|en|alice")
+	assertEqual(t, resp.GetHeader("Age"), "0")
+	assertEqual(t, hits.Load(), int32(3))
+
+	get("/other", "", "alice")
+	get("/other", "en", "alice")
+	assertEqual(t, hits.Load(), int32(4))
+
+	for _, cookie := range []string{"sid=alice", "sid=bob", "sid=alice"} {
+		if _, err := c.Get("/localized").SetHeader("Accept-Language", "en").SetHeader("Cookie", cookie).Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEqual(t, hits.Load(), int32(6))
+
+	get("/private", "", "")
+	get("/private", "", "")
+	assertEqual(t, hits.Load(), int32(8))
+
+	if _, err := c.Get("/other").SetHeader("Authorization", "alice").SetHeader("Cache-Control", "no-cache").Do(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, hits.Load(), int32(9))
+
+	if _, err := c.Post("/other", nil).SetHeader("Authorization", "alice").Do(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, hits.Load(), int32(10))
+
+	assertEqual(t, cache.Len(), 6)
+	cache.SetMaxEntries(2)
+	assertEqual(t, cache.Len(), 2)
+	cache.Clear()
+	assertEqual(t, cache.Len(), 0)
+
+	cache.SetHashedVaryHeaders("X-Api-Key")
+	assertEqual(t, strings.Join(cache.hashedHeaders, ","), "Authorization,Cookie,X-Api-Key")
+}
+
+func TestOffline(t *testing.T) {
+	server := testServer(t)
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRetry(3, time.Second).
+		SetCache(NewResponseCache(time.Millisecond))
+
+	resp, err := c.Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := resp.BodyString()
+
+	server.Close()
+	time.Sleep(5 * time.Millisecond)
+
+	c.SetOffline(true)
+	resp, err = c.Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, resp.BodyString(), want)
+
+	now := time.Now()
+	_, err = c.Get("/other").Do()
+	assertEqual(t, errors.Is(err, ErrOffline), true)
+	assertEqual(t, time.Since(now) < time.Second, true)
+
+	_, err = c.Clone().SetCache(nil).Get("/ping").Do()
+	assertEqual(t, errors.Is(err, ErrOffline), true)
+
+	limited := c.Clone().
+		SetPathRateLimit("/*", 0.001, 1).
+		SetTokenSource(NewJwtMinter("invalid", nil, time.Minute))
+
+	now = time.Now()
+	for range 3 {
+		_, err = limited.Get("/other").Do()
+		assertEqual(t, errors.Is(err, ErrOffline), true)
+	}
+	assertEqual(t, time.Since(now) < time.Second, true)
+
+	c.SetOffline(false)
+	_, err = c.Get("/ping").SetRetry(0, 0).Do()
+	assertEqual(t, err != nil && !errors.Is(err, ErrOffline), true)
+}
+
+func TestNamedMiddleware(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	tag := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+				req.Header.Set("X-Chain", strings.TrimPrefix(req.Header.Get("X-Chain")+","+name, ","))
+				return next.RoundTrip(req)
+			})
+		}
+	}
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		Use(tag("plain")).
+		UseNamed("auth", 10, tag("auth")).
+		UseNamed("tracing", -10, tag("tracing")).
+		UseNamed("metrics", 0, tag("metrics"))
+
+	chain := func() string {
+		t.Helper()
+		resp, err := c.Post("/echo", nil).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.GetHeader("X-Chain")
+	}
+
+	assertEqual(t, chain(), "tracing,plain,metrics,auth")
+	assertEqual(t, strings.Join(c.MiddlewareNames(), ","), "tracing,metrics,auth")
+
+	clone := c.Clone()
+
+	c.UseNamed("auth", 10, tag("auth2"))
+	assertEqual(t, chain(), "tracing,plain,metrics,auth2")
+
+	c.UseNamed("tracing", 20, tag("tracing"))
+	c.RemoveMiddleware("metrics")
+	assertEqual(t, chain(), "plain,auth2,tracing")
+	assertEqual(t, strings.Join(c.MiddlewareNames(), ","), "auth,tracing")
+
+	assertEqual(t, strings.Join(clone.MiddlewareNames(), ","), "tracing,metrics,auth")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	var calls atomic.Int32
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRetry(3, time.Millisecond).
+		SetPanicRecovery(true).
+		UseNamed("bad", 0, func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				if req.Header.Get("X-Panic") != "" {
+					panic("middleware")
+				}
+				return next.RoundTrip(req)
+			})
+		})
+
+	var panicErr *PanicError
+
+	_, err := c.Get("/ping").SetHeader("X-Panic", "1").Do()
+	assertEqual(t, errors.As(err, &panicErr), true)
+	assertEqual(t, panicErr.Value, any("middleware"))
+	assertEqual(t, strings.Contains(string(panicErr.Stack), "TestPanicRecovery"), true)
+	assertEqual(t, calls.Load(), int32(1))
+
+	_, err = c.Get("/ping").WithHttpRequest(func(req *http.Request) { panic(io.ErrUnexpectedEOF) }).Do()
+	assertEqual(t, errors.Is(err, io.ErrUnexpectedEOF), true)
+
+	resp, err := c.Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = resp.Unmarshal(func(r *Response) error { panic("unmarshaler") })
+	assertEqual(t, errors.As(err, &panicErr), true)
+
+	stream, err := c.Get("/ping").DoStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	err = stream.RecvFunc(func(r *bufio.Reader) error { panic("receiver") })
+	assertEqual(t, errors.As(err, &panicErr), true)
+	assertEqual(t, panicErr.Error(), "panic: receiver")
+
+	var logs bytes.Buffer
+	_, err = NewClient().
+		SetLogOutput(&logs).
+		SetLogFlags(0).
+		SetPanicRecovery(true).
+		SetConnEvents(ConnEvents{
+			OnConnect: func(network, addr string, duration time.Duration, err error) { panic("connect") },
+		}).
+		Get(server.URL + "/ping").
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, strings.Contains(logs.String(), "OnConnect: panic: connect"), true)
+
+	defer func() {
+		assertEqual(t, recover(), any("unrecovered"))
+	}()
+	resp, err = c.Clone().SetPanicRecovery(false).Get("/ping").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Unmarshal(func(r *Response) error { panic("unrecovered") })
+}
+
+func TestEndpointCall(t *testing.T) {
+	server := testServer(t)
+	defer server.Close()
+
+	type message struct {
+		Text string `json:"text"`
+	}
+
+	c := NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL).
+		SetRetry(0, 0)
+
+	echo := Endpoint[message, message]{
+		Method: http.MethodPost,
+		Path:   "/echo",
+	}
+
+	got, err := echo.Call(context.Background(), c, message{Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, got, message{Text: "hello"})
+
+	status := Endpoint[struct{}, bool]{
+		Path: "/json",
+		Decode: func(resp *Response) (bool, error) {
+			var v struct{ Success bool }
+			err := resp.UnmarshalJson(&v)
+			return v.Success, err
+		},
+	}
+
+	ok, err := status.Call(context.Background(), c, struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ok, true)
+
+	ping := Endpoint[string, string]{
+		Path: "/{name}",
+		Encode: func(r *Request, name string) {
+			r.SetPathParam("name", name)
+		},
+		Decode: func(resp *Response) (string, error) {
+			return resp.BodyString(), nil
+		},
+	}
+
+	pong, err := ping.Call(context.Background(), c, "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, pong, "pong")
+
+	_, err = ping.Call(context.Background(), c, "error")
+	var respErr *ResponseError
+	assertEqual(t, errors.As(err, &respErr), true)
+	assertEqual(t, respErr.StatusCode(), http.StatusInternalServerError)
+
+	empty := Endpoint[[]byte, *message]{
+		Method: http.MethodPost,
+		Path:   "/echo",
+	}
+
+	nothing, err := empty.Call(context.Background(), c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, nothing, (*message)(nil))
+}
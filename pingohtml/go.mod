@@ -0,0 +1,11 @@
+module github.com/mauserzjeh/pingo/v2/pingohtml
+
+go 1.23
+
+require (
+	github.com/mauserzjeh/pingo/v2 v2.0.0-00010101000000-000000000000
+	golang.org/x/net v0.35.0
+)
+
+// pingohtml uses the root module from the same commit until it is published in a tagged release
+replace github.com/mauserzjeh/pingo/v2 => ../
@@ -0,0 +1,121 @@
+// MIT License
+//
+// Copyright (c) 2024 Soma Rádóczi
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package pingohtml provides HTML parsing convenience functions for pingo responses.
+// It is a separate module so that the pingo package itself stays free of dependencies
+package pingohtml
+
+import (
+	"strings"
+
+	"github.com/mauserzjeh/pingo/v2"
+	"golang.org/x/net/html"
+)
+
+// Document parses the body of the given response as an HTML document.
+// The body is converted to UTF-8 according to its charset before parsing, see [pingo.Response.BodyText]
+func Document(r *pingo.Response) (*html.Node, error) {
+	text, err := r.BodyText()
+	if err != nil {
+		return nil, err
+	}
+
+	return html.Parse(strings.NewReader(text))
+}
+
+// Find returns the first element in the tree of the given node, including the node itself,
+// that matches the given tag name and attributes given as key-value pairs e.g.: Find(doc, "a", "class", "next").
+// It returns nil if there is no such element
+func Find(n *html.Node, tag string, attrs ...string) *html.Node {
+	if matches(n, tag, attrs) {
+		return n
+	}
+
+	for e := range n.Descendants() {
+		if matches(e, tag, attrs) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// FindAll returns every element in the tree of the given node, including the node itself,
+// that matches the given tag name and attributes given as key-value pairs e.g.: FindAll(doc, "meta", "name", "csrf-token").
+// An empty tag name matches every element
+func FindAll(n *html.Node, tag string, attrs ...string) []*html.Node {
+	var nodes []*html.Node
+	if matches(n, tag, attrs) {
+		nodes = append(nodes, n)
+	}
+
+	for e := range n.Descendants() {
+		if matches(e, tag, attrs) {
+			nodes = append(nodes, e)
+		}
+	}
+
+	return nodes
+}
+
+// Attr returns the value of the attribute with the given key of the given node
+// or an empty string if the node has no such attribute
+func Attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+// Text returns the concatenated text content of the given node and its descendants
+func Text(n *html.Node) string {
+	sb := strings.Builder{}
+	if n.Type == html.TextNode {
+		sb.WriteString(n.Data)
+	}
+
+	for e := range n.Descendants() {
+		if e.Type == html.TextNode {
+			sb.WriteString(e.Data)
+		}
+	}
+
+	return sb.String()
+}
+
+// matches reports whether the node is an element with the given tag name and attributes
+func matches(n *html.Node, tag string, attrs []string) bool {
+	if n.Type != html.ElementNode || (tag != "" && n.Data != tag) {
+		return false
+	}
+
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if Attr(n, attrs[i]) != attrs[i+1] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,48 @@
+package pingohtml
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mauserzjeh/pingo/v2"
+)
+
+// assertEqual fails if the two values are not equal
+func assertEqual[T comparable](t testing.TB, got, want T) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got: %v != want: %v", got, want)
+	}
+}
+
+func TestDocument(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		w.Write([]byte(`<html><head><meta name="csrf-token" content="abc"></head>` +
+			`<body><h1>Caf` + "\xe9" + `</h1><a class="next" href="/2">next</a><a href="/0">prev</a></body></html>`))
+	}))
+	defer server.Close()
+
+	resp, err := pingo.NewRequest().
+		SetBaseUrl(server.URL).
+		SetLogEnabled(false).
+		Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := Document(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, Text(Find(doc, "h1")), "Café")
+	assertEqual(t, Attr(Find(doc, "meta", "name", "csrf-token"), "content"), "abc")
+	assertEqual(t, Attr(Find(doc, "a", "class", "next"), "href"), "/2")
+	assertEqual(t, len(FindAll(doc, "a")), 2)
+	assertEqual(t, Find(doc, "table") == nil, true)
+
+	body := Find(doc, "body")
+	assertEqual(t, Find(body, ""), body)
+}
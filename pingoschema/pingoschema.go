@@ -0,0 +1,418 @@
+// MIT License
+//
+// Copyright (c) 2024 Soma Rádóczi
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package pingoschema validates JSON documents against JSON Schemas, it is used by pingo to validate the response bodies.
+// The keywords of the type, enum, const, object, array, string and number validation are supported along with
+// allOf, anyOf, oneOf, not and local references e.g.: "#/$defs/user"
+package pingoschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// Error is returned when a JSON document does not conform to a JSON Schema
+	Error struct {
+		Violations []Violation // violations of the schema
+	}
+
+	// Violation describes a single violation of a JSON Schema
+	Violation struct {
+		Path    string // path of the violating value e.g.: "$.users[0].name"
+		Message string // description of the violation
+	}
+
+	// validator validates a JSON document against a JSON Schema
+	validator struct {
+		root       any                        // root of the schema used to resolve references
+		patterns   map[string]compiledPattern // compiled patterns of the schema by their source
+		active     map[string]bool            // references being resolved by the reference and the path of the value
+		violations []Violation                // collected violations
+	}
+
+	// compiledPattern is the result of compiling a pattern of the schema
+	compiledPattern struct {
+		re  *regexp.Regexp // the compiled pattern
+		err error          // error of compiling the pattern
+	}
+)
+
+// Validate validates the given JSON data against the given JSON Schema.
+// The returned error is an [*Error] listing every violation if the data does not conform to the schema
+func Validate(schemaJSON, data []byte) error {
+	var schema, value any
+	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return &Error{
+			Violations: []Violation{{Path: "$", Message: fmt.Sprintf("invalid JSON: %v", err)}},
+		}
+	}
+
+	v := &validator{
+		root:     schema,
+		patterns: make(map[string]compiledPattern),
+		active:   make(map[string]bool),
+	}
+	v.validate(schema, value, "$")
+	if len(v.violations) > 0 {
+		return &Error{Violations: v.violations}
+	}
+
+	return nil
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	sb := strings.Builder{}
+	sb.WriteString("schema validation failed")
+	for i, v := range e.Violations {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString("; ")
+		}
+
+		fmt.Fprintf(&sb, "%s: %s", v.Path, v.Message)
+	}
+
+	return sb.String()
+}
+
+// fail records a violation at the given path
+func (v *validator) fail(path, format string, args ...any) {
+	v.violations = append(v.violations, Violation{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// valid reports whether the value conforms to the given schema without recording violations
+func (v *validator) valid(schema, value any, path string) bool {
+	sub := &validator{
+		root:     v.root,
+		patterns: v.patterns,
+		active:   v.active,
+	}
+	sub.validate(schema, value, path)
+	return len(sub.violations) == 0
+}
+
+// validate validates the value at the given path against the given schema
+func (v *validator) validate(schema, value any, path string) {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		if b, ok := schema.(bool); ok && !b {
+			v.fail(path, "no value is allowed")
+		}
+		return
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := v.resolve(ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+
+		// a reference resolved again for the same value would recurse forever
+		key := ref + "\x00" + path
+		if v.active[key] {
+			v.fail(path, "circular reference %q", ref)
+			return
+		}
+
+		v.active[key] = true
+		v.validate(target, value, path)
+		delete(v.active, key)
+		return
+	}
+
+	if t, ok := s["type"]; ok && !schemaTypeMatches(t, value) {
+		v.fail(path, "expected type %v, got %s", t, schemaType(value))
+		return
+	}
+
+	if enum, ok := s["enum"].([]any); ok {
+		if !slices.ContainsFunc(enum, func(e any) bool { return reflect.DeepEqual(e, value) }) {
+			v.fail(path, "value is not one of %v", enum)
+		}
+	}
+
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		v.fail(path, "value must be %v", c)
+	}
+
+	switch val := value.(type) {
+	case map[string]any:
+		v.validateObject(s, val, path)
+	case []any:
+		v.validateArray(s, val, path)
+	case string:
+		v.validateString(s, val, path)
+	case float64:
+		v.validateNumber(s, val, path)
+	}
+
+	if allOf, ok := s["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			v.validate(sub, value, path)
+		}
+	}
+
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		if !slices.ContainsFunc(anyOf, func(sub any) bool { return v.valid(sub, value, path) }) {
+			v.fail(path, "value does not match any of the schemas in anyOf")
+		}
+	}
+
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if v.valid(sub, value, path) {
+				matches++
+			}
+		}
+
+		if matches != 1 {
+			v.fail(path, "value matches %d of the schemas in oneOf instead of exactly one", matches)
+		}
+	}
+
+	if not, ok := s["not"]; ok && v.valid(not, value, path) {
+		v.fail(path, "value must not match the schema in not")
+	}
+}
+
+// validateObject validates the keywords of an object schema
+func (v *validator) validateObject(s map[string]any, obj map[string]any, path string) {
+	if required, ok := s["required"].([]any); ok {
+		for _, r := range required {
+			if key, ok := r.(string); ok {
+				if _, ok := obj[key]; !ok {
+					v.fail(path, "missing required property %q", key)
+				}
+			}
+		}
+	}
+
+	properties, _ := s["properties"].(map[string]any)
+	patternProperties, _ := s["patternProperties"].(map[string]any)
+	additional, hasAdditional := s["additionalProperties"]
+
+	keys := slices.Sorted(maps.Keys(obj))
+	for _, key := range keys {
+		keyPath := path + "." + key
+		matched := false
+
+		if sub, ok := properties[key]; ok {
+			matched = true
+			v.validate(sub, obj[key], keyPath)
+		}
+
+		for pattern, sub := range patternProperties {
+			re, err := v.compile(pattern)
+			if err != nil {
+				v.fail(path, "invalid pattern %q: %v", pattern, err)
+				continue
+			}
+
+			if re.MatchString(key) {
+				matched = true
+				v.validate(sub, obj[key], keyPath)
+			}
+		}
+
+		if !matched && hasAdditional {
+			if b, ok := additional.(bool); ok && !b {
+				v.fail(keyPath, "additional property is not allowed")
+			} else {
+				v.validate(additional, obj[key], keyPath)
+			}
+		}
+	}
+}
+
+// validateArray validates the keywords of an array schema
+func (v *validator) validateArray(s map[string]any, arr []any, path string) {
+	if n, ok := s["minItems"].(float64); ok && float64(len(arr)) < n {
+		v.fail(path, "array must have at least %v items", n)
+	}
+
+	if n, ok := s["maxItems"].(float64); ok && float64(len(arr)) > n {
+		v.fail(path, "array must have at most %v items", n)
+	}
+
+	if unique, ok := s["uniqueItems"].(bool); ok && unique {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if reflect.DeepEqual(arr[i], arr[j]) {
+					v.fail(path, "array items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+
+	if items, ok := s["items"]; ok {
+		for i, item := range arr {
+			v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// validateString validates the keywords of a string schema
+func (v *validator) validateString(s map[string]any, str string, path string) {
+	length := float64(utf8.RuneCountInString(str))
+
+	if n, ok := s["minLength"].(float64); ok && length < n {
+		v.fail(path, "string must be at least %v characters long", n)
+	}
+
+	if n, ok := s["maxLength"].(float64); ok && length > n {
+		v.fail(path, "string must be at most %v characters long", n)
+	}
+
+	if pattern, ok := s["pattern"].(string); ok {
+		re, err := v.compile(pattern)
+		if err != nil {
+			v.fail(path, "invalid pattern %q: %v", pattern, err)
+		} else if !re.MatchString(str) {
+			v.fail(path, "string does not match pattern %q", pattern)
+		}
+	}
+}
+
+// validateNumber validates the keywords of a number schema
+func (v *validator) validateNumber(s map[string]any, num float64, path string) {
+	if n, ok := s["minimum"].(float64); ok && num < n {
+		v.fail(path, "value must be greater than or equal to %v", n)
+	}
+
+	if n, ok := s["maximum"].(float64); ok && num > n {
+		v.fail(path, "value must be less than or equal to %v", n)
+	}
+
+	if n, ok := s["exclusiveMinimum"].(float64); ok && num <= n {
+		v.fail(path, "value must be greater than %v", n)
+	}
+
+	if n, ok := s["exclusiveMaximum"].(float64); ok && num >= n {
+		v.fail(path, "value must be less than %v", n)
+	}
+
+	if n, ok := s["multipleOf"].(float64); ok && n > 0 {
+		if q := num / n; q != math.Trunc(q) {
+			v.fail(path, "value must be a multiple of %v", n)
+		}
+	}
+}
+
+// compile returns the compiled regular expression of the given pattern, which is compiled only once per validation
+func (v *validator) compile(pattern string) (*regexp.Regexp, error) {
+	if p, ok := v.patterns[pattern]; ok {
+		return p.re, p.err
+	}
+
+	re, err := regexp.Compile(pattern)
+	v.patterns[pattern] = compiledPattern{re: re, err: err}
+	return re, err
+}
+
+// resolve resolves a local reference e.g.: "#/$defs/user"
+func (v *validator) resolve(ref string) (any, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference %q", ref)
+	}
+
+	current := v.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+
+		switch c := current.(type) {
+		case map[string]any:
+			next, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("unresolvable reference %q", ref)
+			}
+			current = next
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, fmt.Errorf("unresolvable reference %q", ref)
+			}
+			current = c[i]
+		default:
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+	}
+
+	return current, nil
+}
+
+// schemaType returns the JSON Schema type of the given decoded JSON value
+func schemaType(value any) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+
+	return "unknown"
+}
+
+// schemaTypeMatches reports whether the value matches the type keyword, which is either a type or a list of types
+func schemaTypeMatches(t any, value any) bool {
+	matches := func(t any) bool {
+		name, _ := t.(string)
+		actual := schemaType(value)
+		return name == actual || (name == "number" && actual == "integer")
+	}
+
+	if types, ok := t.([]any); ok {
+		return slices.ContainsFunc(types, matches)
+	}
+
+	return matches(t)
+}
@@ -0,0 +1,73 @@
+package pingoschema
+
+import (
+	"errors"
+	"testing"
+)
+
+// assertEqual fails if the two values are not equal
+func assertEqual[T comparable](t testing.TB, got, want T) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got: %v != want: %v", got, want)
+	}
+}
+
+func TestSchemaValidator(t *testing.T) {
+	for i, tc := range []struct {
+		schema string
+		data   string
+		valid  bool
+	}{
+		{`{"type": "integer", "minimum": 1, "maximum": 3}`, `2`, true},
+		{`{"type": "integer"}`, `2.5`, false},
+		{`{"type": ["string", "null"]}`, `null`, true},
+		{`{"enum": ["a", "b"]}`, `"c"`, false},
+		{`{"type": "string", "minLength": 2, "maxLength": 3, "pattern": "^a"}`, `"abc"`, true},
+		{`{"type": "string", "pattern": "^a"}`, `"bc"`, false},
+		{`{"type": "array", "items": {"type": "number"}, "minItems": 1, "uniqueItems": true}`, `[1, 2]`, true},
+		{`{"type": "array", "uniqueItems": true}`, `[1, 1]`, false},
+		{`{"exclusiveMaximum": 3, "multipleOf": 0.5}`, `2.5`, true},
+		{`{"exclusiveMaximum": 3}`, `3`, false},
+		{`{"anyOf": [{"type": "string"}, {"type": "number"}]}`, `1`, true},
+		{`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `1`, false},
+		{`{"not": {"type": "null"}}`, `null`, false},
+		{`{"patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": false}`, `{"x-a": "a"}`, true},
+		{`{"patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": false}`, `{"y": "a"}`, false},
+		{`{"type": "object"}`, `{invalid`, false},
+		{`{"$ref": "#"}`, `1`, false},
+		{`{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`, `1`, false},
+		{`{"type": "object", "properties": {"next": {"$ref": "#"}}}`, `{"next": {"next": {}}}`, true},
+		{`{"type": "object", "properties": {"next": {"$ref": "#"}}}`, `{"next": {"next": 1}}`, false},
+	} {
+		err := Validate([]byte(tc.schema), []byte(tc.data))
+		if (err == nil) != tc.valid {
+			t.Errorf("case %d: got: %v, want valid: %v", i, err, tc.valid)
+		}
+	}
+}
+
+func TestValidateCircularReference(t *testing.T) {
+	err := Validate([]byte(`{"$ref": "#/$defs/a", "$defs": {"a": {"$ref": "#/$defs/a"}}}`), []byte(`{}`))
+
+	var e *Error
+	assertEqual(t, errors.As(err, &e), true)
+	assertEqual(t, len(e.Violations), 1)
+	assertEqual(t, e.Violations[0], Violation{Path: "$", Message: `circular reference "#/$defs/a"`})
+}
+
+func TestValidatePatternCache(t *testing.T) {
+	v := &validator{patterns: make(map[string]compiledPattern)}
+
+	re, err := v.compile("^x-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, _ := v.compile("^x-")
+	assertEqual(t, cached, re)
+
+	_, err = v.compile("(")
+	assertEqual(t, err != nil, true)
+	assertEqual(t, len(v.patterns), 2)
+}
@@ -0,0 +1,285 @@
+// MIT License
+//
+// Copyright (c) 2024 Soma Rádóczi
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package pingotest provides a stub HTTP server for testing code built on pingo.
+// Routes can be stubbed with canned responses and simulated latency, and the received calls
+// can be asserted on, including their order and the number of concurrent calls
+package pingotest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// Server is a stub HTTP server created by calling [NewServer]
+	Server struct {
+		*httptest.Server // the underlying test server
+
+		mu          sync.Mutex // guards the fields below
+		routes      []*Route   // stubbed routes
+		calls       []Call     // received calls in the order of their arrival
+		inFlight    int        // number of calls currently being served
+		maxInFlight int        // maximum number of calls served at the same time
+		generation  int        // incremented by every reset, so the calls served across a reset are not recorded
+	}
+
+	// Route is a stubbed route created by calling [Server.Stub]
+	Route struct {
+		mu      sync.Mutex    // guards the fields below
+		method  string        // method of the route, matches any method if empty
+		path    string        // path of the route
+		status  int           // status code of the response
+		body    []byte        // body of the response
+		headers http.Header   // headers of the response
+		latency time.Duration // delay before responding
+		jitter  time.Duration // maximum random delay added to the latency
+	}
+
+	// Call is a call received by the server
+	Call struct {
+		Method string    // method of the request
+		Path   string    // path of the request
+		Start  time.Time // time the call was received
+		End    time.Time // time the response was written
+	}
+)
+
+// NewServer starts a new stub server. It should be closed when it is no longer needed
+func NewServer() *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Stub stubs the route with the given method and path, which responds with 200 and an empty body by default.
+// An empty method matches any method. Stubbing the same route again replaces the previous stub
+func (s *Server) Stub(method, path string) *Route {
+	route := &Route{
+		method:  method,
+		path:    path,
+		status:  http.StatusOK,
+		headers: make(http.Header),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.routes = slices.DeleteFunc(s.routes, func(r *Route) bool {
+		return r.method == method && r.path == path
+	})
+	s.routes = append(s.routes, route)
+
+	return route
+}
+
+// Calls returns the calls received by the server in the order of their arrival
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.calls)
+}
+
+// MaxConcurrency returns the maximum number of calls that were served at the same time
+func (s *Server) MaxConcurrency() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.maxInFlight
+}
+
+// Reset clears the received calls and the concurrency statistics, but keeps the stubbed routes
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls = nil
+	s.maxInFlight = 0
+	s.generation++
+}
+
+// AssertCalled asserts that the route with the given method and path was called the given number of times
+func (s *Server) AssertCalled(t testing.TB, method, path string, times int) {
+	t.Helper()
+
+	n := 0
+	for _, c := range s.Calls() {
+		if c.Method == method && c.Path == path {
+			n++
+		}
+	}
+
+	if n != times {
+		t.Errorf("pingotest: %s %s was called %d times, want %d", method, path, n, times)
+	}
+}
+
+// AssertCallOrder asserts that the calls were received in the given order.
+// Calls are given in the format of "METHOD /path" e.g.: "GET /users"
+func (s *Server) AssertCallOrder(t testing.TB, calls ...string) {
+	t.Helper()
+
+	got := make([]string, 0, len(calls))
+	for _, c := range s.Calls() {
+		got = append(got, c.String())
+	}
+
+	if !slices.Equal(got, calls) {
+		t.Errorf("pingotest: calls were %q, want %q", got, calls)
+	}
+}
+
+// AssertMaxConcurrency asserts that at most the given number of calls were served at the same time
+func (s *Server) AssertMaxConcurrency(t testing.TB, max int) {
+	t.Helper()
+
+	if n := s.MaxConcurrency(); n > max {
+		t.Errorf("pingotest: %d calls were served concurrently, want at most %d", n, max)
+	}
+}
+
+// serveHTTP serves the stubbed routes and records the calls
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	call := Call{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Start:  time.Now(),
+	}
+
+	s.mu.Lock()
+	i, generation := len(s.calls), s.generation
+	s.calls = append(s.calls, call)
+	s.inFlight++
+	s.maxInFlight = max(s.maxInFlight, s.inFlight)
+	route := s.route(r)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		if generation == s.generation {
+			s.calls[i].End = time.Now()
+		}
+		s.mu.Unlock()
+	}()
+
+	if route == nil {
+		http.Error(w, fmt.Sprintf("pingotest: no stub for %s", call), http.StatusNotFound)
+		return
+	}
+
+	route.serve(w, r)
+}
+
+// route returns the last stubbed route matching the request, the lock must be held by the caller
+func (s *Server) route(r *http.Request) *Route {
+	for _, route := range slices.Backward(s.routes) {
+		if route.path == r.URL.Path && (route.method == "" || route.method == r.Method) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// SetStatus sets the status code of the response
+func (r *Route) SetStatus(status int) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status = status
+	return r
+}
+
+// SetBody sets the body of the response
+func (r *Route) SetBody(body []byte) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.body = body
+	return r
+}
+
+// SetBodyString sets the body of the response as string
+func (r *Route) SetBodyString(body string) *Route {
+	return r.SetBody([]byte(body))
+}
+
+// SetHeader sets a single header of the response
+func (r *Route) SetHeader(key, value string) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.headers.Set(key, value)
+	return r
+}
+
+// SetLatency sets the delay before responding. A random delay up to jitter is added to the latency of every call
+func (r *Route) SetLatency(latency, jitter time.Duration) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.latency = latency
+	r.jitter = jitter
+	return r
+}
+
+// serve writes the response of the route after the latency, or stops early if the request is canceled
+func (r *Route) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	delay := r.latency
+	if r.jitter > 0 {
+		delay += rand.N(r.jitter)
+	}
+	status, body, headers := r.status, r.body, r.headers.Clone()
+	r.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-timer.C:
+		}
+	}
+
+	for k, vs := range headers {
+		w.Header()[k] = vs
+	}
+
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// String returns the call in the format of "METHOD /path"
+func (c Call) String() string {
+	return c.Method + " " + c.Path
+}
@@ -0,0 +1,132 @@
+package pingotest
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mauserzjeh/pingo/v2"
+)
+
+// assertEqual fails if the two values are not equal
+func assertEqual[T comparable](t testing.TB, got, want T) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got: %v != want: %v", got, want)
+	}
+}
+
+func TestServer(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	server.Stub(http.MethodGet, "/users").
+		SetHeader("Content-Type", "application/json").
+		SetBodyString(`[]`)
+	server.Stub(http.MethodPost, "/users").
+		SetStatus(http.StatusCreated)
+
+	c := pingo.NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	resp, err := c.Get("/users").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.BodyString(), "[]")
+	assertEqual(t, resp.GetHeader("Content-Type"), "application/json")
+
+	resp, err = c.Post("/users", nil).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.StatusCode(), http.StatusCreated)
+
+	resp, err = c.Get("/missing").Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, resp.StatusCode(), http.StatusNotFound)
+
+	server.AssertCalled(t, http.MethodGet, "/users", 1)
+	server.AssertCallOrder(t, "GET /users", "POST /users", "GET /missing")
+	assertEqual(t, len(server.Calls()), 3)
+
+	server.Reset()
+	assertEqual(t, len(server.Calls()), 0)
+}
+
+func TestReset(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	server.Stub("", "/slow").SetLatency(100*time.Millisecond, 0)
+	server.Stub("", "/fast")
+
+	c := pingo.NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := c.Get("/slow").Do(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for len(server.Calls()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	server.Reset()
+
+	if _, err := c.Get("/fast").Do(); err != nil {
+		t.Fatal(err)
+	}
+	end := server.Calls()[0].End
+
+	<-done
+
+	calls := server.Calls()
+	assertEqual(t, len(calls), 1)
+	assertEqual(t, calls[0].Path, "/fast")
+	assertEqual(t, calls[0].End, end)
+}
+
+func TestLatency(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	server.Stub("", "/slow").SetLatency(50*time.Millisecond, 10*time.Millisecond)
+
+	c := pingo.NewClient().
+		SetLogEnabled(false).
+		SetBaseUrl(server.URL)
+
+	wg := sync.WaitGroup{}
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get("/slow").Do(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	server.AssertMaxConcurrency(t, 3)
+	assertEqual(t, server.MaxConcurrency() > 1, true)
+
+	for _, call := range server.Calls() {
+		assertEqual(t, call.End.Sub(call.Start) >= 50*time.Millisecond, true)
+	}
+
+	_, err := c.Get("/slow").SetTimeout(10 * time.Millisecond).Do()
+	assertEqual(t, pingo.IsTimeout(err), true)
+}